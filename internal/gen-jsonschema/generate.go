@@ -13,4 +13,5 @@
 // limitations under the License.
 
 //go:generate go run . -o ../../pkg/config/schema.json
+//go:generate go run . -type metadata -o ../../pkg/build/metadata.schema.json
 package main
@@ -7,12 +7,14 @@ import (
 	"log"
 	"os"
 
+	"chainguard.dev/melange/pkg/build"
 	"chainguard.dev/melange/pkg/config"
 	"github.com/invopop/jsonschema"
 )
 
 var (
 	outputFlag = flag.String("o", "", "output path")
+	typeFlag   = flag.String("type", "config", "schema to generate: config, for melange configuration files, or metadata, for the <identity>.metadata.json of packages")
 )
 
 func main() {
@@ -23,10 +25,23 @@ func main() {
 	}
 
 	r := new(jsonschema.Reflector)
-	if err := r.AddGoComments("chainguard.dev/melange/pkg/build", "../../pkg/config"); err != nil {
-		log.Fatal(err)
+	var schema *jsonschema.Schema
+	switch *typeFlag {
+	case "config":
+		if err := r.AddGoComments("chainguard.dev/melange/pkg/build", "../../pkg/config"); err != nil {
+			log.Fatal(err)
+		}
+		schema = r.Reflect(config.Configuration{})
+	case "metadata":
+		if err := r.AddGoComments("chainguard.dev/melange/pkg/build", "../../pkg/build"); err != nil {
+			log.Fatal(err)
+		}
+		// The metadata is flat, so it is described inline.
+		r.DoNotReference = true
+		schema = r.Reflect(build.PackageMetadata{})
+	default:
+		log.Fatalf("unknown schema type %q", *typeFlag)
 	}
-	schema := r.Reflect(config.Configuration{})
 	b := new(bytes.Buffer)
 	enc := json.NewEncoder(b)
 	enc.SetIndent("", "  ")
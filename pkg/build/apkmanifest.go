@@ -0,0 +1,59 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// apkManifest renders checksums, keyed by path, in the format of
+// `apk manifest`: a line of "sha1:<hex>  <path>" per file, sorted by path.
+// Like the manifest apk prints for an installed package, symlinks are
+// listed with the checksum of their target.
+func apkManifest(checksums map[string]string) []byte {
+	paths := make([]string, 0, len(checksums))
+	for path := range checksums {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var buf bytes.Buffer
+	for _, path := range paths {
+		fmt.Fprintf(&buf, "sha1:%s  %s\n", checksums[path], path)
+	}
+	return buf.Bytes()
+}
+
+// emitApkManifest writes the manifest of the package next to it as
+// <identity>.manifest, so that an installed tree can be verified against it
+// without apk.
+func (pc *PackageBuild) emitApkManifest(ctx context.Context, result *EmitResult) error {
+	log := clog.FromContext(ctx)
+
+	path := filepath.Join(pc.OutDir, pc.Identity()+".manifest")
+	if err := writeFileAtomic(path, apkManifest(result.FileChecksums)); err != nil {
+		return fmt.Errorf("unable to write apk manifest: %w", err)
+	}
+
+	log.Infof("wrote %s", path)
+
+	return nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmitApkManifest(t *testing.T) {
+	ctx := context.Background()
+	pc := testPackageBuilder(t, &Build{EmitApkManifest: true})()
+	require.NoError(t, os.Symlink("hello.txt", filepath.Join(pc.WorkspaceSubdir(), "usr", "share", "greeting.txt")))
+
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	// As printed by `apk manifest hello` once the package is installed.
+	got, err := os.ReadFile(filepath.Join(pc.OutDir, "hello-1.0.0-r0.manifest"))
+	require.NoError(t, err)
+	require.Equal(t, `sha1:3857b672471862eab426eba0622e44bd2cedbd5d  usr/share/greeting.txt
+sha1:f572d396fae9206628714fb2ce00f72e94f2258f  usr/share/hello.txt
+`, string(got))
+}
+
+func Test_apkManifest(t *testing.T) {
+	require.Empty(t, apkManifest(nil))
+	require.Equal(t, "sha1:01  a\nsha1:02  b/c\n", string(apkManifest(map[string]string{"b/c": "02", "a": "01"})))
+}
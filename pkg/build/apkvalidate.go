@@ -0,0 +1,93 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+)
+
+// validateWithApk checks the emitted package with apk-tools.  apk manifest
+// reads every section of the package, and when the package is signed, apk
+// verify checks its signature against the public key stored next to the
+// signing key (<key>.pub, as written by melange keygen).  If apk is not
+// installed, validation is skipped with a warning unless it is required.
+func (pc *PackageBuild) validateWithApk(ctx context.Context) error {
+	ctx, span := otel.Tracer("melange").Start(ctx, "validateWithApk")
+	defer span.End()
+
+	apkPath, err := exec.LookPath("apk")
+	if err != nil {
+		if pc.Build.ValidateWithApk == ApkValidationRequired {
+			return fmt.Errorf("unable to validate %s: %w", pc.Filename(), err)
+		}
+		pc.warnf(ctx, "apk not found, skipping validation of %s", pc.Filename())
+		return nil
+	}
+
+	if err := runApk(ctx, apkPath, "manifest", "--allow-untrusted", pc.Filename()); err != nil {
+		return err
+	}
+
+	if !pc.wantSignature() {
+		return nil
+	}
+
+	keysDir, err := os.MkdirTemp("", "melange-keys-*")
+	if err != nil {
+		return fmt.Errorf("unable to create keys directory: %w", err)
+	}
+	defer os.RemoveAll(keysDir)
+
+	pub, err := os.ReadFile(pc.Build.SigningKey + ".pub")
+	if errors.Is(err, fs.ErrNotExist) {
+		pc.warnf(ctx, "public key %s.pub not found, skipping signature validation of %s", pc.Build.SigningKey, pc.Filename())
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to read public key: %w", err)
+	}
+
+	// apk looks the key up by the name in the signature.
+	if err := os.WriteFile(filepath.Join(keysDir, filepath.Base(pc.Build.SigningKey)+".pub"), pub, 0o644); err != nil {
+		return fmt.Errorf("unable to write public key: %w", err)
+	}
+
+	return runApk(ctx, apkPath, "verify", "--keys-dir", keysDir, pc.Filename())
+}
+
+// runApk runs an apk subcommand, returning its stderr in the error if it
+// fails.
+func runApk(ctx context.Context, apkPath string, args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, apkPath, args...)
+	cmd.Stdout = io.Discard
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("apk %s rejected %s: %w: %s", args[0], args[len(args)-1], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeApk installs an apk on PATH which logs its arguments and rejects
+// packages for the subcommand named by reject.
+func fakeApk(t *testing.T, reject string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "apk.log")
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$@" >> %s
+if [ "$1" = %q ]; then
+	echo "ERROR: $1: BAD signature" >&2
+	exit 1
+fi
+`, logFile, reject)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "apk"), []byte(script), 0o755))
+	t.Setenv("PATH", dir)
+
+	return logFile
+}
+
+func TestValidateWithApk(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("missing optional", func(t *testing.T) {
+		t.Setenv("PATH", t.TempDir())
+		pc := testPackageBuilder(t, &Build{ValidateWithApk: ApkValidationOptional})()
+		require.NoError(t, pc.EmitPackage(ctx))
+	})
+
+	t.Run("missing required", func(t *testing.T) {
+		t.Setenv("PATH", t.TempDir())
+		pc := testPackageBuilder(t, &Build{ValidateWithApk: ApkValidationRequired})()
+		require.ErrorContains(t, pc.EmitPackage(ctx), "unable to validate")
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		logFile := fakeApk(t, "verify")
+		pc := testPackageBuilder(t, &Build{ValidateWithApk: ApkValidationRequired})()
+		require.NoError(t, pc.EmitPackage(ctx))
+
+		log, err := os.ReadFile(logFile)
+		require.NoError(t, err)
+		require.Equal(t, "manifest --allow-untrusted "+pc.Filename(), strings.TrimSpace(string(log)))
+	})
+
+	t.Run("signed", func(t *testing.T) {
+		logFile := fakeApk(t, "")
+		b := &Build{ValidateWithApk: ApkValidationRequired}
+		pc := testPackageBuilder(t, b)()
+
+		key, pub := writeTestKey(t, t.TempDir(), "test.rsa")
+		require.NoError(t, os.WriteFile(key+".pub", pub, 0o644))
+		b.SigningKey = key
+		require.NoError(t, pc.EmitPackage(ctx))
+
+		log, err := os.ReadFile(logFile)
+		require.NoError(t, err)
+		lines := strings.Split(strings.TrimSpace(string(log)), "\n")
+		require.Len(t, lines, 2)
+		require.True(t, strings.HasPrefix(lines[1], "verify --keys-dir "), lines[1])
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		fakeApk(t, "manifest")
+		pc := testPackageBuilder(t, &Build{ValidateWithApk: ApkValidationOptional})()
+		err := pc.EmitPackage(ctx)
+		require.ErrorContains(t, err, "apk manifest rejected")
+		require.ErrorContains(t, err, "ERROR: manifest: BAD signature")
+	})
+}
@@ -0,0 +1,211 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/klauspost/pgzip"
+)
+
+// DataCompressionAuto picks the compression level of each data section
+// from its installed size and contents.  See AutoCompressionThresholds.
+const DataCompressionAuto = "auto"
+
+// The compression used for a data section, as recorded in
+// EmitResult.DataCompression.  apk only reads gzip data sections, so these
+// are all gzip streams, differing in level.
+const (
+	// DataCompressionGzip is gzip at the default level.
+	DataCompressionGzip = "gzip"
+	// DataCompressionGzipFast is gzip at the fastest level.
+	DataCompressionGzipFast = "gzip-fast"
+	// DataCompressionGzipBest is gzip at the highest compression level.
+	DataCompressionGzipBest = "gzip-best"
+	// DataCompressionStore is gzip without compression, whose deflate
+	// blocks store the tar verbatim.
+	DataCompressionStore = "store"
+)
+
+// dataCompressionLevels maps each compression to its gzip level.
+var dataCompressionLevels = map[string]int{
+	DataCompressionGzip:     pgzip.DefaultCompression,
+	DataCompressionGzipFast: pgzip.BestSpeed,
+	DataCompressionGzipBest: pgzip.BestCompression,
+	DataCompressionStore:    pgzip.NoCompression,
+}
+
+// AutoCompressionThresholds are the thresholds by which DataCompressionAuto
+// picks the compression of a data section:
+//
+//   - packages whose installed size is below SmallSize use DataCompressionGzipFast,
+//     as there is little to gain from compressing them harder;
+//   - packages in which at least CompressedFraction of the installed size is
+//     in files which are already compressed use DataCompressionStore;
+//   - other packages whose installed size is at least LargeSize use
+//     DataCompressionGzipBest;
+//   - and the remainder use DataCompressionGzip.
+type AutoCompressionThresholds struct {
+	SmallSize          int64
+	LargeSize          int64
+	CompressedFraction float64
+}
+
+// DefaultAutoCompressionThresholds are the thresholds used unless
+// WithAutoCompressionThresholds overrides them.
+var DefaultAutoCompressionThresholds = AutoCompressionThresholds{
+	SmallSize:          64 << 10,
+	LargeSize:          16 << 20,
+	CompressedFraction: 0.9,
+}
+
+// dataCompressionLevel returns the gzip level of the package's data
+// section compression, which is the default level until it is chosen.
+func (pc *PackageBuild) dataCompressionLevel() int {
+	if level, ok := dataCompressionLevels[pc.dataCompression]; ok {
+		return level
+	}
+	return pgzip.DefaultCompression
+}
+
+// compressedMagics are the leading bytes of files in formats which are
+// already compressed.
+var compressedMagics = [][]byte{
+	{0x1f, 0x8b},                       // gzip
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+	{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+	{'B', 'Z', 'h'},                    // bzip2
+	{'P', 'K', 0x03, 0x04},             // zip, jar, wheel
+	{0x89, 'P', 'N', 'G'},              // png
+	{0xff, 0xd8, 0xff},                 // jpeg
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+	{0x04, '"', 'M', 0x18},             // lz4
+	{'h', 's', 'q', 's'},               // squashfs
+}
+
+// compressedSize returns the combined size of the regular files of fsys
+// which are already compressed, judged by their leading bytes.
+func compressedSize(fsys fs.FS) (int64, error) {
+	var size int64
+	magic := make([]byte, 8)
+
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+
+		f, err := fsys.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		n, err := io.ReadFull(f, magic)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		for _, m := range compressedMagics {
+			if bytes.HasPrefix(magic[:n], m) {
+				fi, err := d.Info()
+				if err != nil {
+					return err
+				}
+				size += fi.Size()
+				break
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("unable to sniff package contents: %w", err)
+	}
+
+	return size, nil
+}
+
+// checkPackageDataCompression checks the data compression configured for
+// the package and subpackages, which must be DataCompressionAuto or one of
+// the compressions of dataCompressionLevels.
+func (b *Build) checkPackageDataCompression() error {
+	check := func(name, compression string) error {
+		if compression == "" {
+			return nil
+		}
+		if _, ok := dataCompressionLevels[compression]; !ok && compression != DataCompressionAuto {
+			return fmt.Errorf("unknown data compression %q of %s, expected one of %q, %q, %q, %q or %q", compression, name,
+				DataCompressionAuto, DataCompressionGzip, DataCompressionGzipFast, DataCompressionGzipBest, DataCompressionStore)
+		}
+		if b.StableCompression {
+			return fmt.Errorf("data compression of %s cannot be configured with stable compression", name)
+		}
+		return nil
+	}
+
+	if err := check(b.Configuration.Package.Name, b.Configuration.Package.DataCompression); err != nil {
+		return err
+	}
+	for _, sp := range b.Configuration.Subpackages {
+		if err := check(sp.Name, sp.DataCompression); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chooseDataCompression returns the compression of the data section of the
+// package, whose contents are fsys.  InstalledSize must already be known.
+func (pc *PackageBuild) chooseDataCompression(fsys fs.FS) (string, error) {
+	mode := pc.Build.DataCompression
+	if pc.Compression != "" {
+		mode = pc.Compression
+	}
+
+	switch {
+	case pc.Build.StableCompression:
+		return DataCompressionGzipBest, nil
+	case mode == "":
+		return DataCompressionGzip, nil
+	case mode != DataCompressionAuto:
+		return mode, nil
+	}
+
+	t := pc.Build.AutoCompressionThresholds
+	if t == (AutoCompressionThresholds{}) {
+		t = DefaultAutoCompressionThresholds
+	}
+
+	if pc.InstalledSize < t.SmallSize {
+		return DataCompressionGzipFast, nil
+	}
+
+	compressed, err := compressedSize(fsys)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case float64(compressed) >= t.CompressedFraction*float64(pc.InstalledSize):
+		return DataCompressionStore, nil
+	case pc.InstalledSize >= t.LargeSize:
+		return DataCompressionGzipBest, nil
+	default:
+		return DataCompressionGzip, nil
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChooseDataCompression(t *testing.T) {
+	thresholds := AutoCompressionThresholds{SmallSize: 16 << 10, LargeSize: 256 << 10, CompressedFraction: 0.5}
+
+	for _, tt := range []struct {
+		name  string
+		files map[string][]byte
+		want  string
+	}{{
+		name:  "small",
+		files: map[string][]byte{"hello.txt": []byte("hello\n")},
+		want:  DataCompressionGzipFast,
+	}, {
+		name:  "medium",
+		files: map[string][]byte{"hello.txt": bytes.Repeat([]byte("hello\n"), 8<<10)},
+		want:  DataCompressionGzip,
+	}, {
+		name:  "large",
+		files: map[string][]byte{"hello.txt": bytes.Repeat([]byte("hello\n"), 64<<10)},
+		want:  DataCompressionGzipBest,
+	}, {
+		name: "compressed",
+		files: map[string][]byte{
+			"hello.txt":    bytes.Repeat([]byte("hello\n"), 8<<10),
+			"hello.tar.gz": append([]byte{0x1f, 0x8b}, make([]byte, 64<<10)...),
+		},
+		want: DataCompressionStore,
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Build{DataCompression: DataCompressionAuto, AutoCompressionThresholds: thresholds}
+			pc := testPackageBuilder(t, b)()
+			dir := filepath.Join(pc.WorkspaceSubdir(), "usr", "share")
+			require.NoError(t, os.RemoveAll(dir))
+			require.NoError(t, os.MkdirAll(dir, 0o755))
+			for name, data := range tt.files {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0o644))
+			}
+
+			fsys := readlinkFS(pc.WorkspaceSubdir())
+			require.NoError(t, pc.calculateInstalledSize(fsys))
+			got, err := pc.chooseDataCompression(fsys)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestDataCompressionAuto(t *testing.T) {
+	ctx := context.Background()
+
+	b := &Build{}
+	pc := testPackageBuilder(t, b)()
+	require.NoError(t, pc.EmitPackage(ctx))
+	require.Equal(t, DataCompressionGzip, pc.Result.DataCompression)
+
+	b.DataCompression = DataCompressionAuto
+	require.NoError(t, pc.EmitPackage(ctx))
+	require.Equal(t, DataCompressionGzipFast, pc.Result.DataCompression)
+
+	// The default thresholds store already compressed packages.
+	require.NoError(t, os.WriteFile(filepath.Join(pc.WorkspaceSubdir(), "usr", "share", "hello.gz"), append([]byte{0x1f, 0x8b}, make([]byte, 1<<20)...), 0o644))
+	require.NoError(t, pc.EmitPackage(ctx))
+	require.Equal(t, DataCompressionStore, pc.Result.DataCompression)
+
+	headers, contents := readDataSection(t, pc)
+	require.Contains(t, headers, "usr/share/hello.gz")
+	require.Len(t, contents["usr/share/hello.gz"], 2+1<<20)
+}
+
+func TestPackageDataCompression(t *testing.T) {
+	ctx := context.Background()
+	tmp := t.TempDir()
+
+	sink := &recordingSink{t: t}
+	b := &Build{
+		Arch:            apko_types.ParseArchitecture("x86_64"),
+		OutDir:          filepath.Join(tmp, "packages"),
+		WorkspaceDir:    filepath.Join(tmp, "workspace"),
+		GuestDir:        filepath.Join(tmp, "guest"),
+		SourceDateEpoch: time.Unix(0, 0),
+		MetadataSink:    sink,
+		Configuration: config.Configuration{
+			Package:     config.Package{Name: "hello", Version: "1.0.0", DataCompression: DataCompressionStore},
+			Subpackages: []config.Subpackage{{Name: "hello-doc", DataCompression: DataCompressionGzipBest}},
+		},
+	}
+	require.NoError(t, b.checkPackageDataCompression())
+
+	// Compressible contents, which appear verbatim only in a stored data
+	// section.
+	contents := bytes.Repeat([]byte("hello hello hello\n"), 1<<10)
+	for _, name := range []string{"hello", "hello-doc"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(b.WorkspaceDir, "melange-out", name, "usr", "share"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(b.WorkspaceDir, "melange-out", name, "usr", "share", name+".txt"), contents, 0o644))
+	}
+	require.NoError(t, os.MkdirAll(b.GuestDir, 0o755))
+
+	pb := &PipelineBuild{Build: b}
+	require.NoError(t, pb.Emit(ctx, &b.Configuration.Package))
+	require.NoError(t, pb.Emit(ctx, pkgFromSub(&b.Configuration.Subpackages[0])))
+
+	require.Len(t, sink.results, 2)
+	for _, tt := range []struct {
+		result   *EmitResult
+		want     string
+		verbatim bool
+	}{
+		{sink.results[0], DataCompressionStore, true},
+		{sink.results[1], DataCompressionGzipBest, false},
+	} {
+		require.Equal(t, tt.want, tt.result.DataCompression, tt.result.PackageName)
+		apk, err := os.ReadFile(tt.result.Path)
+		require.NoError(t, err)
+		require.Equal(t, tt.verbatim, bytes.Contains(apk, contents), tt.result.PackageName)
+	}
+
+	b.Configuration.Subpackages[0].DataCompression = "zstd"
+	require.ErrorContains(t, b.checkPackageDataCompression(), `unknown data compression "zstd" of hello-doc`)
+
+	b.Configuration.Subpackages[0].DataCompression = ""
+	b.StableCompression = true
+	require.EqualError(t, b.checkPackageDataCompression(), "data compression of hello cannot be configured with stable compression")
+}
@@ -0,0 +1,160 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// compressionBenchmark is the size and time taken to compress the data
+// section of a package with one algorithm, for BenchmarkCompression.
+type compressionBenchmark struct {
+	Algorithm string `json:"algorithm"`
+	Size      int64  `json:"size"`
+	// In nanoseconds.
+	Duration time.Duration `json:"duration"`
+	// The size relative to the data section as emitted.
+	Ratio float64 `json:"ratio"`
+}
+
+// compressionBenchmarks is what BenchmarkCompression writes next to each
+// package.
+type compressionBenchmarks struct {
+	// The size of the uncompressed data section.
+	UncompressedSize int64 `json:"uncompressedSize"`
+	// The size of the data section as emitted.
+	EmittedSize int64                  `json:"emittedSize"`
+	Results     []compressionBenchmark `json:"results"`
+}
+
+// benchmarkedCompressors are the algorithms BenchmarkCompression tries,
+// each at its default level.  gzip is compressed the way the data section
+// is emitted, so that it is comparable to the others.
+var benchmarkedCompressors = []struct {
+	algorithm string
+	new       func(pc *PackageBuild, ctx context.Context, w io.Writer) (io.WriteCloser, func(), error)
+}{{
+	algorithm: "gzip",
+	new: func(pc *PackageBuild, ctx context.Context, w io.Writer) (io.WriteCloser, func(), error) {
+		return pc.dataCompressor(ctx, w)
+	},
+}, {
+	algorithm: "zstd",
+	new: func(_ *PackageBuild, _ context.Context, w io.Writer) (io.WriteCloser, func(), error) {
+		zw, err := zstd.NewWriter(w)
+		return zw, func() {}, err
+	},
+}, {
+	algorithm: "xz",
+	new: func(_ *PackageBuild, _ context.Context, w io.Writer) (io.WriteCloser, func(), error) {
+		zw, err := xz.NewWriter(w)
+		return zw, func() {}, err
+	},
+}}
+
+// benchmarkCompression compresses the data section of the package with
+// each of benchmarkedCompressors, logs the size and time taken by each and
+// writes them as <identity>.compression.json.  This is a diagnostic for
+// choosing a compressor: the emitted package is not changed, and the
+// compression is done again for each algorithm, so it slows the build down
+// considerably.
+func (pc *PackageBuild) benchmarkCompression(ctx context.Context, data io.ReadSeeker) error {
+	log := clog.FromContext(ctx)
+
+	emittedSize, err := data.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := data.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// Decompress the data section once, so that the time taken to do so
+	// is not counted against each algorithm.
+	tarFile, err := pc.Build.createTemp("melange-benchmark-*.tar", pc.tempKey())
+	if err != nil {
+		return fmt.Errorf("unable to create temporary file: %w", err)
+	}
+	defer os.Remove(tarFile.Name())
+	defer tarFile.Close()
+
+	zr, err := gzip.NewReader(data)
+	if err != nil {
+		return fmt.Errorf("unable to read data section: %w", err)
+	}
+	uncompressedSize, err := io.Copy(tarFile, zr)
+	if err != nil {
+		return fmt.Errorf("unable to decompress data section: %w", err)
+	}
+
+	benchmarks := compressionBenchmarks{
+		UncompressedSize: uncompressedSize,
+		EmittedSize:      emittedSize,
+	}
+	for _, c := range benchmarkedCompressors {
+		if _, err := tarFile.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		var out countingWriter
+		start := time.Now()
+		zw, release, err := c.new(pc, ctx, &out)
+		if err != nil {
+			return fmt.Errorf("unable to create %s compressor: %w", c.algorithm, err)
+		}
+		_, err = io.Copy(zw, tarFile)
+		if err == nil {
+			err = zw.Close()
+		}
+		release()
+		if err != nil {
+			return fmt.Errorf("compressing data section with %s: %w", c.algorithm, err)
+		}
+		duration := time.Since(start)
+
+		benchmarks.Results = append(benchmarks.Results, compressionBenchmark{
+			Algorithm: c.algorithm,
+			Size:      out.n,
+			Duration:  duration,
+			Ratio:     float64(out.n) / float64(emittedSize),
+		})
+		log.Infof("  %s: %d bytes in %s", c.algorithm, out.n, duration)
+	}
+
+	encoded, err := json.MarshalIndent(benchmarks, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode compression benchmark: %w", err)
+	}
+
+	path := filepath.Join(pc.OutDir, pc.Identity()+".compression.json")
+	if err := writeFileAtomic(path, append(encoded, '\n')); err != nil {
+		return fmt.Errorf("unable to write compression benchmark: %w", err)
+	}
+
+	log.Infof("wrote %s", path)
+
+	return nil
+}
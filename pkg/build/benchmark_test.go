@@ -0,0 +1,60 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBenchmarkCompression(t *testing.T) {
+	ctx := context.Background()
+
+	pc := testPackageBuilder(t, &Build{})()
+	require.NoError(t, pc.EmitPackage(ctx))
+	plain, err := os.ReadFile(pc.Filename())
+	require.NoError(t, err)
+
+	pc = testPackageBuilder(t, &Build{BenchmarkCompression: true})()
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	// The emitted package is not changed.
+	benchmarked, err := os.ReadFile(pc.Filename())
+	require.NoError(t, err)
+	require.Equal(t, plain, benchmarked)
+
+	data, err := os.ReadFile(filepath.Join(pc.OutDir, pc.Identity()+".compression.json"))
+	require.NoError(t, err)
+	var benchmarks compressionBenchmarks
+	require.NoError(t, json.Unmarshal(data, &benchmarks))
+
+	require.Positive(t, benchmarks.UncompressedSize)
+	require.Positive(t, benchmarks.EmittedSize)
+	algorithms := []string{}
+	for _, r := range benchmarks.Results {
+		algorithms = append(algorithms, r.Algorithm)
+		require.Positive(t, r.Size, r.Algorithm)
+		if r.Algorithm == "gzip" {
+			// gzip is compressed the way the package was.
+			require.Equal(t, benchmarks.EmittedSize, r.Size)
+		}
+	}
+	require.Equal(t, []string{"gzip", "zstd", "xz"}, algorithms)
+}
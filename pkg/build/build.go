@@ -26,6 +26,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -34,6 +35,7 @@ import (
 	apko_types "chainguard.dev/apko/pkg/build/types"
 	"cloud.google.com/go/storage"
 	"github.com/chainguard-dev/clog"
+	"github.com/chainguard-dev/go-apk/pkg/apk"
 	apkofs "github.com/chainguard-dev/go-apk/pkg/fs"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/storage/filesystem"
@@ -51,10 +53,126 @@ import (
 	"chainguard.dev/melange/pkg/index"
 	"chainguard.dev/melange/pkg/linter"
 	"chainguard.dev/melange/pkg/sbom"
+	"chainguard.dev/melange/pkg/sca"
 )
 
 var ErrSkipThisArch = errors.New("error: skip this arch")
 
+const (
+	// StrippedOriginSelf sets the origin of a package to its own name when
+	// origin names are stripped.
+	StrippedOriginSelf = "self"
+
+	// StrippedOriginEmpty omits the origin of a package entirely when
+	// origin names are stripped.
+	StrippedOriginEmpty = "empty"
+)
+
+const (
+	// CaseCollisionsWarn logs a warning for each pair of paths of a package
+	// which collide on case-insensitive filesystems.
+	CaseCollisionsWarn = "warn"
+
+	// CaseCollisionsError fails to emit a package with paths which collide
+	// on case-insensitive filesystems.
+	CaseCollisionsError = "error"
+)
+
+const (
+	// BuildDateSourceEpoch records SourceDateEpoch as the build date of
+	// packages.  This is the default.
+	BuildDateSourceEpoch = "source-date-epoch"
+
+	// BuildDateSourceReleaseDate records the release-date of the package
+	// configuration as the build date of packages.
+	BuildDateSourceReleaseDate = "release-date"
+)
+
+const (
+	// ProvideMergeUnion keeps both the declared and generated provides of
+	// a package when their versions differ.  This is the default.
+	ProvideMergeUnion = "union"
+
+	// ProvideMergeDeclaredWins drops generated provides whose name is also
+	// declared.
+	ProvideMergeDeclaredWins = "declared-wins"
+
+	// ProvideMergeGeneratedWins drops declared provides whose name is also
+	// generated.
+	ProvideMergeGeneratedWins = "generated-wins"
+)
+
+// BuildIDAuto, passed to WithBuildID, generates a random build ID.
+const BuildIDAuto = "auto"
+
+const (
+	// TarFormatPAX writes the data section as PAX, which can represent any
+	// path or size and carries the per-file apk checksums.  This is the
+	// default.
+	TarFormatPAX = "pax"
+	// TarFormatGNU writes the data section as GNU tar, which supports long
+	// paths and large files but drops the per-file apk checksums and xattrs.
+	TarFormatGNU = "gnu"
+	// TarFormatUSTAR writes the data section as USTAR, which is the most
+	// widely readable, but cannot represent paths which do not fit its 155
+	// byte prefix and 100 byte name fields, or files of 8GiB or more, and
+	// drops the per-file checksums and xattrs.
+	TarFormatUSTAR = "ustar"
+)
+
+const (
+	// ApkValidationOptional validates emitted packages with apk if it is
+	// installed, and warns otherwise.
+	ApkValidationOptional = "optional"
+	// ApkValidationRequired validates emitted packages with apk, failing
+	// if it is not installed.
+	ApkValidationRequired = "required"
+)
+
+const (
+	// LicenseRenderPerEntry writes one license line per copyright entry.
+	// This is what melange has always emitted, and suits consumers which
+	// read every license line of .PKGINFO.
+	LicenseRenderPerEntry = "per-entry"
+	// LicenseRenderExpression writes a single license line holding the
+	// SPDX expression formed by combining every copyright entry with AND.
+	// go-apk, and so the APKINDEX it generates, keeps only one license
+	// value per package, so this form is needed for it to see them all.
+	LicenseRenderExpression = "expression"
+)
+
+const (
+	// ContentAddressedLinkSymlink makes the named file of a content
+	// addressed package a relative symlink to its object.  This is the
+	// default.
+	ContentAddressedLinkSymlink = "symlink"
+	// ContentAddressedLinkCopy makes the named file of a content addressed
+	// package a copy of its object, for consumers which do not follow
+	// symlinks.
+	ContentAddressedLinkCopy = "copy"
+)
+
+const (
+	// SymlinkModePreserve leaves the targets of symlinks as they were
+	// created.  This is the default.
+	SymlinkModePreserve = "preserve"
+	// SymlinkModeRelative rewrites the targets of symlinks which point
+	// within the package relative to the directory of the symlink.
+	SymlinkModeRelative = "relative"
+	// SymlinkModeAbsolute rewrites the targets of symlinks which point
+	// within the package as absolute paths.
+	SymlinkModeAbsolute = "absolute"
+)
+
+const (
+	// SBOMFormatSPDX writes only the SPDX SBOM.  This is the default.
+	SBOMFormatSPDX = "spdx"
+	// SBOMFormatCycloneDX writes only the CycloneDX SBOM.
+	SBOMFormatCycloneDX = "cyclonedx"
+	// SBOMFormatBoth writes both the SPDX and CycloneDX SBOMs.
+	SBOMFormatBoth = "both"
+)
+
 type Build struct {
 	Configuration   config.Configuration
 	ConfigFile      string
@@ -62,10 +180,12 @@ type Build struct {
 	WorkspaceDir    string
 	WorkspaceIgnore string
 	// Ordered directories where to find 'uses' pipelines.
-	PipelineDirs      []string
-	SourceDir         string
-	GuestDir          string
-	SigningKey        string
+	PipelineDirs []string
+	SourceDir    string
+	GuestDir     string
+	SigningKey   string
+	// The passphrase of SigningKey, if it is encrypted.  It is held in
+	// memory for the whole build.
 	SigningPassphrase string
 	Namespace         string
 	GenerateIndex     bool
@@ -95,6 +215,419 @@ type Build struct {
 	DefaultCPU        string
 	DefaultMemory     string
 	DefaultTimeout    time.Duration
+	// Optional: bounds the number of compression workers shared by every
+	// data section emitted by this build (and any other build sharing it).
+	CompressionPool *CompressionPool
+	// Verify that every package installed into the build environment was
+	// signed by a key in VerifyInputKeyring before running pipelines.  The
+	// signatures are read from the apk cache.
+	VerifyInputSignatures bool
+	// The public keys packages installed into the build environment must
+	// be signed by when VerifyInputSignatures is set, independently of the
+	// keyring they are installed with.  Keys are matched to signatures by
+	// file name, as apk does.
+	VerifyInputKeyring []string
+	// What to use as the origin when StripOriginName is set; one of
+	// StrippedOriginSelf (the default) or StrippedOriginEmpty.
+	StrippedOriginMode string
+	// Write an in-toto SLSA provenance statement next to each package.
+	EmitProvenance bool
+	// Omit all scriptlets (and triggers) from the control section, for
+	// images which never run install-time scripts.
+	StripScriptlets bool
+	// Permission bits cleared from every file and directory in the data
+	// section, e.g. 0o022 to strip group and other write access.
+	DefaultFileUmask os.FileMode
+	// How copyright licenses are rendered into .PKGINFO; one of
+	// LicenseRenderPerEntry (the default) or LicenseRenderExpression.
+	LicenseRenderMode string
+	// Experimental: the maximum size in bytes of a package's compressed
+	// data section.  Packages exceeding it fail to emit.
+	MaxDataSize int64
+	// Write a single-package APKINDEX as <identity>.index next to each
+	// package, for installing it without a full index run.
+	EmitPerPackageIndex bool
+	// How many times to retry writing an output file after a transient
+	// error (such as EIO from a network filesystem).
+	OutputWriteRetries int
+	// The tar format of the data section; one of TarFormatPAX (the
+	// default), TarFormatGNU or TarFormatUSTAR.
+	TarFormat string
+	// DataHashes of previously published packages, keyed by package name,
+	// against which emitted packages are compared.
+	BaselineDataHashes map[string]string
+	// The SBOM formats written into each package; one of SBOMFormatSPDX
+	// (the default), SBOMFormatCycloneDX or SBOMFormatBoth.
+	SBOMFormat string
+	// Record melange's version, and BuilderID if set, as comments in
+	// .PKGINFO.
+	EmbedBuilderInfo bool
+	// Identifies the host or system which built the package.
+	BuilderID string
+	// Write the checksum of every file in a package as
+	// <identity>.filesums.json next to it.
+	EmitFileChecksums bool
+	// Pin the provides generated for each package to the package's own
+	// version-rN, rather than the version found by analysis.
+	PinProvidesToPackageVersion bool
+	// How the declared and generated provides of a package with the same
+	// name but different versions are merged: ProvideMergeUnion (the
+	// default), ProvideMergeDeclaredWins or ProvideMergeGeneratedWins.
+	ProvideMergeStrategy string
+	// Arch names written into packages in place of melange's own, keyed
+	// by the latter (e.g. armv7: armhf).  The alias is used for the arch
+	// recorded in .PKGINFO and the SBOM, and the directory packages are
+	// written to.
+	ArchAlias map[string]string
+	// Validate each emitted package with apk-tools; one of "" (disabled),
+	// ApkValidationOptional or ApkValidationRequired.
+	ValidateWithApk string
+	// The directory in which temporary files, such as the data section of
+	// each package while it is assembled, are created.  Defaults to the
+	// system temporary directory.
+	TempDir string
+	// Seeds the randomness of the build, for reproducibility harnesses.
+	// Zero leaves it unseeded.  The seed governs exactly one thing: the
+	// names of the temporary files created in TempDir, which are the data
+	// section of each package, its single stream, its spooled sparse files
+	// and its benchmarked data section.  Nothing else in a build is random:
+	// signing (RSA PKCS#1 v1.5) and the ordering of generated metadata are
+	// deterministic regardless.
+	RandomSeed uint64
+	// Whether temporary files in TempDir are named after the package they
+	// belong to, e.g. melange-data-<identity>-<arch>.tar.gz, rather than
+	// randomly, to aid debugging files left behind by a crashed build.
+	// A file or link already at such a name is replaced, never followed.
+	NamedTempFiles bool
+	// Whether large regular files containing runs of zeroes are written
+	// to the data section as GNU sparse entries, which apk extracts
+	// sparsely.  Holes are detected in runs of 4KiB zeroes.
+	PreserveSparse bool
+	// Called for the passphrase of SigningKey when it is encrypted and
+	// SigningPassphrase is empty.  It is called once by New, which fails
+	// if the passphrase does not decrypt the key.  The passphrase is then
+	// kept in SigningPassphrase, held in memory for the whole build, to
+	// sign packages and, if they are signed with SigningKey, indexes.
+	PassphrasePrompt func() (string, error)
+	// Whether the problems SCA finds in each package, such as RPATH and
+	// RUNPATH entries leaking build-time paths, are written next to it as
+	// <identity>.sca-report.json.  They are logged as warnings regardless.
+	SCAReport bool
+	// The control fields blanked by CanonicalControlData.  Nil means
+	// builddate and commit.
+	VolatileControlFields []string
+	// Whether the test pipelines of each package are run as soon as it is
+	// emitted, installing it into a fresh guest, failing the build if
+	// they fail.  Requires SigningKey, whose public key must be next to it
+	// as <key>.pub.
+	RunTestsAfterEmit bool
+	// Whether packages are written to OutDir/.cas/<datahash>.apk, with
+	// their usual file name linked to it, so that rebuilds producing an
+	// identical package reuse the existing object.
+	ContentAddressedOutput bool
+	// How the usual file name of a content addressed package refers to
+	// its object: ContentAddressedLinkSymlink (the default) or
+	// ContentAddressedLinkCopy.
+	ContentAddressedLink string
+	// EXPERIMENTAL: whether packages are written as a single gzip stream
+	// of the control tarball followed by the data tarball, for transports
+	// which re-wrap them.  The result is NOT an apk, and apk cannot read
+	// it, so it is written as <identity>.stream.tar.gz, and New rejects
+	// the options which sign, index, install or otherwise handle it as
+	// an apk.  EmitResult.ControlHash is empty.  The datahash in .PKGINFO,
+	// and EmitResult.DataHash, remain those of the data section in the
+	// standard format.
+	SingleStream bool
+	// Whether the gzip header of the data section carries the identity of
+	// the package (<name>-<version>-r<epoch>) as its comment, so that a
+	// stray data section can be traced back to its package.  This changes
+	// the compressed bytes, and so DataHash, though deterministically.
+	StampGzipHeader bool
+	// Whether the final runtime dependencies of every package in the
+	// build are checked against RuntimeDepsIndexes once all of them are
+	// emitted, failing the build with those which no package in the
+	// indexes, nor in the build itself, satisfies.
+	VerifyRuntimeDepsResolvable bool
+	// Paths of the local APKINDEX.tar.gz files used by
+	// VerifyRuntimeDepsResolvable.
+	RuntimeDepsIndexes []string
+	// Whether both sections of each package are compressed with the
+	// standard library's gzip encoder at a fixed level, rather than with
+	// the parallel pgzip encoder.  This trades speed, since compression is
+	// single threaded, for output which is expected to stay identical
+	// across upgrades of melange's dependencies, so that a package built
+	// today can still be reproduced byte-for-byte later.  The encoder is
+	// only as stable as the Go release melange is built with; its output
+	// has not changed in many years, and the golden test guards against
+	// it doing so unnoticed.
+	StableCompression bool
+	// The combined installed size of the packages whose data sections may
+	// be compressed at once, bounding the memory used by their compression
+	// buffers, which grows with the size of the package up to a block per
+	// worker.  Each package is charged its installed size, clamped to the
+	// budget so that a package larger than it runs alone; packages smaller
+	// than 1MiB are never charged, so they are not held up behind large
+	// ones.  Zero means no limit.  Builds configured with the same
+	// WithMaxConcurrentEmitBytes option share a budget.
+	MaxConcurrentEmitBytes int64
+	emitBudget             *emitBudget
+	// The hash of all of the inputs of the build, as computed by the
+	// caller for its build cache, recorded in .PKGINFO as a comment so
+	// that packages can be traced back to their inputs.  apk ignores it,
+	// but it is part of the control section, so packages only reproduce
+	// if the hash does.
+	InputsHash string
+	// How the targets of symlinks are written to the data section; one of
+	// SymlinkModePreserve (the default), SymlinkModeRelative or
+	// SymlinkModeAbsolute.  Only targets naming an entry of the package
+	// itself, once resolved against the directory of the symlink, are
+	// rewritten.  Other targets, such as files provided by dependencies,
+	// are always preserved, since whether they exist cannot be checked.
+	SymlinkMode string
+	// Whether any error of an SCA analyzer fails the build.  By default,
+	// errors on individual files, such as an unreadable ELF or a
+	// malformed pkg-config file, are logged and the file is skipped, which
+	// may leave the package missing dependencies.
+	StrictSCA bool
+	// Write the data section of each package, exactly as it appears in
+	// the apk, as <identity>.data.tar.gz next to it, for tooling which
+	// diffs the data sections of consecutive versions.  Its sha256 is the
+	// package's DataHash.  Not supported with SingleStream.
+	EmitDataArtifact bool
+	// Whether packages whose scriptlets are structurally inconsistent,
+	// such as trigger paths without a trigger script, fail to emit.
+	StrictScriptlets bool
+	// Whether packages are written to OutDir/<arch>/<origin>/ rather
+	// than OutDir/<arch>/, grouping each package with the other
+	// subpackages of its origin.  When origin names are stripped, the
+	// origin of each package is itself.  Not supported with GenerateIndex,
+	// as apk fetches the packages of an index from its directory.
+	GroupByOrigin bool
+	// The key the APKINDEX, and per-package indexes, are signed with, when
+	// it differs from SigningKey, which signs the packages themselves.
+	IndexSigningKey string
+	// Identifies the build which produced the packages, recorded as a
+	// comment in .PKGINFO to trace packages back to the job which built
+	// them.  Unlike InputsHash, it differs between builds of the same
+	// inputs, so setting it makes packages not byte-for-byte reproducible.
+	BuildID string
+	// Whether the dependency log is written as a single JSON object at
+	// DependencyLog, holding the entry of each package keyed by arch and
+	// then by package name, rather than as DependencyLog.<arch> per arch.
+	// Entries of other packages and arches already in it are kept.
+	MergedDependencyLog bool
+	// How the data section of each package is compressed: "" for gzip at
+	// the default level, or DataCompressionAuto to pick the level of each
+	// package by AutoCompressionThresholds.  Not supported with
+	// StableCompression, whose level is fixed.
+	DataCompression string
+	// The thresholds of DataCompressionAuto.  The zero value means
+	// DefaultAutoCompressionThresholds.
+	AutoCompressionThresholds AutoCompressionThresholds
+	// Whether packages are emitted as stubs: valid, signed apks whose
+	// metadata, including generated dependencies, is that of the package,
+	// but whose data section is empty, for tooling which only queries
+	// metadata.  Stubs are not installable substitutes for packages, and
+	// the bounds on their installed size are not checked.
+	StubPackages bool
+	// Whether SourceDateEpoch is checked when the build is created,
+	// failing it if the epoch is more than SourceDateEpochMaxSkew in the
+	// future or, when SourceDateEpochMin is set, before it, as happens
+	// when SOURCE_DATE_EPOCH is misconfigured.
+	ValidateSourceDateEpoch bool
+	// How far in the future SourceDateEpoch may be, allowing for clock
+	// skew between the machine setting it and the builder.
+	SourceDateEpochMaxSkew time.Duration
+	// The earliest plausible SourceDateEpoch; zero means no minimum.
+	// Note that the default epoch, when no build date is given, is the
+	// Unix epoch.
+	SourceDateEpochMin time.Time
+	// Whether every directory in the data section is guaranteed an entry
+	// of its own preceding its contents.  Directories in the package
+	// keep the ownership and mode they are written with; any which would
+	// otherwise be implicit are added owned by root with mode 0755.
+	ExplicitDirEntries bool
+	// Called with the name of the package and each dependency, provide or
+	// vendored provide as soon as SCA generates it, for live progress
+	// reporting.  It is called synchronously from the analysis, and may be
+	// called concurrently for different packages.  The dependencies of
+	// the emitted package, which are deduplicated and merged with those
+	// configured once the analysis is complete, remain authoritative.
+	SCADiscoveryCallback func(pkg string, d sca.Discovery)
+	// Whether a copy of .PKGINFO is written next to each package as
+	// <identity>.PKGINFO, for legacy tooling which expects it without the
+	// leading dot.  This is non-standard; the copy is not part of the
+	// package, whose .PKGINFO remains the canonical file.
+	LegacyControlAlias bool
+	// Whether a package fails to emit if any warnings were logged about
+	// it, such as dependencies referring to the build environment,
+	// scriptlets being stripped or the warnings of SCA.  The failure lists
+	// every warning.  Packages with warnings from building or analyzing
+	// them are not written to OutDir.
+	WarningsAsErrors bool
+	// Whether the pipeline step which produced each file of a package is
+	// written next to it as <identity>.fileorigin.json.  Files are
+	// attributed to the top-level step which ran when they were last
+	// modified, which is only known for runners sharing the workspace with
+	// the guest.
+	TrackFileOrigins bool
+	// Whether packages with a world-writable file or directory in their
+	// data section, after DefaultFileUmask is applied, fail to emit.
+	RejectWorldWritable bool
+	// Path globs of the entries, and of directories whose contents, may be
+	// world-writable regardless of RejectWorldWritable, such as tmp
+	// directories with the sticky bit set.
+	WorldWritableAllowlist []string
+	// Directories each package, and the files written next to it, are
+	// also placed in once written to OutDir, laid out as OutDir is.  They
+	// are hard links when on the same filesystem as OutDir, and copies
+	// otherwise.  The build log records the path in OutDir only.
+	AdditionalOutDirs []string
+	// Whether this build leaves architecture independent subpackages
+	// unemitted, as another build of the same configuration for a
+	// different architecture emits them.  LinkNoArchPackages places them
+	// in the directory of this build's arch once that build finishes.
+	SkipNoArch bool
+	// Whether the spelling of the dependencies and provides of packages is
+	// canonicalized, without changing their meaning: no spaces around
+	// version operators, operators such as "=>" written as ">=", and
+	// provides ordered by name.
+	NormalizeDepOperators bool
+	// Whether the sha256 of the configuration file is recorded in .PKGINFO
+	// as "# configdigest = <sha256>", for auditing which definition produced a
+	// package.
+	EmbedConfigDigest bool
+	// The sha256 of the configuration file, recorded when
+	// EmbedConfigDigest is set.  New computes it.
+	ConfigDigest string
+	// Whether the configuration file is shipped in each package as
+	// /usr/share/melange/<name>.yaml, owned by root.
+	EmbedConfigFile bool
+	// The contents of the configuration file, for EmbedConfigFile.
+	configData []byte
+	// Rewrites the name of each runtime dependency, provide and replace of
+	// packages, declared or generated, such as to prefix them to resolve
+	// in a private namespace.  Self-provided dependencies are removed
+	// after rewriting.  See PrefixDepNames.
+	DepNameRewrite func(name string) string
+	// Whether to compress the data section of each package again with
+	// gzip, zstd and xz, reporting the size and time taken by each as
+	// <identity>.compression.json.  This is a diagnostic: the emitted
+	// package is unchanged, and the build is considerably slower.
+	BenchmarkCompression bool
+	// A reference package, or a directory of them, which each package is
+	// compared against after it is emitted, such as the same package
+	// built elsewhere.  The differences found are written as
+	// <identity>.compare.json.  A directory holds the references under
+	// their usual file names; a single package is only compared against
+	// the package of the same name.
+	CompareAgainst string
+	// The mode of the files melange adds to packages, such as changelogs,
+	// protected path lists, embedded configuration and SBOMs.  Zero means
+	// 0644.  They are owned by root regardless of UID and GID remapping.
+	InjectedFileMode os.FileMode
+	// Whether the sha256 of each package emitted is written to
+	// OutDir/SHA256SUMS, in the format of sha256sum, once all of them are
+	// emitted.  Clients which verify packages as they stream them should
+	// use these digests: apk checks every byte after the control section
+	// against the datahash, so a digest cannot be carried in the package
+	// itself.
+	EmitChecksumsFile bool
+	// Whether SHA256SUMS is signed with the index signing key, as
+	// SHA256SUMS.sig.
+	SignChecksumsFile bool
+	// Whether a SigningKey which does not exist is a warning, leaving
+	// packages unsigned, rather than an error, such as for local
+	// development.
+	SigningKeyOptional bool
+	// Whether the entries for standard directories, such as usr and etc,
+	// are owned by root with their standard modes in the data section,
+	// whatever they are in the workspace.
+	NormalizeStandardDirs bool
+	// If set, records the metadata of each package once it is emitted.
+	MetadataSink MetadataSink
+	// Appended to the names of the package and its subpackages, and to the
+	// dependencies between them, so that several flavors of the same
+	// configuration can be built, e.g. "-openssl".
+	PackageNameSuffix string
+	// Whether the control data of each package is also written next to it
+	// as <identity>.metadata.json, with typed fields.
+	EmitMetadataJSON bool
+	// Whether to check, before emitting, that the packages of the build
+	// which pin each other to an exact version pin the version being built.
+	VerifyVersionConsistency bool
+	// The size of the blocks the data section is split into to be
+	// compressed in parallel, a power of two from 32KiB to 64MiB.  Larger
+	// blocks compress better, smaller ones need less memory.  0 means 1MiB.
+	PgzipBlockSize int
+	// Whether each package is also wrapped as an OCI artifact, in an OCI
+	// layout directory next to it as <identity>.oci.
+	EmitOCILayout bool
+	// Whether the build fails if the packages it emits depend on each
+	// other in a cycle, through their final runtime dependencies and
+	// provides.
+	DetectDependencyCycles bool
+	// Whether the ids of the accounts of the build environment are
+	// exported to post-install scriptlets, as MELANGE_UID_<user> and
+	// MELANGE_GID_<group>, so that they need not be hardcoded.
+	ScriptletAccountEnv bool
+	// The maximum number of depend, provides and replaces lines in the
+	// control data of a package, as a guard against runaway SCA.  Packages
+	// over the limit fail to emit, unless MaxDependenciesWarn is set.
+	// Zero means no limit.
+	MaxDependencies     int
+	MaxDependenciesWarn bool
+	// Whether to warn about packages which end up with neither runtime
+	// dependencies nor provides, which usually means nothing useful was
+	// installed into them.  Virtual packages (no-provides) are exempt.
+	WarnIsolatedPackages bool
+	// Whether the data section is compressed with the single threaded
+	// encoder of the standard library at the level of the chosen data
+	// compression, rather than with the parallel pgzip encoder, so that
+	// its bytes and DataHash do not depend on the number of compression
+	// workers available.  Compression then uses one core per package, so
+	// emitting a large package takes up to pgzipThreads (at most 8) times
+	// as long.  StableCompression implies it, at a fixed level.
+	DeterministicCompression bool
+	// Whether the checksum of every file in a package is also written next
+	// to it as <identity>.manifest, in the format of `apk manifest`.
+	// Requires the PAX tar format, which carries the checksums.
+	EmitApkManifest bool
+	// How paths of a package which differ only in case within the same
+	// directory, and so collide when installed on a case-insensitive
+	// filesystem, are reported: "" (not checked), CaseCollisionsWarn or
+	// CaseCollisionsError.
+	DetectCaseCollisions string
+	// Where the builddate of packages comes from: BuildDateSourceEpoch
+	// (the default), BuildDateSourceReleaseDate, or an RFC3339 timestamp.
+	// The timestamps of the data section are SourceDateEpoch regardless.
+	BuildDateSource string
+	// Whether the names offered by each package, its own and those of its
+	// provides, are recorded in provides-map.json in OutDir once all
+	// packages are emitted, mapping each name to the packages offering it.
+	EmitProvidesMap bool
+	// The largest size in bytes a scriptlet may have, as some versions of
+	// apk read scriptlets into fixed buffers.  Zero means no limit.
+	// Scriptlets over 64KiB are warned about regardless.
+	MaxScriptletSize int64
+	// The names of the packages and subpackages to emit; the others are
+	// not linted, analyzed or emitted, though their pipelines still run so
+	// that files are split between packages as usual.  Empty means all of
+	// them.
+	OnlyPackages []string
+	// The packages emitted so far, for VerifyRuntimeDepsResolvable,
+	// DetectDependencyCycles and EmitProvidesMap.
+	emittedPackages []*apk.Package
+	// The warnings logged while emitting packages, for WarningsAsErrors.
+	warnings []Warning
+	// The steps run so far, for TrackFileOrigins.
+	pipelineSteps []pipelineStep
+	// The sha256 of the packages emitted so far by their path relative to
+	// OutDir, for EmitChecksumsFile.
+	checksums map[string]string
+	// The SBOMs written into each package by its name, which are written
+	// again once its dependencies are generated.
+	sbomSpecs map[string]*sbom.Spec
 
 	EnabledBuildOptions []string
 }
@@ -172,6 +705,12 @@ func New(ctx context.Context, opts ...Option) (*Build, error) {
 
 	b.Configuration = *parsedCfg
 
+	if b.EmbedConfigDigest || b.EmbedConfigFile {
+		if err := b.readConfigFile(); err != nil {
+			return nil, err
+		}
+	}
+
 	if len(b.Configuration.Package.TargetArchitecture) == 1 &&
 		b.Configuration.Package.TargetArchitecture[0] == "all" {
 		log.Warnf("target-architecture: ['all'] is deprecated and will become an error; remove this field to build for all available archs")
@@ -189,6 +728,68 @@ func New(ctx context.Context, opts ...Option) (*Build, error) {
 		b.SourceDateEpoch = t
 	}
 
+	if b.ValidateSourceDateEpoch {
+		if err := b.checkSourceDateEpoch(time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	if b.MaxConcurrentEmitBytes > 0 && b.emitBudget == nil {
+		b.emitBudget = newEmitBudget(b.MaxConcurrentEmitBytes)
+	}
+
+	if err := b.checkOnlyPackages(); err != nil {
+		return nil, err
+	}
+
+	if b.GroupByOrigin && b.StripOriginName && b.StrippedOriginMode == StrippedOriginEmpty && b.Configuration.Package.OriginOverride == "" {
+		return nil, fmt.Errorf("packages cannot be grouped by origin when their origin is omitted")
+	}
+
+	if b.GroupByOrigin && b.GenerateIndex {
+		return nil, fmt.Errorf("packages grouped by origin cannot be indexed, as apk fetches them from the directory of the index; disable index generation")
+	}
+
+	if b.DataCompression == DataCompressionAuto && b.StableCompression {
+		return nil, fmt.Errorf("automatic data compression cannot be used with stable compression")
+	}
+
+	if err := b.checkPackageDataCompression(); err != nil {
+		return nil, err
+	}
+
+	if err := b.checkSingleStream(); err != nil {
+		return nil, err
+	}
+
+	if b.EmitApkManifest && b.TarFormat != "" && b.TarFormat != TarFormatPAX {
+		return nil, fmt.Errorf("apk manifests require the %s tar format, which carries file checksums", TarFormatPAX)
+	}
+
+	if b.VerifyRuntimeDepsResolvable && len(b.RuntimeDepsIndexes) == 0 {
+		return nil, fmt.Errorf("verifying runtime dependencies requires at least one index")
+	}
+
+	if _, err := b.buildDate(); err != nil {
+		return nil, err
+	}
+
+	if err := validatePgzipBlockSize(b.PgzipBlockSize); err != nil {
+		return nil, err
+	}
+
+	if err := b.checkSigningKey(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := b.checkVerifyInputs(); err != nil {
+		return nil, err
+	}
+
+	if b.SignChecksumsFile && b.indexSigningKey() == "" {
+		return nil, fmt.Errorf("signing %s requires a signing key", checksumsFile)
+	}
+
 	// Check that we actually can run things in containers.
 	if !b.Runner.TestUsability(ctx) {
 		return nil, fmt.Errorf("unable to run containers using %s, specify --runner and one of %s", b.Runner.Name(), GetAllRunners())
@@ -469,6 +1070,35 @@ func fetchBucket(ctx context.Context, cacheSource string, cmm CacheMembershipMap
 	return tmp, nil
 }
 
+// DataChanged reports whether datahash differs from the baseline DataHash
+// recorded for the named package.  Packages without a baseline are always
+// considered changed.
+func (b *Build) DataChanged(name, datahash string) bool {
+	baseline, ok := b.BaselineDataHashes[name]
+	return !ok || baseline != datahash
+}
+
+// apkArch returns the arch name written into packages, which is the alias
+// of the build arch if one is configured.
+func (b *Build) apkArch() string {
+	if alias, ok := b.ArchAlias[b.Arch.ToAPK()]; ok {
+		return alias
+	}
+	return b.Arch.ToAPK()
+}
+
+// sbomFormats returns the sbom package formats selected by SBOMFormat.
+func (b *Build) sbomFormats() []string {
+	switch b.SBOMFormat {
+	case SBOMFormatCycloneDX:
+		return []string{sbom.FormatCycloneDX}
+	case SBOMFormatBoth:
+		return []string{sbom.FormatSPDX, sbom.FormatCycloneDX}
+	default:
+		return []string{sbom.FormatSPDX}
+	}
+}
+
 // IsBuildLess returns true if the build context does not actually do any building.
 // TODO(kaniini): Improve the heuristic for this by checking for uses/runs statements
 // in the pipeline.
@@ -690,6 +1320,16 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		ctx = tctx
 	}
 
+	skipped := b.skippedPrerequisites()
+	names := make([]string, 0, len(skipped))
+	for name := range skipped {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b.warnf(ctx, name, "%s depends on %s, which will not be emitted", name, strings.Join(skipped[name], ", "))
+	}
+
 	pkg := &b.Configuration.Package
 
 	pb := PipelineBuild{
@@ -782,6 +1422,12 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		cfg.ImgRef = imgRef
 		log.Infof("ImgRef = %s", cfg.ImgRef)
 
+		if b.VerifyInputSignatures {
+			if err := b.VerifyInputs(ctx); err != nil {
+				return fmt.Errorf("unable to verify input signatures: %w", err)
+			}
+		}
+
 		// TODO(kaniini): Make overlay-binsh work with Docker and Kubernetes.
 		// Probably needs help from apko.
 		if err := b.OverlayBinSh(); err != nil {
@@ -805,11 +1451,13 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 
 		// run the main pipeline
 		log.Debug("running the main pipeline")
-		for _, p := range b.Configuration.Pipeline {
+		for i, p := range b.Configuration.Pipeline {
 			pctx := NewPipelineContext(&p, &b.Configuration.Environment, cfg, b.PipelineDirs)
+			start := time.Now()
 			if _, err := pctx.Run(ctx, &pb); err != nil {
 				return fmt.Errorf("unable to run pipeline: %w", err)
 			}
+			b.trackStep(b.Configuration.Package.Name, i, pctx, start)
 		}
 
 		// add the main package to the linter queue
@@ -840,11 +1488,13 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 				continue
 			}
 
-			for _, p := range sp.Pipeline {
+			for i, p := range sp.Pipeline {
 				pctx := NewPipelineContext(&p, &b.Configuration.Environment, cfg, b.PipelineDirs)
+				start := time.Now()
 				if _, err := pctx.Run(ctx, &pb); err != nil {
 					return fmt.Errorf("unable to run pipeline: %w", err)
 				}
+				b.trackStep(sp.Name, i, pctx, start)
 			}
 		}
 
@@ -868,8 +1518,21 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 	}
 	log.Infof("retrieved and wrote post-build workspace to: %s", b.WorkspaceDir)
 
+	// move files into subpackages according to the package's rules
+	subpackageNames := []string{}
+	for _, lt := range linterQueue {
+		subpackageNames = append(subpackageNames, lt.pkgName)
+	}
+	if err := b.routeSubpackageFiles(ctx, b.WorkspaceDir, &b.Configuration.Package, subpackageNames); err != nil {
+		return fmt.Errorf("applying subpackage rules: %w", err)
+	}
+
 	// perform package linting
 	for _, lt := range linterQueue {
+		if !b.selected(lt.pkgName) {
+			continue
+		}
+
 		log.Infof("running package linters for %s", lt.pkgName)
 
 		path := filepath.Join(b.WorkspaceDir, "melange-out", lt.pkgName)
@@ -891,6 +1554,7 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 
 	// Run the SBOM generator.
 	generator := sbom.NewGenerator()
+	b.sbomSpecs = map[string]*sbom.Spec{}
 
 	licensinginfos, err := b.Configuration.Package.LicensingInfos(b.WorkspaceDir)
 	if err != nil {
@@ -900,6 +1564,9 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 	// generate SBOMs for subpackages
 	for _, sp := range b.Configuration.Subpackages {
 		sp := sp
+		if !b.selected(sp.Name) {
+			continue
+		}
 
 		if !b.IsBuildLess() {
 			log.Infof("generating SBOM for subpackage %s", sp.Name)
@@ -914,45 +1581,66 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 			}
 		}
 
-		if err := generator.GenerateSBOM(ctx, &sbom.Spec{
+		spec := &sbom.Spec{
 			Path:            filepath.Join(b.WorkspaceDir, "melange-out", sp.Name),
-			PackageName:     sp.Name,
+			PackageName:     b.emittedName(sp.Name),
+			PackageVersion:  fmt.Sprintf("%s-r%d", b.Configuration.Package.Version, b.Configuration.Package.Epoch),
+			License:         b.Configuration.Package.LicenseExpression(),
+			LicensingInfos:  licensinginfos,
+			ExternalRefs:    externalRefs,
+			Copyright:       b.Configuration.Package.FullCopyright(),
+			Namespace:       namespace,
+			Arch:            b.packageArch(pkgFromSub(&sp)),
+			SourceDateEpoch: b.SourceDateEpoch,
+			Dependencies:    sp.Dependencies.Runtime,
+			Formats:         b.sbomFormats(),
+		}
+		b.sbomSpecs[spec.PackageName] = spec
+		if err := generator.GenerateSBOM(ctx, spec); err != nil {
+			return fmt.Errorf("writing SBOMs: %w", err)
+		}
+	}
+
+	if b.selected(b.Configuration.Package.Name) {
+		spec := &sbom.Spec{
+			Path:            filepath.Join(b.WorkspaceDir, "melange-out", b.Configuration.Package.Name),
+			PackageName:     b.emittedName(b.Configuration.Package.Name),
 			PackageVersion:  fmt.Sprintf("%s-r%d", b.Configuration.Package.Version, b.Configuration.Package.Epoch),
 			License:         b.Configuration.Package.LicenseExpression(),
 			LicensingInfos:  licensinginfos,
 			ExternalRefs:    externalRefs,
 			Copyright:       b.Configuration.Package.FullCopyright(),
 			Namespace:       namespace,
-			Arch:            b.Arch.ToAPK(),
+			Arch:            b.apkArch(),
 			SourceDateEpoch: b.SourceDateEpoch,
-		}); err != nil {
+			Dependencies:    b.Configuration.Package.Dependencies.Runtime,
+			Formats:         b.sbomFormats(),
+		}
+		b.sbomSpecs[spec.PackageName] = spec
+		if err := generator.GenerateSBOM(ctx, spec); err != nil {
 			return fmt.Errorf("writing SBOMs: %w", err)
 		}
 	}
 
-	if err := generator.GenerateSBOM(ctx, &sbom.Spec{
-		Path:            filepath.Join(b.WorkspaceDir, "melange-out", b.Configuration.Package.Name),
-		PackageName:     b.Configuration.Package.Name,
-		PackageVersion:  fmt.Sprintf("%s-r%d", b.Configuration.Package.Version, b.Configuration.Package.Epoch),
-		License:         b.Configuration.Package.LicenseExpression(),
-		LicensingInfos:  licensinginfos,
-		ExternalRefs:    externalRefs,
-		Copyright:       b.Configuration.Package.FullCopyright(),
-		Namespace:       namespace,
-		Arch:            b.Arch.ToAPK(),
-		SourceDateEpoch: b.SourceDateEpoch,
-	}); err != nil {
-		return fmt.Errorf("writing SBOMs: %w", err)
+	if b.VerifyVersionConsistency {
+		if err := b.verifyVersionConsistency(); err != nil {
+			return err
+		}
 	}
 
 	// emit main package
-	if err := pb.Emit(ctx, pkg); err != nil {
-		return fmt.Errorf("unable to emit package: %w", err)
+	if b.selected(pkg.Name) {
+		if err := pb.Emit(ctx, pkg); err != nil {
+			return fmt.Errorf("unable to emit package: %w", err)
+		}
 	}
 
 	// emit subpackages
 	for _, sp := range b.Configuration.Subpackages {
 		sp := sp
+		if !b.selected(sp.Name) {
+			continue
+		}
 		pb.Subpackage = &sp
 
 		result, err := pb.ShouldRun(sp)
@@ -963,11 +1651,34 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 			continue
 		}
 
+		if sp.NoArch && b.SkipNoArch {
+			log.Infof("not emitting %s, which is emitted by the build for another arch", sp.Name)
+			continue
+		}
+
 		if err := pb.Emit(ctx, pkgFromSub(&sp)); err != nil {
 			return fmt.Errorf("unable to emit package: %w", err)
 		}
 	}
 
+	if b.VerifyRuntimeDepsResolvable {
+		if err := b.verifyRuntimeDepsResolvable(ctx); err != nil {
+			return err
+		}
+	}
+
+	if b.DetectDependencyCycles {
+		if err := b.detectDependencyCycles(ctx); err != nil {
+			return err
+		}
+	}
+
+	if b.EmitProvidesMap {
+		if err := b.writeProvidesMap(ctx); err != nil {
+			return err
+		}
+	}
+
 	if !b.IsBuildLess() {
 		// clean build guest container
 		if err := os.RemoveAll(b.GuestDir); err != nil {
@@ -983,17 +1694,28 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		log.Infof("WARNING: unable to clean workspace: %s", err)
 	}
 
+	// Architecture independent packages are also placed in the directory
+	// of the arch, so that they are found through its index.
+	var noarchFiles []string
+	if !b.SkipNoArch {
+		if noarchFiles, err = b.linkNoArchPackages(ctx, &pb); err != nil {
+			return err
+		}
+	}
+
 	// generate APKINDEX.tar.gz and sign it
 	if b.GenerateIndex {
-		packageDir := filepath.Join(pb.Build.OutDir, pb.Build.Arch.ToAPK())
-		log.Infof("generating apk index from packages in %s", packageDir)
-
 		var apkFiles []string
-		pkgFileName := fmt.Sprintf("%s-%s-r%d.apk", b.Configuration.Package.Name, b.Configuration.Package.Version, b.Configuration.Package.Epoch)
-		apkFiles = append(apkFiles, filepath.Join(packageDir, pkgFileName))
+		if b.selected(b.Configuration.Package.Name) {
+			pkgFileName := fmt.Sprintf("%s-%s-r%d.apk", b.emittedName(b.Configuration.Package.Name), b.Configuration.Package.Version, b.Configuration.Package.Epoch)
+			apkFiles = append(apkFiles, filepath.Join(b.packageDir(&b.Configuration.Package), pkgFileName))
+		}
 
 		for _, subpkg := range b.Configuration.Subpackages {
 			subpkg := subpkg
+			if !b.selected(subpkg.Name) || subpkg.NoArch {
+				continue
+			}
 			pb.Subpackage = &subpkg
 
 			result, err := pb.ShouldRun(subpkg)
@@ -1004,28 +1726,18 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 				continue
 			}
 
-			subpkgFileName := fmt.Sprintf("%s-%s-r%d.apk", subpkg.Name, b.Configuration.Package.Version, b.Configuration.Package.Epoch)
-			apkFiles = append(apkFiles, filepath.Join(packageDir, subpkgFileName))
-		}
-
-		opts := []index.Option{
-			index.WithPackageFiles(apkFiles),
-			index.WithSigningKey(b.SigningKey),
-			index.WithMergeIndexFileFlag(true),
-			index.WithIndexFile(filepath.Join(packageDir, "APKINDEX.tar.gz")),
+			subpkgFileName := fmt.Sprintf("%s-%s-r%d.apk", b.emittedName(subpkg.Name), b.Configuration.Package.Version, b.Configuration.Package.Epoch)
+			apkFiles = append(apkFiles, filepath.Join(b.packageDir(pkgFromSub(&subpkg)), subpkgFileName))
 		}
 
-		idx, err := index.New(opts...)
-		if err != nil {
-			return fmt.Errorf("unable to create index: %w", err)
-		}
-
-		if err := idx.GenerateIndex(ctx); err != nil {
-			return fmt.Errorf("unable to generate index: %w", err)
+		if err := b.generateIndex(ctx, append(apkFiles, noarchFiles...)); err != nil {
+			return err
 		}
+	}
 
-		if err := idx.WriteJSONIndex(filepath.Join(packageDir, "APKINDEX.json")); err != nil {
-			return fmt.Errorf("unable to generate JSON index: %w", err)
+	if b.EmitChecksumsFile {
+		if err := b.writeChecksumsFile(ctx); err != nil {
+			return err
 		}
 	}
 
@@ -1229,6 +1941,49 @@ func (b *Build) RetrieveWorkspace(ctx context.Context, fs apkofs.FullFS) error {
 	return nil
 }
 
+// checkSourceDateEpoch returns an error if SourceDateEpoch is implausible
+// at the time now: more than SourceDateEpochMaxSkew after it, or before
+// SourceDateEpochMin.
+func (b *Build) checkSourceDateEpoch(now time.Time) error {
+	epoch := b.SourceDateEpoch
+	if ahead := epoch.Sub(now); ahead > b.SourceDateEpochMaxSkew {
+		return fmt.Errorf("source date epoch %d (%s) is %s in the future, more than the allowed skew of %s",
+			epoch.Unix(), epoch.UTC().Format(time.RFC3339), ahead.Round(time.Second), b.SourceDateEpochMaxSkew)
+	}
+
+	if !b.SourceDateEpochMin.IsZero() && epoch.Before(b.SourceDateEpochMin) {
+		return fmt.Errorf("source date epoch %d (%s) is before the minimum of %s",
+			epoch.Unix(), epoch.UTC().Format(time.RFC3339), b.SourceDateEpochMin.UTC().Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// buildDate returns the build date recorded in packages, according to
+// BuildDateSource.
+func (b *Build) buildDate() (time.Time, error) {
+	switch b.BuildDateSource {
+	case "", BuildDateSourceEpoch:
+		return b.SourceDateEpoch, nil
+	case BuildDateSourceReleaseDate:
+		date := b.Configuration.Package.ReleaseDate
+		if date == "" {
+			return time.Time{}, fmt.Errorf("build date source is %s, but %s has no release-date", BuildDateSourceReleaseDate, b.Configuration.Package.Name)
+		}
+		t, err := time.Parse(time.RFC3339, date)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("parsing release-date of %s: %w", b.Configuration.Package.Name, err)
+		}
+		return t, nil
+	default:
+		t, err := time.Parse(time.RFC3339, b.BuildDateSource)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("build date source %q is neither %s, %s nor an RFC3339 timestamp", b.BuildDateSource, BuildDateSourceEpoch, BuildDateSourceReleaseDate)
+		}
+		return t, nil
+	}
+}
+
 // sourceDateEpoch parses the SOURCE_DATE_EPOCH environment variable.
 // If it is not set, it returns the defaultTime.
 // If it is set, it MUST be an ASCII representation of an integer.
@@ -1252,3 +2007,36 @@ func sourceDateEpoch(defaultTime time.Time) (time.Time, error) {
 
 	return time.Unix(sec, 0).UTC(), nil
 }
+
+// generateIndex adds apkFiles to the signed APKINDEX of the arch being built,
+// OutDir/<arch>/APKINDEX.tar.gz, merging them with the packages it already
+// lists, and writes it as JSON too.
+func (b *Build) generateIndex(ctx context.Context, apkFiles []string) error {
+	log := clog.FromContext(ctx)
+
+	indexDir := filepath.Join(b.OutDir, b.apkArch())
+	log.Infof("generating apk index from packages in %s", indexDir)
+
+	opts := []index.Option{
+		index.WithPackageFiles(apkFiles),
+		index.WithSigningKey(b.indexSigningKey()),
+		index.WithSigningPassphrase(b.indexSigningPassphrase()),
+		index.WithMergeIndexFileFlag(true),
+		index.WithIndexFile(filepath.Join(indexDir, "APKINDEX.tar.gz")),
+	}
+
+	idx, err := index.New(opts...)
+	if err != nil {
+		return fmt.Errorf("unable to create index: %w", err)
+	}
+
+	if err := idx.GenerateIndex(ctx); err != nil {
+		return fmt.Errorf("unable to generate index: %w", err)
+	}
+
+	if err := idx.WriteJSONIndex(filepath.Join(indexDir, "APKINDEX.json")); err != nil {
+		return fmt.Errorf("unable to generate JSON index: %w", err)
+	}
+
+	return nil
+}
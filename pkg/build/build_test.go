@@ -369,3 +369,32 @@ func TestSourceDateEpoch(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckSourceDateEpoch(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	earliest := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, tt := range []struct {
+		name    string
+		epoch   time.Time
+		min     time.Time
+		wantErr string
+	}{
+		{name: "now", epoch: now},
+		{name: "within skew", epoch: now.Add(30 * time.Minute)},
+		{name: "unix epoch", epoch: time.Unix(0, 0)},
+		{name: "future", epoch: time.Unix(4102444800, 0), wantErr: "source date epoch 4102444800 (2100-01-01T00:00:00Z) is 663300h0m0s in the future, more than the allowed skew of 1h0m0s"},
+		{name: "too early", epoch: time.Unix(0, 0), min: earliest, wantErr: "source date epoch 0 (1970-01-01T00:00:00Z) is before the minimum of 2000-01-01T00:00:00Z"},
+		{name: "after minimum", epoch: now, min: earliest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Build{SourceDateEpoch: tt.epoch, SourceDateEpochMaxSkew: time.Hour, SourceDateEpochMin: tt.min}
+			err := b.checkSourceDateEpoch(now)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
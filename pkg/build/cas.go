@@ -0,0 +1,141 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// casDir is the directory within OutDir holding content addressed packages.
+const casDir = ".cas"
+
+// casObject returns the path, relative to OutDir, of the content addressed
+// object of a package whose data section has dataHash.
+func casObject(dataHash string) string {
+	return filepath.Join(casDir, dataHash+".apk")
+}
+
+// writeContentAddressed writes the parts of the apk to its content addressed
+// object, unless an identical object already exists, and links the usual
+// file name of the package to it.  It returns the hex-encoded sha256 of the
+// apk.
+//
+// Packages whose data sections are identical but whose control sections
+// differ, such as two versions of a package which did not change, share a
+// key.  The object is never replaced, as other packages may be linked to
+// it, so such a package is written to its usual file name instead.
+func (pc *PackageBuild) writeContentAddressed(ctx context.Context, parts []io.Reader, dataHash string) (string, error) {
+	log := clog.FromContext(ctx)
+
+	object := filepath.Join(pc.OutDir, casObject(dataHash))
+	if err := os.MkdirAll(filepath.Dir(object), 0o755); err != nil {
+		return "", fmt.Errorf("unable to create content addressed store: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(object), dataHash+".apk.*")
+	if err != nil {
+		return "", fmt.Errorf("unable to create temporary apk file: %w", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	digest, err := writePackageFile(tmp.Name(), parts)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.Remove(pc.Filename()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("unable to replace %s: %w", pc.Filename(), err)
+	}
+
+	existing, err := fileSHA256(object)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if err := os.Rename(tmp.Name(), object); err != nil {
+			return "", fmt.Errorf("unable to store content addressed apk: %w", err)
+		}
+		log.Infof("stored %s as %s", pc.Identity(), casObject(dataHash))
+	case err != nil:
+		return "", fmt.Errorf("unable to read content addressed apk: %w", err)
+	case existing == digest:
+		log.Infof("reusing %s for %s", casObject(dataHash), pc.Identity())
+	default:
+		pc.warnf(ctx, "%s holds another package with the same data section as %s, writing it without deduplication", casObject(dataHash), pc.Identity())
+		if err := os.Rename(tmp.Name(), pc.Filename()); err != nil {
+			return "", fmt.Errorf("unable to write apk file: %w", err)
+		}
+		return digest, nil
+	}
+
+	if pc.Build.ContentAddressedLink == ContentAddressedLinkCopy {
+		if err := copyRegularFile(object, pc.Filename()); err != nil {
+			return "", fmt.Errorf("unable to copy content addressed apk: %w", err)
+		}
+		return digest, nil
+	}
+
+	if err := os.Symlink(casObject(dataHash), pc.Filename()); err != nil {
+		return "", fmt.Errorf("unable to link content addressed apk: %w", err)
+	}
+
+	return digest, nil
+}
+
+// fileSHA256 returns the hex-encoded sha256 of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	digest := sha256.New()
+	if _, err := io.Copy(digest, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// copyRegularFile copies the file at src to dest.
+func copyRegularFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
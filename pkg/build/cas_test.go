@@ -0,0 +1,94 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentAddressedOutput(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{ContentAddressedOutput: true}
+	newPackageBuild := testPackageBuilder(t, b)
+
+	pc := newPackageBuild()
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	object := filepath.Join(pc.OutDir, ".cas", pc.Result.DataHash+".apk")
+	require.FileExists(t, object)
+	link, err := os.Readlink(pc.Filename())
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(".cas", pc.Result.DataHash+".apk"), link)
+	require.Equal(t, pc.Result.Digest, mustSHA256(t, pc.Filename()))
+
+	// Rebuilding an identical package reuses the object.
+	info, err := os.Stat(object)
+	require.NoError(t, err)
+	pc = newPackageBuild()
+	require.NoError(t, pc.EmitPackage(ctx))
+	again, err := os.Stat(object)
+	require.NoError(t, err)
+	require.True(t, os.SameFile(info, again))
+
+	// Building without content addressing replaces the link, rather than
+	// writing through it into the object.
+	objectDigest := mustSHA256(t, object)
+	b.ContentAddressedOutput = false
+	pc = newPackageBuild()
+	pc.Description = "changed"
+	require.NoError(t, pc.EmitPackage(ctx))
+	fi, err := os.Lstat(pc.Filename())
+	require.NoError(t, err)
+	require.True(t, fi.Mode().IsRegular())
+	require.Equal(t, objectDigest, mustSHA256(t, object))
+	require.NotEqual(t, objectDigest, pc.Result.Digest)
+	b.ContentAddressedOutput = true
+
+	// The named file may be a copy instead.
+	b.ContentAddressedLink = ContentAddressedLinkCopy
+	pc = newPackageBuild()
+	require.NoError(t, pc.EmitPackage(ctx))
+	fi, err = os.Lstat(pc.Filename())
+	require.NoError(t, err)
+	require.True(t, fi.Mode().IsRegular())
+	require.Equal(t, mustSHA256(t, object), mustSHA256(t, pc.Filename()))
+
+	// Another version with the same data section shares the key, but not
+	// the object.
+	pc = newPackageBuild()
+	pc.Origin.Version = "1.0.1"
+	require.NoError(t, pc.EmitPackage(ctx))
+	require.Equal(t, pc.Result.Digest, mustSHA256(t, pc.Filename()))
+	require.NotEqual(t, mustSHA256(t, object), pc.Result.Digest)
+
+	logDir := t.TempDir()
+	b.CreateBuildLog = true
+	require.NoError(t, pc.AppendBuildLog(logDir))
+	buildLog, err := os.ReadFile(filepath.Join(logDir, "packages.log"))
+	require.NoError(t, err)
+	require.Contains(t, string(buildLog), "x86_64|hello|hello|1.0.1-r0|datahash="+pc.Result.DataHash+"\n")
+}
+
+func mustSHA256(t *testing.T, path string) string {
+	t.Helper()
+	digest, err := fileSHA256(path)
+	require.NoError(t, err)
+	return digest
+}
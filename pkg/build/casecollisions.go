@@ -0,0 +1,75 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"chainguard.dev/melange/pkg/sca"
+)
+
+// caseCollision is a pair of paths of a package which differ only in the
+// case of their names, within the same directory.
+type caseCollision struct {
+	first, second string
+}
+
+// caseCollisions returns the paths of walked which differ only in case from
+// an earlier path in the same directory.  The entries of two directories
+// which collide are not compared with each other, as the directories
+// themselves are reported.
+func caseCollisions(walked []sca.WalkedEntry) []caseCollision {
+	seen := map[string]string{}
+	collisions := []caseCollision{}
+	for _, we := range walked {
+		dir, name := path.Split(we.Path)
+		key := dir + strings.ToLower(name)
+		if first, ok := seen[key]; ok {
+			collisions = append(collisions, caseCollision{first: first, second: we.Path})
+			continue
+		}
+		seen[key] = we.Path
+	}
+	return collisions
+}
+
+// checkCaseCollisions reports the paths of the package which collide on
+// case-insensitive filesystems, according to Build.DetectCaseCollisions.
+func (pc *PackageBuild) checkCaseCollisions(ctx context.Context, walked []sca.WalkedEntry) error {
+	if pc.Build.DetectCaseCollisions == "" {
+		return nil
+	}
+
+	collisions := caseCollisions(walked)
+	if len(collisions) == 0 {
+		return nil
+	}
+
+	if pc.Build.DetectCaseCollisions == CaseCollisionsWarn {
+		for _, c := range collisions {
+			pc.warnf(ctx, "%s and %s of %s collide on case-insensitive filesystems", c.first, c.second, pc.PackageName)
+		}
+		return nil
+	}
+
+	pairs := make([]string, 0, len(collisions))
+	for _, c := range collisions {
+		pairs = append(pairs, c.first+" and "+c.second)
+	}
+	return fmt.Errorf("paths of %s collide on case-insensitive filesystems: %s", pc.Identity(), strings.Join(pairs, "; "))
+}
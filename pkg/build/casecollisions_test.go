@@ -0,0 +1,68 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectCaseCollisions(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		mode    string
+		wantErr string
+		warns   []string
+	}{{
+		mode: "",
+	}, {
+		mode: CaseCollisionsWarn,
+		warns: []string{
+			"usr/share/Doc and usr/share/doc of hello collide on case-insensitive filesystems",
+			"usr/share/doc/README and usr/share/doc/readme of hello collide on case-insensitive filesystems",
+		},
+	}, {
+		mode:    CaseCollisionsError,
+		wantErr: "paths of hello-1.0.0-r0 collide on case-insensitive filesystems: usr/share/Doc and usr/share/doc; usr/share/doc/README and usr/share/doc/readme",
+	}} {
+		t.Run(tc.mode, func(t *testing.T) {
+			b := &Build{DetectCaseCollisions: tc.mode}
+			pc := testPackageBuilder(t, b)()
+			share := filepath.Join(pc.WorkspaceSubdir(), "usr", "share")
+			for _, name := range []string{"Doc/README", "doc/README", "doc/readme", "doc/NEWS"} {
+				require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(share, name)), 0o755))
+				require.NoError(t, os.WriteFile(filepath.Join(share, name), []byte(name), 0o644))
+			}
+
+			err := pc.EmitPackage(ctx)
+			if tc.wantErr != "" {
+				require.EqualError(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			warns := []string{}
+			for _, w := range b.Warnings() {
+				warns = append(warns, w.Message)
+			}
+			require.ElementsMatch(t, tc.warns, warns)
+		})
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// checksumsFile is the name of the file EmitChecksumsFile writes in OutDir.
+const checksumsFile = "SHA256SUMS"
+
+// checksumsFileMu serializes writing checksumsFile, which the builds for
+// each architecture share.
+var checksumsFileMu sync.Mutex
+
+// recordChecksum records the sha256 of the package written to path, for
+// EmitChecksumsFile.
+func (b *Build) recordChecksum(path, digest string) error {
+	rel, err := filepath.Rel(b.OutDir, path)
+	if err != nil {
+		return fmt.Errorf("unable to resolve %s relative to the output directory: %w", path, err)
+	}
+
+	if b.checksums == nil {
+		b.checksums = map[string]string{}
+	}
+	b.checksums[filepath.ToSlash(rel)] = digest
+
+	return nil
+}
+
+// writeChecksumsFile writes the sha256 of each package emitted to
+// OutDir/SHA256SUMS, in the format of sha256sum, sorted by file name.  The
+// entries already in the file are kept, so that builds for several
+// architectures or several configurations into the same OutDir are all
+// covered, except for the files which no longer exist.  If
+// SignChecksumsFile is set, it is signed with the index signing key as
+// OutDir/SHA256SUMS.sig.
+func (b *Build) writeChecksumsFile(ctx context.Context) error {
+	log := clog.FromContext(ctx)
+
+	checksumsFileMu.Lock()
+	defer checksumsFileMu.Unlock()
+
+	path := filepath.Join(b.OutDir, checksumsFile)
+	sums, err := readChecksumsFile(path)
+	if err != nil {
+		return err
+	}
+	for name := range sums {
+		if _, err := os.Stat(filepath.Join(b.OutDir, filepath.FromSlash(name))); errors.Is(err, os.ErrNotExist) {
+			delete(sums, name)
+		}
+	}
+	for name, digest := range b.checksums {
+		sums[name] = digest
+	}
+
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sb, "%s  %s\n", sums[name], name)
+	}
+	data := []byte(sb.String())
+
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("unable to write %s: %w", checksumsFile, err)
+	}
+	log.Infof("wrote %s", path)
+
+	if !b.SignChecksumsFile {
+		return nil
+	}
+
+	key := b.indexSigningKey()
+	if key == "" {
+		return fmt.Errorf("signing %s requires a signing key", checksumsFile)
+	}
+	signer := KeyApkSigner{
+		KeyFile:       key,
+		KeyPassphrase: b.indexSigningPassphrase(),
+	}
+	sig, err := signer.Sign(data)
+	if err != nil {
+		return fmt.Errorf("unable to sign %s: %w", checksumsFile, err)
+	}
+	if err := writeFileAtomic(path+".sig", sig); err != nil {
+		return fmt.Errorf("unable to write %s signature: %w", checksumsFile, err)
+	}
+	log.Infof("wrote %s.sig", path)
+
+	return nil
+}
+
+// readChecksumsFile returns the entries of the checksums file at path, by
+// file name.  A missing file has no entries.
+func readChecksumsFile(path string) (map[string]string, error) {
+	sums := map[string]string{}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return sums, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if scanner.Text() == "" {
+			continue
+		}
+		digest, name, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			return nil, fmt.Errorf("malformed line in %s: %q", path, scanner.Text())
+		}
+		// sha256sum marks files read in binary mode with "*".
+		name = strings.TrimPrefix(strings.TrimPrefix(name, " "), "*")
+		sums[name] = digest
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+
+	return sums, nil
+}
+
+// writeFileAtomic replaces the file at path with data, so that readers
+// never see it partially written.
+func writeFileAtomic(path string, data []byte) error {
+	return writeFileAtomicFunc(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// writeFileAtomicFunc replaces the file at path with what write writes to a
+// temporary file next to it.  Renaming the temporary file into place also
+// leaves any hard links to, or symlink targets of, the previous file as they
+// were, rather than rewriting them in place.
+func writeFileAtomicFunc(path string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
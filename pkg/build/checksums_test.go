@@ -0,0 +1,72 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteChecksumsFile(t *testing.T) {
+	ctx := context.Background()
+	keyFile, pub := writeTestKey(t, t.TempDir(), "repo.rsa")
+	b := &Build{EmitChecksumsFile: true, SignChecksumsFile: true, IndexSigningKey: keyFile}
+	newPackageBuild := testPackageBuilder(t, b)
+	require.NoError(t, os.MkdirAll(filepath.Join(b.WorkspaceDir, "melange-out", "hello-doc", "usr", "share", "doc"), 0o755))
+
+	pkg := newPackageBuild()
+	b.OutDir = filepath.Dir(pkg.OutDir)
+	require.NoError(t, os.MkdirAll(b.OutDir, 0o755))
+
+	// Entries for other packages are kept while they exist.
+	other := filepath.Join(b.OutDir, "other.apk")
+	require.NoError(t, os.WriteFile(other, []byte("other\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(b.OutDir, checksumsFile), []byte(
+		"0000  gone.apk\n"+
+			"1111  other.apk\n",
+	), 0o644))
+
+	sub := newPackageBuild()
+	sub.PackageName = "hello-doc"
+	for _, pc := range []*PackageBuild{sub, pkg} {
+		require.NoError(t, pc.EmitPackage(ctx))
+	}
+	require.NoError(t, b.writeChecksumsFile(ctx))
+
+	sum := func(path string) string {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		digest := sha256.Sum256(data)
+		return hex.EncodeToString(digest[:])
+	}
+	data, err := os.ReadFile(filepath.Join(b.OutDir, checksumsFile))
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("1111  other.apk\n%s  packages/hello-1.0.0-r0.apk\n%s  packages/hello-doc-1.0.0-r0.apk\n",
+		sum(pkg.Filename()), sum(sub.Filename())), string(data))
+
+	sig, err := os.ReadFile(filepath.Join(b.OutDir, checksumsFile+".sig"))
+	require.NoError(t, err)
+	digest := sha1.Sum(data) //nolint:gosec
+	require.NoError(t, sign.RSAVerifySHA1Digest(digest[:], sig, pub))
+}
@@ -0,0 +1,661 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+// maxReportedDifferences is the number of differences listed in the report
+// written for CompareAgainst; the rest are only counted.
+const maxReportedDifferences = 100
+
+// packageDifference is a difference between an emitted package and its
+// reference, for CompareAgainst.
+type packageDifference struct {
+	// The part of the package: apk, signature, control or data.
+	Section string `json:"section"`
+	// The tar entry of the section which differs, if any.
+	Path string `json:"path,omitempty"`
+	// What differs, such as a tar header field, a gzip header field,
+	// a control field or the contents.
+	Field string `json:"field"`
+	// The offset of the first differing byte, in the apk for the apk
+	// section and otherwise in the contents of the entry.
+	Offset *int64 `json:"offset,omitempty"`
+	// The values in the reference and the emitted package.
+	Reference string `json:"reference,omitempty"`
+	Emitted   string `json:"emitted,omitempty"`
+}
+
+// packageComparison is the report CompareAgainst writes next to each
+// package compared.
+type packageComparison struct {
+	Reference string `json:"reference"`
+	Identical bool   `json:"identical"`
+	// The number of differences found, of which the first
+	// maxReportedDifferences are listed.
+	Total       int                 `json:"total"`
+	Differences []packageDifference `json:"differences"`
+}
+
+func (c *packageComparison) add(d packageDifference) {
+	c.Total++
+	if len(c.Differences) < maxReportedDifferences {
+		c.Differences = append(c.Differences, d)
+	}
+}
+
+// compareReference returns the reference package to compare the package
+// against, or "" if there is none.  If CompareAgainst is a directory, the
+// reference is the package of the same file name in it; otherwise it is
+// CompareAgainst itself, which is only compared with the package of the
+// same name.
+func (pc *PackageBuild) compareReference(ctx context.Context) (string, error) {
+	ref := pc.Build.CompareAgainst
+	fi, err := os.Stat(ref)
+	if err != nil {
+		return "", fmt.Errorf("unable to stat reference package: %w", err)
+	}
+
+	if fi.IsDir() {
+		ref = filepath.Join(ref, filepath.Base(pc.Filename()))
+		if _, err := os.Stat(ref); errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		} else if err != nil {
+			return "", fmt.Errorf("unable to stat reference package: %w", err)
+		}
+		return ref, nil
+	}
+
+	f, err := os.Open(ref)
+	if err != nil {
+		return "", fmt.Errorf("unable to open reference package: %w", err)
+	}
+	defer f.Close()
+
+	exp, err := expandapk.ExpandApk(ctx, f, "")
+	if err != nil {
+		return "", fmt.Errorf("unable to expand reference package %s: %w", ref, err)
+	}
+	defer exp.Close()
+
+	control, err := readControlFile(exp.ControlFile)
+	if err != nil {
+		return "", fmt.Errorf("unable to read control data of %s: %w", ref, err)
+	}
+	for _, line := range strings.Split(control, "\n") {
+		if name, ok := strings.CutPrefix(line, "pkgname = "); ok && name == pc.PackageName {
+			return ref, nil
+		}
+	}
+
+	return "", nil
+}
+
+// compareAgainstReference compares the emitted package with its reference
+// package, logging a summary and writing the differences found as
+// <identity>.compare.json.  Unlike rebuilding, this explains where a
+// package differs from one built elsewhere: the apk itself, the gzip
+// headers and tar entries of each section, and the control fields, other
+// than the volatile ones (VolatileControlFields).
+func (pc *PackageBuild) compareAgainstReference(ctx context.Context) error {
+	log := clog.FromContext(ctx)
+
+	ref, err := pc.compareReference(ctx)
+	if err != nil {
+		return err
+	}
+	if ref == "" {
+		log.Debugf("no reference package to compare %s against", pc.PackageName)
+		return nil
+	}
+
+	comparison, err := comparePackages(ctx, ref, pc.Filename(), pc.Build.VolatileControlFields)
+	if err != nil {
+		return fmt.Errorf("comparing %s against %s: %w", pc.Filename(), ref, err)
+	}
+
+	if comparison.Identical {
+		log.Infof("%s is identical to %s", pc.Filename(), ref)
+	} else {
+		log.Infof("%s differs from %s in %d ways", pc.Filename(), ref, comparison.Total)
+	}
+
+	data, err := json.MarshalIndent(comparison, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode package comparison: %w", err)
+	}
+
+	path := filepath.Join(pc.OutDir, pc.Identity()+".compare.json")
+	if err := writeFileAtomic(path, append(data, '\n')); err != nil {
+		return fmt.Errorf("unable to write package comparison: %w", err)
+	}
+
+	log.Infof("wrote %s", path)
+
+	return nil
+}
+
+// comparePackages compares the apk emitted with the apk ref.
+func comparePackages(ctx context.Context, ref, emitted string, volatile []string) (*packageComparison, error) {
+	comparison := &packageComparison{
+		Reference:   ref,
+		Differences: []packageDifference{},
+	}
+
+	offset, err := firstDifferenceInFiles(ref, emitted)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 {
+		comparison.Identical = true
+		return comparison, nil
+	}
+	comparison.add(packageDifference{Section: "apk", Field: "contents", Offset: &offset})
+
+	refExp, err := expandPackageFile(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	defer refExp.Close()
+
+	emittedExp, err := expandPackageFile(ctx, emitted)
+	if err != nil {
+		return nil, err
+	}
+	defer emittedExp.Close()
+
+	for _, section := range []struct {
+		name             string
+		ref, emitted     string
+		compareContentFn func(path string, ref, emitted []byte) []packageDifference
+	}{{
+		name:    "signature",
+		ref:     refExp.SignatureFile,
+		emitted: emittedExp.SignatureFile,
+	}, {
+		name:    "control",
+		ref:     refExp.ControlFile,
+		emitted: emittedExp.ControlFile,
+		compareContentFn: func(path string, ref, emitted []byte) []packageDifference {
+			if path != ".PKGINFO" {
+				return nil
+			}
+			return compareControlData(string(ref), string(emitted), volatile)
+		},
+	}, {
+		name:    "data",
+		ref:     refExp.PackageFile,
+		emitted: emittedExp.PackageFile,
+	}} {
+		switch {
+		case section.ref == "" && section.emitted == "":
+			continue
+		case section.ref == "" || section.emitted == "":
+			comparison.add(packageDifference{
+				Section:   section.name,
+				Field:     "present",
+				Reference: fmt.Sprint(section.ref != ""),
+				Emitted:   fmt.Sprint(section.emitted != ""),
+			})
+			continue
+		}
+
+		if err := compareSections(comparison, section.name, section.ref, section.emitted, section.compareContentFn); err != nil {
+			return nil, fmt.Errorf("comparing %s sections: %w", section.name, err)
+		}
+	}
+
+	return comparison, nil
+}
+
+func expandPackageFile(ctx context.Context, path string) (*expandapk.APKExpanded, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	exp, err := expandapk.ExpandApk(ctx, f, "")
+	if err != nil {
+		return nil, fmt.Errorf("unable to expand %s: %w", path, err)
+	}
+	return exp, nil
+}
+
+// readControlFile returns the .PKGINFO of the gzipped control section.
+func readControlFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return "", fmt.Errorf("no .PKGINFO in control section")
+		} else if err != nil {
+			return "", err
+		}
+		if hdr.Name == ".PKGINFO" {
+			data, err := io.ReadAll(tr)
+			return string(data), err
+		}
+	}
+}
+
+// tarEntry is an entry of a tar file, indexed by indexTar.
+type tarEntry struct {
+	hdr    *tar.Header
+	offset int64
+	digest [sha256.Size]byte
+}
+
+// compareSections compares the gzipped tar sections ref and emitted: their
+// gzip headers, the order of their entries, and the headers and contents
+// of each entry.  If compareContentFn returns differences for an entry,
+// they replace the comparison of its size and contents.
+func compareSections(comparison *packageComparison, section, ref, emitted string, compareContentFn func(path string, ref, emitted []byte) []packageDifference) error {
+	refTar, refGzip, err := decompressSection(ref)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(refTar)
+
+	emittedTar, emittedGzip, err := decompressSection(emitted)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(emittedTar)
+
+	for _, field := range compareGzipHeaders(refGzip, emittedGzip) {
+		comparison.add(packageDifference{Section: section, Field: "gzip " + field[0], Reference: field[1], Emitted: field[2]})
+	}
+
+	refOrder, refEntries, err := indexTar(refTar)
+	if err != nil {
+		return err
+	}
+	emittedOrder, emittedEntries, err := indexTar(emittedTar)
+	if err != nil {
+		return err
+	}
+
+	common := func(order []string, other map[string]tarEntry) []string {
+		names := []string{}
+		for _, name := range order {
+			if _, ok := other[name]; ok {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	if refCommon, emittedCommon := common(refOrder, emittedEntries), common(emittedOrder, refEntries); !slices.Equal(refCommon, emittedCommon) {
+		comparison.add(packageDifference{
+			Section:   section,
+			Field:     "order",
+			Reference: strings.Join(refCommon, " "),
+			Emitted:   strings.Join(emittedCommon, " "),
+		})
+	}
+
+	names := []string{}
+	for name := range refEntries {
+		names = append(names, name)
+	}
+	for name := range emittedEntries {
+		if _, ok := refEntries[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		r, inRef := refEntries[name]
+		e, inEmitted := emittedEntries[name]
+		if !inRef || !inEmitted {
+			comparison.add(packageDifference{
+				Section:   section,
+				Path:      name,
+				Field:     "present",
+				Reference: fmt.Sprint(inRef),
+				Emitted:   fmt.Sprint(inEmitted),
+			})
+			continue
+		}
+
+		var contentDiffs []packageDifference
+		if compareContentFn != nil && r.digest != e.digest {
+			refData, err := readAt(refTar, r.offset, r.hdr.Size)
+			if err != nil {
+				return err
+			}
+			emittedData, err := readAt(emittedTar, e.offset, e.hdr.Size)
+			if err != nil {
+				return err
+			}
+			contentDiffs = compareContentFn(name, refData, emittedData)
+		}
+
+		for _, field := range compareTarHeaders(r.hdr, e.hdr, contentDiffs == nil) {
+			comparison.add(packageDifference{Section: section, Path: name, Field: field[0], Reference: field[1], Emitted: field[2]})
+		}
+
+		switch {
+		case contentDiffs != nil:
+			for _, d := range contentDiffs {
+				d.Section = section
+				d.Path = name
+				comparison.add(d)
+			}
+		case r.digest != e.digest:
+			offset, err := firstDifferenceAt(refTar, r.offset, r.hdr.Size, emittedTar, e.offset, e.hdr.Size)
+			if err != nil {
+				return err
+			}
+			comparison.add(packageDifference{Section: section, Path: name, Field: "contents", Offset: &offset})
+		}
+	}
+
+	return nil
+}
+
+// decompressSection decompresses the gzipped section at path next to it,
+// returning the path of the tar and the gzip header.
+func decompressSection(path string) (string, gzip.Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", gzip.Header{}, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return "", gzip.Header{}, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(path), "compare-*.tar")
+	if err != nil {
+		return "", gzip.Header{}, err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, zr); err != nil {
+		os.Remove(out.Name())
+		return "", gzip.Header{}, fmt.Errorf("unable to decompress %s: %w", path, err)
+	}
+
+	return out.Name(), zr.Header, out.Close()
+}
+
+// indexTar returns the names of the entries of the tar at path in order,
+// and the entries by name.
+func indexTar(path string) ([]string, map[string]tarEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	// archive/tar reads the headers in whole blocks, so the count after
+	// Next is the offset of the contents of the entry.
+	cr := &countingReader{r: f}
+	tr := tar.NewReader(cr)
+	order := []string{}
+	entries := map[string]tarEntry{}
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return order, entries, nil
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("unable to read %s: %w", path, err)
+		}
+
+		entry := tarEntry{hdr: hdr, offset: cr.n}
+		digest := sha256.New()
+		if _, err := io.Copy(digest, tr); err != nil {
+			return nil, nil, fmt.Errorf("unable to read %s: %w", path, err)
+		}
+		copy(entry.digest[:], digest.Sum(nil))
+
+		order = append(order, hdr.Name)
+		entries[hdr.Name] = entry
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// compareGzipHeaders returns the fields of the gzip headers which differ,
+// each as its name and values in the reference and emitted package.
+func compareGzipHeaders(ref, emitted gzip.Header) [][3]string {
+	diffs := [][3]string{}
+	compare := func(field string, ref, emitted string) {
+		if ref != emitted {
+			diffs = append(diffs, [3]string{field, ref, emitted})
+		}
+	}
+	compare("name", ref.Name, emitted.Name)
+	compare("comment", ref.Comment, emitted.Comment)
+	compare("extra", fmt.Sprintf("%x", ref.Extra), fmt.Sprintf("%x", emitted.Extra))
+	compare("mtime", ref.ModTime.UTC().String(), emitted.ModTime.UTC().String())
+	compare("os", fmt.Sprint(ref.OS), fmt.Sprint(emitted.OS))
+	return diffs
+}
+
+// compareTarHeaders returns the fields of the tar headers which differ,
+// each as its name and values in the reference and emitted package.  The
+// size and PAX records, which record checksums of the contents, are
+// skipped unless withContent is set.
+func compareTarHeaders(ref, emitted *tar.Header, withContent bool) [][3]string {
+	diffs := [][3]string{}
+	compare := func(field string, ref, emitted any) {
+		if r, e := fmt.Sprint(ref), fmt.Sprint(emitted); r != e {
+			diffs = append(diffs, [3]string{field, r, e})
+		}
+	}
+	compare("type", string(ref.Typeflag), string(emitted.Typeflag))
+	compare("mode", fmt.Sprintf("%#o", ref.Mode), fmt.Sprintf("%#o", emitted.Mode))
+	compare("uid", ref.Uid, emitted.Uid)
+	compare("gid", ref.Gid, emitted.Gid)
+	compare("uname", ref.Uname, emitted.Uname)
+	compare("gname", ref.Gname, emitted.Gname)
+	compare("mtime", ref.ModTime.UTC(), emitted.ModTime.UTC())
+	compare("linkname", ref.Linkname, emitted.Linkname)
+	compare("devmajor", ref.Devmajor, emitted.Devmajor)
+	compare("devminor", ref.Devminor, emitted.Devminor)
+	if !withContent {
+		return diffs
+	}
+
+	compare("size", ref.Size, emitted.Size)
+	keys := []string{}
+	for key := range ref.PAXRecords {
+		keys = append(keys, key)
+	}
+	for key := range emitted.PAXRecords {
+		if _, ok := ref.PAXRecords[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		compare("pax "+key, ref.PAXRecords[key], emitted.PAXRecords[key])
+	}
+	return diffs
+}
+
+// compareControlData returns the differences between the canonical forms
+// (see CanonicalControlData) of two .PKGINFO files: the lines present in
+// only one of them, paired by field where they can be.
+func compareControlData(ref, emitted string, volatile []string) []packageDifference {
+	ref, emitted = canonicalizeControl(ref, volatile), canonicalizeControl(emitted, volatile)
+	count := func(data string) map[string]int {
+		lines := map[string]int{}
+		for _, line := range strings.Split(data, "\n") {
+			lines[line]++
+		}
+		return lines
+	}
+	refLines, emittedLines := count(ref), count(emitted)
+
+	diffs := []packageDifference{}
+	for _, line := range strings.Split(ref, "\n") {
+		if line != "" && refLines[line] > emittedLines[line] {
+			refLines[line]--
+			key, value, _ := strings.Cut(line, " = ")
+			diffs = append(diffs, packageDifference{Field: key, Reference: value})
+		}
+	}
+	unpaired := len(diffs)
+	for _, line := range strings.Split(emitted, "\n") {
+		if line == "" || emittedLines[line] <= refLines[line] {
+			continue
+		}
+		emittedLines[line]--
+		key, value, _ := strings.Cut(line, " = ")
+
+		paired := false
+		for i := range diffs[:unpaired] {
+			if diffs[i].Field == key && diffs[i].Emitted == "" {
+				diffs[i].Emitted = value
+				paired = true
+				break
+			}
+		}
+		if !paired {
+			diffs = append(diffs, packageDifference{Field: key, Emitted: value})
+		}
+	}
+	return diffs
+}
+
+func readAt(path string, offset, size int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// firstDifferenceInFiles returns the offset of the first byte which
+// differs between the files a and b, or -1 if they are identical.
+func firstDifferenceInFiles(a, b string) (int64, error) {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return 0, err
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return 0, err
+	}
+	return firstDifferenceAt(a, 0, fa.Size(), b, 0, fb.Size())
+}
+
+// firstDifferenceAt returns the offset of the first byte which differs
+// between the sizeA bytes of a at offsetA and the sizeB bytes of b at
+// offsetB, or -1 if they are identical.
+func firstDifferenceAt(a string, offsetA, sizeA int64, b string, offsetB, sizeB int64) (int64, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return 0, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return 0, err
+	}
+	defer fb.Close()
+
+	ra := bufio.NewReader(io.NewSectionReader(fa, offsetA, sizeA))
+	rb := bufio.NewReader(io.NewSectionReader(fb, offsetB, sizeB))
+	bufA, bufB := make([]byte, 32*1024), make([]byte, 32*1024)
+	var offset int64
+	for {
+		na, errA := io.ReadFull(ra, bufA)
+		nb, errB := io.ReadFull(rb, bufB)
+		if i := firstDifference(bufA[:na], bufB[:nb]); i >= 0 {
+			return offset + int64(i), nil
+		}
+		offset += int64(na)
+
+		doneA := errors.Is(errA, io.EOF) || errors.Is(errA, io.ErrUnexpectedEOF)
+		doneB := errors.Is(errB, io.EOF) || errors.Is(errB, io.ErrUnexpectedEOF)
+		if errA != nil && !doneA {
+			return 0, errA
+		}
+		if errB != nil && !doneB {
+			return 0, errB
+		}
+		if doneA || doneB {
+			return -1, nil
+		}
+	}
+}
+
+// firstDifference returns the index of the first byte which differs between
+// a and b, including where one is a prefix of the other, or -1 if they are
+// equal.
+func firstDifference(a, b []byte) int {
+	if bytes.Equal(a, b) {
+		return -1
+	}
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareAgainst(t *testing.T) {
+	ctx := context.Background()
+	refDir := t.TempDir()
+	b := &Build{}
+	newPackageBuild := testPackageBuilder(t, b)
+
+	ref := newPackageBuild()
+	require.NoError(t, ref.EmitPackage(ctx))
+	require.NoError(t, os.Rename(ref.Filename(), filepath.Join(refDir, filepath.Base(ref.Filename()))))
+
+	readComparison := func(pc *PackageBuild) packageComparison {
+		data, err := os.ReadFile(filepath.Join(pc.OutDir, pc.Identity()+".compare.json"))
+		require.NoError(t, err)
+		var comparison packageComparison
+		require.NoError(t, json.Unmarshal(data, &comparison))
+		return comparison
+	}
+
+	b.CompareAgainst = refDir
+	pc := newPackageBuild()
+	require.NoError(t, pc.EmitPackage(ctx))
+	require.True(t, readComparison(pc).Identical)
+
+	// The commit is volatile, so only the file changed is reported.
+	require.NoError(t, os.WriteFile(filepath.Join(b.WorkspaceDir, "melange-out", "hello", "usr", "share", "hello.txt"), []byte("hellO\n"), 0o644))
+	pc = newPackageBuild()
+	pc.Commit = "cafef00d"
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	comparison := readComparison(pc)
+	require.False(t, comparison.Identical)
+	require.Equal(t, comparison.Total, len(comparison.Differences))
+
+	fields := map[string]packageDifference{}
+	for _, d := range comparison.Differences {
+		fields[d.Section+" "+d.Path+" "+d.Field] = d
+	}
+	require.Contains(t, fields, "apk  contents")
+	datahash, ok := fields["control .PKGINFO datahash"]
+	require.True(t, ok, "%v", fields)
+	require.NotEmpty(t, datahash.Reference)
+	require.NotEmpty(t, datahash.Emitted)
+	require.NotContains(t, fields, "control .PKGINFO commit")
+	require.NotContains(t, fields, "control .PKGINFO size")
+
+	contents, ok := fields["data usr/share/hello.txt contents"]
+	require.True(t, ok, "%v", fields)
+	require.Equal(t, int64(4), *contents.Offset)
+
+	// A single reference is only compared with the package of its name.
+	b.CompareAgainst = filepath.Join(refDir, filepath.Base(ref.Filename()))
+	require.NoError(t, os.Remove(filepath.Join(pc.OutDir, pc.Identity()+".compare.json")))
+	pc = newPackageBuild()
+	pc.PackageName = "hello-other"
+	require.NoError(t, pc.EmitPackage(ctx))
+	require.NoFileExists(t, filepath.Join(pc.OutDir, pc.Identity()+".compare.json"))
+}
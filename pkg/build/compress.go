@@ -0,0 +1,211 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+
+	kgzip "github.com/klauspost/compress/gzip"
+	"github.com/klauspost/pgzip"
+	"golang.org/x/sync/semaphore"
+)
+
+// smallEmitBytes is the installed size below which a package is not
+// charged against the emit budget.  Its data section fits in a single pgzip
+// block, so compressing it needs little memory.
+const smallEmitBytes = 1 << 20
+
+// emitBudget bounds the combined installed size of the packages whose data
+// sections are compressed at once.  See Build.MaxConcurrentEmitBytes.
+type emitBudget struct {
+	size int64
+	sem  *semaphore.Weighted
+}
+
+func newEmitBudget(size int64) *emitBudget {
+	return &emitBudget{
+		size: size,
+		sem:  semaphore.NewWeighted(size),
+	}
+}
+
+// acquire charges a package of the given installed size against the
+// budget, blocking until enough of it is available, and returns a function
+// which returns the charge.  Small packages, and every package when the
+// budget is nil, are not charged.  The charge of a package larger than the
+// whole budget is clamped to it, so it runs alone rather than never.
+func (b *emitBudget) acquire(ctx context.Context, installedSize int64) (func(), error) {
+	if b == nil || installedSize < smallEmitBytes {
+		return func() {}, nil
+	}
+
+	n := installedSize
+	if n > b.size {
+		n = b.size
+	}
+	if err := b.sem.Acquire(ctx, n); err != nil {
+		return nil, err
+	}
+
+	return func() { b.sem.Release(n) }, nil
+}
+
+// stableCompressionLevel is the level of the standard library's gzip
+// encoder used when StableCompression is set.  It must never change, as
+// doing so changes the bytes of every package built with it.
+const stableCompressionLevel = gzip.BestCompression
+
+// CompressionPool bounds the total number of compression workers which may
+// be active at once across every data section compressed with it.  A single
+// pool may be shared between several builds (for example, one per
+// architecture) so that emitting many packages concurrently does not
+// oversubscribe the CPU.
+type CompressionPool struct {
+	size int64
+	sem  *semaphore.Weighted
+}
+
+// NewCompressionPool returns a CompressionPool with the given number of
+// workers.  A size of less than one is treated as one.
+func NewCompressionPool(size int) *CompressionPool {
+	if size < 1 {
+		size = 1
+	}
+
+	return &CompressionPool{
+		size: int64(size),
+		sem:  semaphore.NewWeighted(int64(size)),
+	}
+}
+
+// acquire reserves up to want workers from the pool, blocking until they are
+// available.  It returns the number of workers reserved and a function which
+// returns them to the pool.  A nil pool reserves exactly want workers without
+// blocking.
+func (p *CompressionPool) acquire(ctx context.Context, want int) (int, func(), error) {
+	if p == nil {
+		return want, func() {}, nil
+	}
+
+	n := int64(want)
+	if n > p.size {
+		n = p.size
+	}
+	if err := p.sem.Acquire(ctx, n); err != nil {
+		return 0, nil, err
+	}
+
+	return int(n), func() { p.sem.Release(n) }, nil
+}
+
+// The default, minimum and maximum sizes of the blocks pgzip compresses in
+// parallel.  pgzip requires blocks larger than the 16KiB it carries over
+// between them as a dictionary.
+const (
+	defaultPgzipBlockSize = 1 << 20
+	minPgzipBlockSize     = 32 << 10
+	maxPgzipBlockSize     = 64 << 20
+)
+
+// validatePgzipBlockSize checks that size is a power of two pgzip accepts,
+// or 0 for the default.
+func validatePgzipBlockSize(size int) error {
+	if size == 0 {
+		return nil
+	}
+	if size < minPgzipBlockSize || size > maxPgzipBlockSize || size&(size-1) != 0 {
+		return fmt.Errorf("pgzip block size %d must be a power of two between %d and %d", size, minPgzipBlockSize, maxPgzipBlockSize)
+	}
+	return nil
+}
+
+// pgzipBlockSize returns the size of the blocks pgzip compresses in
+// parallel, PgzipBlockSize if set.
+func (b *Build) pgzipBlockSize() int {
+	if b.PgzipBlockSize == 0 {
+		return defaultPgzipBlockSize
+	}
+	return b.PgzipBlockSize
+}
+
+// newStableGzipWriter returns the encoder used for both sections when
+// StableCompression is set.
+func newStableGzipWriter(w io.Writer) (*gzip.Writer, error) {
+	return gzip.NewWriterLevel(w, stableCompressionLevel)
+}
+
+// controlCompressor returns the gzip writer for the control section.
+func (pc *PackageBuild) controlCompressor(w io.Writer) (io.WriteCloser, error) {
+	if pc.Build.StableCompression {
+		return newStableGzipWriter(w)
+	}
+
+	return kgzip.NewWriter(w), nil
+}
+
+// dataCompressor returns the gzip writer for the data section, and a
+// function releasing the compression workers it reserved.  Unless
+// StableCompression or DeterministicCompression is set, it is a parallel
+// pgzip writer at the level of the chosen data compression, using up to
+// pgzipThreads workers of the compression pool.
+func (pc *PackageBuild) dataCompressor(ctx context.Context, w io.Writer) (io.WriteCloser, func(), error) {
+	comment := ""
+	if pc.Build.StampGzipHeader {
+		comment = pc.Identity()
+	}
+
+	if pc.Build.StableCompression || pc.Build.DeterministicCompression {
+		// The standard library encoder is single threaded.
+		_, release, err := pc.Build.CompressionPool.acquire(ctx, 1)
+		if err != nil {
+			return nil, nil, fmt.Errorf("waiting for compression workers: %w", err)
+		}
+
+		var zw *gzip.Writer
+		if pc.Build.StableCompression {
+			zw, err = newStableGzipWriter(w)
+		} else {
+			zw, err = gzip.NewWriterLevel(w, pc.dataCompressionLevel())
+		}
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		zw.Comment = comment
+
+		return zw, release, nil
+	}
+
+	threads, release, err := pc.Build.CompressionPool.acquire(ctx, pgzipThreads)
+	if err != nil {
+		return nil, nil, fmt.Errorf("waiting for compression workers: %w", err)
+	}
+
+	zw, err := pgzip.NewWriterLevel(w, pc.dataCompressionLevel())
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	if err := zw.SetConcurrency(pc.Build.pgzipBlockSize(), threads); err != nil {
+		release()
+		return nil, nil, fmt.Errorf("tried to set pgzip concurrency to %d: %w", threads, err)
+	}
+	zw.Comment = comment
+
+	return zw, release, nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+)
+
+// dependencyGraph returns, for each of pkgs, the names of the others which
+// satisfy one of its runtime dependencies, by name or by a provide.
+func dependencyGraph(pkgs []*apk.Package) map[string][]string {
+	providers := map[string][]string{}
+	for _, pkg := range pkgs {
+		providers[pkg.Name] = append(providers[pkg.Name], pkg.Name)
+		for _, provide := range pkg.Provides {
+			name := dependencyName(provide)
+			providers[name] = append(providers[name], pkg.Name)
+		}
+	}
+
+	graph := map[string][]string{}
+	for _, pkg := range pkgs {
+		seen := map[string]bool{}
+		for _, dep := range pkg.Dependencies {
+			if strings.HasPrefix(dep, "!") {
+				continue
+			}
+			for _, provider := range providers[dependencyName(dep)] {
+				if provider != pkg.Name && !seen[provider] {
+					seen[provider] = true
+					graph[pkg.Name] = append(graph[pkg.Name], provider)
+				}
+			}
+		}
+		sort.Strings(graph[pkg.Name])
+	}
+
+	return graph
+}
+
+// dependencyCycles returns a cycle through each group of packages in graph
+// which depend on each other, as the chain of names starting and ending with
+// the first of them.
+func dependencyCycles(graph map[string][]string) [][]string {
+	names := make([]string, 0, len(graph))
+	for name := range graph {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Find the strongly connected components with Tarjan's algorithm.
+	index := map[string]int{}
+	lowlink := map[string]int{}
+	onStack := map[string]bool{}
+	var stack []string
+	var components [][]string
+
+	var visit func(name string)
+	visit = func(name string) {
+		index[name] = len(index)
+		lowlink[name] = index[name]
+		stack = append(stack, name)
+		onStack[name] = true
+
+		for _, next := range graph[name] {
+			if _, ok := index[next]; !ok {
+				visit(next)
+				lowlink[name] = min(lowlink[name], lowlink[next])
+			} else if onStack[next] {
+				lowlink[name] = min(lowlink[name], index[next])
+			}
+		}
+
+		if lowlink[name] == index[name] {
+			var component []string
+			for {
+				top := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[top] = false
+				component = append(component, top)
+				if top == name {
+					break
+				}
+			}
+			if len(component) > 1 {
+				components = append(components, component)
+			}
+		}
+	}
+	for _, name := range names {
+		if _, ok := index[name]; !ok {
+			visit(name)
+		}
+	}
+
+	var cycles [][]string
+	for _, component := range components {
+		sort.Strings(component)
+		cycles = append(cycles, shortestCycle(graph, component))
+	}
+	sort.Slice(cycles, func(i, j int) bool { return cycles[i][0] < cycles[j][0] })
+
+	return cycles
+}
+
+// shortestCycle returns the shortest chain from the first of component back
+// to it through the others.
+func shortestCycle(graph map[string][]string, component []string) []string {
+	start := component[0]
+	within := map[string]bool{}
+	for _, name := range component {
+		within[name] = true
+	}
+
+	prev := map[string]string{start: ""}
+	queue := []string{start}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, next := range graph[name] {
+			if next == start {
+				chain := []string{start}
+				for n := name; n != start; n = prev[n] {
+					chain = append([]string{n}, chain...)
+				}
+				return append([]string{start}, chain...)
+			}
+			if _, ok := prev[next]; !ok && within[next] {
+				prev[next] = name
+				queue = append(queue, next)
+			}
+		}
+	}
+
+	// Unreachable, as the packages of a component reach each other.
+	return component
+}
+
+// detectDependencyCycles fails if packages emitted by this build depend on
+// each other in a cycle, through their final runtime dependencies and
+// provides.  apk installs such packages, but they can no longer be
+// installed separately, which usually means the split between them is
+// wrong.
+func (b *Build) detectDependencyCycles(ctx context.Context) error {
+	log := clog.FromContext(ctx)
+
+	cycles := dependencyCycles(dependencyGraph(b.emittedPackages))
+	if len(cycles) == 0 {
+		log.Infof("no dependency cycles between packages")
+		return nil
+	}
+
+	chains := make([]string, 0, len(cycles))
+	for _, cycle := range cycles {
+		chains = append(chains, strings.Join(cycle, " -> "))
+	}
+
+	return fmt.Errorf("packages depend on each other in a cycle: %s", strings.Join(chains, "; "))
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectDependencyCycles(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{DetectDependencyCycles: true}
+	newPackageBuild := testPackageBuilder(t, b)
+
+	pc := newPackageBuild()
+	pc.Dependencies.Runtime = []string{"so:libhello.so.1", "glibc"}
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	libs := newPackageBuild()
+	libs.PackageName = "hello-libs"
+	libs.Dependencies.Provides = []string{"so:libhello.so.1=1"}
+	require.NoError(t, libs.EmitPackage(ctx))
+
+	// hello depends on hello-libs, but not the other way around.
+	require.NoError(t, b.detectDependencyCycles(ctx))
+
+	b.emittedPackages = nil
+	require.NoError(t, pc.EmitPackage(ctx))
+	libs.Dependencies.Runtime = []string{"hello=1.0.0-r0"}
+	require.NoError(t, libs.EmitPackage(ctx))
+
+	require.EqualError(t, b.detectDependencyCycles(ctx), "packages depend on each other in a cycle: hello -> hello-libs -> hello")
+}
+
+func Test_dependencyCycles(t *testing.T) {
+	graph := map[string][]string{
+		"a": {"b"},
+		"b": {"c", "d"},
+		"c": {"a"},
+		"d": {"e"},
+		"e": {"d"},
+		"f": {"a"},
+	}
+	require.Equal(t, [][]string{
+		{"a", "b", "c", "a"},
+		{"d", "e", "d"},
+	}, dependencyCycles(graph))
+
+	delete(graph, "c")
+	delete(graph, "e")
+	require.Empty(t, dependencyCycles(graph))
+}
@@ -0,0 +1,690 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+
+	//nolint:gosec
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"chainguard.dev/melange/pkg/config"
+	"github.com/chainguard-dev/go-apk/pkg/passwd"
+)
+
+const apkChecksumPAXRecord = "APK-TOOLS.checksum.SHA1"
+
+// defaultPathScrubMaxSize is the size of the largest file whose leaked paths
+// are scrubbed, unless configured otherwise.
+const defaultPathScrubMaxSize = 1 << 20
+
+// defaultShebangRewriteMaxSize is the size of the largest script whose
+// interpreter is rewritten, unless configured otherwise.
+const defaultShebangRewriteMaxSize = 1 << 20
+
+// dataFilter inspects or rewrites a single entry of the data section as it
+// is written.  It may modify hdr in place.  To replace the contents of the
+// entry, it returns a different reader than body; otherwise it returns body
+// itself, or, if it read some of body, unchanged wrapping the contents.
+type dataFilter func(hdr *tar.Header, body io.Reader) (io.Reader, error)
+
+// unchanged is returned by a dataFilter which had to read some of the
+// contents of an entry to decide to leave it alone, so that filterTar does
+// not treat them as replaced, buffering them and updating their checksum.
+type unchanged struct {
+	io.Reader
+}
+
+// dataFilters returns the filters which apply to the data section of this
+// package, whose contents are in fsys and whose user and group names are
+// resolved from userinfofs.  When there are none, the data section is
+// written directly by the tarball context.
+func (pc *PackageBuild) dataFilters(fsys, userinfofs fs.FS) ([]dataFilter, error) {
+	filters := []dataFilter{}
+
+	if patterns := pc.PreserveOwnership(); len(patterns) > 0 {
+		filters = append(filters, ownershipFilter(patterns, fsys, userinfofs))
+	}
+
+	if len(pc.injected) > 0 {
+		filters = append(filters, injectedFilter(pc.injected, pc.Build.injectedFileMode()))
+	}
+
+	if pc.Build.NormalizeStandardDirs {
+		filters = append(filters, standardDirsFilter)
+	}
+
+	if pc.Origin != nil && pc.Origin.ShebangRewrite != nil {
+		filter, err := shebangFilter(pc.Origin.ShebangRewrite)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+
+	if pc.Origin != nil && pc.Origin.ConfigPathScrub != nil {
+		filter, err := pathScrubFilter(pc.Origin.ConfigPathScrub)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+
+	switch pc.Build.SymlinkMode {
+	case SymlinkModeRelative, SymlinkModeAbsolute:
+		filters = append(filters, symlinkFilter(pc.Build.SymlinkMode, fsys))
+	}
+
+	if pc.Build.DefaultFileUmask != 0 {
+		filters = append(filters, umaskFilter(pc.Build.DefaultFileUmask))
+	}
+
+	if pc.Build.RejectWorldWritable {
+		filters = append(filters, worldWritableFilter(pc.Build.WorldWritableAllowlist))
+	}
+
+	switch pc.Build.TarFormat {
+	case TarFormatGNU:
+		filters = append(filters, tarFormatFilter(tar.FormatGNU))
+	case TarFormatUSTAR:
+		filters = append(filters, tarFormatFilter(tar.FormatUSTAR))
+	}
+
+	return filters, nil
+}
+
+// dirEntries tracks the directories written to the data section, so that
+// an entry for every directory precedes the entries within it.
+type dirEntries struct {
+	seen    map[string]bool
+	modTime time.Time
+}
+
+func newDirEntries(modTime time.Time) *dirEntries {
+	return &dirEntries{seen: map[string]bool{}, modTime: modTime}
+}
+
+// missing records hdr as written, and returns entries for those of its
+// ancestor directories which have not been, outermost first.  They are
+// owned by root with mode 0755.
+func (d *dirEntries) missing(hdr *tar.Header) []*tar.Header {
+	name := strings.TrimSuffix(hdr.Name, "/")
+	if hdr.Typeflag == tar.TypeDir {
+		d.seen[name] = true
+	}
+
+	var dirs []*tar.Header
+	for dir := path.Dir(name); dir != "." && dir != "/" && !d.seen[dir]; dir = path.Dir(dir) {
+		d.seen[dir] = true
+		dirs = append([]*tar.Header{{
+			Typeflag: tar.TypeDir,
+			Name:     dir,
+			Mode:     0o755,
+			Uname:    "root",
+			Gname:    "root",
+			ModTime:  d.modTime,
+			Format:   hdr.Format,
+		}}, dirs...)
+	}
+
+	return dirs
+}
+
+// filterTar copies the tar stream in r to w, passing every entry through
+// filters.  Entries whose contents are replaced have their size and apk
+// checksum updated accordingly.  If createSpool is not nil, large regular
+// files containing holes are written as sparse entries, spooled to the
+// temporary files it creates.  If dirs is not nil,
+// entries are added for directories which have none.
+func filterTar(w io.Writer, r io.Reader, filters []dataFilter, createSpool func() (*os.File, error), dirs *dirEntries) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading data tarball: %w", err)
+		}
+
+		var body io.Reader = tr
+		replaced := false
+		for _, filter := range filters {
+			out, err := filter(hdr, body)
+			if err != nil {
+				return fmt.Errorf("filtering %s: %w", hdr.Name, err)
+			}
+			if u, ok := out.(unchanged); ok {
+				body = u.Reader
+				continue
+			}
+			if out != body {
+				replaced = true
+				body = out
+			}
+		}
+
+		if replaced {
+			data, err := io.ReadAll(body)
+			if err != nil {
+				return fmt.Errorf("filtering %s: %w", hdr.Name, err)
+			}
+
+			hdr.Size = int64(len(data))
+			if _, ok := hdr.PAXRecords[apkChecksumPAXRecord]; ok {
+				//nolint:gosec
+				digest := sha1.Sum(data)
+				hdr.PAXRecords[apkChecksumPAXRecord] = hex.EncodeToString(digest[:])
+			}
+			body = bytes.NewReader(data)
+		}
+
+		if dirs != nil {
+			for _, dir := range dirs.missing(hdr) {
+				if err := tw.WriteHeader(dir); err != nil {
+					return fmt.Errorf("writing data tarball: %w", err)
+				}
+			}
+		}
+
+		if createSpool != nil {
+			written, err := writeSparse(tw, w, hdr, body, createSpool)
+			if err != nil {
+				return fmt.Errorf("writing sparse entry %s: %w", hdr.Name, err)
+			}
+			if written {
+				continue
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("writing data tarball: %w", err)
+		}
+		if _, err := io.Copy(tw, body); err != nil {
+			return fmt.Errorf("writing data tarball: %w", err)
+		}
+	}
+
+	return tw.Close()
+}
+
+// checksumCollector reads the tar stream written to it and records the apk
+// checksum of every entry which carries one, keyed by name.
+type checksumCollector struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	sums map[string]string
+	err  error
+}
+
+func newChecksumCollector() *checksumCollector {
+	pr, pw := io.Pipe()
+	c := &checksumCollector{
+		pw:   pw,
+		done: make(chan struct{}),
+		sums: map[string]string{},
+	}
+
+	go func() {
+		defer close(c.done)
+
+		tr := tar.NewReader(pr)
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				c.err = err
+				break
+			}
+			if sum, ok := hdr.PAXRecords[apkChecksumPAXRecord]; ok {
+				c.sums[hdr.Name] = sum
+			}
+		}
+
+		// Drain any trailing padding so that writers never block.
+		_, _ = io.Copy(io.Discard, pr)
+	}()
+
+	return c
+}
+
+func (c *checksumCollector) Write(p []byte) (int, error) {
+	return c.pw.Write(p)
+}
+
+// Close ends the stream and returns the checksums collected from it.
+func (c *checksumCollector) Close() (map[string]string, error) {
+	c.pw.Close()
+	<-c.done
+	return c.sums, c.err
+}
+
+// umaskFilter clears the bits in umask from the permissions of regular files
+// and directories.  Special bits (setuid, setgid, sticky) are preserved.
+func umaskFilter(umask os.FileMode) dataFilter {
+	return func(hdr *tar.Header, body io.Reader) (io.Reader, error) {
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeDir {
+			hdr.Mode &^= int64(umask.Perm())
+		}
+		return body, nil
+	}
+}
+
+// worldWritableFilter fails on regular files and directories which other
+// users may write to, unless they match, or are within a directory which
+// matches, one of allow.
+func worldWritableFilter(allow []string) dataFilter {
+	patterns := []string{}
+	for _, pattern := range allow {
+		patterns = append(patterns, strings.TrimPrefix(pattern, "/"))
+	}
+
+	return func(hdr *tar.Header, body io.Reader) (io.Reader, error) {
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeDir {
+			return body, nil
+		}
+		name := strings.TrimSuffix(hdr.Name, "/")
+		if hdr.Mode&0o002 != 0 && !matchesPathOrParent(patterns, name) {
+			return nil, fmt.Errorf("%s has mode %#o, which is world-writable", name, hdr.Mode&0o7777)
+		}
+		return body, nil
+	}
+}
+
+// ownershipFilter restores the ownership files had in fsys to entries which
+// match, or are within a directory which matches, one of patterns, undoing
+// the remapping of the build user to root.  User and group names are taken
+// from the etc/passwd and etc/group files of userinfofs, and left empty for
+// ids they do not name.
+func ownershipFilter(patterns []string, fsys, userinfofs fs.FS) dataFilter {
+	users := map[int]string{}
+	if uf, err := passwd.ReadUserFile(userinfofs, "etc/passwd"); err == nil {
+		for _, u := range uf.Entries {
+			users[int(u.UID)] = u.UserName
+		}
+	}
+
+	groups := map[int]string{}
+	if gf, err := passwd.ReadGroupFile(userinfofs, "etc/group"); err == nil {
+		for _, g := range gf.Entries {
+			groups[int(g.GID)] = g.GroupName
+		}
+	}
+
+	// Entries are read from their directory, so that symlinks are not
+	// followed.
+	dirs := map[string]map[string]fs.DirEntry{}
+	lstat := func(name string) (fs.FileInfo, error) {
+		dir := path.Dir(name)
+		if _, ok := dirs[dir]; !ok {
+			entries, err := fs.ReadDir(fsys, dir)
+			if err != nil {
+				return nil, err
+			}
+			dirs[dir] = map[string]fs.DirEntry{}
+			for _, ent := range entries {
+				dirs[dir][ent.Name()] = ent
+			}
+		}
+
+		ent, ok := dirs[dir][path.Base(name)]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+		return ent.Info()
+	}
+
+	return func(hdr *tar.Header, body io.Reader) (io.Reader, error) {
+		name := strings.TrimSuffix(hdr.Name, "/")
+		if !matchesPathOrParent(patterns, name) {
+			return body, nil
+		}
+
+		info, err := lstat(name)
+		if err != nil {
+			return nil, fmt.Errorf("reading ownership: %w", err)
+		}
+
+		orig, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return nil, fmt.Errorf("reading ownership: %w", err)
+		}
+
+		hdr.Uid, hdr.Gid = orig.Uid, orig.Gid
+		hdr.Uname, hdr.Gname = users[hdr.Uid], groups[hdr.Gid]
+
+		return body, nil
+	}
+}
+
+// symlinkFilter rewrites the targets of symlinks which name an entry of
+// fsys into the form given by mode.  Targets are resolved lexically against
+// the directory of the symlink, without following other symlinks.  The apk
+// checksum of a symlink is that of its target, so it is updated to match.
+func symlinkFilter(mode string, fsys fs.FS) dataFilter {
+	var entries map[string]bool
+	inPackage := func(name string) (bool, error) {
+		if entries == nil {
+			entries = map[string]bool{}
+			if err := fs.WalkDir(fsys, ".", func(p string, _ fs.DirEntry, err error) error {
+				entries[p] = true
+				return err
+			}); err != nil {
+				return false, fmt.Errorf("listing package contents: %w", err)
+			}
+		}
+		return entries[name], nil
+	}
+
+	return func(hdr *tar.Header, body io.Reader) (io.Reader, error) {
+		if hdr.Typeflag != tar.TypeSymlink || hdr.Linkname == "" {
+			return body, nil
+		}
+
+		dir := path.Dir(strings.TrimSuffix(hdr.Name, "/"))
+		target := path.Clean(hdr.Linkname)
+		if !path.IsAbs(target) {
+			target = path.Join("/", dir, target)
+		}
+
+		ok, err := inPackage(strings.TrimPrefix(target, "/"))
+		if err != nil || !ok {
+			return body, err
+		}
+
+		link := target
+		if mode == SymlinkModeRelative {
+			link = relativeTarget("/"+dir, target)
+		}
+		if link == hdr.Linkname {
+			return body, nil
+		}
+
+		hdr.Linkname = link
+		if _, ok := hdr.PAXRecords[apkChecksumPAXRecord]; ok {
+			//nolint:gosec
+			digest := sha1.Sum([]byte(link))
+			hdr.PAXRecords[apkChecksumPAXRecord] = hex.EncodeToString(digest[:])
+		}
+
+		return body, nil
+	}
+}
+
+// relativeTarget returns the path of target relative to dir, both of which
+// are clean and absolute.
+func relativeTarget(dir, target string) string {
+	from := strings.Split(strings.Trim(dir, "/"), "/")
+	to := strings.Split(strings.Trim(target, "/"), "/")
+	if from[0] == "" {
+		from = nil
+	}
+
+	common := 0
+	for common < len(from) && common < len(to) && from[common] == to[common] {
+		common++
+	}
+
+	parts := make([]string, 0, len(from)-common+len(to)-common)
+	for range from[common:] {
+		parts = append(parts, "..")
+	}
+	parts = append(parts, to[common:]...)
+	if len(parts) == 0 {
+		return "."
+	}
+
+	return path.Join(parts...)
+}
+
+// injectedFilter makes root the owner of the entries melange added to the
+// package, which are owned by the user melange runs as in the workspace,
+// and gives the files among them mode.  It runs after UIDs and GIDs are
+// remapped, so the entries stay owned by root.
+func injectedFilter(injected map[string]bool, mode os.FileMode) dataFilter {
+	return func(hdr *tar.Header, body io.Reader) (io.Reader, error) {
+		if injected[strings.TrimSuffix(hdr.Name, "/")] {
+			hdr.Uid, hdr.Gid = 0, 0
+			hdr.Uname, hdr.Gname = "root", "root"
+			if hdr.Typeflag == tar.TypeReg {
+				hdr.Mode = int64(mode.Perm())
+			}
+		}
+		return body, nil
+	}
+}
+
+// standardDirModes are the modes of the directories of the filesystem
+// hierarchy which standardDirsFilter normalizes.  The root directory itself
+// has no entry in the data section.
+var standardDirModes = map[string]int64{
+	"bin":           0o755,
+	"boot":          0o755,
+	"etc":           0o755,
+	"home":          0o755,
+	"lib":           0o755,
+	"lib64":         0o755,
+	"opt":           0o755,
+	"root":          0o700,
+	"sbin":          0o755,
+	"srv":           0o755,
+	"usr":           0o755,
+	"usr/bin":       0o755,
+	"usr/include":   0o755,
+	"usr/lib":       0o755,
+	"usr/lib64":     0o755,
+	"usr/libexec":   0o755,
+	"usr/local":     0o755,
+	"usr/local/bin": 0o755,
+	"usr/local/lib": 0o755,
+	"usr/sbin":      0o755,
+	"usr/share":     0o755,
+	"var":           0o755,
+	"var/cache":     0o755,
+	"var/lib":       0o755,
+	"var/log":       0o755,
+}
+
+// standardDirsFilter makes the entries for standard directories owned by
+// root with their standard mode, whatever they had in the workspace, so
+// that a package does not change the ownership of /usr on install.
+func standardDirsFilter(hdr *tar.Header, body io.Reader) (io.Reader, error) {
+	if hdr.Typeflag != tar.TypeDir {
+		return body, nil
+	}
+	if mode, ok := standardDirModes[strings.TrimSuffix(hdr.Name, "/")]; ok {
+		hdr.Uid, hdr.Gid = 0, 0
+		hdr.Uname, hdr.Gname = "root", "root"
+		hdr.Mode = mode
+	}
+	return body, nil
+}
+
+// matchesPathOrParent reports whether name, or any directory containing
+// it, matches one of patterns.
+func matchesPathOrParent(patterns []string, name string) bool {
+	for p := name; p != "." && p != "/"; p = path.Dir(p) {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tarFormatFilter encodes every entry in format.  Neither GNU nor USTAR can
+// carry PAX records, so the per-file apk checksums and any xattrs are
+// dropped.
+func tarFormatFilter(format tar.Format) dataFilter {
+	return func(hdr *tar.Header, body io.Reader) (io.Reader, error) {
+		hdr.Format = format
+		hdr.PAXRecords = nil
+		if format == tar.FormatUSTAR {
+			// USTAR has no fields for access or change times.
+			hdr.AccessTime = time.Time{}
+			hdr.ChangeTime = time.Time{}
+		}
+		return body, nil
+	}
+}
+
+// shebangFilter rewrites the interpreter named on the first line of scripts
+// according to the rules in cfg.  Only regular files which start with #!,
+// contain no NUL bytes and are no larger than the configured size are
+// considered scripts.
+func shebangFilter(cfg *config.ShebangRewrite) (dataFilter, error) {
+	type rule struct {
+		re *regexp.Regexp
+		to string
+	}
+
+	rules := make([]rule, 0, len(cfg.Rules))
+	for i, r := range cfg.Rules {
+		expr, to := regexp.QuoteMeta(r.From), strings.ReplaceAll(r.To, "$", "$$")
+		if r.Regex != "" {
+			expr, to = r.Regex, r.To
+		}
+
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("shebang rewrite rule (index: %d): %w", i, err)
+		}
+		rules = append(rules, rule{re: re, to: to})
+	}
+
+	maxSize := cfg.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultShebangRewriteMaxSize
+	}
+
+	return func(hdr *tar.Header, body io.Reader) (io.Reader, error) {
+		if hdr.Typeflag != tar.TypeReg || hdr.Size < 2 || hdr.Size > maxSize {
+			return body, nil
+		}
+
+		// Only the first line is read, unless it is to be rewritten.
+		br := bufio.NewReader(body)
+		if magic, err := br.Peek(2); err != nil || string(magic) != "#!" {
+			return unchanged{br}, nil
+		}
+		first, err := br.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		// Keep any whitespace around the interpreter, and its arguments.
+		line := strings.TrimSuffix(string(first[2:]), "\n")
+		start := len(line) - len(strings.TrimLeft(line, " \t"))
+		stop := len(line)
+		if i := strings.IndexAny(line[start:], " \t"); i >= 0 {
+			stop = start + i
+		}
+		interpreter := line[start:stop]
+
+		for _, r := range rules {
+			if !r.re.MatchString(interpreter) {
+				continue
+			}
+
+			rest, err := io.ReadAll(br)
+			if err != nil {
+				return nil, err
+			}
+			data := append(first, rest...)
+			if bytes.IndexByte(data, 0) >= 0 {
+				return unchanged{bytes.NewReader(data)}, nil
+			}
+
+			rewritten := r.re.ReplaceAllString(interpreter, r.to)
+			out := make([]byte, 0, len(data)+len(rewritten)-len(interpreter))
+			out = append(out, data[:2+start]...)
+			out = append(out, rewritten...)
+			out = append(out, data[2+stop:]...)
+			return bytes.NewReader(out), nil
+		}
+
+		return unchanged{io.MultiReader(bytes.NewReader(first), br)}, nil
+	}, nil
+}
+
+// pathScrubFilter rewrites the paths leaked into the text files matching
+// cfg.Paths, such as configuration files embedding the build workspace.
+// Files containing a NUL byte are taken to be binaries and left alone.
+func pathScrubFilter(cfg *config.ConfigPathScrub) (dataFilter, error) {
+	type rule struct {
+		re *regexp.Regexp
+		to string
+	}
+
+	rules := make([]rule, 0, len(cfg.Rules))
+	for i, r := range cfg.Rules {
+		expr, to := regexp.QuoteMeta(r.From), strings.ReplaceAll(r.To, "$", "$$")
+		if r.Regex != "" {
+			expr, to = r.Regex, r.To
+		}
+
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("config path scrub rule (index: %d): %w", i, err)
+		}
+		rules = append(rules, rule{re: re, to: to})
+	}
+
+	maxSize := cfg.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultPathScrubMaxSize
+	}
+
+	return func(hdr *tar.Header, body io.Reader) (io.Reader, error) {
+		if hdr.Typeflag != tar.TypeReg || hdr.Size > maxSize || !matchesPathOrParent(cfg.Paths, strings.TrimPrefix(hdr.Name, "/")) {
+			return body, nil
+		}
+
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.IndexByte(data, 0) >= 0 {
+			return unchanged{bytes.NewReader(data)}, nil
+		}
+
+		scrubbed := data
+		for _, r := range rules {
+			scrubbed = r.re.ReplaceAll(scrubbed, []byte(r.to))
+		}
+		if bytes.Equal(scrubbed, data) {
+			return unchanged{bytes.NewReader(data)}, nil
+		}
+
+		return bytes.NewReader(scrubbed), nil
+	}, nil
+}
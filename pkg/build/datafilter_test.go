@@ -0,0 +1,555 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+
+	//nolint:gosec
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"chainguard.dev/melange/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+// readDataSection emits the data section of pc and returns its headers
+// and file contents, keyed by name.
+func readDataSection(t *testing.T, pc *PackageBuild) (map[string]*tar.Header, map[string][]byte) {
+	t.Helper()
+
+	f, err := os.CreateTemp(t.TempDir(), "data-*.tar.gz")
+	require.NoError(t, err)
+	defer f.Close()
+
+	fsys := readlinkFS(pc.WorkspaceSubdir())
+	require.NoError(t, pc.emitDataSection(context.Background(), fsys, os.DirFS(pc.Build.GuestDir), nil, nil, f))
+
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	tr := tar.NewReader(zr)
+
+	headers := map[string]*tar.Header{}
+	contents := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		headers[hdr.Name] = hdr
+		contents[hdr.Name] = data
+	}
+
+	return headers, contents
+}
+
+func TestDefaultFileUmask(t *testing.T) {
+	b := &Build{DefaultFileUmask: 0o022}
+	pc := testPackageBuilder(t, b)()
+
+	dir := filepath.Join(pc.WorkspaceSubdir(), "usr", "share")
+	require.NoError(t, os.Chmod(dir, 0o777))
+	file := filepath.Join(dir, "hello.txt")
+	require.NoError(t, os.Chmod(file, 0o777))
+	data := filepath.Join(dir, "data.txt")
+	require.NoError(t, os.WriteFile(data, []byte("data\n"), 0o644))
+	require.NoError(t, os.Chmod(data, 0o666))
+
+	headers, _ := readDataSection(t, pc)
+	require.Equal(t, int64(0o755), headers["usr/share/hello.txt"].Mode)
+	require.Equal(t, int64(0o755), headers["usr/share"].Mode&0o7777)
+	require.Equal(t, int64(0o644), headers["usr/share/data.txt"].Mode)
+
+	// Without a umask, modes are preserved.
+	b.DefaultFileUmask = 0
+	headers, _ = readDataSection(t, pc)
+	require.Equal(t, int64(0o777), headers["usr/share/hello.txt"].Mode)
+}
+
+func TestRejectWorldWritable(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{RejectWorldWritable: true}
+	pc := testPackageBuilder(t, b)()
+
+	file := filepath.Join(pc.WorkspaceSubdir(), "usr", "share", "hello.txt")
+	require.NoError(t, os.Chmod(file, 0o666))
+
+	emit := func() error {
+		f, err := os.CreateTemp(t.TempDir(), "data-*.tar.gz")
+		require.NoError(t, err)
+		defer f.Close()
+		return pc.emitDataSection(ctx, readlinkFS(pc.WorkspaceSubdir()), os.DirFS(b.GuestDir), nil, nil, f)
+	}
+	require.ErrorContains(t, emit(), "usr/share/hello.txt has mode 0666, which is world-writable")
+
+	// Allowlisted by a glob matching the file, or a directory containing it.
+	for _, allow := range []string{"/usr/share/*.txt", "usr/share"} {
+		b.WorldWritableAllowlist = []string{allow}
+		headers, _ := readDataSection(t, pc)
+		require.Equal(t, int64(0o666), headers["usr/share/hello.txt"].Mode)
+	}
+
+	// A umask clearing the bit first satisfies the policy.
+	b.WorldWritableAllowlist = nil
+	b.DefaultFileUmask = 0o002
+	headers, _ := readDataSection(t, pc)
+	require.Equal(t, int64(0o664), headers["usr/share/hello.txt"].Mode)
+
+	// World-writable directories are rejected too.
+	b.DefaultFileUmask = 0
+	require.NoError(t, os.Chmod(file, 0o644))
+	require.NoError(t, os.Chmod(filepath.Dir(file), 0o777))
+	require.ErrorContains(t, emit(), "usr/share has mode 0777, which is world-writable")
+}
+
+func TestSymlinkMode(t *testing.T) {
+	b := &Build{}
+	pc := testPackageBuilder(t, b)()
+
+	bin := filepath.Join(pc.WorkspaceSubdir(), "usr", "bin")
+	require.NoError(t, os.MkdirAll(bin, 0o755))
+	require.NoError(t, os.Symlink("/usr/share/hello.txt", filepath.Join(bin, "abs")))
+	require.NoError(t, os.Symlink("../share/./hello.txt", filepath.Join(bin, "rel")))
+	require.NoError(t, os.Symlink("/usr/lib/libc.so.6", filepath.Join(bin, "ext")))
+	require.NoError(t, os.Symlink("../lib/libc.so.6", filepath.Join(bin, "extrel")))
+
+	linkChecksum := func(target string) string {
+		//nolint:gosec
+		digest := sha1.Sum([]byte(target))
+		return hex.EncodeToString(digest[:])
+	}
+
+	for _, tt := range []struct {
+		mode string
+		want map[string]string
+	}{{
+		mode: SymlinkModePreserve,
+		want: map[string]string{"abs": "/usr/share/hello.txt", "rel": "../share/./hello.txt", "ext": "/usr/lib/libc.so.6", "extrel": "../lib/libc.so.6"},
+	}, {
+		mode: SymlinkModeRelative,
+		want: map[string]string{"abs": "../share/hello.txt", "rel": "../share/hello.txt", "ext": "/usr/lib/libc.so.6", "extrel": "../lib/libc.so.6"},
+	}, {
+		mode: SymlinkModeAbsolute,
+		want: map[string]string{"abs": "/usr/share/hello.txt", "rel": "/usr/share/hello.txt", "ext": "/usr/lib/libc.so.6", "extrel": "../lib/libc.so.6"},
+	}} {
+		b.SymlinkMode = tt.mode
+		headers, _ := readDataSection(t, pc)
+		for name, target := range tt.want {
+			hdr := headers["usr/bin/"+name]
+			require.Equal(t, target, hdr.Linkname, "%s in %s mode", name, tt.mode)
+			require.Equal(t, linkChecksum(target), hdr.PAXRecords[apkChecksumPAXRecord], "%s in %s mode", name, tt.mode)
+		}
+	}
+}
+
+func Test_relativeTarget(t *testing.T) {
+	for _, tt := range []struct {
+		dir, target, want string
+	}{
+		{"/usr/bin", "/usr/share/hello.txt", "../share/hello.txt"},
+		{"/usr/bin", "/usr/bin/hello", "hello"},
+		{"/", "/usr/bin/hello", "usr/bin/hello"},
+		{"/usr/lib/debug", "/usr", "../.."},
+		{"/usr", "/usr", "."},
+	} {
+		require.Equal(t, tt.want, relativeTarget(tt.dir, tt.target), "%s -> %s", tt.dir, tt.target)
+	}
+}
+
+func TestTarFormat(t *testing.T) {
+	b := &Build{}
+	pc := testPackageBuilder(t, b)()
+
+	long := filepath.Join("usr", "share", strings.Repeat("a", 80), strings.Repeat("b", 120))
+	require.NoError(t, os.MkdirAll(filepath.Join(pc.WorkspaceSubdir(), filepath.Dir(long)), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(pc.WorkspaceSubdir(), long), []byte("long\n"), 0o644))
+
+	for _, format := range []string{"", TarFormatPAX, TarFormatGNU} {
+		b.TarFormat = format
+		headers, contents := readDataSection(t, pc)
+
+		hdr := headers[long]
+		require.NotNil(t, hdr, "format %q", format)
+		require.Equal(t, "long\n", string(contents[long]))
+
+		if format == TarFormatGNU {
+			require.Equal(t, tar.FormatGNU, hdr.Format)
+			require.Empty(t, hdr.PAXRecords)
+		} else {
+			require.Equal(t, tar.FormatPAX, hdr.Format)
+			require.Contains(t, hdr.PAXRecords, apkChecksumPAXRecord)
+		}
+	}
+
+	// USTAR cannot represent a file name longer than 100 bytes.
+	b.TarFormat = TarFormatUSTAR
+	f, err := os.CreateTemp(t.TempDir(), "data-*.tar.gz")
+	require.NoError(t, err)
+	defer f.Close()
+	err = pc.emitDataSection(context.Background(), readlinkFS(pc.WorkspaceSubdir()), os.DirFS(b.GuestDir), nil, nil, f)
+	require.ErrorContains(t, err, "cannot encode header")
+}
+
+func TestEmptyFiles(t *testing.T) {
+	b := &Build{}
+	pc := testPackageBuilder(t, b)()
+
+	app := filepath.Join(pc.WorkspaceSubdir(), "etc", "app")
+	require.NoError(t, os.MkdirAll(app, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(app, "enabled"), nil, 0o644))
+	require.NoError(t, os.Symlink("missing", filepath.Join(app, "disabled")))
+
+	//nolint:gosec
+	empty := sha1.Sum(nil)
+
+	for _, format := range []string{TarFormatPAX, TarFormatGNU, TarFormatUSTAR} {
+		for _, sparse := range []bool{false, true} {
+			b.TarFormat = format
+			b.PreserveSparse = sparse
+			headers, contents := readDataSection(t, pc)
+
+			hdr := headers["etc/app/enabled"]
+			require.NotNil(t, hdr, "format %q, sparse %t", format, sparse)
+			require.Equal(t, byte(tar.TypeReg), hdr.Typeflag)
+			require.Equal(t, int64(0), hdr.Size)
+			require.Empty(t, contents["etc/app/enabled"])
+			if format == TarFormatPAX {
+				require.Equal(t, hex.EncodeToString(empty[:]), hdr.PAXRecords[apkChecksumPAXRecord])
+			}
+
+			// A broken symlink is kept as a symlink, not an empty file.
+			hdr = headers["etc/app/disabled"]
+			require.NotNil(t, hdr, "format %q, sparse %t", format, sparse)
+			require.Equal(t, byte(tar.TypeSymlink), hdr.Typeflag)
+			require.Equal(t, "missing", hdr.Linkname)
+		}
+	}
+}
+
+func TestExplicitDirEntries(t *testing.T) {
+	b := &Build{ExplicitDirEntries: true}
+	pc := testPackageBuilder(t, b)()
+
+	app := filepath.Join(pc.WorkspaceSubdir(), "usr", "share", "app")
+	require.NoError(t, os.MkdirAll(app, 0o750))
+	require.NoError(t, os.Chmod(app, 0o750))
+	require.NoError(t, os.WriteFile(filepath.Join(app, "data"), []byte("data\n"), 0o644))
+
+	headers, _ := readDataSection(t, pc)
+
+	hdr := headers["usr/share/app"]
+	require.NotNil(t, hdr)
+	require.Equal(t, byte(tar.TypeDir), hdr.Typeflag)
+	require.Equal(t, fs.FileMode(0o750), hdr.FileInfo().Mode().Perm())
+	require.Equal(t, 0, hdr.Uid)
+	require.Equal(t, 0, hdr.Gid)
+
+	for name := range headers {
+		if dir := path.Dir(name); dir != "." {
+			require.Contains(t, headers, dir, "directory of %s", name)
+		}
+	}
+}
+
+func Test_dirEntries(t *testing.T) {
+	epoch := time.Unix(1234567890, 0)
+	d := newDirEntries(epoch)
+
+	names := func(hdrs []*tar.Header) []string {
+		out := []string{}
+		for _, hdr := range hdrs {
+			require.Equal(t, byte(tar.TypeDir), hdr.Typeflag)
+			require.Equal(t, int64(0o755), hdr.Mode)
+			require.Equal(t, epoch, hdr.ModTime)
+			out = append(out, hdr.Name)
+		}
+		return out
+	}
+
+	require.Empty(t, names(d.missing(&tar.Header{Typeflag: tar.TypeDir, Name: "usr"})))
+	require.Equal(t, []string{"usr/lib", "usr/lib/app"}, names(d.missing(&tar.Header{Typeflag: tar.TypeReg, Name: "usr/lib/app/data"})))
+	require.Empty(t, names(d.missing(&tar.Header{Typeflag: tar.TypeReg, Name: "usr/lib/app/more"})))
+	require.Empty(t, names(d.missing(&tar.Header{Typeflag: tar.TypeReg, Name: "top"})))
+}
+
+func TestShebangRewrite(t *testing.T) {
+	pc := testPackageBuilder(t, &Build{})()
+	pc.Origin.ShebangRewrite = &config.ShebangRewrite{
+		Rules: []config.ShebangRule{
+			{From: "/usr/bin/python3.11", To: "/usr/bin/python3"},
+			{Regex: `/usr/bin/perl5\.[0-9]+`, To: "/usr/bin/perl"},
+		},
+		MaxSize: 64,
+	}
+
+	bin := filepath.Join(pc.WorkspaceSubdir(), "usr", "bin")
+	require.NoError(t, os.MkdirAll(bin, 0o755))
+	for name, content := range map[string]string{
+		"tool":   "#!/usr/bin/python3.11 -u\nprint('hello')\n",
+		"report": "#! /usr/bin/perl5.36\nprint \"hello\\n\";\n",
+		"other":  "#!/bin/sh\necho hello\n",
+		"binary": "#!/usr/bin/python3.11\n\x00",
+		"large":  "#!/usr/bin/python3.11\n" + strings.Repeat("#", 64),
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(bin, name), []byte(content), 0o755))
+	}
+
+	headers, contents := readDataSection(t, pc)
+	require.Equal(t, "#!/usr/bin/python3 -u\nprint('hello')\n", string(contents["usr/bin/tool"]))
+	require.Equal(t, "#! /usr/bin/perl\nprint \"hello\\n\";\n", string(contents["usr/bin/report"]))
+	require.Equal(t, "#!/bin/sh\necho hello\n", string(contents["usr/bin/other"]))
+	require.Equal(t, "#!/usr/bin/python3.11\n\x00", string(contents["usr/bin/binary"]))
+	require.True(t, strings.HasPrefix(string(contents["usr/bin/large"]), "#!/usr/bin/python3.11\n"))
+
+	hdr := headers["usr/bin/tool"]
+	require.Equal(t, int64(len(contents["usr/bin/tool"])), hdr.Size)
+	//nolint:gosec
+	digest := sha1.Sum(contents["usr/bin/tool"])
+	require.Equal(t, hex.EncodeToString(digest[:]), hdr.PAXRecords[apkChecksumPAXRecord])
+}
+
+func Test_shebangFilter_unchanged(t *testing.T) {
+	filter, err := shebangFilter(&config.ShebangRewrite{
+		Rules: []config.ShebangRule{{From: "/usr/bin/python3.11", To: "/usr/bin/python3"}},
+	})
+	require.NoError(t, err)
+
+	// Only the first line is read of files which are left alone; reading
+	// any further fails.
+	errRest := errors.New("read past the first line")
+	for _, first := range []string{"\x7fELF\x02\x01\x01\n", "#!/bin/sh -e\n"} {
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: "usr/bin/tool", Size: 1 << 20}
+		out, err := filter(hdr, io.MultiReader(strings.NewReader(first), iotest.ErrReader(errRest)))
+		require.NoError(t, err)
+		require.IsType(t, unchanged{}, out)
+
+		data, err := io.ReadAll(out)
+		require.ErrorIs(t, err, errRest)
+		require.Equal(t, first, string(data))
+	}
+}
+
+func Test_pathScrubFilter_unchanged(t *testing.T) {
+	filter, err := pathScrubFilter(&config.ConfigPathScrub{
+		Paths: []string{"etc/hello"},
+		Rules: []config.PathScrubRule{{From: "/home/build", To: ""}},
+	})
+	require.NoError(t, err)
+
+	// Binaries and files no rule changes are left alone.
+	for _, content := range []string{"root = /var/lib/hello\n", "root = /home/build\x00"} {
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: "etc/hello/hello.conf", Size: int64(len(content))}
+		out, err := filter(hdr, strings.NewReader(content))
+		require.NoError(t, err)
+		require.IsType(t, unchanged{}, out)
+
+		data, err := io.ReadAll(out)
+		require.NoError(t, err)
+		require.Equal(t, content, string(data))
+	}
+
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: "etc/hello/hello.conf", Size: 24}
+	out, err := filter(hdr, strings.NewReader("root = /home/build/hello\n"))
+	require.NoError(t, err)
+	_, ok := out.(unchanged)
+	require.False(t, ok)
+}
+
+func TestPreserveSparse(t *testing.T) {
+	const size = 8 << 20
+
+	for _, preserve := range []bool{false, true} {
+		pc := testPackageBuilder(t, &Build{PreserveSparse: preserve})()
+
+		path := filepath.Join(pc.WorkspaceSubdir(), "usr", "share", "sparse.img")
+		f, err := os.Create(path)
+		require.NoError(t, err)
+		require.NoError(t, f.Truncate(size))
+		_, err = f.WriteAt([]byte("head"), 0)
+		require.NoError(t, err)
+		_, err = f.WriteAt([]byte("tail"), size-4)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		headers, contents := readDataSection(t, pc)
+		require.Equal(t, int64(size), headers["usr/share/sparse.img"].Size)
+		require.Len(t, contents["usr/share/sparse.img"], size)
+		require.Equal(t, "head", string(contents["usr/share/sparse.img"][:4]))
+		require.Equal(t, "tail", string(contents["usr/share/sparse.img"][size-4:]))
+		require.Equal(t, "hello\n", string(contents["usr/share/hello.txt"]))
+
+		//nolint:gosec
+		digest := sha1.Sum(contents["usr/share/sparse.img"])
+		require.Equal(t, hex.EncodeToString(digest[:]), headers["usr/share/sparse.img"].PAXRecords[apkChecksumPAXRecord])
+
+		var tarball countingWriter
+		fsys := readlinkFS(pc.WorkspaceSubdir())
+		require.NoError(t, pc.writeDataTar(context.Background(), &tarball, fsys, os.DirFS(pc.Build.GuestDir), nil, nil))
+
+		out, err := os.CreateTemp(t.TempDir(), "data-*.tar.gz")
+		require.NoError(t, err)
+		require.NoError(t, pc.emitDataSection(context.Background(), fsys, os.DirFS(pc.Build.GuestDir), nil, nil, out))
+		fi, err := out.Stat()
+		require.NoError(t, err)
+		require.NoError(t, out.Close())
+
+		if preserve {
+			require.Less(t, tarball.n, int64(64<<10), "uncompressed data section")
+			require.Less(t, fi.Size(), int64(4<<10), "compressed data section")
+		} else {
+			require.Greater(t, tarball.n, int64(size))
+		}
+	}
+}
+
+func TestPreserveSparse_Dense(t *testing.T) {
+	const size = 2 << 20
+
+	b := &Build{PreserveSparse: true, TempDir: t.TempDir()}
+	pc := testPackageBuilder(t, b)()
+
+	// A large file without holes is written as a regular entry, from the
+	// spool it was read into.
+	dense := bytes.Repeat([]byte("dense\n"), size/6)
+	require.NoError(t, os.WriteFile(filepath.Join(pc.WorkspaceSubdir(), "usr", "share", "dense.bin"), dense, 0o644))
+
+	headers, contents := readDataSection(t, pc)
+	hdr := headers["usr/share/dense.bin"]
+	require.Equal(t, byte(tar.TypeReg), hdr.Typeflag)
+	require.Equal(t, int64(len(dense)), hdr.Size)
+	require.Equal(t, dense, contents["usr/share/dense.bin"])
+	//nolint:gosec
+	digest := sha1.Sum(dense)
+	require.Equal(t, hex.EncodeToString(digest[:]), hdr.PAXRecords[apkChecksumPAXRecord])
+	require.Equal(t, "hello\n", string(contents["usr/share/hello.txt"]))
+
+	entries, err := os.ReadDir(b.TempDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestPreserveOwnership(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing file ownership requires root")
+	}
+
+	const buildUID, appUID = 1000, 82
+
+	pc := testPackageBuilder(t, &Build{})()
+	pc.Origin.PreserveOwnership = []string{"/var/lib/app", "etc/app/*.conf"}
+
+	ws := pc.WorkspaceSubdir()
+	for _, dir := range []string{"var/lib/app/data", "etc/app"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(ws, dir), 0o755))
+	}
+	for name, uid := range map[string]int{
+		"var/lib/app":            appUID,
+		"var/lib/app/data":       appUID,
+		"var/lib/app/data/state": appUID,
+		"etc/app/app.conf":       appUID,
+		"etc/app/other":          buildUID,
+		"usr/share/hello.txt":    buildUID,
+	} {
+		path := filepath.Join(ws, name)
+		if _, err := os.Stat(path); err != nil {
+			require.NoError(t, os.WriteFile(path, []byte("x"), 0o644))
+		}
+		require.NoError(t, os.Lchown(path, uid, uid))
+	}
+
+	etc := filepath.Join(pc.Build.GuestDir, "etc")
+	require.NoError(t, os.MkdirAll(etc, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(etc, "passwd"), []byte("root:x:0:0:root:/root:/bin/sh\nwww-data:x:82:82::/var/lib/app:/sbin/nologin\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(etc, "group"), []byte("root:x:0:\nwww-data:x:82:\n"), 0o644))
+
+	var buf bytes.Buffer
+	remap := map[int]int{buildUID: 0}
+	require.NoError(t, pc.writeDataTar(context.Background(), &buf, readlinkFS(ws), os.DirFS(pc.Build.GuestDir), remap, remap))
+
+	owners := map[string]string{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		owners[strings.TrimSuffix(hdr.Name, "/")] = fmt.Sprintf("%d:%d %s:%s", hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname)
+	}
+
+	require.Equal(t, "82:82 www-data:www-data", owners["var/lib/app"])
+	require.Equal(t, "82:82 www-data:www-data", owners["var/lib/app/data/state"])
+	require.Equal(t, "82:82 www-data:www-data", owners["etc/app/app.conf"])
+	require.Equal(t, "0:0 root:root", owners["etc/app/other"])
+	require.Equal(t, "0:0 root:root", owners["usr/share/hello.txt"])
+}
+
+func TestConfigPathScrub(t *testing.T) {
+	pc := testPackageBuilder(t, &Build{})()
+	pc.Origin.ConfigPathScrub = &config.ConfigPathScrub{
+		Paths: []string{"etc/hello/*.conf", "usr/share/hello"},
+		Rules: []config.PathScrubRule{
+			{From: "/home/build/melange-out/hello", To: ""},
+			{Regex: `/home/build/(bin|lib)`, To: "/usr/$1"},
+		},
+		MaxSize: 256,
+	}
+
+	for name, content := range map[string]string{
+		"etc/hello/hello.conf":  "root = /home/build/melange-out/hello/var/lib/hello\nplugins = /home/build/lib/hello\n",
+		"etc/hello/hello.ini":   "root = /home/build/melange-out/hello/var/lib/hello\n",
+		"etc/hello/binary.conf": "root = /home/build/lib\x00",
+		"etc/hello/large.conf":  "root = /home/build/lib\n" + strings.Repeat("#", 256),
+		"usr/share/hello.txt":   "/home/build/bin\n",
+		"usr/share/hello/paths": "/home/build/bin\n",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(pc.WorkspaceSubdir(), name)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(pc.WorkspaceSubdir(), name), []byte(content), 0o644))
+	}
+
+	headers, contents := readDataSection(t, pc)
+	require.Equal(t, "root = /var/lib/hello\nplugins = /usr/lib/hello\n", string(contents["etc/hello/hello.conf"]))
+	require.Equal(t, "/usr/bin\n", string(contents["usr/share/hello/paths"]))
+
+	// Files not matching, binaries and large files are left alone.
+	require.Equal(t, "root = /home/build/melange-out/hello/var/lib/hello\n", string(contents["etc/hello/hello.ini"]))
+	require.Equal(t, "root = /home/build/lib\x00", string(contents["etc/hello/binary.conf"]))
+	require.True(t, strings.HasPrefix(string(contents["etc/hello/large.conf"]), "root = /home/build/lib\n"))
+	require.Equal(t, "/home/build/bin\n", string(contents["usr/share/hello.txt"]))
+
+	hdr := headers["etc/hello/hello.conf"]
+	require.Equal(t, int64(len(contents["etc/hello/hello.conf"])), hdr.Size)
+	//nolint:gosec
+	digest := sha1.Sum(contents["etc/hello/hello.conf"])
+	require.Equal(t, hex.EncodeToString(digest[:]), hdr.PAXRecords[apkChecksumPAXRecord])
+}
@@ -0,0 +1,64 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// mergedDependencyLogMu serializes updates of merged dependency logs, as
+// the builds of each architecture run concurrently.
+var mergedDependencyLogMu sync.Mutex
+
+// mergedDependencyLog is the content of a merged dependency log: the
+// entries of each package, keyed by arch and then by package name.
+type mergedDependencyLog map[string]map[string]dependencyLogEntry
+
+// writeMergedDependencyLog records entry as that of the package named name
+// on arch in the merged dependency log at path, replacing any previous
+// entry and keeping those of other packages and arches.
+func writeMergedDependencyLog(path, arch, name string, entry dependencyLogEntry) error {
+	mergedDependencyLogMu.Lock()
+	defer mergedDependencyLogMu.Unlock()
+
+	merged := mergedDependencyLog{}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("unable to read merged dependency log: %w", err)
+	default:
+		if err := json.Unmarshal(data, &merged); err != nil {
+			return fmt.Errorf("unable to parse merged dependency log %s: %w", path, err)
+		}
+	}
+
+	if merged[arch] == nil {
+		merged[arch] = map[string]dependencyLogEntry{}
+	}
+	merged[arch][name] = entry
+
+	data, err = json.MarshalIndent(merged, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode merged dependency log: %w", err)
+	}
+
+	return writeFileAtomic(path, append(data, '\n'))
+}
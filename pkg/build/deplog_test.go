@@ -0,0 +1,84 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestMergedDependencyLog(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{MergedDependencyLog: true}
+	newPackageBuild := testPackageBuilder(t, b)
+	b.DependencyLog = filepath.Join(t.TempDir(), "deps.json")
+
+	bin := filepath.Join(b.WorkspaceDir, "melange-out", "hello", "usr", "bin")
+	require.NoError(t, os.MkdirAll(bin, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "hello"), []byte("#!/usr/bin/perl\nprint \"hello\\n\";\n"), 0o755))
+
+	var g errgroup.Group
+	for _, arch := range []string{"x86_64", "aarch64"} {
+		pc := newPackageBuild()
+		pc.Arch = arch
+		g.Go(func() error {
+			return pc.GenerateDependencies(ctx, &SCABuildInterface{PackageBuild: pc})
+		})
+	}
+	require.NoError(t, g.Wait())
+
+	data, err := os.ReadFile(b.DependencyLog)
+	require.NoError(t, err)
+	var merged mergedDependencyLog
+	require.NoError(t, json.Unmarshal(data, &merged))
+	require.Len(t, merged, 2)
+	for _, arch := range []string{"x86_64", "aarch64"} {
+		require.Contains(t, merged[arch], "hello", arch)
+		require.Equal(t, []string{"cmd:perl"}, merged[arch]["hello"].Runtime, arch)
+	}
+	require.NoFileExists(t, b.DependencyLog+".x86_64")
+}
+
+func TestDependencyLogSorted(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{}
+	pc := testPackageBuilder(t, b)()
+	b.DependencyLog = filepath.Join(t.TempDir(), "deps.json")
+	pc.Dependencies.Runtime = []string{"zlib", "busybox"}
+	pc.Dependencies.Provides = []string{"hello-world=1.0.0", "hello-bin=1.0.0"}
+
+	bin := filepath.Join(pc.WorkspaceSubdir(), "usr", "bin")
+	require.NoError(t, os.MkdirAll(bin, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "a"), []byte("#!/usr/bin/perl\nprint \"hello\\n\";\n"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "b"), []byte("#!/usr/bin/bash\necho hello\n"), 0o755))
+
+	require.NoError(t, pc.GenerateDependencies(ctx, &SCABuildInterface{PackageBuild: pc}))
+
+	data, err := os.ReadFile(b.DependencyLog + ".x86_64")
+	require.NoError(t, err)
+	var entry dependencyLogEntry
+	require.NoError(t, json.Unmarshal(data, &entry))
+
+	require.Equal(t, []string{"cmd:bash", "cmd:perl"}, entry.Runtime)
+	require.Equal(t, []string{"busybox", "zlib"}, entry.Provenance.Declared.Runtime)
+	require.Equal(t, []string{"cmd:bash", "cmd:perl"}, entry.Provenance.Generated.Runtime)
+	require.Equal(t, []string{"hello-bin=1.0.0", "hello-world=1.0.0"}, entry.Provenance.Declared.Provides)
+}
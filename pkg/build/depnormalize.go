@@ -0,0 +1,102 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"sort"
+	"strings"
+)
+
+// depOperatorOrder is the canonical order of the characters of a version
+// constraint operator, as in ">=", "<=", "><" and "=~".  apk treats an
+// operator as the set of its characters, so reordering them preserves its
+// meaning.
+const depOperatorOrder = "><=~"
+
+// normalizeDep canonicalizes the spelling of the dependency or provide dep,
+// such as "foo => 1.2", to "foo>=1.2" without changing its meaning: spaces
+// around the name, the conflict marker and the operator are removed and the
+// characters of the operator are put in canonical order.  Strings which
+// cannot be parsed are returned unchanged.
+func normalizeDep(dep string) string {
+	s := strings.TrimSpace(dep)
+
+	conflict := ""
+	if rest, ok := strings.CutPrefix(s, "!"); ok {
+		conflict, s = "!", strings.TrimSpace(rest)
+	}
+
+	i := strings.IndexAny(s, depOperatorOrder)
+	if i < 0 {
+		if s == "" || strings.ContainsAny(s, " \t") {
+			return dep
+		}
+		return conflict + s
+	}
+
+	name := strings.TrimSpace(s[:i])
+	rest := s[i:]
+	j := len(rest) - len(strings.TrimLeft(rest, depOperatorOrder+" \t"))
+	op := strings.Join(strings.Fields(rest[:j]), "")
+	version := strings.TrimSpace(rest[j:])
+	if name == "" || version == "" || strings.ContainsAny(name+version, " \t") {
+		return dep
+	}
+
+	canonical := ""
+	for _, c := range depOperatorOrder {
+		switch strings.Count(op, string(c)) {
+		case 0:
+		case 1:
+			canonical += string(c)
+		default:
+			return dep
+		}
+	}
+
+	return conflict + name + canonical + version
+}
+
+// normalizeDeps canonicalizes the spelling of each of deps.
+func normalizeDeps(deps []string) []string {
+	if deps == nil {
+		return nil
+	}
+
+	normalized := make([]string, 0, len(deps))
+	for _, dep := range deps {
+		normalized = append(normalized, normalizeDep(dep))
+	}
+	return normalized
+}
+
+// sortProvides orders provides by name, and those with the same name by
+// their constraint, which apk does not attach meaning to.
+func sortProvides(provides []string) []string {
+	sorted := append([]string{}, provides...)
+	name := func(provide string) string {
+		if i := strings.IndexAny(provide, depOperatorOrder); i >= 0 {
+			return provide[:i]
+		}
+		return provide
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if ni, nj := name(sorted[i]), name(sorted[j]); ni != nj {
+			return ni < nj
+		}
+		return sorted[i] < sorted[j]
+	})
+	return sorted
+}
@@ -0,0 +1,80 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"testing"
+
+	"chainguard.dev/melange/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_normalizeDep(t *testing.T) {
+	for _, tc := range []struct {
+		dep, want string
+	}{
+		{dep: "foo", want: "foo"},
+		{dep: " foo ", want: "foo"},
+		{dep: "foo >= 1.2", want: "foo>=1.2"},
+		{dep: "foo=>1.2", want: "foo>=1.2"},
+		{dep: "foo =< 1.2-r3", want: "foo<=1.2-r3"},
+		{dep: "foo ~= 1.2", want: "foo=~1.2"},
+		{dep: "foo=~1.2", want: "foo=~1.2"},
+		{dep: "foo~1.2", want: "foo~1.2"},
+		{dep: "foo <> 1.2", want: "foo><1.2"},
+		{dep: "so:libc.so.6 = 6", want: "so:libc.so.6=6"},
+		{dep: "! foo < 2", want: "!foo<2"},
+		// Not parseable, so left alone.
+		{dep: "foo ==1.2", want: "foo ==1.2"},
+		{dep: "foo >=", want: "foo >="},
+		{dep: "foo bar", want: "foo bar"},
+		{dep: "= 1.2", want: "= 1.2"},
+	} {
+		require.Equal(t, tc.want, normalizeDep(tc.dep), tc.dep)
+	}
+}
+
+func Test_sortProvides(t *testing.T) {
+	require.Equal(t,
+		[]string{"bar=1", "foo=1.0", "foo=2.0", "foo-bar=1", "so:libfoo.so.1=1"},
+		sortProvides([]string{"so:libfoo.so.1=1", "foo=2.0", "bar=1", "foo-bar=1", "foo=1.0"}))
+}
+
+func TestGenerateDependencies_NormalizeDepOperators(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{}
+	newPackageBuild := testPackageBuilder(t, b)
+
+	deps := config.Dependencies{
+		Runtime:  []string{"glibc >= 2.38", "glibc>=2.38", "busybox"},
+		Provides: []string{"hello-compat = 1.0", "cmd:hello=1.0", "hello-compat => 0.9"},
+	}
+
+	pc := newPackageBuild()
+	pc.Dependencies = deps
+	require.NoError(t, pc.GenerateDependencies(ctx, &SCABuildInterface{PackageBuild: pc}))
+	require.Contains(t, pc.Dependencies.Runtime, "glibc >= 2.38")
+
+	b.NormalizeDepOperators = true
+	pc = newPackageBuild()
+	pc.Dependencies = config.Dependencies{
+		Runtime:  append([]string{}, deps.Runtime...),
+		Provides: append([]string{}, deps.Provides...),
+	}
+	require.NoError(t, pc.GenerateDependencies(ctx, &SCABuildInterface{PackageBuild: pc}))
+	require.Equal(t, []string{"busybox", "glibc>=2.38"}, pc.Dependencies.Runtime)
+	require.Equal(t, []string{"cmd:hello=1.0", "hello-compat=1.0", "hello-compat>=0.9"}, pc.Dependencies.Provides)
+}
@@ -0,0 +1,58 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import "strings"
+
+// rewriteDepName returns dep with its name replaced by rewrite(name),
+// keeping any conflict marker and version constraint.
+func rewriteDepName(dep string, rewrite func(string) string) string {
+	conflict := ""
+	if rest, ok := strings.CutPrefix(dep, "!"); ok {
+		conflict, dep = "!", rest
+	}
+
+	name, constraint := dep, ""
+	if i := strings.IndexAny(dep, depOperatorOrder); i >= 0 {
+		name, constraint = dep[:i], dep[i:]
+	}
+
+	return conflict + rewrite(name) + constraint
+}
+
+// rewriteDepNames applies rewriteDepName to each of deps.
+func rewriteDepNames(deps []string, rewrite func(string) string) []string {
+	if deps == nil {
+		return nil
+	}
+
+	rewritten := make([]string, 0, len(deps))
+	for _, dep := range deps {
+		rewritten = append(rewritten, rewriteDepName(dep, rewrite))
+	}
+	return rewritten
+}
+
+// PrefixDepNames returns a DepNameRewrite which prefixes the names of
+// packages with prefix.  Typed names, such as so:libc.so.6 or cmd:sh, and
+// names which already have the prefix are left alone.
+func PrefixDepNames(prefix string) func(string) string {
+	return func(name string) string {
+		if strings.Contains(name, ":") || strings.HasPrefix(name, prefix) {
+			return name
+		}
+		return prefix + name
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"testing"
+
+	"chainguard.dev/melange/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_rewriteDepName(t *testing.T) {
+	prefix := PrefixDepNames("corp-")
+	for _, tc := range []struct {
+		dep, want string
+	}{
+		{dep: "glibc", want: "corp-glibc"},
+		{dep: "glibc>=2.38", want: "corp-glibc>=2.38"},
+		{dep: "!busybox", want: "!corp-busybox"},
+		{dep: "corp-glibc", want: "corp-glibc"},
+		{dep: "so:libc.so.6", want: "so:libc.so.6"},
+		{dep: "cmd:sh=1.36", want: "cmd:sh=1.36"},
+	} {
+		require.Equal(t, tc.want, rewriteDepName(tc.dep, prefix), tc.dep)
+	}
+}
+
+func TestGenerateDependencies_DepNameRewrite(t *testing.T) {
+	ctx := context.Background()
+	pc := testPackageBuilder(t, &Build{DepNameRewrite: PrefixDepNames("corp-")})()
+	pc.Dependencies = config.Dependencies{
+		Runtime:  []string{"glibc", "hello-libs", "so:libc.so.6"},
+		Provides: []string{"hello-libs=1.0.0"},
+		Replaces: []string{"hello-legacy"},
+	}
+
+	require.NoError(t, pc.GenerateDependencies(ctx, &SCABuildInterface{PackageBuild: pc}))
+
+	// hello-libs is provided by the package itself, which is still the case
+	// once both the dependency and the provide are rewritten.
+	require.Equal(t, []string{"corp-glibc", "so:libc.so.6"}, pc.Dependencies.Runtime)
+	require.Equal(t, []string{"corp-hello-libs=1.0.0"}, pc.Dependencies.Provides)
+	require.Equal(t, []string{"corp-hello-legacy"}, pc.Dependencies.Replaces)
+}
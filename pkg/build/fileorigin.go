@@ -0,0 +1,126 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// fileOriginSlack is how far a file's modification time may fall outside
+// the window of the step which wrote it, allowing for the coarse clock the
+// kernel stamps files with.
+const fileOriginSlack = 10 * time.Millisecond
+
+// pipelineStep is a top-level step of the pipeline of a package, with the
+// window of time in which it ran, for TrackFileOrigins.
+type pipelineStep struct {
+	// The package whose pipeline the step is in.
+	Package string `json:"package"`
+	// The position of the step in the pipeline, from 1.
+	Index int `json:"index"`
+	// The name of the step, or the pipeline it uses, if either is set.
+	Name  string    `json:"name,omitempty"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// trackStep records that the index'th step of the pipeline of pkg ran from
+// start until now, if file origins are tracked.
+func (b *Build) trackStep(pkg string, index int, pctx *PipelineContext, start time.Time) {
+	if !b.TrackFileOrigins {
+		return
+	}
+
+	step := pipelineStep{Package: pkg, Index: index + 1, Start: start, End: time.Now()}
+	if pctx.Pipeline.Name != "" || pctx.Pipeline.Uses != "" {
+		step.Name = pctx.Identity()
+	}
+	b.pipelineSteps = append(b.pipelineSteps, step)
+}
+
+// stepAt returns the step which last modified a file at mtime: the last to
+// start before then, if it had not yet ended.
+func (b *Build) stepAt(mtime time.Time) (pipelineStep, bool) {
+	for i := len(b.pipelineSteps) - 1; i >= 0; i-- {
+		step := b.pipelineSteps[i]
+		if step.Start.After(mtime.Add(fileOriginSlack)) {
+			continue
+		}
+		return step, !mtime.After(step.End.Add(fileOriginSlack))
+	}
+	return pipelineStep{}, false
+}
+
+// fileOrigins is the content of <identity>.fileorigin.json.
+type fileOrigins struct {
+	// The steps of the build, in the order they ran.
+	Steps []pipelineStep `json:"steps"`
+	// The step which last modified each file of the package.
+	Files map[string]pipelineStep `json:"files"`
+	// The files which were last modified outside of any step, for example
+	// by melange itself, or with their modification time preserved from
+	// the source.
+	Unknown []string `json:"unknown"`
+}
+
+// emitFileOrigins writes the pipeline step which produced each file of the
+// package next to it as <identity>.fileorigin.json.  Files are attributed to
+// steps by their modification time in the workspace, so a runner which
+// copies the workspace back from the guest, rather than sharing it,
+// leaves every file unknown.
+func (pc *PackageBuild) emitFileOrigins(ctx context.Context, result *EmitResult) error {
+	log := clog.FromContext(ctx)
+
+	origins := fileOrigins{
+		Steps:   append([]pipelineStep{}, pc.Build.pipelineSteps...),
+		Files:   map[string]pipelineStep{},
+		Unknown: []string{},
+	}
+	for path := range result.FileChecksums {
+		fi, err := os.Lstat(filepath.Join(pc.WorkspaceSubdir(), path))
+		if err != nil {
+			return fmt.Errorf("unable to stat %s: %w", path, err)
+		}
+
+		if step, ok := pc.Build.stepAt(fi.ModTime()); ok {
+			origins.Files[path] = step
+		} else {
+			origins.Unknown = append(origins.Unknown, path)
+		}
+	}
+	sort.Strings(origins.Unknown)
+
+	data, err := json.MarshalIndent(origins, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode file origins: %w", err)
+	}
+
+	path := filepath.Join(pc.OutDir, pc.Identity()+".fileorigin.json")
+	if err := writeFileAtomic(path, append(data, '\n')); err != nil {
+		return fmt.Errorf("unable to write file origins: %w", err)
+	}
+
+	log.Infof("wrote %s", path)
+
+	return nil
+}
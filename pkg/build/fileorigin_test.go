@@ -0,0 +1,69 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"chainguard.dev/melange/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrackFileOrigins(t *testing.T) {
+	ctx := context.Background()
+	pc := testPackageBuilder(t, &Build{TrackFileOrigins: true})()
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	configure := NewPipelineContext(&config.Pipeline{Uses: "autoconf/configure"}, nil, nil, nil)
+	install := NewPipelineContext(&config.Pipeline{Runs: "make install"}, nil, nil, nil)
+
+	pc.Build.trackStep("hello", 0, configure, base)
+	pc.Build.pipelineSteps[0].End = base.Add(time.Minute)
+	pc.Build.trackStep("hello", 1, install, base.Add(2*time.Minute))
+	pc.Build.pipelineSteps[1].End = base.Add(3 * time.Minute)
+
+	ws := pc.WorkspaceSubdir()
+	touch := func(path string, mtime time.Time) {
+		full := filepath.Join(ws, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(full), 0o755))
+		require.NoError(t, os.WriteFile(full, []byte(path), 0o644))
+		require.NoError(t, os.Chtimes(full, mtime, mtime))
+	}
+	touch("usr/share/hello.txt", base.Add(150*time.Second))
+	touch("usr/bin/hello", base.Add(30*time.Second))
+	// Between the steps, and after them.
+	touch("usr/share/gap.txt", base.Add(90*time.Second))
+	touch("usr/share/late.txt", base.Add(time.Hour))
+
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	data, err := os.ReadFile(filepath.Join(pc.OutDir, pc.Identity()+".fileorigin.json"))
+	require.NoError(t, err)
+	var got fileOrigins
+	require.NoError(t, json.Unmarshal(data, &got))
+
+	require.Len(t, got.Steps, 2)
+	require.Equal(t, "autoconf/configure", got.Steps[0].Name)
+	require.Equal(t, "", got.Steps[1].Name)
+	require.Len(t, got.Files, 2)
+	require.Equal(t, 1, got.Files["usr/bin/hello"].Index)
+	require.Equal(t, 2, got.Files["usr/share/hello.txt"].Index)
+	require.Equal(t, []string{"usr/share/gap.txt", "usr/share/late.txt"}, got.Unknown)
+}
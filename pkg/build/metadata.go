@@ -0,0 +1,174 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// MetadataSink records the metadata of each package melange emits, such as
+// in a package inventory database.
+type MetadataSink interface {
+	// Record is called once the package described by result has been
+	// written to disk and synced.  An error fails the build.
+	Record(ctx context.Context, result *EmitResult) error
+}
+
+// recordMetadata syncs the emitted package to disk and passes its result to
+// the build's MetadataSink.
+func (pc *PackageBuild) recordMetadata(ctx context.Context, result *EmitResult) error {
+	if err := syncFile(pc.Filename()); err != nil {
+		return fmt.Errorf("unable to sync %s: %w", pc.Filename(), err)
+	}
+
+	if err := pc.Build.MetadataSink.Record(ctx, result); err != nil {
+		return fmt.Errorf("unable to record metadata of %s: %w", pc.Identity(), err)
+	}
+
+	return nil
+}
+
+// syncFile commits the contents of the file at path, following symlinks, to
+// stable storage.
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
+
+// PackageMetadata is the content of <identity>.metadata.json: the fields of
+// the control data (.PKGINFO) of a package, typed.  The names of the fields
+// are stable; new fields may be added.  Its JSON schema is published as
+// pkg/build/metadata.schema.json, generated by internal/gen-jsonschema.
+type PackageMetadata struct {
+	// Name is the name of the package.
+	Name string `json:"name"`
+	// Version is the version of the package, without the epoch.
+	Version string `json:"version"`
+	// Epoch is the epoch of the package, the N of the -rN suffix of its
+	// full version.
+	Epoch uint64 `json:"epoch"`
+	// Arch is the architecture of the package, or noarch.
+	Arch string `json:"arch"`
+	// InstalledSize is the size in bytes of the contents of the package
+	// once installed.
+	InstalledSize int64 `json:"installed_size"`
+	// Origin is the name of the package this one was built with, if any.
+	Origin string `json:"origin,omitempty"`
+	// Description is the description of the package.
+	Description string `json:"description"`
+	// URL is the homepage of the package.
+	URL string `json:"url"`
+	// Commit is the commit of the configuration the package was built from.
+	Commit string `json:"commit"`
+	// BuildDate is the build date of the package in seconds since the Unix
+	// epoch, if one was recorded.
+	BuildDate int64 `json:"build_date,omitempty"`
+	// Licenses are the licenses of the package.
+	Licenses []string `json:"licenses"`
+	// Dependencies are the runtime dependencies of the package.
+	Dependencies []string `json:"dependencies"`
+	// Provides are what the package provides.
+	Provides []string `json:"provides"`
+	// Replaces are the packages whose files the package may overwrite.
+	Replaces []string `json:"replaces"`
+	// ReplacesPriority is the priority of the package among those which
+	// replace the same files.
+	ReplacesPriority int `json:"replaces_priority,omitempty"`
+	// ProviderPriority is the priority of the package among those which
+	// provide the same names.
+	ProviderPriority int `json:"provider_priority,omitempty"`
+	// DataHash is the hex-encoded sha256 of the data section.
+	DataHash string `json:"datahash"`
+}
+
+// Metadata returns the metadata of the package, as written to its control
+// data.
+func (pc *PackageBuild) Metadata() (*PackageMetadata, error) {
+	licenses, err := pc.Licenses()
+	if err != nil {
+		return nil, err
+	}
+
+	nonNil := func(s []string) []string {
+		if s == nil {
+			return []string{}
+		}
+		return s
+	}
+
+	md := &PackageMetadata{
+		Name:             pc.PackageName,
+		Version:          pc.Origin.Version,
+		Epoch:            pc.Origin.Epoch,
+		Arch:             pc.Arch,
+		InstalledSize:    pc.InstalledSize,
+		Origin:           pc.OriginName,
+		Description:      pc.Description,
+		URL:              pc.URL,
+		Commit:           pc.Commit,
+		Licenses:         nonNil(licenses),
+		Dependencies:     nonNil(pc.Dependencies.Runtime),
+		Provides:         nonNil(pc.Dependencies.Provides),
+		Replaces:         nonNil(pc.Replaces()),
+		ReplacesPriority: pc.ReplacesPriority(),
+		ProviderPriority: pc.Dependencies.ProviderPriority,
+		DataHash:         pc.DataHash,
+	}
+	buildDate, err := pc.BuildDate()
+	if err != nil {
+		return nil, err
+	}
+	if buildDate.Unix() != 0 {
+		md.BuildDate = buildDate.Unix()
+	}
+
+	return md, nil
+}
+
+// emitMetadataJSON writes the metadata of the package next to it as
+// <identity>.metadata.json.
+func (pc *PackageBuild) emitMetadataJSON(ctx context.Context) error {
+	log := clog.FromContext(ctx)
+
+	md, err := pc.Metadata()
+	if err != nil {
+		return fmt.Errorf("unable to collect metadata: %w", err)
+	}
+
+	data, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode metadata: %w", err)
+	}
+
+	path := filepath.Join(pc.OutDir, pc.Identity()+".metadata.json")
+	if err := writeFileAtomic(path, append(data, '\n')); err != nil {
+		return fmt.Errorf("unable to write metadata: %w", err)
+	}
+
+	log.Infof("wrote %s", path)
+
+	return nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"chainguard.dev/melange/pkg/config"
+
+	"github.com/go-openapi/spec"
+	"github.com/go-openapi/strfmt"
+	"github.com/go-openapi/validate"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingSink records the results passed to it, checking that each
+// package has been written first.
+type recordingSink struct {
+	t       *testing.T
+	results []*EmitResult
+	err     error
+}
+
+func (s *recordingSink) Record(_ context.Context, result *EmitResult) error {
+	require.FileExists(s.t, result.Path)
+	s.results = append(s.results, result)
+	return s.err
+}
+
+func TestMetadataSink(t *testing.T) {
+	ctx := context.Background()
+	sink := &recordingSink{t: t}
+	b := &Build{MetadataSink: sink}
+	pc := testPackageBuilder(t, b)()
+	b.SourceDateEpoch = time.Unix(12345678, 0)
+	pc.Dependencies.Runtime = []string{"glibc"}
+
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	require.Len(t, sink.results, 1)
+	result := sink.results[0]
+	require.Same(t, pc.Result, result)
+	require.Equal(t, "hello", result.PackageName)
+	require.Equal(t, "1.0.0-r0", result.Version)
+	require.Equal(t, "x86_64", result.Arch)
+	require.Equal(t, pc.Filename(), result.Path)
+	require.Equal(t, time.Unix(12345678, 0), result.BuildDate)
+	require.Equal(t, pc.DataHash, result.DataHash)
+	require.NotEmpty(t, result.Digest)
+	require.NotZero(t, result.Size)
+	require.Equal(t, []string{"glibc"}, result.Dependencies.Declared.Runtime)
+
+	// An error from the sink fails the build.
+	sink.err = errors.New("database is down")
+	require.ErrorContains(t, pc.EmitPackage(ctx), "database is down")
+}
+
+func TestEmitMetadataJSON(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{EmitMetadataJSON: true}
+	pc := testPackageBuilder(t, b)()
+	b.SourceDateEpoch = time.Unix(12345678, 0)
+	pc.Origin.Epoch = 2
+	pc.Origin.Copyright = []config.Copyright{{License: "Apache-2.0"}}
+	pc.Description = "hello world"
+	pc.URL = "https://example.com/hello"
+	pc.Dependencies = config.Dependencies{
+		Runtime:          []string{"glibc", "so:libc.so.6"},
+		Provides:         []string{"cmd:hello=1.0.0-r2"},
+		ProviderPriority: 10,
+	}
+
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	got, err := os.ReadFile(filepath.Join(pc.OutDir, pc.Identity()+".metadata.json"))
+	require.NoError(t, err)
+	want, err := os.ReadFile(filepath.Join("testdata", "metadata", "hello.metadata.json"))
+	require.NoError(t, err)
+
+	// The data hash depends on the compressor, so it is not in the golden
+	// file.
+	require.Equal(t, string(want), strings.Replace(string(got), pc.DataHash, "DATAHASH", 1))
+}
+
+func TestPackageMetadataSchema(t *testing.T) {
+	data, err := os.ReadFile("metadata.schema.json")
+	require.NoError(t, err)
+	var schema spec.Schema
+	require.NoError(t, json.Unmarshal(data, &schema))
+
+	validateJSON := func(data string) error {
+		var md any
+		require.NoError(t, json.Unmarshal([]byte(data), &md))
+		return validate.AgainstSchema(&schema, md, strfmt.Default)
+	}
+
+	golden, err := os.ReadFile(filepath.Join("testdata", "metadata", "hello.metadata.json"))
+	require.NoError(t, err)
+	require.NoError(t, validateJSON(string(golden)))
+
+	// The schema rejects metadata with missing, mistyped or unknown fields.
+	for _, data := range []string{
+		`{"name": "hello"}`,
+		strings.Replace(string(golden), `"epoch": 2`, `"epoch": "2"`, 1),
+		strings.Replace(string(golden), `"name": "hello"`, `"name": "hello", "nmae": "hello"`, 1),
+	} {
+		require.Error(t, validateJSON(data), data)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// linkNoArchPackages places the architecture independent subpackages, which
+// are emitted once to OutDir/noarch/, in the directory of the arch being
+// built too, and in the same place in each of AdditionalOutDirs, as apk
+// fetches the packages of an index from its directory.  It returns their
+// paths in OutDir.
+func (b *Build) linkNoArchPackages(ctx context.Context, pb *PipelineBuild) ([]string, error) {
+	log := clog.FromContext(ctx)
+
+	paths := []string{}
+	for _, sp := range b.Configuration.Subpackages {
+		sp := sp
+		if !sp.NoArch || !b.selected(sp.Name) {
+			continue
+		}
+		pb.Subpackage = &sp
+
+		result, err := pb.ShouldRun(sp)
+		if err != nil {
+			return nil, err
+		}
+		if !result {
+			continue
+		}
+
+		pkg := pkgFromSub(&sp)
+		name := fmt.Sprintf("%s-%s-r%d.apk", b.emittedName(sp.Name), b.Configuration.Package.Version, b.Configuration.Package.Epoch)
+		src := filepath.Join(b.packageDir(pkg), name)
+
+		rel := b.apkArch()
+		if b.GroupByOrigin {
+			rel = filepath.Join(rel, b.originName(pkg))
+		}
+		for _, root := range append([]string{b.OutDir}, b.AdditionalOutDirs...) {
+			dir := filepath.Join(root, rel)
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return nil, fmt.Errorf("unable to create output directory: %w", err)
+			}
+			if err := linkOrCopy(src, filepath.Join(dir, name)); err != nil {
+				return nil, fmt.Errorf("unable to place %s in %s: %w", name, dir, err)
+			}
+		}
+
+		log.Infof("placed %s in %s", name, filepath.Join(b.OutDir, rel))
+		paths = append(paths, filepath.Join(b.OutDir, rel, name))
+	}
+
+	return paths, nil
+}
+
+// LinkNoArchPackages places the architecture independent subpackages emitted
+// by the build of another arch in the directory of the arch of this build,
+// which has SkipNoArch set, and adds them to its index when GenerateIndex is
+// set.  It must be called once the build which emits them has finished.
+func (b *Build) LinkNoArchPackages(ctx context.Context) error {
+	pb := &PipelineBuild{
+		Build:   b,
+		Package: &b.Configuration.Package,
+	}
+
+	apkFiles, err := b.linkNoArchPackages(ctx, pb)
+	if err != nil {
+		return err
+	}
+
+	if b.GenerateIndex && len(apkFiles) != 0 {
+		return b.generateIndex(ctx, apkFiles)
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ociAPKMediaType is the media type of the apk in, and the artifact type of,
+// the OCI artifact of a package.
+const ociAPKMediaType = "application/vnd.apk"
+
+// The annotations of the manifest of the OCI artifact of a package, which
+// carry the fields of its control data.
+const (
+	ociAnnotationName     = "dev.melange.apk.name"
+	ociAnnotationVersion  = "dev.melange.apk.version"
+	ociAnnotationArch     = "dev.melange.apk.arch"
+	ociAnnotationOrigin   = "dev.melange.apk.origin"
+	ociAnnotationDataHash = "dev.melange.apk.datahash"
+	ociAnnotationSize     = "dev.melange.apk.installed-size"
+)
+
+// ociLayoutDir returns the OCI layout directory the package is wrapped in.
+func (pc *PackageBuild) ociLayoutDir() string {
+	return filepath.Join(pc.OutDir, pc.Identity()+".oci")
+}
+
+// emitOCILayout wraps the emitted apk as an OCI artifact, in an OCI layout
+// directory next to it as <identity>.oci, so that it can be pushed to a
+// registry as is, such as with oras or crane.  The manifest has the apk as
+// its only layer and its control data as annotations, and is tagged with
+// the version of the package.  The apk itself is linked into the layout
+// rather than copied where possible.
+func (pc *PackageBuild) emitOCILayout(ctx context.Context, result *EmitResult) error {
+	log := clog.FromContext(ctx)
+
+	dir := pc.ociLayoutDir()
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("unable to replace OCI layout: %w", err)
+	}
+	blobs := filepath.Join(dir, ocispec.ImageBlobsDir, digest.SHA256.String())
+	if err := os.MkdirAll(blobs, 0o755); err != nil {
+		return fmt.Errorf("unable to create OCI layout: %w", err)
+	}
+
+	writeBlob := func(data []byte) (digest.Digest, error) {
+		dgst := digest.FromBytes(data)
+		return dgst, os.WriteFile(filepath.Join(blobs, dgst.Encoded()), data, 0o644)
+	}
+
+	apk := digest.NewDigestFromEncoded(digest.SHA256, result.Digest)
+	if err := linkOrCopy(pc.Filename(), filepath.Join(blobs, apk.Encoded())); err != nil {
+		return fmt.Errorf("unable to add %s to OCI layout: %w", pc.Filename(), err)
+	}
+
+	config := ocispec.DescriptorEmptyJSON
+	if _, err := writeBlob(config.Data); err != nil {
+		return fmt.Errorf("unable to write OCI config: %w", err)
+	}
+	config.Data = nil
+
+	annotations := map[string]string{
+		ociAnnotationName:       result.PackageName,
+		ociAnnotationVersion:    result.Version,
+		ociAnnotationArch:       result.Arch,
+		ociAnnotationDataHash:   result.DataHash,
+		ociAnnotationSize:       strconv.FormatInt(result.InstalledSize, 10),
+		ocispec.AnnotationTitle: filepath.Base(pc.Filename()),
+	}
+	if pc.OriginName != "" {
+		annotations[ociAnnotationOrigin] = pc.OriginName
+	}
+	if !result.BuildDate.IsZero() {
+		annotations[ocispec.AnnotationCreated] = result.BuildDate.UTC().Format(time.RFC3339)
+	}
+
+	manifest, err := json.Marshal(ocispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: ociAPKMediaType,
+		Config:       config,
+		Layers: []ocispec.Descriptor{{
+			MediaType: ociAPKMediaType,
+			Digest:    apk,
+			Size:      result.Size,
+			Annotations: map[string]string{
+				ocispec.AnnotationTitle: filepath.Base(pc.Filename()),
+			},
+		}},
+		Annotations: annotations,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to encode OCI manifest: %w", err)
+	}
+	manifestDigest, err := writeBlob(manifest)
+	if err != nil {
+		return fmt.Errorf("unable to write OCI manifest: %w", err)
+	}
+
+	index, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{{
+			MediaType:    ocispec.MediaTypeImageManifest,
+			ArtifactType: ociAPKMediaType,
+			Digest:       manifestDigest,
+			Size:         int64(len(manifest)),
+			Annotations: map[string]string{
+				ocispec.AnnotationRefName: result.Version,
+			},
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to encode OCI index: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ocispec.ImageIndexFile), index, 0o644); err != nil {
+		return fmt.Errorf("unable to write OCI index: %w", err)
+	}
+
+	layout, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err != nil {
+		return fmt.Errorf("unable to encode OCI layout: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ocispec.ImageLayoutFile), layout, 0o644); err != nil {
+		return fmt.Errorf("unable to write OCI layout: %w", err)
+	}
+
+	log.Infof("wrote %s", dir)
+
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmitOCILayout(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{EmitOCILayout: true}
+	pc := testPackageBuilder(t, b)()
+	b.SourceDateEpoch = time.Unix(12345678, 0)
+
+	require.NoError(t, pc.EmitPackage(ctx))
+	// Emitting again replaces the layout.
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	lp, err := layout.FromPath(pc.ociLayoutDir())
+	require.NoError(t, err)
+	idx, err := lp.ImageIndex()
+	require.NoError(t, err)
+	im, err := idx.IndexManifest()
+	require.NoError(t, err)
+	require.Len(t, im.Manifests, 1)
+	require.Equal(t, "1.0.0-r0", im.Manifests[0].Annotations["org.opencontainers.image.ref.name"])
+
+	img, err := idx.Image(im.Manifests[0].Digest)
+	require.NoError(t, err)
+	raw, err := img.RawManifest()
+	require.NoError(t, err)
+	var manifest ocispec.Manifest
+	require.NoError(t, json.Unmarshal(raw, &manifest))
+	require.Equal(t, ociAPKMediaType, manifest.ArtifactType)
+	require.Equal(t, map[string]string{
+		ociAnnotationName:                  "hello",
+		ociAnnotationVersion:               "1.0.0-r0",
+		ociAnnotationArch:                  "x86_64",
+		ociAnnotationOrigin:                "hello",
+		ociAnnotationDataHash:              pc.DataHash,
+		ociAnnotationSize:                  strconv.FormatInt(pc.InstalledSize, 10),
+		"org.opencontainers.image.title":   "hello-1.0.0-r0.apk",
+		"org.opencontainers.image.created": "1970-05-23T21:21:18Z",
+	}, manifest.Annotations)
+
+	// The only layer is the apk itself.
+	layers, err := img.Layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+	digest, err := layers[0].Digest()
+	require.NoError(t, err)
+	require.Equal(t, pc.Result.Digest, digest.Hex)
+	rc, err := layers[0].Compressed()
+	require.NoError(t, err)
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	want, err := os.ReadFile(pc.Filename())
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+}
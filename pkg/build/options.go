@@ -17,10 +17,14 @@ package build
 import (
 	"fmt"
 	"os"
+	"path"
+	"strings"
 	"time"
 
 	apko_types "chainguard.dev/apko/pkg/build/types"
 	"chainguard.dev/melange/pkg/container"
+	"chainguard.dev/melange/pkg/sca"
+	"github.com/google/uuid"
 )
 
 type Option func(*Build) error
@@ -63,6 +67,21 @@ func WithBuildDate(s string) Option {
 	}
 }
 
+// WithValidateSourceDateEpoch sets whether the source date epoch is
+// checked to be at most maxSkew in the future and, unless earliest is
+// zero, no earlier than earliest.
+func WithValidateSourceDateEpoch(validate bool, maxSkew time.Duration, earliest time.Time) Option {
+	return func(b *Build) error {
+		if maxSkew < 0 {
+			return fmt.Errorf("source date epoch skew %s must not be negative", maxSkew)
+		}
+		b.ValidateSourceDateEpoch = validate
+		b.SourceDateEpochMaxSkew = maxSkew
+		b.SourceDateEpochMin = earliest
+		return nil
+	}
+}
+
 // WithWorkspaceDir sets the workspace directory to use.
 func WithWorkspaceDir(workspaceDir string) Option {
 	return func(b *Build) error {
@@ -145,6 +164,21 @@ func WithSigningKey(signingKey string) Option {
 	}
 }
 
+// WithIndexSigningKey sets the path of the key indexes are signed with,
+// when it differs from the signing key of the packages.
+func WithIndexSigningKey(signingKey string) Option {
+	return func(b *Build) error {
+		if signingKey != "" {
+			if _, err := os.Stat(signingKey); err != nil {
+				return fmt.Errorf("could not open index signing key: %w", err)
+			}
+		}
+
+		b.IndexSigningKey = signingKey
+		return nil
+	}
+}
+
 // WithGenerateIndex sets whether or not the apk index should be generated.
 func WithGenerateIndex(generateIndex bool) Option {
 	return func(b *Build) error {
@@ -193,6 +227,15 @@ func WithDependencyLog(logFile string) Option {
 	}
 }
 
+// WithMergedDependencyLog sets whether the dependency logs of all arches
+// are merged into a single file.
+func WithMergedDependencyLog(merged bool) Option {
+	return func(b *Build) error {
+		b.MergedDependencyLog = merged
+		return nil
+	}
+}
+
 // WithBinShOverlay sets a filename to copy from when installing /bin/sh
 // into a build environment.
 func WithBinShOverlay(binShOverlay string) Option {
@@ -214,6 +257,787 @@ func WithStripOriginName(stripOriginName bool) Option {
 	}
 }
 
+// WithEmitProvenance sets whether an in-toto statement carrying SLSA
+// provenance is written as <identity>.intoto.jsonl next to each package.
+func WithEmitProvenance(emit bool) Option {
+	return func(b *Build) error {
+		b.EmitProvenance = emit
+		return nil
+	}
+}
+
+// WithStripScriptlets sets whether scriptlets and triggers are omitted from
+// the control section of generated packages.  Packages whose scriptlets
+// perform real setup may be incomplete without them.
+func WithStripScriptlets(strip bool) Option {
+	return func(b *Build) error {
+		b.StripScriptlets = strip
+		return nil
+	}
+}
+
+// WithDefaultFileUmask sets the permission bits which are cleared from every
+// file and directory in the data section of generated packages.
+func WithDefaultFileUmask(umask os.FileMode) Option {
+	return func(b *Build) error {
+		b.DefaultFileUmask = umask
+		return nil
+	}
+}
+
+// WithLicenseRenderMode sets how copyright licenses are rendered into the
+// control data: one line per entry ("per-entry", the default) or a single
+// line holding the combined SPDX expression ("expression").
+func WithLicenseRenderMode(mode string) Option {
+	return func(b *Build) error {
+		switch mode {
+		case "", LicenseRenderPerEntry, LicenseRenderExpression:
+			b.LicenseRenderMode = mode
+			return nil
+		default:
+			return fmt.Errorf("unknown license render mode %q, expected %q or %q", mode, LicenseRenderPerEntry, LicenseRenderExpression)
+		}
+	}
+}
+
+// WithMaxDataSize sets the maximum size in bytes of the compressed data
+// section of a package.  Emitting a package over the limit fails rather than
+// producing an artifact which cannot be published.  Zero means no limit.
+func WithMaxDataSize(size int64) Option {
+	return func(b *Build) error {
+		b.MaxDataSize = size
+		return nil
+	}
+}
+
+// WithEmitPerPackageIndex sets whether an APKINDEX containing only the
+// package is written next to each package as <identity>.index.  It is signed
+// with the signing key, if one is set.
+func WithEmitPerPackageIndex(emit bool) Option {
+	return func(b *Build) error {
+		b.EmitPerPackageIndex = emit
+		return nil
+	}
+}
+
+// WithOutputWriteRetries sets how many times writing a package is retried,
+// with exponential backoff, after a transient error such as EIO.
+func WithOutputWriteRetries(retries int) Option {
+	return func(b *Build) error {
+		b.OutputWriteRetries = retries
+		return nil
+	}
+}
+
+// WithTarFormat sets the tar format used for the data section: "pax" (the
+// default), "gnu" or "ustar".  See TarFormatGNU and TarFormatUSTAR for the
+// limitations of the legacy formats.
+func WithTarFormat(format string) Option {
+	return func(b *Build) error {
+		switch format {
+		case "", TarFormatPAX, TarFormatGNU, TarFormatUSTAR:
+			b.TarFormat = format
+			return nil
+		default:
+			return fmt.Errorf("unknown tar format %q, expected %q, %q or %q", format, TarFormatPAX, TarFormatGNU, TarFormatUSTAR)
+		}
+	}
+}
+
+// WithBaselineDataHashes sets the DataHashes of previously published
+// packages, keyed by package name.  Emitted packages whose data section
+// matches their baseline are reported as unchanged in their EmitResult.
+func WithBaselineDataHashes(hashes map[string]string) Option {
+	return func(b *Build) error {
+		b.BaselineDataHashes = hashes
+		return nil
+	}
+}
+
+// WithSBOMFormat sets which SBOMs are written into each package: "spdx"
+// (the default), "cyclonedx" or "both".
+func WithSBOMFormat(format string) Option {
+	return func(b *Build) error {
+		switch format {
+		case "", SBOMFormatSPDX, SBOMFormatCycloneDX, SBOMFormatBoth:
+			b.SBOMFormat = format
+			return nil
+		default:
+			return fmt.Errorf("unknown SBOM format %q, expected %q, %q or %q", format, SBOMFormatSPDX, SBOMFormatCycloneDX, SBOMFormatBoth)
+		}
+	}
+}
+
+// WithEmbedBuilderInfo sets whether melange's version and the builder ID are
+// recorded as comments in .PKGINFO.
+func WithEmbedBuilderInfo(embed bool) Option {
+	return func(b *Build) error {
+		b.EmbedBuilderInfo = embed
+		return nil
+	}
+}
+
+// WithBuilderID sets the builder ID recorded in .PKGINFO when builder info
+// is embedded.
+func WithBuilderID(id string) Option {
+	return func(b *Build) error {
+		b.BuilderID = id
+		return nil
+	}
+}
+
+// WithEmitFileChecksums sets whether the checksum of every file in a package
+// is written as <identity>.filesums.json next to it.
+func WithEmitFileChecksums(emit bool) Option {
+	return func(b *Build) error {
+		b.EmitFileChecksums = emit
+		return nil
+	}
+}
+
+// WithPinProvidesToPackageVersion sets whether generated provides are pinned
+// to the version of the package providing them.
+func WithPinProvidesToPackageVersion(pin bool) Option {
+	return func(b *Build) error {
+		b.PinProvidesToPackageVersion = pin
+		return nil
+	}
+}
+
+// WithArchAlias sets the arch names written into packages in place of
+// melange's own, keyed by the latter.
+func WithArchAlias(aliases map[string]string) Option {
+	return func(b *Build) error {
+		b.ArchAlias = aliases
+		return nil
+	}
+}
+
+// WithValidateWithApk sets whether emitted packages are validated with
+// apk-tools: "" (never), "optional" (when apk is installed) or "required".
+func WithValidateWithApk(mode string) Option {
+	return func(b *Build) error {
+		switch mode {
+		case "", ApkValidationOptional, ApkValidationRequired:
+			b.ValidateWithApk = mode
+			return nil
+		default:
+			return fmt.Errorf("unknown apk validation mode %q, expected %q or %q", mode, ApkValidationOptional, ApkValidationRequired)
+		}
+	}
+}
+
+// WithTempDir sets the directory in which temporary files are created.
+func WithTempDir(dir string) Option {
+	return func(b *Build) error {
+		b.TempDir = dir
+		return nil
+	}
+}
+
+// WithRandomSeed seeds the randomness of the build.  See Build.RandomSeed
+// for the operations it governs.
+func WithRandomSeed(seed uint64) Option {
+	return func(b *Build) error {
+		b.RandomSeed = seed
+		return nil
+	}
+}
+
+// WithNamedTempFiles sets whether temporary files are named after the
+// package they belong to.
+func WithNamedTempFiles(named bool) Option {
+	return func(b *Build) error {
+		b.NamedTempFiles = named
+		return nil
+	}
+}
+
+// WithPreserveSparse sets whether holes in sparse files are preserved in
+// the data section.
+func WithPreserveSparse(preserve bool) Option {
+	return func(b *Build) error {
+		b.PreserveSparse = preserve
+		return nil
+	}
+}
+
+// WithPassphrasePrompt sets the function called for the passphrase of an
+// encrypted signing key.
+func WithPassphrasePrompt(prompt func() (string, error)) Option {
+	return func(b *Build) error {
+		b.PassphrasePrompt = prompt
+		return nil
+	}
+}
+
+// WithSCAReport sets whether a report of the problems SCA finds is written
+// next to each package.
+func WithSCAReport(report bool) Option {
+	return func(b *Build) error {
+		b.SCAReport = report
+		return nil
+	}
+}
+
+// WithVolatileControlFields sets the control fields which are blanked when
+// comparing builds for reproducibility.
+func WithVolatileControlFields(fields []string) Option {
+	return func(b *Build) error {
+		b.VolatileControlFields = fields
+		return nil
+	}
+}
+
+// WithRunTestsAfterEmit sets whether the test pipelines of each package are
+// run as soon as it is emitted.
+func WithRunTestsAfterEmit(run bool) Option {
+	return func(b *Build) error {
+		b.RunTestsAfterEmit = run
+		return nil
+	}
+}
+
+// WithContentAddressedOutput sets whether packages are written to a content
+// addressed store in OutDir.
+func WithContentAddressedOutput(enabled bool) Option {
+	return func(b *Build) error {
+		b.ContentAddressedOutput = enabled
+		return nil
+	}
+}
+
+// WithContentAddressedLink sets how the usual file names of content
+// addressed packages refer to their objects.
+func WithContentAddressedLink(mode string) Option {
+	return func(b *Build) error {
+		switch mode {
+		case "", ContentAddressedLinkSymlink, ContentAddressedLinkCopy:
+			b.ContentAddressedLink = mode
+			return nil
+		default:
+			return fmt.Errorf("unknown content addressed link mode %q, expected %q or %q", mode, ContentAddressedLinkSymlink, ContentAddressedLinkCopy)
+		}
+	}
+}
+
+// WithSingleStream sets whether packages are written as a single gzip
+// stream.  This is experimental, and the packages written are not apks.
+func WithSingleStream(single bool) Option {
+	return func(b *Build) error {
+		b.SingleStream = single
+		return nil
+	}
+}
+
+// WithStampGzipHeader sets whether the gzip header of the data section
+// carries the identity of the package.
+func WithStampGzipHeader(stamp bool) Option {
+	return func(b *Build) error {
+		b.StampGzipHeader = stamp
+		return nil
+	}
+}
+
+// WithVerifyRuntimeDepsResolvable sets whether the runtime dependencies of
+// the packages in the build are checked to be resolvable against the given
+// local APKINDEX.tar.gz files.
+func WithVerifyRuntimeDepsResolvable(verify bool, indexes []string) Option {
+	return func(b *Build) error {
+		b.VerifyRuntimeDepsResolvable = verify
+		b.RuntimeDepsIndexes = indexes
+		return nil
+	}
+}
+
+// WithStableCompression sets whether packages are compressed with an
+// encoder chosen for stable output rather than speed.
+func WithStableCompression(stable bool) Option {
+	return func(b *Build) error {
+		b.StableCompression = stable
+		return nil
+	}
+}
+
+// WithMaxConcurrentEmitBytes bounds the combined installed size of the
+// packages whose data sections are compressed at once.  Every build this
+// option is applied to shares the same budget, so passing it to the build
+// of each architecture bounds their combined memory use.
+func WithMaxConcurrentEmitBytes(n int64) Option {
+	var budget *emitBudget
+	if n > 0 {
+		budget = newEmitBudget(n)
+	}
+
+	return func(b *Build) error {
+		b.MaxConcurrentEmitBytes = n
+		b.emitBudget = budget
+		return nil
+	}
+}
+
+// WithInputsHash sets the hash of the build inputs recorded in .PKGINFO.
+func WithInputsHash(hash string) Option {
+	return func(b *Build) error {
+		if strings.ContainsAny(hash, " \t\r\n") {
+			return fmt.Errorf("inputs hash %q must not contain whitespace", hash)
+		}
+		b.InputsHash = hash
+		return nil
+	}
+}
+
+// WithBuildID sets the ID of the build recorded in .PKGINFO.  BuildIDAuto
+// generates a random one.
+func WithBuildID(id string) Option {
+	return func(b *Build) error {
+		if id == BuildIDAuto {
+			id = uuid.NewString()
+		}
+		if strings.ContainsAny(id, " \t\r\n") {
+			return fmt.Errorf("build ID %q must not contain whitespace", id)
+		}
+		b.BuildID = id
+		return nil
+	}
+}
+
+// WithOnlyPackages limits the packages and subpackages emitted to those
+// named.  An empty list emits all of them.
+func WithOnlyPackages(names []string) Option {
+	return func(b *Build) error {
+		b.OnlyPackages = names
+		return nil
+	}
+}
+
+// WithSymlinkMode sets how the targets of symlinks within the package are
+// written: "preserve" (the default), "relative" or "absolute".
+func WithSymlinkMode(mode string) Option {
+	return func(b *Build) error {
+		switch mode {
+		case "", SymlinkModePreserve, SymlinkModeRelative, SymlinkModeAbsolute:
+			b.SymlinkMode = mode
+			return nil
+		default:
+			return fmt.Errorf("unknown symlink mode %q, expected %q, %q or %q", mode, SymlinkModePreserve, SymlinkModeRelative, SymlinkModeAbsolute)
+		}
+	}
+}
+
+// WithStrictSCA sets whether any error of an SCA analyzer fails the build.
+func WithStrictSCA(strict bool) Option {
+	return func(b *Build) error {
+		b.StrictSCA = strict
+		return nil
+	}
+}
+
+// WithEmitDataArtifact sets whether the data section of each package is
+// written next to it as <identity>.data.tar.gz.
+func WithEmitDataArtifact(emit bool) Option {
+	return func(b *Build) error {
+		b.EmitDataArtifact = emit
+		return nil
+	}
+}
+
+// WithStrictScriptlets sets whether packages with inconsistent scriptlets
+// fail to emit.
+func WithStrictScriptlets(strict bool) Option {
+	return func(b *Build) error {
+		b.StrictScriptlets = strict
+		return nil
+	}
+}
+
+// WithGroupByOrigin sets whether packages are written to a subdirectory of
+// the per-arch output directory named after their origin.
+func WithGroupByOrigin(group bool) Option {
+	return func(b *Build) error {
+		b.GroupByOrigin = group
+		return nil
+	}
+}
+
+// WithDataCompression sets how the data section of each package is
+// compressed; one of "" (gzip at the default level) or DataCompressionAuto.
+func WithDataCompression(mode string) Option {
+	return func(b *Build) error {
+		switch mode {
+		case "", DataCompressionAuto:
+			b.DataCompression = mode
+			return nil
+		default:
+			return fmt.Errorf("unknown data compression %q, expected %q", mode, DataCompressionAuto)
+		}
+	}
+}
+
+// WithAutoCompressionThresholds overrides the thresholds by which
+// DataCompressionAuto picks the compression of each data section.
+func WithAutoCompressionThresholds(t AutoCompressionThresholds) Option {
+	return func(b *Build) error {
+		if t.SmallSize < 0 || t.LargeSize < 0 || t.CompressedFraction < 0 || t.CompressedFraction > 1 {
+			return fmt.Errorf("invalid automatic compression thresholds %+v", t)
+		}
+		b.AutoCompressionThresholds = t
+		return nil
+	}
+}
+
+// WithStubPackages sets whether packages are emitted as stubs with an
+// empty data section.
+func WithStubPackages(stub bool) Option {
+	return func(b *Build) error {
+		b.StubPackages = stub
+		return nil
+	}
+}
+
+// WithExplicitDirEntries sets whether every directory in the data section
+// is guaranteed an entry of its own.
+func WithExplicitDirEntries(explicit bool) Option {
+	return func(b *Build) error {
+		b.ExplicitDirEntries = explicit
+		return nil
+	}
+}
+
+// WithSCADiscoveryCallback sets a function called with each dependency
+// SCA generates as soon as it is found.
+func WithSCADiscoveryCallback(cb func(pkg string, d sca.Discovery)) Option {
+	return func(b *Build) error {
+		b.SCADiscoveryCallback = cb
+		return nil
+	}
+}
+
+// WithLegacyControlAlias sets whether a non-standard copy of .PKGINFO is
+// written next to each package as <identity>.PKGINFO.
+func WithLegacyControlAlias(alias bool) Option {
+	return func(b *Build) error {
+		b.LegacyControlAlias = alias
+		return nil
+	}
+}
+
+// WithWarningsAsErrors sets whether packages fail to emit if any warnings
+// were logged about them.
+func WithWarningsAsErrors(strict bool) Option {
+	return func(b *Build) error {
+		b.WarningsAsErrors = strict
+		return nil
+	}
+}
+
+// WithTrackFileOrigins sets whether the pipeline step which produced each
+// file of a package is written next to it as <identity>.fileorigin.json.
+func WithTrackFileOrigins(track bool) Option {
+	return func(b *Build) error {
+		b.TrackFileOrigins = track
+		return nil
+	}
+}
+
+// WithRejectWorldWritable sets whether packages with world-writable files or
+// directories fail to emit, except for those matching the allowlist globs.
+func WithRejectWorldWritable(reject bool, allowlist []string) Option {
+	return func(b *Build) error {
+		for _, pattern := range allowlist {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid world-writable allowlist pattern %q: %w", pattern, err)
+			}
+		}
+		b.RejectWorldWritable = reject
+		b.WorldWritableAllowlist = allowlist
+		return nil
+	}
+}
+
+// WithAdditionalOutDirs sets directories packages are also placed in once
+// they are written to the output directory.
+func WithAdditionalOutDirs(dirs []string) Option {
+	return func(b *Build) error {
+		b.AdditionalOutDirs = dirs
+		return nil
+	}
+}
+
+// WithNormalizeDepOperators sets whether the spelling of the dependencies
+// and provides of packages is canonicalized.
+func WithNormalizeDepOperators(normalize bool) Option {
+	return func(b *Build) error {
+		b.NormalizeDepOperators = normalize
+		return nil
+	}
+}
+
+// WithEmbedConfigDigest sets whether the sha256 of the configuration file is
+// recorded in .PKGINFO.
+func WithEmbedConfigDigest(embed bool) Option {
+	return func(b *Build) error {
+		b.EmbedConfigDigest = embed
+		return nil
+	}
+}
+
+// WithEmbedConfigFile sets whether the configuration file is shipped in
+// each package as /usr/share/melange/<name>.yaml.
+func WithEmbedConfigFile(embed bool) Option {
+	return func(b *Build) error {
+		b.EmbedConfigFile = embed
+		return nil
+	}
+}
+
+// WithDepNameRewrite sets a function rewriting the names of the
+// dependencies, provides and replaces of packages.
+func WithDepNameRewrite(rewrite func(name string) string) Option {
+	return func(b *Build) error {
+		b.DepNameRewrite = rewrite
+		return nil
+	}
+}
+
+// WithBenchmarkCompression sets whether the data section of each package is
+// compressed again with other algorithms to compare their size and speed.
+func WithBenchmarkCompression(benchmark bool) Option {
+	return func(b *Build) error {
+		b.BenchmarkCompression = benchmark
+		return nil
+	}
+}
+
+// WithCompareAgainst sets a reference package, or a directory of them,
+// which each package is compared against after it is emitted.
+func WithCompareAgainst(path string) Option {
+	return func(b *Build) error {
+		b.CompareAgainst = path
+		return nil
+	}
+}
+
+// WithInjectedFileMode sets the mode of the files melange adds to packages.
+func WithInjectedFileMode(mode os.FileMode) Option {
+	return func(b *Build) error {
+		b.InjectedFileMode = mode
+		return nil
+	}
+}
+
+// WithEmitChecksumsFile sets whether SHA256SUMS is written in the output
+// directory, and whether it is signed with the index signing key.
+func WithEmitChecksumsFile(emit, sign bool) Option {
+	return func(b *Build) error {
+		b.EmitChecksumsFile = emit
+		b.SignChecksumsFile = sign
+		return nil
+	}
+}
+
+// WithSigningKeyOptional sets whether a signing key which does not exist
+// leaves packages unsigned with a warning, rather than failing the build.
+func WithSigningKeyOptional(optional bool) Option {
+	return func(b *Build) error {
+		b.SigningKeyOptional = optional
+		return nil
+	}
+}
+
+// WithNormalizeStandardDirs sets whether the entries for standard
+// directories are owned by root with their standard modes.
+func WithNormalizeStandardDirs(normalize bool) Option {
+	return func(b *Build) error {
+		b.NormalizeStandardDirs = normalize
+		return nil
+	}
+}
+
+// WithMetadataSink sets the sink which records the metadata of each
+// emitted package.
+func WithMetadataSink(sink MetadataSink) Option {
+	return func(b *Build) error {
+		b.MetadataSink = sink
+		return nil
+	}
+}
+
+// WithPackageNameSuffix sets the suffix appended to the names of the
+// package and its subpackages.
+func WithPackageNameSuffix(suffix string) Option {
+	return func(b *Build) error {
+		b.PackageNameSuffix = suffix
+		return nil
+	}
+}
+
+// WithEmitMetadataJSON sets whether the control data of each package is
+// also written next to it as JSON.
+func WithEmitMetadataJSON(emit bool) Option {
+	return func(b *Build) error {
+		b.EmitMetadataJSON = emit
+		return nil
+	}
+}
+
+// WithVerifyVersionConsistency sets whether the exact versions the packages
+// of the build pin each other to are checked before they are emitted.
+func WithVerifyVersionConsistency(verify bool) Option {
+	return func(b *Build) error {
+		b.VerifyVersionConsistency = verify
+		return nil
+	}
+}
+
+// WithPgzipBlockSize sets the size of the blocks the data section is
+// compressed in, 0 for the default.
+func WithPgzipBlockSize(size int) Option {
+	return func(b *Build) error {
+		b.PgzipBlockSize = size
+		return nil
+	}
+}
+
+// WithEmitOCILayout sets whether each package is also wrapped as an OCI
+// artifact in an OCI layout directory.
+func WithEmitOCILayout(emit bool) Option {
+	return func(b *Build) error {
+		b.EmitOCILayout = emit
+		return nil
+	}
+}
+
+// WithDetectDependencyCycles sets whether the build fails if the packages
+// it emits depend on each other in a cycle.
+func WithDetectDependencyCycles(detect bool) Option {
+	return func(b *Build) error {
+		b.DetectDependencyCycles = detect
+		return nil
+	}
+}
+
+// WithScriptletAccountEnv sets whether the ids of the accounts of the build
+// environment are exported to post-install scriptlets.
+func WithScriptletAccountEnv(export bool) Option {
+	return func(b *Build) error {
+		b.ScriptletAccountEnv = export
+		return nil
+	}
+}
+
+// WithMaxDependencies sets the maximum number of dependency lines in the
+// control data of a package, and whether exceeding it is a warning rather
+// than an error.  Zero means no limit.
+func WithMaxDependencies(limit int, warn bool) Option {
+	return func(b *Build) error {
+		b.MaxDependencies = limit
+		b.MaxDependenciesWarn = warn
+		return nil
+	}
+}
+
+// WithWarnIsolatedPackages sets whether packages which depend on nothing and
+// provide nothing are warned about.
+func WithWarnIsolatedPackages(warn bool) Option {
+	return func(b *Build) error {
+		b.WarnIsolatedPackages = warn
+		return nil
+	}
+}
+
+// WithDeterministicCompression sets whether the data section is compressed
+// single threaded, so that it does not depend on the number of compression
+// workers.
+func WithDeterministicCompression(deterministic bool) Option {
+	return func(b *Build) error {
+		b.DeterministicCompression = deterministic
+		return nil
+	}
+}
+
+// WithEmitApkManifest sets whether the checksum of every file in a package
+// is written next to it in the format of `apk manifest`.
+func WithEmitApkManifest(emit bool) Option {
+	return func(b *Build) error {
+		b.EmitApkManifest = emit
+		return nil
+	}
+}
+
+// WithDetectCaseCollisions sets how paths of a package which collide on
+// case-insensitive filesystems are reported: "" (not checked),
+// CaseCollisionsWarn or CaseCollisionsError.
+func WithDetectCaseCollisions(mode string) Option {
+	return func(b *Build) error {
+		switch mode {
+		case "", CaseCollisionsWarn, CaseCollisionsError:
+			b.DetectCaseCollisions = mode
+			return nil
+		default:
+			return fmt.Errorf("unknown case collision mode %q, expected %q or %q", mode, CaseCollisionsWarn, CaseCollisionsError)
+		}
+	}
+}
+
+// WithBuildDateSource sets where the build date recorded in packages comes
+// from: BuildDateSourceEpoch (the default), BuildDateSourceReleaseDate, or an
+// RFC3339 timestamp.
+func WithBuildDateSource(source string) Option {
+	return func(b *Build) error {
+		b.BuildDateSource = source
+		return nil
+	}
+}
+
+// WithEmitProvidesMap sets whether the names offered by the packages are
+// recorded in provides-map.json in the output directory.
+func WithEmitProvidesMap(emit bool) Option {
+	return func(b *Build) error {
+		b.EmitProvidesMap = emit
+		return nil
+	}
+}
+
+// WithMaxScriptletSize sets the largest size in bytes a scriptlet may have.
+// Zero means no limit.
+func WithMaxScriptletSize(size int64) Option {
+	return func(b *Build) error {
+		b.MaxScriptletSize = size
+		return nil
+	}
+}
+
+// WithProvideMergeStrategy sets how declared and generated provides of the
+// same name are merged: ProvideMergeUnion (the default),
+// ProvideMergeDeclaredWins or ProvideMergeGeneratedWins.
+func WithProvideMergeStrategy(strategy string) Option {
+	return func(b *Build) error {
+		switch strategy {
+		case "", ProvideMergeUnion, ProvideMergeDeclaredWins, ProvideMergeGeneratedWins:
+			b.ProvideMergeStrategy = strategy
+			return nil
+		default:
+			return fmt.Errorf("unknown provide merge strategy %q, expected %q, %q or %q", strategy, ProvideMergeUnion, ProvideMergeDeclaredWins, ProvideMergeGeneratedWins)
+		}
+	}
+}
+
+// WithStrippedOriginMode determines what the origin of a package is set to
+// when origin names are stripped: either the package's own name ("self",
+// the default) or nothing at all ("empty").
+func WithStrippedOriginMode(mode string) Option {
+	return func(b *Build) error {
+		switch mode {
+		case "", StrippedOriginSelf, StrippedOriginEmpty:
+			b.StrippedOriginMode = mode
+			return nil
+		default:
+			return fmt.Errorf("unknown stripped origin mode %q, expected %q or %q", mode, StrippedOriginSelf, StrippedOriginEmpty)
+		}
+	}
+}
+
 // WithEnvFile specifies an environment file to use to preload the build
 // environment.  It should contain the CFLAGS and LDFLAGS used by the C
 // toolchain as well as any other desired environment settings for the
@@ -350,3 +1174,32 @@ func WithExtraPackages(extraPackages []string) Option {
 		return nil
 	}
 }
+
+// WithCompressionPool sets a compression worker pool which bounds the number of
+// concurrent compression workers used when emitting packages.  The same pool
+// may be passed to several builds to bound their combined CPU use.
+func WithCompressionPool(pool *CompressionPool) Option {
+	return func(b *Build) error {
+		b.CompressionPool = pool
+		return nil
+	}
+}
+
+// WithVerifyInputSignatures sets whether the signatures of the packages
+// installed into the build environment are verified against the input
+// keyring before running the pipelines.
+func WithVerifyInputSignatures(verify bool) Option {
+	return func(b *Build) error {
+		b.VerifyInputSignatures = verify
+		return nil
+	}
+}
+
+// WithVerifyInputKeyring sets the public keys the packages installed into
+// the build environment must be signed by.  See Build.VerifyInputKeyring.
+func WithVerifyInputKeyring(keys []string) Option {
+	return func(b *Build) error {
+		b.VerifyInputKeyring = keys
+		return nil
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// additionalPackageDir returns the directory within the additional output
+// directory root which the package is written to, laid out as OutDir is.
+func (pc *PackageBuild) additionalPackageDir(root string) string {
+	dir := filepath.Join(root, pc.Arch)
+	if pc.Build.GroupByOrigin {
+		dir = filepath.Join(dir, pc.OriginName)
+	}
+	return dir
+}
+
+// emitAdditionalOutDirs places the package, and the files written next to
+// it, in each of the additional output directories.
+func (pc *PackageBuild) emitAdditionalOutDirs(ctx context.Context) error {
+	log := clog.FromContext(ctx)
+
+	entries, err := os.ReadDir(pc.OutDir)
+	if err != nil {
+		return fmt.Errorf("unable to list output directory: %w", err)
+	}
+	files := []string{}
+	for _, ent := range entries {
+		if !ent.IsDir() && strings.HasPrefix(ent.Name(), pc.Identity()+".") {
+			files = append(files, ent.Name())
+		}
+	}
+
+	for _, root := range pc.Build.AdditionalOutDirs {
+		dir := pc.additionalPackageDir(root)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("unable to create output directory: %w", err)
+		}
+
+		for _, name := range files {
+			dst := filepath.Join(dir, name)
+			if err := pc.retryOutputWrite(ctx, "writing "+dst, func() error {
+				return linkOrCopy(filepath.Join(pc.OutDir, name), dst)
+			}); err != nil {
+				return fmt.Errorf("unable to write %s: %w", dst, err)
+			}
+		}
+
+		log.Infof("wrote %s to %s", pc.Identity(), dir)
+	}
+
+	return nil
+}
+
+// linkOrCopy replaces dst with a hard link to the file src refers to, or a
+// copy of it if they are on different filesystems.
+func linkOrCopy(src, dst string) error {
+	src, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,102 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdditionalOutDirs(t *testing.T) {
+	ctx := context.Background()
+	extra := t.TempDir()
+	pc := testPackageBuilder(t, &Build{
+		AdditionalOutDirs: []string{extra},
+		EmitFileChecksums: true,
+	})()
+
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	for _, name := range []string{pc.Identity() + ".apk", pc.Identity() + ".filesums.json"} {
+		primary, err := os.Stat(filepath.Join(pc.OutDir, name))
+		require.NoError(t, err)
+		additional, err := os.Stat(filepath.Join(extra, "x86_64", name))
+		require.NoError(t, err)
+		// Both are on the same filesystem, so they are linked.
+		require.True(t, os.SameFile(primary, additional), name)
+	}
+
+	// Emitting again replaces the links, leaving the files which were
+	// linked before as they were rather than rewriting them in place.
+	staged := filepath.Join(t.TempDir(), "staged.apk")
+	require.NoError(t, os.Link(filepath.Join(extra, "x86_64", pc.Identity()+".apk"), staged))
+	before, err := os.ReadFile(staged)
+	require.NoError(t, err)
+
+	require.NoError(t, pc.EmitPackage(ctx))
+	require.FileExists(t, filepath.Join(extra, "x86_64", pc.Identity()+".apk"))
+	after, err := os.ReadFile(staged)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+	stagedFi, err := os.Stat(staged)
+	require.NoError(t, err)
+	primary, err := os.Stat(pc.Filename())
+	require.NoError(t, err)
+	require.False(t, os.SameFile(stagedFi, primary))
+}
+
+func Test_writePackageFile_failure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hello-1.0-r0.apk")
+	require.NoError(t, os.WriteFile(path, []byte("previous\n"), 0o644))
+
+	_, err := writePackageFile(path, []io.Reader{
+		strings.NewReader("partial"),
+		iotest.ErrReader(errors.New("boom")),
+	})
+	require.Error(t, err)
+
+	// A failed write leaves the previous file, and no temporary file.
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "previous\n", string(data))
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func Test_linkOrCopy(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	require.NoError(t, os.WriteFile(src, []byte("hello\n"), 0o640))
+	require.NoError(t, os.Symlink("src", filepath.Join(dir, "link")))
+
+	// Links are resolved, so that the file itself is placed.
+	dst := filepath.Join(dir, "dst")
+	require.NoError(t, linkOrCopy(filepath.Join(dir, "link"), dst))
+	fi, err := os.Lstat(dst)
+	require.NoError(t, err)
+	require.True(t, fi.Mode().IsRegular())
+	data, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	require.Equal(t, "hello\n", string(data))
+}
@@ -17,30 +17,39 @@ package build
 import (
 	"bytes"
 	"context"
+
+	//nolint:gosec
+	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"sort"
 	"strings"
+	"testing/fstest"
 	"text/template"
+	"time"
 
 	apko_types "chainguard.dev/apko/pkg/build/types"
 	"sigs.k8s.io/release-utils/version"
 
-	"github.com/klauspost/compress/gzip"
-	"github.com/klauspost/pgzip"
-
 	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/index"
+	"chainguard.dev/melange/pkg/sbom"
 	"chainguard.dev/melange/pkg/sca"
 	"chainguard.dev/melange/pkg/util"
 
 	"github.com/chainguard-dev/clog"
 	"github.com/chainguard-dev/go-apk/pkg/tarball"
+	"github.com/github/go-spdx/v2/spdxexp"
 	"github.com/psanford/memfs"
 	"go.opentelemetry.io/otel"
 )
@@ -79,17 +88,39 @@ type PackageBuild struct {
 	Description    string
 	URL            string
 	Commit         string
+	// The data section compression configured for the package, which
+	// overrides Build.DataCompression when set.
+	Compression string
+	// Result describes the most recently emitted package.
+	Result *EmitResult
+
+	fileChecksums map[string]string
+	contentHash   string
+	// Paths, relative to the root of the package, of the files and
+	// directories melange adds to it, which are owned by root.
+	injected map[string]bool
+	// Problems found by SCA, reported when Build.SCAReport is set.
+	scaFindings []sca.Finding
+	// The final runtime dependencies and provides, split by whether they
+	// were declared or generated.
+	dependencyProvenance DependencyProvenance
+	// The compression of the data section, one of the DataCompression*
+	// constants other than DataCompressionAuto.
+	dataCompression string
+	// The .PKGINFO of the package, for Build.LegacyControlAlias.
+	pkginfo []byte
 }
 
 func pkgFromSub(sub *config.Subpackage) *config.Package {
 	return &config.Package{
-		Name:         sub.Name,
-		Dependencies: sub.Dependencies,
-		Options:      sub.Options,
-		Scriptlets:   sub.Scriptlets,
-		Description:  sub.Description,
-		URL:          sub.URL,
-		Commit:       sub.Commit,
+		Name:            sub.Name,
+		Dependencies:    sub.Dependencies,
+		Options:         sub.Options,
+		Scriptlets:      sub.Scriptlets,
+		Description:     sub.Description,
+		URL:             sub.URL,
+		Commit:          sub.Commit,
+		DataCompression: sub.DataCompression,
 	}
 }
 
@@ -98,23 +129,142 @@ func (pb *PipelineBuild) Emit(ctx context.Context, pkg *config.Package) error {
 		MelangeVersion: version.GetVersionInfo().GitVersion,
 		Build:          pb.Build,
 		Origin:         &pb.Build.Configuration.Package,
-		PackageName:    pkg.Name,
-		OriginName:     pkg.Name,
-		OutDir:         filepath.Join(pb.Build.OutDir, pb.Build.Arch.ToAPK()),
-		Dependencies:   pkg.Dependencies,
-		Arch:           pb.Build.Arch.ToAPK(),
+		PackageName:    pb.Build.emittedName(pkg.Name),
+		OriginName:     pb.Build.originName(pkg),
+		OutDir:         pb.Build.packageDir(pkg),
+		Dependencies:   pb.Build.suffixDependencies(pkg.Dependencies),
+		Arch:           pb.Build.packageArch(pkg),
 		Options:        pkg.Options,
-		Scriptlets:     pkg.Scriptlets,
+		Scriptlets:     pkg.Scriptlets.ForArch(pb.Build.scriptletArch(pkg)),
 		Description:    pkg.Description,
 		URL:            pkg.URL,
 		Commit:         pkg.Commit,
+		Compression:    pkg.DataCompression,
 	}
 
-	if !pb.Build.StripOriginName {
-		pc.OriginName = pc.Origin.Name
+	return pc.EmitPackage(ctx)
+}
+
+// BuildDate returns the build date recorded in the package, which is
+// SourceDateEpoch unless Build.BuildDateSource says otherwise.
+func (pc *PackageBuild) BuildDate() (time.Time, error) {
+	return pc.Build.buildDate()
+}
+
+// originName returns the origin recorded for pkg, which is the configured
+// origin override if any, otherwise the name of the main package unless
+// origin names are stripped.
+func (b *Build) originName(pkg *config.Package) string {
+	if b.Configuration.Package.OriginOverride != "" {
+		return b.Configuration.Package.OriginOverride
 	}
 
-	return pc.EmitPackage(ctx)
+	if !b.StripOriginName {
+		return b.emittedName(b.Configuration.Package.Name)
+	}
+
+	if b.StrippedOriginMode == StrippedOriginEmpty {
+		return ""
+	}
+
+	return b.emittedName(pkg.Name)
+}
+
+// emittedName returns the name the package or subpackage configured as name
+// is emitted as, with PackageNameSuffix appended.
+func (b *Build) emittedName(name string) string {
+	return name + b.PackageNameSuffix
+}
+
+// suffixDependencies returns deps with PackageNameSuffix appended to the
+// names of the runtime dependencies, provides and replaces which refer to
+// packages of this build, so that the flavors of a build depend on each
+// other rather than on another flavor.
+func (b *Build) suffixDependencies(deps config.Dependencies) config.Dependencies {
+	if b.PackageNameSuffix == "" {
+		return deps
+	}
+
+	names := map[string]bool{b.Configuration.Package.Name: true}
+	for _, sp := range b.Configuration.Subpackages {
+		names[sp.Name] = true
+	}
+
+	suffix := func(in []string) []string {
+		if in == nil {
+			return nil
+		}
+		out := make([]string, 0, len(in))
+		for _, dep := range in {
+			name, constraint := dep, ""
+			if i := strings.IndexAny(dep, "=<>~"); i >= 0 {
+				name, constraint = dep[:i], dep[i:]
+			}
+			if names[name] {
+				dep = b.emittedName(name) + constraint
+			}
+			out = append(out, dep)
+		}
+		return out
+	}
+
+	deps.Runtime = suffix(deps.Runtime)
+	deps.Provides = suffix(deps.Provides)
+	deps.Replaces = suffix(deps.Replaces)
+	return deps
+}
+
+// configName returns the name of the package in the configuration, which
+// PackageName extends with Build.PackageNameSuffix.  The workspace of the
+// package is named after it.
+func (pc *PackageBuild) configName() string {
+	if pc.Build == nil {
+		return pc.PackageName
+	}
+	return strings.TrimSuffix(pc.PackageName, pc.Build.PackageNameSuffix)
+}
+
+// noarchArch is the arch of architecture independent packages.
+const noarchArch = "noarch"
+
+// noarch returns true if the package or subpackage named name is
+// architecture independent.
+func (b *Build) noarch(name string) bool {
+	for _, sp := range b.Configuration.Subpackages {
+		if sp.Name == name {
+			return sp.NoArch
+		}
+	}
+	return false
+}
+
+// packageArch returns the arch of pkg: noarch if it is architecture
+// independent, and the arch being built otherwise.
+func (b *Build) packageArch(pkg *config.Package) string {
+	if b.noarch(pkg.Name) {
+		return noarchArch
+	}
+	return b.apkArch()
+}
+
+// scriptletArch returns the architecture whose scriptlets apply to pkg.  It
+// is the architecture being built, before any alias, and noarch packages have
+// no architecture-specific scriptlets.
+func (b *Build) scriptletArch(pkg *config.Package) string {
+	if b.noarch(pkg.Name) {
+		return noarchArch
+	}
+	return b.Arch.ToAPK()
+}
+
+// packageDir returns the directory pkg is written to: OutDir/<arch>, or
+// OutDir/<arch>/<origin> when packages are grouped by origin.
+func (b *Build) packageDir(pkg *config.Package) string {
+	dir := filepath.Join(b.OutDir, b.packageArch(pkg))
+	if b.GroupByOrigin {
+		dir = filepath.Join(dir, b.originName(pkg))
+	}
+	return dir
 }
 
 // AppendBuildLog will create or append a list of packages that were built by melange build
@@ -130,8 +280,18 @@ func (pc *PackageBuild) AppendBuildLog(dir string) error {
 	}
 	defer f.Close()
 
-	// separate with pipe so it is easy to parse
-	_, err = f.WriteString(fmt.Sprintf("%s|%s|%s|%s-r%d\n", pc.Arch, pc.OriginName, pc.PackageName, pc.Origin.Version, pc.Origin.Epoch))
+	// separate with pipe so it is easy to parse; the fields which only
+	// some options add are key=value, so that they may be told apart
+	line := fmt.Sprintf("%s|%s|%s|%s-r%d", pc.Arch, pc.OriginName, pc.PackageName, pc.Origin.Version, pc.Origin.Epoch)
+	if pc.Build.ContentAddressedOutput && pc.Result != nil {
+		// the key of the package in the content addressed store
+		line += "|datahash=" + pc.Result.DataHash
+	}
+	if pc.Build.GroupByOrigin {
+		// the path of the package relative to OutDir
+		line += "|path=" + filepath.Join(pc.Arch, pc.OriginName, filepath.Base(pc.Filename()))
+	}
+	_, err = f.WriteString(line + "\n")
 	return err
 }
 
@@ -140,27 +300,47 @@ func (pc *PackageBuild) Identity() string {
 }
 
 func (pc *PackageBuild) Filename() string {
+	if pc.Build != nil && pc.Build.SingleStream {
+		return fmt.Sprintf("%s/%s%s", pc.OutDir, pc.Identity(), singleStreamExt)
+	}
 	return fmt.Sprintf("%s/%s.apk", pc.OutDir, pc.Identity())
 }
 
 func (pc *PackageBuild) WorkspaceSubdir() string {
-	return filepath.Join(pc.Build.WorkspaceDir, "melange-out", pc.PackageName)
+	return filepath.Join(pc.Build.WorkspaceDir, "melange-out", pc.configName())
 }
 
 var controlTemplate = `# Generated by melange {{.MelangeVersion}}
+{{- if .Build.EmbedBuilderInfo }}
+# melange: {{.MelangeVersion}}
+{{- if .Build.BuilderID }}
+# builder: {{.Build.BuilderID}}
+{{- end }}
+{{- end }}
+{{- if .Build.InputsHash }}
+# inputs = {{.Build.InputsHash}}
+{{- end }}
+{{- if .Build.BuildID }}
+# buildid = {{.Build.BuildID}}
+{{- end }}
+{{- if and .Build.EmbedConfigDigest .Build.ConfigDigest }}
+# configdigest = {{.Build.ConfigDigest}}
+{{- end }}
 pkgname = {{.PackageName}}
 pkgver = {{.Origin.Version}}-r{{.Origin.Epoch}}
 arch = {{.Arch}}
 size = {{.InstalledSize}}
+{{- if .OriginName }}
 origin = {{.OriginName}}
+{{- end }}
 pkgdesc = {{.Description}}
 url = {{.URL}}
 commit = {{.Commit}}
-{{- if ne .Build.SourceDateEpoch.Unix 0 }}
-builddate = {{ .Build.SourceDateEpoch.Unix }}
-{{- end}}
-{{- range $copyright := .Origin.Copyright }}
-license = {{ $copyright.License }}
+{{- with .BuildDate }}{{ if ne .Unix 0 }}
+builddate = {{ .Unix }}
+{{- end}}{{ end }}
+{{- range $license := .Licenses }}
+license = {{ $license }}
 {{- end }}
 {{- range $dep := .Dependencies.Runtime }}
 depend = {{ $dep }}
@@ -168,26 +348,133 @@ depend = {{ $dep }}
 {{- range $dep := .Dependencies.Provides }}
 provides = {{ $dep }}
 {{- end }}
-{{- range $dep := .Dependencies.Replaces }}
+{{- range $dep := .Replaces }}
 replaces = {{ $dep }}
 {{- end }}
+{{- if .ReplacesPriority }}
+replaces_priority = {{ .ReplacesPriority }}
+{{- end }}
 {{- range $dep := .Dependencies.Vendored }}
 # vendored = {{ $dep }}
 {{- end }}
+{{- range $path := .ConfigFiles }}
+# config = {{ $path }}
+{{- end }}
+{{- if .Changelog }}
+# changelog present
+{{- end }}
 {{- if .Dependencies.ProviderPriority }}
 provider_priority = {{ .Dependencies.ProviderPriority }}
 {{- end }}
-{{- if .Scriptlets.Trigger.Paths }}
+{{- if and .Scriptlets.Trigger.Paths (not .Build.StripScriptlets) }}
 triggers = {{ range $item := .Scriptlets.Trigger.Paths }}{{ $item }} {{ end }}
 {{- end }}
 datahash = {{.DataHash}}
 `
 
+// Licenses returns the values of the license lines of the control data,
+// according to the build's LicenseRenderMode.
+func (pc *PackageBuild) Licenses() ([]string, error) {
+	licenses := []string{}
+	for _, cp := range pc.Origin.Copyright {
+		licenses = append(licenses, cp.License)
+	}
+
+	if pc.Build.LicenseRenderMode != LicenseRenderExpression || len(licenses) == 0 {
+		return licenses, nil
+	}
+
+	expr := licenses[0]
+	if len(licenses) > 1 {
+		// Each entry covers its own set of paths, so the package as a
+		// whole is subject to all of them.
+		parts := make([]string, 0, len(licenses))
+		for _, license := range licenses {
+			if strings.Contains(license, " ") {
+				license = "(" + license + ")"
+			}
+			parts = append(parts, license)
+		}
+		expr = strings.Join(parts, " AND ")
+	}
+
+	if valid, bad := spdxexp.ValidateLicenses([]string{expr}); !valid {
+		return nil, fmt.Errorf("license expression %q is invalid: %s", expr, strings.Join(bad, ", "))
+	}
+
+	return []string{expr}, nil
+}
+
 func (pc *PackageBuild) GenerateControlData(w io.Writer) error {
+	var buf bytes.Buffer
 	tmpl := template.New("control")
-	return template.Must(tmpl.Parse(controlTemplate)).Execute(w, pc)
+	if err := template.Must(tmpl.Parse(controlTemplate)).Execute(&buf, pc); err != nil {
+		return err
+	}
+
+	_, err := w.Write(normalizeControlData(buf.Bytes()))
+	return err
+}
+
+// normalizeControlData strips the artifacts the control template can leave
+// behind, so that the same control data always renders the same bytes:
+// line endings are \n, lines have no trailing whitespace, blank lines are
+// dropped and the data ends with exactly one newline.
+func normalizeControlData(data []byte) []byte {
+	var out bytes.Buffer
+	for _, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" {
+			continue
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+// defaultVolatileControlFields are the control fields which legitimately
+// differ between two builds of the same package, unless configured
+// otherwise.
+var defaultVolatileControlFields = []string{"builddate", "commit"}
+
+// CanonicalControlData writes the control data of the package with the
+// values of its volatile fields (Build.VolatileControlFields) blanked, for
+// comparing two builds for reproducibility.  The fields themselves are kept
+// so that a field missing from one build is still a difference.  The
+// control data emitted in the package is unaffected.
+func (pc *PackageBuild) CanonicalControlData(w io.Writer) error {
+	var buf bytes.Buffer
+	if err := pc.GenerateControlData(&buf); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, canonicalizeControl(buf.String(), pc.Build.VolatileControlFields))
+	return err
+}
+
+// canonicalizeControl blanks the values of the volatile fields of the
+// control data, defaulting to defaultVolatileControlFields if nil.
+func canonicalizeControl(data string, volatile []string) string {
+	if volatile == nil {
+		volatile = defaultVolatileControlFields
+	}
+
+	lines := strings.SplitAfter(data, "\n")
+	for i, line := range lines {
+		key, _, ok := strings.Cut(line, " = ")
+		if ok && slices.Contains(volatile, key) {
+			lines[i] = key + " =\n"
+		}
+	}
+
+	return strings.Join(lines, "")
 }
 
+// legacyControlAlias is the extension of the copy of .PKGINFO written next
+// to the package for legacy tooling when LegacyControlAlias is set.
+const legacyControlAlias = ".PKGINFO"
+
 func (pc *PackageBuild) generateControlSection(ctx context.Context) ([]byte, error) {
 	tarctx, err := tarball.NewContext(
 		tarball.WithSourceDateEpoch(pc.Build.SourceDateEpoch),
@@ -205,71 +492,159 @@ func (pc *PackageBuild) generateControlSection(ctx context.Context) ([]byte, err
 		return nil, fmt.Errorf("unable to process control template: %w", err)
 	}
 
+	if err := pc.checkDependencyCount(ctx, controlBuf.Bytes()); err != nil {
+		return nil, err
+	}
+
 	fsys := memfs.New()
 	if err := fsys.WriteFile(".PKGINFO", controlBuf.Bytes(), 0644); err != nil {
 		return nil, fmt.Errorf("unable to build control FS: %w", err)
 	}
 
-	if pc.Scriptlets.Trigger.Script != "" {
-		// #nosec G306 -- scriptlets must be executable
-		if err := fsys.WriteFile(".trigger", []byte(pc.Scriptlets.Trigger.Script), 0755); err != nil {
-			return nil, fmt.Errorf("unable to build control FS: %w", err)
+	pc.pkginfo = bytes.Clone(controlBuf.Bytes())
+
+	if pc.Build.StripScriptlets {
+		if pc.hasScriptlets() {
+			pc.warnf(ctx, "stripping scriptlets from %s, the package may be incomplete if they performed setup", pc.PackageName)
+		}
+	} else {
+		if pc.Build.StrictScriptlets {
+			if err := pc.checkScriptlets(); err != nil {
+				return nil, err
+			}
+		}
+		if err := pc.writeScriptlets(fsys); err != nil {
+			return nil, err
+		}
+		if err := pc.writeGeneratedScriptlets(fsys); err != nil {
+			return nil, err
+		}
+		if pc.Build.ScriptletAccountEnv {
+			if err := pc.writeAccountEnv(fsys); err != nil {
+				return nil, err
+			}
+		}
+		if err := pc.checkScriptletSizes(ctx, fsys); err != nil {
+			return nil, err
 		}
 	}
 
-	if pc.Scriptlets.PreInstall != "" {
-		// #nosec G306 -- scriptlets must be executable
-		if err := fsys.WriteFile(".pre-install", []byte(pc.Scriptlets.PreInstall), 0755); err != nil {
-			return nil, fmt.Errorf("unable to build control FS: %w", err)
-		}
+	var buf bytes.Buffer
+	zw, err := pc.controlCompressor(&buf)
+	if err != nil {
+		return nil, err
 	}
 
-	if pc.Scriptlets.PostInstall != "" {
-		// #nosec G306 -- scriptlets must be executable
-		if err := fsys.WriteFile(".post-install", []byte(pc.Scriptlets.PostInstall), 0755); err != nil {
-			return nil, fmt.Errorf("unable to build control FS: %w", err)
-		}
+	if err := tarctx.WriteTar(ctx, zw, controlFS{fsys}, fsys); err != nil {
+		return nil, fmt.Errorf("unable to write control tarball: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("flushing control section gzip: %w", err)
 	}
 
-	if pc.Scriptlets.PreDeinstall != "" {
-		// #nosec G306 -- scriptlets must be executable
-		if err := fsys.WriteFile(".pre-deinstall", []byte(pc.Scriptlets.PreDeinstall), 0755); err != nil {
-			return nil, fmt.Errorf("unable to build control FS: %w", err)
-		}
+	return buf.Bytes(), nil
+}
+
+// checkDependencyCount enforces Build.MaxDependencies on the depend,
+// provides and replaces lines of the rendered control data, which are
+// already deduplicated.
+func (pc *PackageBuild) checkDependencyCount(ctx context.Context, control []byte) error {
+	limit := pc.Build.MaxDependencies
+	if limit <= 0 {
+		return nil
 	}
 
-	if pc.Scriptlets.PostDeinstall != "" {
-		// #nosec G306 -- scriptlets must be executable
-		if err := fsys.WriteFile(".post-deinstall", []byte(pc.Scriptlets.PostDeinstall), 0755); err != nil {
-			return nil, fmt.Errorf("unable to build control FS: %w", err)
+	counts := map[string]int{}
+	total := 0
+	for _, line := range strings.Split(string(control), "\n") {
+		key, _, _ := strings.Cut(line, " = ")
+		switch key {
+		case "depend", "provides", "replaces":
+			counts[key]++
+			total++
 		}
 	}
+	if total <= limit {
+		return nil
+	}
 
-	if pc.Scriptlets.PreUpgrade != "" {
-		// #nosec G306 -- scriptlets must be executable
-		if err := fsys.WriteFile(".pre-upgrade", []byte(pc.Scriptlets.PreUpgrade), 0755); err != nil {
-			return nil, fmt.Errorf("unable to build control FS: %w", err)
-		}
+	msg := fmt.Sprintf("%s has %d dependency lines (%d depend, %d provides, %d replaces), exceeding the limit of %d", pc.Identity(), total, counts["depend"], counts["provides"], counts["replaces"], limit)
+	if pc.Build.MaxDependenciesWarn {
+		pc.warnf(ctx, "%s", msg)
+		return nil
 	}
+	return errors.New(msg)
+}
+
+// hasScriptlets returns true if the package defines any scriptlets.
+func (pc *PackageBuild) hasScriptlets() bool {
+	sc := pc.Scriptlets
+	return sc.Trigger.Script != "" || len(sc.Trigger.Paths) > 0 ||
+		sc.PreInstall != "" || sc.PostInstall != "" ||
+		sc.PreDeinstall != "" || sc.PostDeinstall != "" ||
+		sc.PreUpgrade != "" || sc.PostUpgrade != ""
+}
 
-	if pc.Scriptlets.PostUpgrade != "" {
+// writeScriptlets adds the package's scriptlets to the control FS, in
+// order of their file names.
+func (pc *PackageBuild) writeScriptlets(fsys *memfs.FS) error {
+	sc := pc.Scriptlets
+	for _, scriptlet := range []struct {
+		file, script string
+	}{
+		{".post-deinstall", sc.PostDeinstall},
+		{".post-install", sc.PostInstall},
+		{".post-upgrade", sc.PostUpgrade},
+		{".pre-deinstall", sc.PreDeinstall},
+		{".pre-install", sc.PreInstall},
+		{".pre-upgrade", sc.PreUpgrade},
+		{".trigger", sc.Trigger.Script},
+	} {
+		if scriptlet.script == "" {
+			continue
+		}
 		// #nosec G306 -- scriptlets must be executable
-		if err := fsys.WriteFile(".post-upgrade", []byte(pc.Scriptlets.PostUpgrade), 0755); err != nil {
-			return nil, fmt.Errorf("unable to build control FS: %w", err)
+		if err := fsys.WriteFile(scriptlet.file, []byte(scriptlet.script), 0755); err != nil {
+			return fmt.Errorf("unable to build control FS: %w", err)
 		}
 	}
 
-	var buf bytes.Buffer
-	zw := gzip.NewWriter(&buf)
+	return nil
+}
 
-	if err := tarctx.WriteTar(ctx, zw, fsys, fsys); err != nil {
-		return nil, fmt.Errorf("unable to write control tarball: %w", err)
+// controlFS lists the files of the control section in its canonical order:
+// .PKGINFO first, then the others, such as the scriptlets, sorted by name.
+// The order of the control tarball therefore depends neither on the order
+// the files were written in nor on the FS holding them.
+type controlFS struct {
+	*memfs.FS
+}
+
+func (c controlFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := c.Open(name)
+	if err != nil {
+		return nil, err
 	}
-	if err := zw.Close(); err != nil {
-		return nil, fmt.Errorf("flushing control section gzip: %w", err)
+	defer f.Close()
+
+	dir, ok := f.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		return nil, err
 	}
 
-	return buf.Bytes(), nil
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i].Name(), entries[j].Name()
+		if (a == ".PKGINFO") != (b == ".PKGINFO") {
+			return a == ".PKGINFO"
+		}
+		return a < b
+	})
+
+	return entries, nil
 }
 
 func (pc *PackageBuild) SignatureName() string {
@@ -298,27 +673,226 @@ func removeSelfProvidedDeps(runtimeDeps, providedDeps []string) []string {
 	return newRuntimeDeps
 }
 
+// pinProvides replaces the version of every provide with version, adding one
+// to provides which have none.
+func pinProvides(provides []string, version string) []string {
+	pinned := make([]string, 0, len(provides))
+	for _, provide := range provides {
+		name := strings.Split(provide, "=")[0]
+		pinned = append(pinned, fmt.Sprintf("%s=%s", name, version))
+	}
+	return pinned
+}
+
+// dropProvidesTypes removes the provides whose type, the part before the
+// colon, is one of types.
+func dropProvidesTypes(provides []string, types []string) []string {
+	if len(types) == 0 {
+		return provides
+	}
+
+	kept := make([]string, 0, len(provides))
+	for _, provide := range provides {
+		typ, _, ok := strings.Cut(provide, ":")
+		if ok && slices.Contains(types, typ) {
+			continue
+		}
+		kept = append(kept, provide)
+	}
+	return kept
+}
+
+// mergeProvides combines the declared and generated provides of a package,
+// deduplicated, according to strategy, one of the ProvideMerge* constants.
+// Provides of the same name whose versions differ are all kept by
+// ProvideMergeUnion (or ""); otherwise only those of the winning side are.
+func mergeProvides(declared, generated []string, strategy string) []string {
+	names := func(provides []string) map[string]bool {
+		m := make(map[string]bool, len(provides))
+		for _, provide := range provides {
+			m[dependencyName(provide)] = true
+		}
+		return m
+	}
+	without := func(provides []string, names map[string]bool) []string {
+		return slices.DeleteFunc(slices.Clone(provides), func(provide string) bool {
+			return names[dependencyName(provide)]
+		})
+	}
+
+	switch strategy {
+	case ProvideMergeDeclaredWins:
+		generated = without(generated, names(declared))
+	case ProvideMergeGeneratedWins:
+		declared = without(declared, names(generated))
+	}
+
+	return util.Dedup(append(slices.Clone(declared), generated...))
+}
+
+// sourceRecordingHandle wraps an SCAHandle in order to collect the files
+// which caused each generated dependency to be emitted, and the problems
+// found in the package.
+type sourceRecordingHandle struct {
+	sca.SCAHandle
+
+	sources  map[string][]string
+	findings []sca.Finding
+}
+
+// RecordFinding implements sca.FindingRecorder.
+func (h *sourceRecordingHandle) RecordFinding(f sca.Finding) {
+	h.findings = append(h.findings, f)
+}
+
+// Strict implements sca.StrictHandle for the wrapped SCAHandle.
+func (h *sourceRecordingHandle) Strict() bool {
+	sh, ok := h.SCAHandle.(sca.StrictHandle)
+	return ok && sh.Strict()
+}
+
+// RecordDiscovery implements sca.DiscoveryRecorder for the wrapped SCAHandle.
+func (h *sourceRecordingHandle) RecordDiscovery(d sca.Discovery) {
+	if dr, ok := h.SCAHandle.(sca.DiscoveryRecorder); ok {
+		dr.RecordDiscovery(d)
+	}
+}
+
+// RecordWarning implements sca.WarningRecorder for the wrapped SCAHandle.
+func (h *sourceRecordingHandle) RecordWarning(msg string) {
+	if wr, ok := h.SCAHandle.(sca.WarningRecorder); ok {
+		wr.RecordWarning(msg)
+	}
+}
+
+// Walked implements sca.WalkedHandle for the wrapped SCAHandle.
+func (h *sourceRecordingHandle) Walked() []sca.WalkedEntry {
+	if wh, ok := h.SCAHandle.(sca.WalkedHandle); ok {
+		return wh.Walked()
+	}
+	return nil
+}
+
+// RecordSource implements sca.SourceRecorder.
+func (h *sourceRecordingHandle) RecordSource(dep, path string) {
+	if h.sources == nil {
+		h.sources = map[string][]string{}
+	}
+
+	h.sources[dep] = append(h.sources[dep], path)
+}
+
+// Sources returns the files which caused each generated dependency, sorted
+// and deduplicated.
+func (h *sourceRecordingHandle) Sources() map[string][]string {
+	sources := make(map[string][]string, len(h.sources))
+	for dep, paths := range h.sources {
+		paths = util.Dedup(paths)
+		sort.Strings(paths)
+		sources[dep] = paths
+	}
+
+	return sources
+}
+
+// DependencySet is a set of runtime dependencies and provides.
+type DependencySet struct {
+	Runtime  []string `json:"runtime,omitempty"`
+	Provides []string `json:"provides,omitempty"`
+}
+
+// DependencyProvenance splits the final runtime dependencies and provides of
+// a package by where they came from.
+type DependencyProvenance struct {
+	// Declared are those configured for the package.
+	Declared DependencySet `json:"declared"`
+	// Generated are those discovered by SCA which were not also declared.
+	Generated DependencySet `json:"generated"`
+}
+
+// splitProvenance divides deps into those in declared and the others.
+func splitProvenance(deps, declared []string) (fromDeclared, fromGenerated []string) {
+	for _, dep := range deps {
+		if slices.Contains(declared, dep) {
+			fromDeclared = append(fromDeclared, dep)
+		} else {
+			fromGenerated = append(fromGenerated, dep)
+		}
+	}
+	return fromDeclared, fromGenerated
+}
+
+// dependencyLogEntry is the structure written to the dependency log.  It
+// extends the generated dependencies with the files which caused them.
+type dependencyLogEntry struct {
+	config.Dependencies
+
+	// Sources maps each generated dependency to the files responsible for it.
+	Sources map[string][]string `json:"sources,omitempty"`
+	// Provenance splits the final dependencies of the package into those
+	// which were declared and those which were generated.
+	Provenance DependencyProvenance `json:"provenance"`
+}
+
+// sorted returns a copy of the entry with its dependencies sorted, so that
+// the dependency log does not depend on the order they were found in.
+func (e dependencyLogEntry) sorted() dependencyLogEntry {
+	sortedCopy := func(deps []string) []string {
+		deps = slices.Clone(deps)
+		sort.Strings(deps)
+		return deps
+	}
+
+	e.Runtime = sortedCopy(e.Runtime)
+	e.Provides = sortedCopy(e.Provides)
+	e.Replaces = sortedCopy(e.Replaces)
+	e.Vendored = sortedCopy(e.Vendored)
+	e.Provenance.Declared.Runtime = sortedCopy(e.Provenance.Declared.Runtime)
+	e.Provenance.Declared.Provides = sortedCopy(e.Provenance.Declared.Provides)
+	e.Provenance.Generated.Runtime = sortedCopy(e.Provenance.Generated.Runtime)
+	e.Provenance.Generated.Provides = sortedCopy(e.Provenance.Generated.Provides)
+	return e
+}
+
 func (pc *PackageBuild) GenerateDependencies(ctx context.Context, hdl sca.SCAHandle) error {
 	log := clog.FromContext(ctx)
 	generated := config.Dependencies{}
 
-	if err := sca.Analyze(ctx, hdl, &generated); err != nil {
+	rec := &sourceRecordingHandle{SCAHandle: hdl}
+	if err := sca.Analyze(ctx, rec, &generated); err != nil {
 		return fmt.Errorf("analyzing package: %w", err)
 	}
 
-	if pc.Build.DependencyLog != "" {
-		log.Info("writing dependency log")
+	for _, f := range rec.findings {
+		pc.warnf(ctx, "%s has %s %s, which refers to the build environment", f.Path, f.Kind, f.Value)
+	}
+	pc.scaFindings = rec.findings
 
-		logFile, err := os.Create(fmt.Sprintf("%s.%s", pc.Build.DependencyLog, pc.Arch))
-		if err != nil {
-			log.Warnf("Unable to open dependency log: %v", err)
-		}
-		defer logFile.Close()
+	generated.Provides = dropProvidesTypes(generated.Provides, pc.Options.NoProvidesTypes)
 
-		je := json.NewEncoder(logFile)
-		if err := je.Encode(&generated); err != nil {
-			return err
-		}
+	if pc.Build.NormalizeDepOperators {
+		pc.Dependencies.Runtime = normalizeDeps(pc.Dependencies.Runtime)
+		pc.Dependencies.Provides = normalizeDeps(pc.Dependencies.Provides)
+		generated.Runtime = normalizeDeps(generated.Runtime)
+		generated.Provides = normalizeDeps(generated.Provides)
+	}
+
+	if rewrite := pc.Build.DepNameRewrite; rewrite != nil {
+		pc.Dependencies.Runtime = rewriteDepNames(pc.Dependencies.Runtime, rewrite)
+		pc.Dependencies.Provides = rewriteDepNames(pc.Dependencies.Provides, rewrite)
+		pc.Dependencies.Replaces = rewriteDepNames(pc.Dependencies.Replaces, rewrite)
+		generated.Runtime = rewriteDepNames(generated.Runtime, rewrite)
+		generated.Provides = rewriteDepNames(generated.Provides, rewrite)
+		generated.Vendored = rewriteDepNames(generated.Vendored, rewrite)
+	}
+
+	declared := DependencySet{
+		Runtime:  slices.Clone(pc.Dependencies.Runtime),
+		Provides: slices.Clone(pc.Dependencies.Provides),
+	}
+
+	if pc.Build.PinProvidesToPackageVersion {
+		generated.Provides = pinProvides(generated.Provides, fmt.Sprintf("%s-r%d", pc.Origin.Version, pc.Origin.Epoch))
 	}
 
 	// Only consider vendored deps for self-provided generated runtime deps.
@@ -330,14 +904,53 @@ func (pc *PackageBuild) GenerateDependencies(ctx context.Context, hdl sca.SCAHan
 	newruntime := append(pc.Dependencies.Runtime, unvendored...)
 	pc.Dependencies.Runtime = util.Dedup(newruntime)
 
-	newprovides := append(pc.Dependencies.Provides, generated.Provides...)
-	pc.Dependencies.Provides = util.Dedup(newprovides)
+	pc.Dependencies.Provides = mergeProvides(pc.Dependencies.Provides, generated.Provides, pc.Build.ProvideMergeStrategy)
 
 	pc.Dependencies.Runtime = removeSelfProvidedDeps(pc.Dependencies.Runtime, pc.Dependencies.Provides)
 
+	if pc.Build.NormalizeDepOperators {
+		pc.Dependencies.Provides = sortProvides(pc.Dependencies.Provides)
+	}
+
 	// Sets .PKGINFO `# vendored = ...` comments; does not affect resolution.
 	pc.Dependencies.Vendored = util.Dedup(generated.Vendored)
 
+	prov := &pc.dependencyProvenance
+	prov.Declared.Runtime, prov.Generated.Runtime = splitProvenance(pc.Dependencies.Runtime, declared.Runtime)
+	prov.Declared.Provides, prov.Generated.Provides = splitProvenance(pc.Dependencies.Provides, declared.Provides)
+
+	if pc.Build.DependencyLog != "" {
+		log.Info("writing dependency log")
+
+		entry := dependencyLogEntry{
+			Dependencies: generated,
+			Sources:      rec.Sources(),
+			Provenance:   pc.dependencyProvenance,
+		}.sorted()
+
+		if pc.Build.MergedDependencyLog {
+			if err := writeMergedDependencyLog(pc.Build.DependencyLog, pc.Arch, pc.PackageName, entry); err != nil {
+				return err
+			}
+		} else {
+			logFile, err := os.Create(fmt.Sprintf("%s.%s", pc.Build.DependencyLog, pc.Arch))
+			if err != nil {
+				log.Warnf("Unable to open dependency log: %v", err)
+			}
+			defer logFile.Close()
+
+			je := json.NewEncoder(logFile)
+			if err := je.Encode(&entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	if pc.Build.WarnIsolatedPackages && !pc.Options.NoProvides &&
+		len(pc.Dependencies.Runtime) == 0 && len(pc.Dependencies.Provides) == 0 {
+		pc.warnf(ctx, "%s depends on nothing and provides nothing, check that the build installed its files", pc.PackageName)
+	}
+
 	pc.Dependencies.Summarize(ctx)
 
 	return nil
@@ -353,55 +966,424 @@ func combine(out io.Writer, inputs ...io.Reader) error {
 	return nil
 }
 
-// TODO(kaniini): generate APKv3 packages
-func (pc *PackageBuild) calculateInstalledSize(fsys fs.FS) error {
-	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-
-		fi, err := d.Info()
-		if err != nil {
-			return err
-		}
+// forkReplacesPriority is the replaces_priority of packages which replace
+// the packages they were forked from, unless one is configured, so that
+// their files win over the upstream package's.
+const forkReplacesPriority = 100
 
-		pc.InstalledSize += fi.Size()
+// forkReplaces returns the names of the packages the origin package was
+// forked from.  Subpackages have none.
+func (pc *PackageBuild) forkReplaces() []string {
+	if pc.Origin == nil || pc.configName() != pc.Origin.Name {
 		return nil
-	}); err != nil {
-		return fmt.Errorf("unable to preprocess package data: %w", err)
 	}
-
-	return nil
+	return pc.Origin.ForkReplaces
 }
 
-func (pc *PackageBuild) emitDataSection(ctx context.Context, fsys fs.FS, userinfofs fs.FS, remapUIDs map[int]int, remapGIDs map[int]int, w io.WriteSeeker) error {
-	log := clog.FromContext(ctx)
-	tarctx, err := tarball.NewContext(
-		tarball.WithSourceDateEpoch(pc.Build.SourceDateEpoch),
-		tarball.WithRemapUIDs(remapUIDs),
-		tarball.WithRemapGIDs(remapGIDs),
-		tarball.WithUseChecksums(true),
-	)
-	if err != nil {
-		return fmt.Errorf("unable to build tarball context: %w", err)
+// Replaces returns the values of the replaces lines of the control data:
+// the configured replaces, followed by every version of each forked package
+// below this package's version.
+func (pc *PackageBuild) Replaces() []string {
+	replaces := append([]string{}, pc.Dependencies.Replaces...)
+	for _, name := range pc.forkReplaces() {
+		replaces = append(replaces, fmt.Sprintf("%s<%s-r%d", name, pc.Origin.Version, pc.Origin.Epoch))
 	}
+	return replaces
+}
 
-	digest := sha256.New()
-	mw := io.MultiWriter(digest, w)
-	zw := pgzip.NewWriter(mw)
-	if err := zw.SetConcurrency(1<<20, pgzipThreads); err != nil {
-		return fmt.Errorf("tried to set pgzip concurrency to %d: %w", pgzipThreads, err)
+// ReplacesPriority returns the replaces_priority of the control data.
+func (pc *PackageBuild) ReplacesPriority() int {
+	if pc.Dependencies.ReplacesPriority == 0 && len(pc.forkReplaces()) > 0 {
+		return forkReplacesPriority
 	}
+	return pc.Dependencies.ReplacesPriority
+}
 
-	if err := tarctx.WriteTar(ctx, zw, fsys, userinfofs); err != nil {
-		return fmt.Errorf("unable to write data tarball: %w", err)
+// PreserveOwnership returns the path globs, relative to the root of the
+// package, of files which keep the ownership they have in the workspace
+// rather than having the build user remapped to root.
+func (pc *PackageBuild) PreserveOwnership() []string {
+	if pc.Origin == nil || pc.configName() != pc.Origin.Name {
+		return nil
 	}
 
-	if err := zw.Close(); err != nil {
-		return fmt.Errorf("flushing data section gzip: %w", err)
+	patterns := []string{}
+	for _, pattern := range pc.Origin.PreserveOwnership {
+		patterns = append(patterns, strings.TrimPrefix(pattern, "/"))
 	}
 
-	pc.DataHash = hex.EncodeToString(digest.Sum(nil))
+	return patterns
+}
+
+// ConfigFiles returns the paths, relative to the package root, of the
+// configuration files of the origin package.  Subpackages have none.
+func (pc *PackageBuild) ConfigFiles() []string {
+	if pc.Origin == nil || pc.configName() != pc.Origin.Name {
+		return nil
+	}
+
+	files := []string{}
+	for _, file := range pc.Origin.ConfigFiles {
+		files = append(files, strings.TrimPrefix(file, "/"))
+	}
+	sort.Strings(files)
+
+	return files
+}
+
+// writeProtectedPaths marks the configuration files of the package as
+// protected by adding etc/apk/protected_paths.d/<name>.list to it.  apk
+// does not overwrite modified protected files on upgrade, instead writing
+// the packaged version next to them as <file>.apk-new.
+func (pc *PackageBuild) writeProtectedPaths() error {
+	files := pc.ConfigFiles()
+	if len(files) == 0 {
+		return nil
+	}
+
+	var list bytes.Buffer
+	for _, file := range files {
+		if _, err := os.Lstat(filepath.Join(pc.WorkspaceSubdir(), file)); err != nil {
+			return fmt.Errorf("config file %s is not in %s: %w", file, pc.PackageName, err)
+		}
+		fmt.Fprintf(&list, "+%s\n", file)
+	}
+
+	if err := pc.injectFile(path.Join("etc", "apk", "protected_paths.d", pc.PackageName+".list"), list.Bytes()); err != nil {
+		return fmt.Errorf("unable to write protected paths: %w", err)
+	}
+
+	return nil
+}
+
+// Changelog returns the path, relative to the root of the package, at which
+// the changelog of the origin package is shipped, or "" if it has none.
+func (pc *PackageBuild) Changelog() string {
+	if pc.Origin == nil || pc.configName() != pc.Origin.Name || pc.Origin.Changelog == nil {
+		return ""
+	}
+
+	return path.Join("usr", "share", "doc", pc.PackageName, "changelog")
+}
+
+// writeChangelog adds the configured changelog to the package.
+func (pc *PackageBuild) writeChangelog() error {
+	dest := pc.Changelog()
+	if dest == "" {
+		return nil
+	}
+
+	data := []byte(pc.Origin.Changelog.Contents)
+	if file := pc.Origin.Changelog.File; file != "" {
+		var err error
+		if data, err = os.ReadFile(filepath.Join(pc.Build.SourceDir, file)); err != nil {
+			return fmt.Errorf("unable to read changelog: %w", err)
+		}
+	}
+
+	if err := pc.injectFile(dest, data); err != nil {
+		return fmt.Errorf("unable to write changelog: %w", err)
+	}
+
+	return nil
+}
+
+// readConfigFile reads the configuration file for EmbedConfigDigest and
+// EmbedConfigFile.
+func (b *Build) readConfigFile() error {
+	data, err := os.ReadFile(b.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("unable to read configuration file: %w", err)
+	}
+
+	sum := sha256.Sum256(data)
+	b.ConfigDigest = hex.EncodeToString(sum[:])
+	b.configData = data
+
+	return nil
+}
+
+// writeEmbeddedConfig adds the configuration file to the package as
+// usr/share/melange/<name>.yaml, if EmbedConfigFile is set.
+func (pc *PackageBuild) writeEmbeddedConfig() error {
+	if !pc.Build.EmbedConfigFile {
+		return nil
+	}
+
+	if err := pc.injectFile(path.Join("usr", "share", "melange", pc.PackageName+".yaml"), pc.Build.configData); err != nil {
+		return fmt.Errorf("unable to write embedded configuration: %w", err)
+	}
+
+	return nil
+}
+
+// defaultInjectedFileMode is the mode of the files melange adds to
+// packages, unless configured otherwise.
+const defaultInjectedFileMode = 0o644
+
+// injectedFileMode returns the mode of the files melange adds to packages.
+func (b *Build) injectedFileMode() os.FileMode {
+	if b.InjectedFileMode == 0 {
+		return defaultInjectedFileMode
+	}
+	return b.InjectedFileMode.Perm()
+}
+
+// injectFile writes data to the file at rel, relative to the root of the
+// package, creating its parent directories as needed.  The file, and the
+// directories it creates, are recorded so that they are owned by root in
+// the data section regardless of the user melange runs as, and so that the
+// file has the mode Build.InjectedFileMode.
+func (pc *PackageBuild) injectFile(rel string, data []byte) error {
+	if pc.injected == nil {
+		pc.injected = map[string]bool{}
+	}
+
+	created := []string{}
+	for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+		if _, err := os.Lstat(filepath.Join(pc.WorkspaceSubdir(), dir)); err == nil || pc.injected[dir] {
+			break
+		}
+		created = append(created, dir)
+	}
+
+	if err := os.MkdirAll(filepath.Join(pc.WorkspaceSubdir(), path.Dir(rel)), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(pc.WorkspaceSubdir(), rel), data, pc.Build.injectedFileMode()); err != nil {
+		return err
+	}
+
+	for _, dir := range created {
+		pc.injected[dir] = true
+	}
+	pc.injected[rel] = true
+
+	return nil
+}
+
+// sbomDir is the directory of the package the SBOMs of the package are
+// written to, relative to its root.
+const sbomDir = "var/lib/db/sbom"
+
+// recordInjectedSBOMs records the SBOMs written into the package before
+// it is emitted, so that they are owned and have the same mode as the other
+// files melange adds to it.
+func (pc *PackageBuild) recordInjectedSBOMs() error {
+	ents, err := os.ReadDir(filepath.Join(pc.WorkspaceSubdir(), sbomDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to read SBOM directory: %w", err)
+	}
+
+	prefix := fmt.Sprintf("%s-%s-r%d.", pc.PackageName, pc.Origin.Version, pc.Origin.Epoch)
+	for _, ent := range ents {
+		if !ent.Type().IsRegular() || !strings.HasPrefix(ent.Name(), prefix) || !strings.HasSuffix(ent.Name(), ".json") {
+			continue
+		}
+		if pc.injected == nil {
+			pc.injected = map[string]bool{}
+		}
+		pc.injected[path.Join(sbomDir, ent.Name())] = true
+	}
+
+	return nil
+}
+
+// refreshSBOMs writes the SBOMs of the package again with the runtime
+// dependencies generated for it, which are not known when the build first
+// writes them, and updates their entries in walked.
+func (pc *PackageBuild) refreshSBOMs(ctx context.Context, fsys fs.FS, walked []sca.WalkedEntry) error {
+	spec, ok := pc.Build.sbomSpecs[pc.PackageName]
+	if !ok {
+		return nil
+	}
+
+	refreshed := *spec
+	refreshed.Dependencies = pc.Dependencies.Runtime
+	if err := sbom.NewGenerator().GenerateSBOM(ctx, &refreshed); err != nil {
+		return fmt.Errorf("writing SBOMs: %w", err)
+	}
+
+	for i, we := range walked {
+		if path.Dir(we.Path) != sbomDir || !pc.injected[we.Path] {
+			continue
+		}
+		fi, err := fs.Stat(fsys, we.Path)
+		if err != nil {
+			return fmt.Errorf("unable to preprocess package data: %w", err)
+		}
+		walked[i].Entry = fs.FileInfoToDirEntry(fi)
+	}
+
+	return nil
+}
+
+// checkInstalledSize fails if the installed size of the origin package falls
+// outside the bounds set in its configuration.
+func (pc *PackageBuild) checkInstalledSize() error {
+	if pc.Origin == nil || pc.configName() != pc.Origin.Name {
+		return nil
+	}
+
+	if limit := pc.Origin.MaxInstalledSize; limit > 0 && pc.InstalledSize > limit {
+		return fmt.Errorf("installed size of %s is %d bytes, exceeding the maximum of %d bytes", pc.Identity(), pc.InstalledSize, limit)
+	}
+
+	if limit := pc.Origin.MinInstalledSize; limit > 0 && pc.InstalledSize < limit {
+		return fmt.Errorf("installed size of %s is %d bytes, below the minimum of %d bytes", pc.Identity(), pc.InstalledSize, limit)
+	}
+
+	return nil
+}
+
+// walkPackage walks fsys, loading the info of each entry once, so that the
+// installed size and SCA are computed from a single walk of the package.
+func walkPackage(fsys fs.FS) ([]sca.WalkedEntry, error) {
+	walked := []sca.WalkedEntry{}
+	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		walked = append(walked, sca.WalkedEntry{Path: path, Entry: fs.FileInfoToDirEntry(fi)})
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("unable to preprocess package data: %w", err)
+	}
+
+	return walked, nil
+}
+
+// TODO(kaniini): generate APKv3 packages
+func (pc *PackageBuild) calculateInstalledSize(fsys fs.FS) error {
+	walked, err := walkPackage(fsys)
+	if err != nil {
+		return err
+	}
+
+	return pc.addInstalledSize(walked)
+}
+
+// addInstalledSize adds the sizes of the walked entries to InstalledSize.
+func (pc *PackageBuild) addInstalledSize(walked []sca.WalkedEntry) error {
+	for _, we := range walked {
+		fi, err := we.Entry.Info()
+		if err != nil {
+			return fmt.Errorf("unable to preprocess package data: %w", err)
+		}
+
+		pc.InstalledSize += fi.Size()
+	}
+
+	return nil
+}
+
+// writeDataTar writes the uncompressed data section to w, passing it
+// through the package's data filters.
+func (pc *PackageBuild) writeDataTar(ctx context.Context, w io.Writer, fsys fs.FS, userinfofs fs.FS, remapUIDs map[int]int, remapGIDs map[int]int) error {
+	tarctx, err := tarball.NewContext(
+		tarball.WithSourceDateEpoch(pc.Build.SourceDateEpoch),
+		tarball.WithRemapUIDs(remapUIDs),
+		tarball.WithRemapGIDs(remapGIDs),
+		tarball.WithUseChecksums(true),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to build tarball context: %w", err)
+	}
+
+	filters, err := pc.dataFilters(fsys, userinfofs)
+	if err != nil {
+		return fmt.Errorf("unable to configure data filters: %w", err)
+	}
+
+	var dirs *dirEntries
+	if pc.Build.ExplicitDirEntries {
+		dirs = newDirEntries(pc.Build.SourceDateEpoch)
+	}
+
+	if len(filters) == 0 && !pc.Build.PreserveSparse && dirs == nil {
+		if err := tarctx.WriteTar(ctx, w, fsys, userinfofs); err != nil {
+			return fmt.Errorf("unable to write data tarball: %w", err)
+		}
+		return nil
+	}
+
+	var createSpool func() (*os.File, error)
+	if pc.Build.PreserveSparse {
+		createSpool = func() (*os.File, error) {
+			return pc.Build.createTemp("melange-sparse-*", pc.tempKey())
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(tarctx.WriteTar(ctx, pw, fsys, userinfofs))
+	}()
+
+	if err := filterTar(w, pr, filters, createSpool, dirs); err != nil {
+		pr.CloseWithError(err)
+		return fmt.Errorf("unable to write data tarball: %w", err)
+	}
+
+	return nil
+}
+
+// ComputeDataHash returns the hex-encoded sha256 of the uncompressed data
+// section which would be emitted for fsys, without compressing or writing
+// it.  This is a content hash, which is not the same as DataHash: the
+// datahash recorded in .PKGINFO is computed over the gzipped data section,
+// so it also depends on the compressor.  The content hash of an emitted
+// package is reported as EmitResult.ContentHash for comparison.
+func (pc *PackageBuild) ComputeDataHash(ctx context.Context, fsys fs.FS, remapUIDs map[int]int, remapGIDs map[int]int) (string, error) {
+	digest := sha256.New()
+	if err := pc.writeDataTar(ctx, digest, fsys, os.DirFS(pc.Build.GuestDir), remapUIDs, remapGIDs); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+func (pc *PackageBuild) emitDataSection(ctx context.Context, fsys fs.FS, userinfofs fs.FS, remapUIDs map[int]int, remapGIDs map[int]int, w io.WriteSeeker) error {
+	log := clog.FromContext(ctx)
+
+	releaseBudget, err := pc.Build.emitBudget.acquire(ctx, pc.InstalledSize)
+	if err != nil {
+		return fmt.Errorf("waiting for emit memory budget: %w", err)
+	}
+	defer releaseBudget()
+
+	digest := sha256.New()
+	zw, release, err := pc.dataCompressor(ctx, io.MultiWriter(digest, w))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	sums := newChecksumCollector()
+	defer sums.pw.Close()
+	contentDigest := sha256.New()
+
+	if err := pc.writeDataTar(ctx, io.MultiWriter(zw, sums, contentDigest), fsys, userinfofs, remapUIDs, remapGIDs); err != nil {
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("flushing data section gzip: %w", err)
+	}
+
+	if pc.fileChecksums, err = sums.Close(); err != nil {
+		return fmt.Errorf("unable to collect file checksums: %w", err)
+	}
+
+	pc.DataHash = hex.EncodeToString(digest.Sum(nil))
+	pc.contentHash = hex.EncodeToString(contentDigest.Sum(nil))
 	log.Infof("  data.tar.gz digest: %s", pc.DataHash)
 
 	if _, err := w.Seek(0, io.SeekStart); err != nil {
@@ -411,51 +1393,248 @@ func (pc *PackageBuild) emitDataSection(ctx context.Context, fsys fs.FS, userinf
 	return nil
 }
 
+// resolvePath returns the absolute, symlink-resolved form of path.  Path
+// components which do not exist yet are appended verbatim to the resolved
+// form of their nearest existing ancestor.
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	rest := ""
+	for dir := abs; ; dir = filepath.Dir(dir) {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) || dir == filepath.Dir(dir) {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+	}
+}
+
+// isSubpath returns true if path is equal to or nested inside of base,
+// after resolving symlinks and relative components of both.
+func isSubpath(base, path string) (bool, error) {
+	resolvedBase, err := resolvePath(base)
+	if err != nil {
+		return false, err
+	}
+
+	resolvedPath, err := resolvePath(path)
+	if err != nil {
+		return false, err
+	}
+
+	rel, err := filepath.Rel(resolvedBase, resolvedPath)
+	if err != nil {
+		return false, nil
+	}
+
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, "../")), nil
+}
+
+// checkOutDir ensures that the output directory does not live inside of the
+// workspace.  Otherwise, emitted packages would be picked up by the file walk
+// of any package emitted afterwards.
+func (pc *PackageBuild) checkOutDir() error {
+	if pc.Build.WorkspaceDir == "" {
+		return nil
+	}
+
+	inside, err := isSubpath(pc.Build.WorkspaceDir, pc.OutDir)
+	if err != nil {
+		return fmt.Errorf("unable to resolve output directory: %w", err)
+	}
+
+	if inside {
+		return fmt.Errorf("output directory %s must not be inside of the workspace directory %s", pc.OutDir, pc.Build.WorkspaceDir)
+	}
+
+	return nil
+}
+
+// wantSignature returns whether the package is signed: when a signing key
+// is given, unless the package opts out with SkipSignature.
 func (pc *PackageBuild) wantSignature() bool {
+	if pc.Origin != nil && pc.configName() == pc.Origin.Name && pc.Origin.SkipSignature {
+		return false
+	}
 	return pc.Build.SigningKey != ""
 }
 
-func (pc *PackageBuild) EmitPackage(ctx context.Context) error {
+// indexSigningKey returns the key indexes are signed with: IndexSigningKey
+// if set, and otherwise SigningKey.
+func (b *Build) indexSigningKey() string {
+	if b.IndexSigningKey != "" {
+		return b.IndexSigningKey
+	}
+	return b.SigningKey
+}
+
+// indexSigningPassphrase returns the passphrase of the key indexes are
+// signed with, which is SigningPassphrase only if that key is SigningKey.
+func (b *Build) indexSigningPassphrase() string {
+	if b.indexSigningKey() != b.SigningKey {
+		return ""
+	}
+	return b.SigningPassphrase
+}
+
+// EmitResult describes a package assembled by EmitPackage or
+// EmitPackageReader.
+type EmitResult struct {
+	// Identity is the name-version-release of the package.
+	Identity string
+	// DataHash is the hex-encoded sha256 of the data section.
+	DataHash string
+	// ContentHash is the hex-encoded sha256 of the uncompressed data
+	// section, as computed by ComputeDataHash.  Unlike DataHash, it does
+	// not depend on the compressor.
+	ContentHash string
+	// ControlHash is the hex-encoded sha1 of the control section, which is
+	// also the apk's checksum in an APKINDEX.
+	ControlHash string
+	// InstalledSize is the size of the package contents once installed.
+	InstalledSize int64
+	// Size is the size in bytes of the final apk.
+	Size int64
+	// Digest is the hex-encoded sha256 of the final apk.  It is only known
+	// once the apk has been written, so EmitPackageReader leaves it empty.
+	Digest string
+	// Signed is true if a signature section was prepended to the apk.
+	Signed bool
+	// Changed is true unless the data section matches the package's
+	// baseline DataHash (see Build.BaselineDataHashes).  As the data
+	// section excludes the build date, rebuilds of identical content are
+	// not reported as changed.
+	Changed bool
+	// FileChecksums maps the path of each file and symlink in the data
+	// section to the hex-encoded sha1 apk recorded for it, which is the
+	// checksum of its contents or link target.  It is empty when the tar
+	// format cannot carry the checksums (see Build.TarFormat).
+	FileChecksums map[string]string
+	// Dependencies splits the runtime dependencies and provides of the
+	// package into those which were declared in its configuration and
+	// those which SCA generated.
+	Dependencies DependencyProvenance
+	// DataCompression is the compression of the data section, one of the
+	// DataCompression* constants other than DataCompressionAuto.
+	DataCompression string
+	// PackageName, Version and Arch are the name, version-release and
+	// architecture of the package, as in its control data.
+	PackageName string
+	Version     string
+	Arch        string
+	// BuildDate is the build date recorded in the package.
+	BuildDate time.Time
+	// Path is the file the package was written to.  EmitPackageReader
+	// leaves it empty.
+	Path string
+}
+
+// assemblePackage generates the signature, control and data sections of the
+// package, returning them in the order they appear in the final apk along
+// with a function which releases the temporary data section.
+func (pc *PackageBuild) assemblePackage(ctx context.Context) ([]io.Reader, *EmitResult, func(), error) {
 	log := clog.FromContext(ctx)
-	ctx, span := otel.Tracer("melange").Start(ctx, "EmitPackage")
-	defer span.End()
 
 	err := os.MkdirAll(pc.WorkspaceSubdir(), 0o755)
 	if err != nil {
-		return fmt.Errorf("unable to ensure workspace exists: %w", err)
+		return nil, nil, nil, fmt.Errorf("unable to ensure workspace exists: %w", err)
 	}
 
 	log.Info("generating package " + pc.Identity())
 
+	if err := pc.writeProtectedPaths(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := pc.writeChangelog(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := pc.writeEmbeddedConfig(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := pc.recordInjectedSBOMs(); err != nil {
+		return nil, nil, nil, err
+	}
+
 	// filesystem for the data package
-	fsys := readlinkFS(pc.WorkspaceSubdir())
+	var fsys fs.FS = readlinkFS(pc.WorkspaceSubdir())
 
 	// provide the tar writer etc/passwd and etc/group of guest filesystem
 	userinfofs := os.DirFS(pc.Build.GuestDir)
 
+	// walk the filesystem once, for both SCA and the installed-size
+	walked, err := walkPackage(fsys)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
 	hdl := &SCABuildInterface{
 		PackageBuild: pc,
+		walked:       walked,
 	}
 
 	// generate so:/cmd: virtuals for the filesystem
 	if err := pc.GenerateDependencies(ctx, hdl); err != nil {
-		return fmt.Errorf("unable to build final dependencies set: %w", err)
+		return nil, nil, nil, fmt.Errorf("unable to build final dependencies set: %w", err)
 	}
 
-	// walk the filesystem to calculate the installed-size
-	if err := pc.calculateInstalledSize(fsys); err != nil {
-		return err
+	if err := pc.refreshSBOMs(ctx, fsys, walked); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// A stub carries the metadata of the package, including the
+	// dependencies generated from its contents, but none of the contents.
+	if pc.Build.StubPackages {
+		pc.warnf(ctx, "emitting %s as a stub with an empty data section", pc.Identity())
+		fsys = fstest.MapFS{}
+		if walked, err = walkPackage(fsys); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	if err := pc.checkCaseCollisions(ctx, walked); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := pc.addInstalledSize(walked); err != nil {
+		return nil, nil, nil, err
 	}
 
 	log.Infof("  installed-size: %d", pc.InstalledSize)
 
+	if !pc.Build.StubPackages {
+		if err := pc.checkInstalledSize(); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	if pc.dataCompression, err = pc.chooseDataCompression(fsys); err != nil {
+		return nil, nil, nil, err
+	}
+	if pc.Build.DataCompression == DataCompressionAuto || pc.Compression != "" {
+		log.Infof("  data compression: %s", pc.dataCompression)
+	}
+
 	// prepare data.tar.gz
-	dataTarGz, err := os.CreateTemp("", "melange-data-*.tar.gz")
-	if err != nil {
-		return fmt.Errorf("unable to open temporary file for writing: %w", err)
+	var dataTarGz *os.File
+	if err := pc.retryOutputWrite(ctx, "creating temporary data tarball", func() error {
+		dataTarGz, err = pc.Build.createTemp("melange-data-*.tar.gz", pc.tempKey())
+		return err
+	}); err != nil {
+		return nil, nil, nil, fmt.Errorf("unable to open temporary file for writing: %w", err)
+	}
+	cleanup := func() {
+		dataTarGz.Close()
+		os.Remove(dataTarGz.Name())
 	}
-	defer dataTarGz.Close()
-	defer os.Remove(dataTarGz.Name())
 
 	// why remap UIDs and GIDs of build?
 	// the build user is not intended to be exposed as an owner of the contents of the package.
@@ -490,12 +1669,80 @@ func (pc *PackageBuild) EmitPackage(ctx context.Context) error {
 	remapGIDs[int(buildGroup.GID)] = 0
 
 	if err := pc.emitDataSection(ctx, fsys, userinfofs, remapUIDs, remapGIDs, dataTarGz); err != nil {
-		return err
+		cleanup()
+		return nil, nil, nil, err
+	}
+
+	dataInfo, err := dataTarGz.Stat()
+	if err != nil {
+		cleanup()
+		return nil, nil, nil, fmt.Errorf("unable to stat data tarball: %w", err)
+	}
+
+	if limit := pc.Build.MaxDataSize; limit > 0 && dataInfo.Size() > limit {
+		cleanup()
+		return nil, nil, nil, fmt.Errorf("data section of %s is %d bytes (installed size %d bytes), exceeding the limit of %d bytes: consider moving files into subpackages", pc.Identity(), dataInfo.Size(), pc.InstalledSize, limit)
 	}
 
 	controlSectionData, err := pc.generateControlSection(ctx)
 	if err != nil {
-		return err
+		cleanup()
+		return nil, nil, nil, err
+	}
+
+	buildDate, err := pc.BuildDate()
+	if err != nil {
+		cleanup()
+		return nil, nil, nil, err
+	}
+
+	//nolint:gosec
+	controlHash := sha1.Sum(controlSectionData)
+	result := &EmitResult{
+		Identity:        pc.Identity(),
+		DataHash:        pc.DataHash,
+		ContentHash:     pc.contentHash,
+		ControlHash:     hex.EncodeToString(controlHash[:]),
+		InstalledSize:   pc.InstalledSize,
+		Size:            int64(len(controlSectionData)) + dataInfo.Size(),
+		Changed:         pc.Build.DataChanged(pc.PackageName, pc.DataHash),
+		FileChecksums:   pc.fileChecksums,
+		Dependencies:    pc.dependencyProvenance,
+		DataCompression: pc.dataCompression,
+		PackageName:     pc.PackageName,
+		Version:         fmt.Sprintf("%s-r%d", pc.Origin.Version, pc.Origin.Epoch),
+		Arch:            pc.Arch,
+		BuildDate:       buildDate,
+	}
+
+	if pc.Build.SingleStream {
+		pc.warnf(ctx, "EXPERIMENTAL: writing %s as a single gzip stream, which apk cannot install", pc.Identity())
+		if pc.wantSignature() {
+			cleanup()
+			return nil, nil, nil, fmt.Errorf("single stream packages cannot be signed")
+		}
+
+		stream, err := pc.writeSingleStream(ctx, controlSectionData, dataTarGz)
+		cleanup()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		streamInfo, err := stream.Stat()
+		if err != nil {
+			stream.Close()
+			os.Remove(stream.Name())
+			return nil, nil, nil, fmt.Errorf("unable to stat single stream: %w", err)
+		}
+
+		// There is no control section of its own to hash or sign.
+		result.ControlHash = ""
+		result.Size = streamInfo.Size()
+
+		return []io.Reader{stream}, result, func() {
+			stream.Close()
+			os.Remove(stream.Name())
+		}, nil
 	}
 
 	combinedParts := []io.Reader{bytes.NewReader(controlSectionData), dataTarGz}
@@ -503,10 +1750,39 @@ func (pc *PackageBuild) EmitPackage(ctx context.Context) error {
 	if pc.wantSignature() {
 		signatureData, err := EmitSignature(ctx, pc.Signer(), controlSectionData, pc.Build.SourceDateEpoch)
 		if err != nil {
-			return fmt.Errorf("emitting signature: %w", err)
+			cleanup()
+			return nil, nil, nil, fmt.Errorf("emitting signature: %w", err)
 		}
 
 		combinedParts = append([]io.Reader{bytes.NewReader(signatureData)}, combinedParts...)
+		result.Size += int64(len(signatureData))
+		result.Signed = true
+	}
+
+	return combinedParts, result, cleanup, nil
+}
+
+func (pc *PackageBuild) EmitPackage(ctx context.Context) error {
+	log := clog.FromContext(ctx)
+	ctx, span := otel.Tracer("melange").Start(ctx, "EmitPackage")
+	defer span.End()
+
+	if err := pc.checkOutDir(); err != nil {
+		return err
+	}
+
+	combinedParts, result, cleanup, err := pc.assemblePackage(ctx)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	// Warnings from building and analyzing the package fail it before it
+	// is written; those from writing it and its sidecars fail it below.
+	if pc.Build.WarningsAsErrors {
+		if err := pc.Build.warningsError(pc.PackageName); err != nil {
+			return err
+		}
 	}
 
 	// build the final tarball
@@ -514,26 +1790,329 @@ func (pc *PackageBuild) EmitPackage(ctx context.Context) error {
 		return fmt.Errorf("unable to create output directory: %w", err)
 	}
 
-	outFile, err := os.Create(pc.Filename())
-	if err != nil {
-		return fmt.Errorf("unable to create apk file: %w", err)
+	var digest string
+	if err := pc.retryOutputWrite(ctx, "writing "+pc.Filename(), func() error {
+		if pc.Build.ContentAddressedOutput {
+			digest, err = pc.writeContentAddressed(ctx, combinedParts, result.DataHash)
+		} else {
+			digest, err = writePackageFile(pc.Filename(), combinedParts)
+		}
+		return err
+	}); err != nil {
+		return err
+	}
+
+	log.Infof("wrote %s", pc.Filename())
+	result.Digest = digest
+	result.Path = pc.Filename()
+	pc.Result = result
+
+	if pc.Build.EmitChecksumsFile {
+		if err := pc.Build.recordChecksum(pc.Filename(), digest); err != nil {
+			return err
+		}
+	}
+
+	if pc.Build.VerifyRuntimeDepsResolvable || pc.Build.DetectDependencyCycles || pc.Build.EmitProvidesMap {
+		pc.recordEmitted()
+	}
+
+	if pc.Build.ValidateWithApk != "" {
+		if err := pc.validateWithApk(ctx); err != nil {
+			return err
+		}
+	}
+
+	if pc.Build.EmitProvenance {
+		if err := pc.emitProvenance(ctx, result); err != nil {
+			return err
+		}
+	}
+
+	if pc.Build.EmitPerPackageIndex {
+		if err := pc.emitPerPackageIndex(ctx); err != nil {
+			return err
+		}
+	}
+
+	if pc.Build.EmitDataArtifact || pc.Build.BenchmarkCompression {
+		// The data section is always the last part of the apk.
+		data, ok := combinedParts[len(combinedParts)-1].(io.ReadSeeker)
+		if !ok {
+			return fmt.Errorf("data section of %s is not seekable", pc.Identity())
+		}
+		if pc.Build.EmitDataArtifact {
+			if err := pc.emitDataArtifact(ctx, data); err != nil {
+				return err
+			}
+		}
+		if pc.Build.BenchmarkCompression {
+			if err := pc.benchmarkCompression(ctx, data); err != nil {
+				return err
+			}
+		}
+	}
+
+	if pc.Build.EmitFileChecksums {
+		if err := pc.emitFileChecksums(ctx, result); err != nil {
+			return err
+		}
+	}
+
+	if pc.Build.LegacyControlAlias {
+		if err := pc.emitLegacyControlAlias(ctx); err != nil {
+			return err
+		}
+	}
+
+	if pc.Build.EmitApkManifest {
+		if err := pc.emitApkManifest(ctx, result); err != nil {
+			return err
+		}
+	}
+
+	if pc.Build.EmitMetadataJSON {
+		if err := pc.emitMetadataJSON(ctx); err != nil {
+			return err
+		}
 	}
-	defer outFile.Close()
 
-	if err := combine(outFile, combinedParts...); err != nil {
-		return fmt.Errorf("unable to write apk file: %w", err)
+	if pc.Build.EmitOCILayout {
+		if err := pc.emitOCILayout(ctx, result); err != nil {
+			return err
+		}
+	}
+
+	if pc.Build.TrackFileOrigins {
+		if err := pc.emitFileOrigins(ctx, result); err != nil {
+			return err
+		}
+	}
+
+	if pc.Build.CompareAgainst != "" {
+		if err := pc.compareAgainstReference(ctx); err != nil {
+			return err
+		}
 	}
 
-	log.Infof("wrote %s", outFile.Name())
+	if pc.Build.SCAReport {
+		if err := pc.emitSCAReport(ctx); err != nil {
+			return err
+		}
+	}
+
+	if pc.Build.RunTestsAfterEmit {
+		if err := pc.runTestsAfterEmit(ctx); err != nil {
+			return err
+		}
+	}
+
+	if len(pc.Build.AdditionalOutDirs) > 0 {
+		if err := pc.emitAdditionalOutDirs(ctx); err != nil {
+			return err
+		}
+	}
+
+	if pc.Build.MetadataSink != nil {
+		if err := pc.recordMetadata(ctx, result); err != nil {
+			return err
+		}
+	}
 
 	// add the package to the build log if requested
 	if err := pc.AppendBuildLog(""); err != nil {
-		log.Warnf("unable to append package log: %s", err)
+		pc.warnf(ctx, "unable to append package log: %s", err)
+	}
+
+	if pc.Build.WarningsAsErrors {
+		return pc.Build.warningsError(pc.PackageName)
 	}
 
 	return nil
 }
 
+// writePackageFile writes the parts of an apk to path from their beginning,
+// returning the hex-encoded sha256 of the file.  The file is replaced rather
+// than rewritten, as it may be linked into AdditionalOutDirs, an OCI layout
+// or the content addressed store.
+func writePackageFile(path string, parts []io.Reader) (string, error) {
+	for _, part := range parts {
+		if seeker, ok := part.(io.Seeker); ok {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return "", fmt.Errorf("unable to rewind apk section: %w", err)
+			}
+		}
+	}
+
+	digest := sha256.New()
+	if err := writeFileAtomicFunc(path, func(w io.Writer) error {
+		return combine(io.MultiWriter(w, digest), parts...)
+	}); err != nil {
+		return "", fmt.Errorf("unable to write apk file: %w", err)
+	}
+
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// packageReader streams the assembled parts of an apk, releasing the
+// temporary data section when closed.
+type packageReader struct {
+	io.Reader
+	cleanup func()
+}
+
+func (r *packageReader) Close() error {
+	r.cleanup()
+	return nil
+}
+
+// EmitPackageReader performs the same assembly as EmitPackage, but returns a
+// reader over the final apk instead of writing it to OutDir.  The caller must
+// close the reader to release the temporary data section.
+func (pc *PackageBuild) EmitPackageReader(ctx context.Context) (io.ReadCloser, *EmitResult, error) {
+	ctx, span := otel.Tracer("melange").Start(ctx, "EmitPackageReader")
+	defer span.End()
+
+	combinedParts, result, cleanup, err := pc.assemblePackage(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	pc.Result = result
+
+	return &packageReader{
+		Reader:  io.MultiReader(combinedParts...),
+		cleanup: cleanup,
+	}, result, nil
+}
+
+// emitDataArtifact writes the data section of the package next to it as
+// <identity>.data.tar.gz.
+func (pc *PackageBuild) emitDataArtifact(ctx context.Context, data io.ReadSeeker) error {
+	log := clog.FromContext(ctx)
+
+	path := filepath.Join(pc.OutDir, pc.Identity()+".data.tar.gz")
+	if err := pc.retryOutputWrite(ctx, "writing "+path, func() error {
+		if _, err := data.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return writeFileAtomicFunc(path, func(w io.Writer) error {
+			_, err := io.Copy(w, data)
+			return err
+		})
+	}); err != nil {
+		return fmt.Errorf("unable to write data artifact: %w", err)
+	}
+
+	log.Infof("wrote %s", path)
+
+	return nil
+}
+
+// emitLegacyControlAlias writes a copy of the .PKGINFO of the package next to
+// it as <identity>.PKGINFO, for legacy tooling.  The copy is kept out of the
+// control section, as apk takes any member there without a leading dot to
+// start the data section, and so would reject the package.
+func (pc *PackageBuild) emitLegacyControlAlias(ctx context.Context) error {
+	log := clog.FromContext(ctx)
+
+	path := filepath.Join(pc.OutDir, pc.Identity()+legacyControlAlias)
+	pc.warnf(ctx, "writing non-standard %s for legacy tooling", path)
+	if err := writeFileAtomic(path, pc.pkginfo); err != nil {
+		return fmt.Errorf("unable to write %s: %w", path, err)
+	}
+
+	log.Infof("wrote %s", path)
+
+	return nil
+}
+
+// fileChecksums is the content of <identity>.filesums.json.
+type fileChecksums struct {
+	Algorithm string            `json:"algorithm"`
+	Files     map[string]string `json:"files"`
+}
+
+// emitFileChecksums writes the checksum of every file in the data section of
+// the package next to it as <identity>.filesums.json, so that files may be
+// verified individually.
+func (pc *PackageBuild) emitFileChecksums(ctx context.Context, result *EmitResult) error {
+	log := clog.FromContext(ctx)
+
+	data, err := json.MarshalIndent(fileChecksums{Algorithm: "sha1", Files: result.FileChecksums}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode file checksums: %w", err)
+	}
+
+	path := filepath.Join(pc.OutDir, pc.Identity()+".filesums.json")
+	if err := writeFileAtomic(path, append(data, '\n')); err != nil {
+		return fmt.Errorf("unable to write file checksums: %w", err)
+	}
+
+	log.Infof("wrote %s", path)
+
+	return nil
+}
+
+// scaReport is the content of <identity>.sca-report.json.
+type scaReport struct {
+	Findings []sca.Finding `json:"findings"`
+}
+
+// emitSCAReport writes the problems SCA found in the package next to it as
+// <identity>.sca-report.json.  The report is written even if there are none.
+func (pc *PackageBuild) emitSCAReport(ctx context.Context) error {
+	log := clog.FromContext(ctx)
+
+	findings := append([]sca.Finding{}, pc.scaFindings...)
+	sort.Slice(findings, func(i, j int) bool {
+		if findings[i].Path != findings[j].Path {
+			return findings[i].Path < findings[j].Path
+		}
+		return findings[i].Kind < findings[j].Kind
+	})
+
+	data, err := json.MarshalIndent(scaReport{Findings: findings}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode SCA report: %w", err)
+	}
+
+	path := filepath.Join(pc.OutDir, pc.Identity()+".sca-report.json")
+	if err := writeFileAtomic(path, append(data, '\n')); err != nil {
+		return fmt.Errorf("unable to write SCA report: %w", err)
+	}
+
+	log.Infof("wrote %s", path)
+
+	return nil
+}
+
+// emitPerPackageIndex writes an APKINDEX containing only this package next
+// to it as <identity>.index, signed with the package signing key if set.
+func (pc *PackageBuild) emitPerPackageIndex(ctx context.Context) error {
+	log := clog.FromContext(ctx)
+
+	opts := []index.Option{
+		index.WithPackageFiles([]string{pc.Filename()}),
+		index.WithIndexFile(filepath.Join(pc.OutDir, pc.Identity()+".index")),
+	}
+	if key := pc.Build.indexSigningKey(); key != "" {
+		opts = append(opts, index.WithSigningKey(key), index.WithSigningPassphrase(pc.Build.indexSigningPassphrase()))
+	}
+
+	idx, err := index.New(opts...)
+	if err != nil {
+		return fmt.Errorf("unable to create per-package index: %w", err)
+	}
+
+	if err := idx.GenerateIndex(ctx); err != nil {
+		return fmt.Errorf("unable to generate per-package index: %w", err)
+	}
+
+	log.Infof("wrote %s", idx.IndexFile)
+
+	return nil
+}
+
 func (pc *PackageBuild) Signer() ApkSigner {
 	return &KeyApkSigner{
 		KeyFile:       pc.Build.SigningKey,
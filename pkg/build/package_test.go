@@ -15,11 +15,40 @@
 package build
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+
+	//nolint:gosec
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/sbom"
+	"chainguard.dev/melange/pkg/sca"
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
 
 	"github.com/stretchr/testify/require"
 )
@@ -138,3 +167,2247 @@ datahash = baadf00d
 		})
 	}
 }
+
+// Test_GenerateControlData_Golden locks the exact formatting of control data
+// using every optional field, so that changes to the template which leave
+// stray whitespace or blank lines behind are caught.
+func Test_GenerateControlData_Golden(t *testing.T) {
+	pb := &PackageBuild{
+		MelangeVersion: "v1.2.3",
+		Build: &Build{
+			SourceDateEpoch:   time.Unix(12345678, 0),
+			EmbedBuilderInfo:  true,
+			BuilderID:         "builder-1",
+			InputsHash:        "cafef00d",
+			BuildID:           "build-1",
+			EmbedConfigDigest: true,
+			ConfigDigest:      "sha256:f00dcafe",
+		},
+		Origin: &config.Package{
+			Name:        "glibc",
+			Version:     "1.2.3",
+			Epoch:       4,
+			Copyright:   []config.Copyright{{License: "LGPL-2.1-or-later"}, {License: "GPL-2.0-or-later"}},
+			ConfigFiles: []string{"/etc/ld.so.conf"},
+			Changelog:   &config.Changelog{Contents: "changes"},
+		},
+		PackageName:   "glibc",
+		Arch:          "aarch64",
+		InstalledSize: 666,
+		OriginName:    "glibc",
+		Description:   "I'm a unit test ",
+		URL:           "https://chainguard.dev",
+		Commit:        "deadbeef",
+		DataHash:      "baadf00d",
+		Dependencies: config.Dependencies{
+			Runtime:          []string{"ld-linux", "libcrypt1"},
+			Provides:         []string{"so:libc.so.6=6"},
+			Replaces:         []string{"musl"},
+			ReplacesPriority: 10,
+			Vendored:         []string{"tzdata=2024a"},
+			ProviderPriority: 5,
+		},
+		Scriptlets: config.Scriptlets{
+			Trigger: config.Trigger{
+				Script: "ldconfig",
+				Paths:  []string{"/usr/lib", "/lib"},
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, pb.GenerateControlData(&buf))
+
+	want, err := os.ReadFile(filepath.Join("testdata", "control", "pkginfo.golden"))
+	require.NoError(t, err)
+	require.Equal(t, string(want), buf.String())
+}
+
+func Test_normalizeControlData(t *testing.T) {
+	for _, test := range []struct {
+		name, in, want string
+	}{
+		{"clean", "a = 1\nb = 2\n", "a = 1\nb = 2\n"},
+		{"trailing spaces", "a = 1  \nb = 2\t\n", "a = 1\nb = 2\n"},
+		{"crlf", "a = 1\r\nb = 2\r\n", "a = 1\nb = 2\n"},
+		{"blank lines", "a = 1\n\n  \nb = 2\n\n\n", "a = 1\nb = 2\n"},
+		{"no trailing newline", "a = 1\nb = 2", "a = 1\nb = 2\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.want, string(normalizeControlData([]byte(test.in))))
+		})
+	}
+}
+
+func Test_pinProvides(t *testing.T) {
+	provides := []string{"so:libfoo.so.3=3", "cmd:foo=1.0.0-r0", "pc:foo"}
+	pinned := pinProvides(provides, "1.0.0-r2")
+
+	require.Equal(t, []string{"so:libfoo.so.3=1.0.0-r2", "cmd:foo=1.0.0-r2", "pc:foo=1.0.0-r2"}, pinned)
+	require.Equal(t, []string{"so:libbaz.so.4"}, removeSelfProvidedDeps([]string{"so:libbaz.so.4", "so:libfoo.so.3", "pc:foo"}, pinned))
+}
+
+func TestGenerateDependencies_PinProvides(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{}
+	newPackageBuild := testPackageBuilder(t, b)
+
+	pcDir := filepath.Join(b.WorkspaceDir, "melange-out", "hello", "usr", "lib", "pkgconfig")
+	require.NoError(t, os.MkdirAll(pcDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(pcDir, "hello.pc"), []byte("Name: hello\nDescription: hello\nVersion: 2.5\n"), 0o644))
+
+	for _, tt := range []struct {
+		pin  bool
+		want string
+	}{
+		{pin: false, want: "pc:hello=2.5"},
+		{pin: true, want: "pc:hello=1.0.0-r0"},
+	} {
+		b.PinProvidesToPackageVersion = tt.pin
+		pc := newPackageBuild()
+		pc.Dependencies = config.Dependencies{
+			Runtime:  []string{"pc:hello", "busybox"},
+			Provides: []string{tt.want},
+		}
+
+		require.NoError(t, pc.GenerateDependencies(ctx, &SCABuildInterface{PackageBuild: pc}))
+		require.Equal(t, []string{tt.want}, pc.Dependencies.Provides, "pin %t", tt.pin)
+		require.Equal(t, []string{"busybox"}, pc.Dependencies.Runtime, "pin %t", tt.pin)
+	}
+}
+
+func TestGenerateDependencies_NoProvidesTypes(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{}
+	newPackageBuild := testPackageBuilder(t, b)
+
+	lib, err := os.ReadFile(filepath.Join("..", "sca", "testdata", "rpath", "usr", "lib", "libleaky-rpath.so.1"))
+	require.NoError(t, err)
+	for _, name := range []string{"hello", "hello-static"} {
+		dir := filepath.Join(b.WorkspaceDir, "melange-out", name)
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "usr", "lib"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "usr", "lib", "libleaky-rpath.so"), lib, 0o755))
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "usr", "bin"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "usr", "bin", name), []byte("#!/bin/sh\n"), 0o755))
+	}
+
+	pc := newPackageBuild()
+	require.NoError(t, pc.GenerateDependencies(ctx, &SCABuildInterface{PackageBuild: pc}))
+	require.Equal(t, []string{"cmd:hello=1.0.0-r0", "so:libleaky-rpath.so=0"}, pc.Dependencies.Provides)
+
+	pc = newPackageBuild()
+	pc.PackageName = "hello-static"
+	pc.Options = config.PackageOption{NoProvidesTypes: []string{"so"}}
+	pc.Dependencies = config.Dependencies{Provides: []string{"so:libstatic.so=1"}}
+	require.NoError(t, pc.GenerateDependencies(ctx, &SCABuildInterface{PackageBuild: pc}))
+	require.Equal(t, []string{"cmd:hello-static=1.0.0-r0", "so:libstatic.so=1"}, pc.Dependencies.Provides)
+}
+
+func TestGenerateDependencies_ProvideMergeStrategy(t *testing.T) {
+	ctx := context.Background()
+
+	lib, err := os.ReadFile(filepath.Join("..", "sca", "testdata", "rpath", "usr", "lib", "libleaky-rpath.so.1"))
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		strategy string
+		want     []string
+	}{
+		{"", []string{"cmd:hello=1.0.0-r0", "so:libleaky-rpath.so=0", "so:libleaky-rpath.so=2"}},
+		{ProvideMergeUnion, []string{"cmd:hello=1.0.0-r0", "so:libleaky-rpath.so=0", "so:libleaky-rpath.so=2"}},
+		{ProvideMergeDeclaredWins, []string{"cmd:hello=1.0.0-r0", "so:libleaky-rpath.so=2"}},
+		{ProvideMergeGeneratedWins, []string{"cmd:hello=1.0.0-r0", "so:libleaky-rpath.so=0"}},
+	} {
+		t.Run(tc.strategy, func(t *testing.T) {
+			pc := testPackageBuilder(t, &Build{ProvideMergeStrategy: tc.strategy})()
+			dir := pc.WorkspaceSubdir()
+			require.NoError(t, os.MkdirAll(filepath.Join(dir, "usr", "lib"), 0o755))
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "usr", "lib", "libleaky-rpath.so"), lib, 0o755))
+			require.NoError(t, os.MkdirAll(filepath.Join(dir, "usr", "bin"), 0o755))
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "usr", "bin", "hello"), []byte("#!/bin/sh\n"), 0o755))
+
+			pc.Dependencies.Provides = []string{"so:libleaky-rpath.so=2"}
+			require.NoError(t, pc.GenerateDependencies(ctx, &SCABuildInterface{PackageBuild: pc}))
+			require.Equal(t, tc.want, pc.Dependencies.Provides)
+		})
+	}
+}
+
+func Test_mergeProvides(t *testing.T) {
+	declared := []string{"so:libfoo.so.1=2", "cmd:foo", "foo-compat"}
+	generated := []string{"so:libfoo.so.1=3", "cmd:foo=1.0-r0", "so:libbar.so.1=1"}
+
+	require.ElementsMatch(t, append(slices.Clone(declared), generated...), mergeProvides(declared, generated, ProvideMergeUnion))
+	require.ElementsMatch(t, []string{"so:libfoo.so.1=2", "cmd:foo", "foo-compat", "so:libbar.so.1=1"}, mergeProvides(declared, generated, ProvideMergeDeclaredWins))
+	require.ElementsMatch(t, []string{"foo-compat", "so:libfoo.so.1=3", "cmd:foo=1.0-r0", "so:libbar.so.1=1"}, mergeProvides(declared, generated, ProvideMergeGeneratedWins))
+
+	// The inputs are left alone.
+	require.Equal(t, []string{"so:libfoo.so.1=2", "cmd:foo", "foo-compat"}, declared)
+	require.Equal(t, []string{"so:libfoo.so.1=3", "cmd:foo=1.0-r0", "so:libbar.so.1=1"}, generated)
+}
+
+func TestGenerateDependencies_WarnIsolatedPackages(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{WarnIsolatedPackages: true}
+	newPackageBuild := testPackageBuilder(t, b)
+
+	pc := newPackageBuild()
+	require.NoError(t, pc.GenerateDependencies(ctx, &SCABuildInterface{PackageBuild: pc}))
+	require.Equal(t, []Warning{{Package: "hello", Message: "hello depends on nothing and provides nothing, check that the build installed its files"}}, b.Warnings())
+
+	// Virtual packages are intentionally empty.
+	b.warnings = nil
+	pc = newPackageBuild()
+	pc.Options = config.PackageOption{NoProvides: true}
+	require.NoError(t, pc.GenerateDependencies(ctx, &SCABuildInterface{PackageBuild: pc}))
+	require.Empty(t, b.Warnings())
+
+	pc = newPackageBuild()
+	pc.Dependencies = config.Dependencies{Runtime: []string{"busybox"}}
+	require.NoError(t, pc.GenerateDependencies(ctx, &SCABuildInterface{PackageBuild: pc}))
+	require.Empty(t, b.Warnings())
+
+	b.WarnIsolatedPackages = false
+	pc = newPackageBuild()
+	require.NoError(t, pc.GenerateDependencies(ctx, &SCABuildInterface{PackageBuild: pc}))
+	require.Empty(t, b.Warnings())
+}
+
+func TestGenerateDependencies_Walked(t *testing.T) {
+	ctx := context.Background()
+	newPackageBuild := testPackageBuilder(t, &Build{})
+	pc := newPackageBuild()
+	bin := filepath.Join(pc.WorkspaceSubdir(), "usr", "bin")
+	require.NoError(t, os.MkdirAll(bin, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "hello"), []byte("#!/usr/bin/perl\n"), 0o755))
+
+	fsys := readlinkFS(pc.WorkspaceSubdir())
+	require.NoError(t, pc.GenerateDependencies(ctx, &SCABuildInterface{PackageBuild: pc}))
+	require.NoError(t, pc.calculateInstalledSize(fsys))
+	want, wantSize := pc.Dependencies, pc.InstalledSize
+
+	// Sharing one walk between SCA and the installed size gives the same
+	// results as walking separately.
+	pc = newPackageBuild()
+	walked, err := walkPackage(fsys)
+	require.NoError(t, err)
+	require.NoError(t, pc.GenerateDependencies(ctx, &SCABuildInterface{PackageBuild: pc, walked: walked}))
+	require.NoError(t, pc.addInstalledSize(walked))
+	require.Equal(t, want, pc.Dependencies)
+	require.Equal(t, wantSize, pc.InstalledSize)
+
+	// SCA replays the walk rather than walking again.
+	ghost, err := fs.Stat(fstest.MapFS{"ghost": {Mode: 0o755}}, "ghost")
+	require.NoError(t, err)
+	pc = newPackageBuild()
+	require.NoError(t, pc.GenerateDependencies(ctx, &SCABuildInterface{PackageBuild: pc, walked: []sca.WalkedEntry{
+		{Path: "usr/bin/ghost", Entry: fs.FileInfoToDirEntry(ghost)},
+	}}))
+	require.Equal(t, []string{"cmd:ghost=1.0.0-r0"}, pc.Dependencies.Provides)
+}
+
+func TestGenerateDependencies_Provenance(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{}
+	newPackageBuild := testPackageBuilder(t, b)
+	b.DependencyLog = filepath.Join(t.TempDir(), "deps.json")
+
+	dir := filepath.Join(b.WorkspaceDir, "melange-out", "hello")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "usr", "bin"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "usr", "bin", "hello"), []byte("#!/usr/bin/perl\nprint \"hello\\n\";\n"), 0o755))
+
+	pc := newPackageBuild()
+	pc.Dependencies = config.Dependencies{
+		Runtime:  []string{"busybox"},
+		Provides: []string{"hello-compat=1.0.0-r0"},
+	}
+	require.NoError(t, pc.GenerateDependencies(ctx, &SCABuildInterface{PackageBuild: pc}))
+
+	want := DependencyProvenance{
+		Declared:  DependencySet{Runtime: []string{"busybox"}, Provides: []string{"hello-compat=1.0.0-r0"}},
+		Generated: DependencySet{Runtime: []string{"cmd:perl"}, Provides: []string{"cmd:hello=1.0.0-r0"}},
+	}
+	require.Equal(t, want, pc.dependencyProvenance)
+
+	data, err := os.ReadFile(b.DependencyLog + ".x86_64")
+	require.NoError(t, err)
+	var entry dependencyLogEntry
+	require.NoError(t, json.Unmarshal(data, &entry))
+	require.Equal(t, want, entry.Provenance)
+
+	pc = newPackageBuild()
+	pc.Dependencies = config.Dependencies{
+		Runtime:  []string{"busybox"},
+		Provides: []string{"hello-compat=1.0.0-r0"},
+	}
+	require.NoError(t, pc.EmitPackage(ctx))
+	require.Equal(t, want, pc.Result.Dependencies)
+}
+
+func TestGenerateDependencies_StrictSCA(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{}
+	newPackageBuild := testPackageBuilder(t, b)
+
+	bin := filepath.Join(b.WorkspaceDir, "melange-out", "hello", "usr", "bin")
+	require.NoError(t, os.MkdirAll(bin, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "broken"), []byte("#!/usr/bin/env  \n"), 0o755))
+
+	pc := newPackageBuild()
+	require.NoError(t, pc.GenerateDependencies(ctx, &SCABuildInterface{PackageBuild: pc}))
+
+	b.StrictSCA = true
+	pc = newPackageBuild()
+	err := pc.GenerateDependencies(ctx, &SCABuildInterface{PackageBuild: pc})
+	require.ErrorContains(t, err, "shbang analyzer failed on usr/bin/broken")
+}
+
+func Test_GenerateControlData_Licenses(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      string
+		copyright []config.Copyright
+		want      []string
+		wantErr   bool
+	}{{
+		name:      "per-entry default",
+		copyright: []config.Copyright{{License: "MIT OR Apache-2.0"}, {License: "GPL-3.0-only"}},
+		want:      []string{"license = MIT OR Apache-2.0", "license = GPL-3.0-only"},
+	}, {
+		name:      "per-entry",
+		mode:      LicenseRenderPerEntry,
+		copyright: []config.Copyright{{License: "MIT"}, {License: "BSD-3-Clause"}},
+		want:      []string{"license = MIT", "license = BSD-3-Clause"},
+	}, {
+		name:      "expression single",
+		mode:      LicenseRenderExpression,
+		copyright: []config.Copyright{{License: "MIT OR Apache-2.0"}},
+		want:      []string{"license = MIT OR Apache-2.0"},
+	}, {
+		name:      "expression combined",
+		mode:      LicenseRenderExpression,
+		copyright: []config.Copyright{{License: "MIT OR Apache-2.0"}, {License: "GPL-3.0-only"}},
+		want:      []string{"license = (MIT OR Apache-2.0) AND GPL-3.0-only"},
+	}, {
+		name:      "expression invalid",
+		mode:      LicenseRenderExpression,
+		copyright: []config.Copyright{{License: "MIT OR"}},
+		wantErr:   true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pb := &PackageBuild{
+				Build:       &Build{LicenseRenderMode: tt.mode},
+				Origin:      &config.Package{Name: "hello", Version: "1.0.0", Copyright: tt.copyright},
+				PackageName: "hello",
+			}
+
+			var buf bytes.Buffer
+			err := pb.GenerateControlData(&buf)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			got := []string{}
+			for _, line := range strings.Split(buf.String(), "\n") {
+				if strings.HasPrefix(line, "license = ") {
+					got = append(got, line)
+				}
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_GenerateControlData_BuilderInfo(t *testing.T) {
+	pb := &PackageBuild{
+		MelangeVersion: "v1.2.3",
+		Build:          &Build{EmbedBuilderInfo: true, BuilderID: "builder-7"},
+		Origin:         &config.Package{Name: "hello", Version: "1.0.0"},
+		PackageName:    "hello",
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, pb.GenerateControlData(&buf))
+	require.Contains(t, buf.String(), "\n# melange: v1.2.3\n# builder: builder-7\n")
+
+	pb.Build.EmbedBuilderInfo = false
+	buf.Reset()
+	require.NoError(t, pb.GenerateControlData(&buf))
+	require.NotContains(t, buf.String(), "# melange:")
+	require.NotContains(t, buf.String(), "# builder:")
+}
+
+func Test_GenerateControlData_InputsHash(t *testing.T) {
+	pb := &PackageBuild{
+		Build:       &Build{InputsHash: "sha256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"},
+		Origin:      &config.Package{Name: "hello", Version: "1.0.0"},
+		PackageName: "hello",
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, pb.GenerateControlData(&buf))
+	require.Contains(t, buf.String(), "\n# inputs = sha256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03\npkgname = hello\n")
+
+	pb.Build.InputsHash = ""
+	buf.Reset()
+	require.NoError(t, pb.GenerateControlData(&buf))
+	require.NotContains(t, buf.String(), "# inputs")
+
+	require.Error(t, WithInputsHash("abc\npkgname = evil")(&Build{}))
+}
+
+func Test_GenerateControlData_BuildID(t *testing.T) {
+	b := &Build{}
+	require.NoError(t, WithBuildID("job-1234")(b))
+	pb := &PackageBuild{
+		Build:       b,
+		Origin:      &config.Package{Name: "hello", Version: "1.0.0"},
+		PackageName: "hello",
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, pb.GenerateControlData(&buf))
+	require.Contains(t, buf.String(), "\n# buildid = job-1234\n")
+
+	// Generated IDs are unique per build.
+	require.NoError(t, WithBuildID(BuildIDAuto)(b))
+	other := &Build{}
+	require.NoError(t, WithBuildID(BuildIDAuto)(other))
+	require.NotEqual(t, BuildIDAuto, b.BuildID)
+	require.NotEqual(t, b.BuildID, other.BuildID)
+
+	require.Error(t, WithBuildID("job 1234")(b))
+
+	pb.Build = &Build{}
+	buf.Reset()
+	require.NoError(t, pb.GenerateControlData(&buf))
+	require.NotContains(t, buf.String(), "buildid")
+}
+
+func TestEmbedBuilderInfoDataHash(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{}
+	newPackageBuild := testPackageBuilder(t, b)
+
+	pc := newPackageBuild()
+	require.NoError(t, pc.EmitPackage(ctx))
+	plain := pc.Result
+
+	b.EmbedBuilderInfo = true
+	b.BuilderID = "builder-7"
+	pc = newPackageBuild()
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	require.Equal(t, plain.DataHash, pc.Result.DataHash)
+	require.NotEqual(t, plain.ControlHash, pc.Result.ControlHash)
+}
+
+func Test_GenerateControlData_ForkReplaces(t *testing.T) {
+	pb := &PackageBuild{
+		Build:        &Build{},
+		Origin:       &config.Package{Name: "hello", Version: "2.4.1", Epoch: 3, ForkReplaces: []string{"hello-upstream"}},
+		PackageName:  "hello",
+		Dependencies: config.Dependencies{Replaces: []string{"hello-legacy"}},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, pb.GenerateControlData(&buf))
+	require.Contains(t, buf.String(), "\nreplaces = hello-legacy\nreplaces = hello-upstream<2.4.1-r3\nreplaces_priority = 100\n")
+
+	// A configured priority is kept.
+	pb.Dependencies.ReplacesPriority = 5
+	buf.Reset()
+	require.NoError(t, pb.GenerateControlData(&buf))
+	require.Contains(t, buf.String(), "\nreplaces_priority = 5\n")
+
+	// Subpackages do not replace the forked package.
+	pb = &PackageBuild{
+		Build:       &Build{},
+		Origin:      pb.Origin,
+		PackageName: "hello-doc",
+	}
+	buf.Reset()
+	require.NoError(t, pb.GenerateControlData(&buf))
+	require.NotContains(t, buf.String(), "replaces")
+}
+
+func Test_GenerateControlData_Priorities(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "hello-compat.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+package:
+  name: hello-compat
+  version: 1.0.0
+  epoch: 0
+  dependencies:
+    provides:
+      - hello=1.0.0
+    replaces:
+      - hello
+    provider-priority: 10
+    replaces-priority: 20
+`), 0o644))
+
+	cfg, err := config.ParseConfiguration(ctx, path)
+	require.NoError(t, err)
+
+	pb := &PackageBuild{
+		Build:        &Build{},
+		Origin:       &cfg.Package,
+		PackageName:  cfg.Package.Name,
+		Dependencies: cfg.Package.Dependencies,
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, pb.GenerateControlData(&buf))
+	pkginfo := buf.String()
+	require.Contains(t, pkginfo, "\nreplaces_priority = 20\n")
+	require.Contains(t, pkginfo, "\nprovider_priority = 10\n")
+	require.Less(t, strings.Index(pkginfo, "replaces_priority"), strings.Index(pkginfo, "provider_priority"))
+
+	buf.Reset()
+	require.NoError(t, pb.GenerateControlData(&buf))
+	require.Equal(t, pkginfo, buf.String())
+}
+
+func Test_originName(t *testing.T) {
+	sub := &config.Package{Name: "glibc-dev"}
+
+	tests := []struct {
+		name        string
+		strip       bool
+		mode        string
+		override    string
+		want        string
+		wantControl string
+	}{{
+		name:        "not stripped",
+		mode:        StrippedOriginEmpty,
+		want:        "glibc",
+		wantControl: "origin = glibc\n",
+	}, {
+		name:        "stripped default",
+		strip:       true,
+		want:        "glibc-dev",
+		wantControl: "origin = glibc-dev\n",
+	}, {
+		name:        "stripped self",
+		strip:       true,
+		mode:        StrippedOriginSelf,
+		want:        "glibc-dev",
+		wantControl: "origin = glibc-dev\n",
+	}, {
+		name:  "stripped empty",
+		strip: true,
+		mode:  StrippedOriginEmpty,
+		want:  "",
+	}, {
+		name:        "override",
+		override:    "upstream",
+		want:        "upstream",
+		wantControl: "origin = upstream\n",
+	}, {
+		name:        "override stripped",
+		strip:       true,
+		override:    "upstream",
+		want:        "upstream",
+		wantControl: "origin = upstream\n",
+	}, {
+		name:        "override stripped empty",
+		strip:       true,
+		mode:        StrippedOriginEmpty,
+		override:    "upstream",
+		want:        "upstream",
+		wantControl: "origin = upstream\n",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Build{
+				Configuration:      config.Configuration{Package: config.Package{Name: "glibc", Version: "1.2.3", OriginOverride: tt.override}},
+				StripOriginName:    tt.strip,
+				StrippedOriginMode: tt.mode,
+			}
+
+			got := b.originName(sub)
+			require.Equal(t, tt.want, got)
+
+			pb := &PackageBuild{
+				Build:       b,
+				Origin:      &b.Configuration.Package,
+				PackageName: sub.Name,
+				OriginName:  got,
+			}
+			var buf bytes.Buffer
+			require.NoError(t, pb.GenerateControlData(&buf))
+			if tt.wantControl == "" {
+				require.NotContains(t, buf.String(), "origin =")
+			} else {
+				require.Contains(t, buf.String(), tt.wantControl)
+			}
+		})
+	}
+}
+
+func Test_generateControlSection_StripScriptlets(t *testing.T) {
+	scriptlets := config.Scriptlets{
+		Trigger: config.Trigger{
+			Script: "#!/bin/sh\n",
+			Paths:  []string{"/usr/lib"},
+		},
+		PreInstall:  "#!/bin/sh\n",
+		PostInstall: "#!/bin/sh\n",
+	}
+
+	for _, strip := range []bool{false, true} {
+		pc := &PackageBuild{
+			Build: &Build{
+				SourceDateEpoch: time.Unix(0, 0),
+				StripScriptlets: strip,
+			},
+			Origin:      &config.Package{Name: "hello", Version: "1.0.0"},
+			PackageName: "hello",
+			Scriptlets:  scriptlets,
+		}
+
+		control, err := pc.generateControlSection(context.Background())
+		require.NoError(t, err)
+
+		zr, err := gzip.NewReader(bytes.NewReader(control))
+		require.NoError(t, err)
+		tr := tar.NewReader(zr)
+
+		names := []string{}
+		var pkginfo []byte
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+			names = append(names, hdr.Name)
+			if hdr.Name == ".PKGINFO" {
+				pkginfo, err = io.ReadAll(tr)
+				require.NoError(t, err)
+			}
+		}
+
+		if strip {
+			require.Equal(t, []string{".PKGINFO"}, names)
+			require.NotContains(t, string(pkginfo), "triggers =")
+		} else {
+			require.ElementsMatch(t, []string{".PKGINFO", ".trigger", ".pre-install", ".post-install"}, names)
+			require.Contains(t, string(pkginfo), "triggers = /usr/lib")
+		}
+	}
+}
+
+func Test_generateControlSection_StrictScriptlets(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		trigger config.Trigger
+		strict  bool
+		wantErr string
+	}{
+		{name: "consistent", trigger: config.Trigger{Script: "#!/bin/sh\n", Paths: []string{"/usr/lib"}}, strict: true},
+		{name: "paths without script", trigger: config.Trigger{Script: " \n", Paths: []string{"/usr/lib"}}, strict: true, wantErr: "trigger scriptlet of hello has trigger paths but no script"},
+		{name: "script without paths", trigger: config.Trigger{Script: "#!/bin/sh\n"}, strict: true, wantErr: "trigger scriptlet of hello has a script but no trigger paths"},
+		{name: "not strict", trigger: config.Trigger{Paths: []string{"/usr/lib"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pc := &PackageBuild{
+				Build: &Build{
+					SourceDateEpoch:  time.Unix(0, 0),
+					StrictScriptlets: tc.strict,
+				},
+				Origin:      &config.Package{Name: "hello", Version: "1.0.0"},
+				PackageName: "hello",
+				Scriptlets:  config.Scriptlets{Trigger: tc.trigger},
+			}
+
+			_, err := pc.generateControlSection(context.Background())
+			if tc.wantErr != "" {
+				require.EqualError(t, err, tc.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_generateControlSection_Order(t *testing.T) {
+	all := config.Scriptlets{
+		Trigger:       config.Trigger{Script: "#!/bin/sh\n", Paths: []string{"/usr/lib"}},
+		PreInstall:    "#!/bin/sh\n",
+		PostInstall:   "#!/bin/sh\n",
+		PreDeinstall:  "#!/bin/sh\n",
+		PostDeinstall: "#!/bin/sh\n",
+		PreUpgrade:    "#!/bin/sh\n",
+		PostUpgrade:   "#!/bin/sh\n",
+	}
+
+	for _, tc := range []struct {
+		name       string
+		scriptlets config.Scriptlets
+		legacy     bool
+		want       []string
+	}{{
+		name: "none",
+		want: []string{".PKGINFO"},
+	}, {
+		name:       "all",
+		scriptlets: all,
+		want:       []string{".PKGINFO", ".post-deinstall", ".post-install", ".post-upgrade", ".pre-deinstall", ".pre-install", ".pre-upgrade", ".trigger"},
+	}, {
+		name:       "some",
+		scriptlets: config.Scriptlets{PreInstall: "#!/bin/sh\n", Trigger: all.Trigger, PostInstall: "#!/bin/sh\n"},
+		want:       []string{".PKGINFO", ".post-install", ".pre-install", ".trigger"},
+	}, {
+		name:       "legacy alias",
+		scriptlets: config.Scriptlets{PostInstall: "#!/bin/sh\n"},
+		legacy:     true,
+		want:       []string{".PKGINFO", ".post-install"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			pc := &PackageBuild{
+				Build:       &Build{SourceDateEpoch: time.Unix(0, 0), LegacyControlAlias: tc.legacy},
+				Origin:      &config.Package{Name: "hello", Version: "1.0.0"},
+				PackageName: "hello",
+				Scriptlets:  tc.scriptlets,
+			}
+
+			// The order is the same however often the section is generated.
+			var first []byte
+			for i := 0; i < 5; i++ {
+				control, err := pc.generateControlSection(context.Background())
+				require.NoError(t, err)
+				if first == nil {
+					first = control
+				}
+				require.Equal(t, first, control)
+			}
+
+			zr, err := gzip.NewReader(bytes.NewReader(first))
+			require.NoError(t, err)
+			tr := tar.NewReader(zr)
+			var got []string
+			for {
+				hdr, err := tr.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				require.NoError(t, err)
+				got = append(got, hdr.Name)
+			}
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func Test_generateControlSection_MaxDependencies(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{SourceDateEpoch: time.Unix(0, 0), MaxDependencies: 4}
+	pc := &PackageBuild{
+		Build:       b,
+		Origin:      &config.Package{Name: "hello", Version: "1.0.0"},
+		PackageName: "hello",
+		Dependencies: config.Dependencies{
+			Runtime:  []string{"glibc", "so:libc.so.6"},
+			Provides: []string{"cmd:hello=1.0.0-r0"},
+			Replaces: []string{"hello-compat"},
+		},
+	}
+
+	_, err := pc.generateControlSection(ctx)
+	require.NoError(t, err)
+
+	b.MaxDependencies = 3
+	_, err = pc.generateControlSection(ctx)
+	require.EqualError(t, err, "hello-1.0.0-r0 has 4 dependency lines (2 depend, 1 provides, 1 replaces), exceeding the limit of 3")
+
+	b.MaxDependenciesWarn = true
+	_, err = pc.generateControlSection(ctx)
+	require.NoError(t, err)
+	require.Len(t, b.warnings, 1)
+}
+
+func Test_generateControlSection_MaxScriptletSize(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{SourceDateEpoch: time.Unix(0, 0), MaxScriptletSize: 1024}
+	pc := &PackageBuild{
+		Build:       b,
+		Origin:      &config.Package{Name: "hello", Version: "1.0.0"},
+		PackageName: "hello",
+		Scriptlets:  config.Scriptlets{PostInstall: "#!/bin/sh\n" + strings.Repeat("#", 1014)},
+	}
+
+	_, err := pc.generateControlSection(ctx)
+	require.NoError(t, err)
+
+	pc.Scriptlets.PostInstall += "\n"
+	_, err = pc.generateControlSection(ctx)
+	require.EqualError(t, err, ".post-install scriptlet of hello is 1025 bytes, exceeding the limit of 1024 bytes")
+
+	// Without a limit, large scriptlets are only warned about.
+	b.MaxScriptletSize = 0
+	pc.Scriptlets.PostInstall = "#!/bin/sh\n" + strings.Repeat("#", suspiciousScriptletSize)
+	_, err = pc.generateControlSection(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []Warning{{Package: "hello", Message: ".post-install scriptlet of hello is 65546 bytes, check that no file was pasted into it by mistake"}}, b.Warnings())
+}
+
+func Test_generateControlSection_GeneratedScriptlets(t *testing.T) {
+	origin := &config.Package{
+		Name:                "nginx",
+		Version:             "1.0.0",
+		GeneratedScriptlets: config.GeneratedScriptlets{ProtectRunningService: "nginx"},
+	}
+
+	for _, tc := range []struct {
+		name       string
+		pkg        string
+		scriptlets config.Scriptlets
+		want       string
+		wantErr    string
+	}{{
+		name: "main package",
+		pkg:  "nginx",
+		want: `#!/bin/sh
+# Generated by melange from protect-running-service.
+if pidof nginx >/dev/null 2>&1; then
+	echo "nginx is running, stop it before removing nginx" >&2
+	exit 1
+fi
+`,
+	}, {
+		name: "subpackage",
+		pkg:  "nginx-doc",
+	}, {
+		name:       "configured too",
+		pkg:        "nginx",
+		scriptlets: config.Scriptlets{PreDeinstall: "#!/bin/sh\n"},
+		wantErr:    ".pre-deinstall of nginx is generated from protect-running-service, it cannot also be configured",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			pc := &PackageBuild{
+				Build:       &Build{SourceDateEpoch: time.Unix(0, 0)},
+				Origin:      origin,
+				PackageName: tc.pkg,
+				Scriptlets:  tc.scriptlets,
+			}
+
+			control, err := pc.generateControlSection(context.Background())
+			if tc.wantErr != "" {
+				require.EqualError(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			zr, err := gzip.NewReader(bytes.NewReader(control))
+			require.NoError(t, err)
+			tr := tar.NewReader(zr)
+
+			var got string
+			for {
+				hdr, err := tr.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				require.NoError(t, err)
+				if hdr.Name == ".pre-deinstall" {
+					require.Equal(t, int64(0o755), hdr.Mode&0o777)
+					b, err := io.ReadAll(tr)
+					require.NoError(t, err)
+					got = string(b)
+				}
+			}
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func Test_generateControlSection_ScriptletAccountEnv(t *testing.T) {
+	b := &Build{SourceDateEpoch: time.Unix(0, 0), ScriptletAccountEnv: true}
+	b.Configuration.Environment.Accounts = apko_types.ImageAccounts{
+		Users:  []apko_types.User{{UserName: "www-data", UID: 82, GID: 82}},
+		Groups: []apko_types.Group{{GroupName: "www-data", GID: 82}},
+	}
+
+	for _, tc := range []struct {
+		name, script, want string
+	}{{
+		name:   "interpreter",
+		script: "#!/bin/sh\nadduser -u \"$MELANGE_UID_www_data\" www-data\n",
+		want: `#!/bin/sh
+# Generated by melange from the accounts of the build environment.
+export MELANGE_UID_www_data=82
+export MELANGE_GID_www_data=82
+adduser -u "$MELANGE_UID_www_data" www-data
+`,
+	}, {
+		name:   "no interpreter",
+		script: "true\n",
+		want: `# Generated by melange from the accounts of the build environment.
+export MELANGE_UID_www_data=82
+export MELANGE_GID_www_data=82
+true
+`,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			pc := &PackageBuild{
+				Build:       b,
+				Origin:      &config.Package{Name: "nginx", Version: "1.0.0"},
+				PackageName: "nginx",
+				Scriptlets:  config.Scriptlets{PostInstall: tc.script, PreInstall: "#!/bin/sh\n"},
+			}
+
+			control, err := pc.generateControlSection(context.Background())
+			require.NoError(t, err)
+
+			zr, err := gzip.NewReader(bytes.NewReader(control))
+			require.NoError(t, err)
+			tr := tar.NewReader(zr)
+
+			scripts := map[string]string{}
+			for {
+				hdr, err := tr.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				require.NoError(t, err)
+				if strings.HasPrefix(hdr.Name, ".pre-") || strings.HasPrefix(hdr.Name, ".post-") {
+					// The scriptlet remains executable.
+					require.Equal(t, int64(0o755), hdr.Mode&0o777, hdr.Name)
+					b, err := io.ReadAll(tr)
+					require.NoError(t, err)
+					scripts[hdr.Name] = string(b)
+				}
+			}
+
+			require.Equal(t, tc.want, scripts[".post-install"])
+			// Other scriptlets are left alone.
+			require.Equal(t, "#!/bin/sh\n", scripts[".pre-install"])
+		})
+	}
+}
+
+func Test_protectRunningService(t *testing.T) {
+	_, err := protectRunningService("nginx", "nginx; rm -rf /")
+	require.EqualError(t, err, `invalid service name "nginx; rm -rf /"`)
+}
+
+func TestEmitPackage_LegacyControlAlias(t *testing.T) {
+	ctx := context.Background()
+	for _, alias := range []bool{false, true} {
+		pc := testPackageBuilder(t, &Build{LegacyControlAlias: alias})()
+		require.NoError(t, pc.EmitPackage(ctx))
+
+		f, err := os.Open(pc.Filename())
+		require.NoError(t, err)
+		defer f.Close()
+
+		// apk takes the first control member without a leading dot to
+		// start the data section, so the control section has none.
+		exp, err := expandapk.ExpandApk(ctx, f, t.TempDir())
+		require.NoError(t, err)
+		defer exp.Close()
+		cf, err := os.Open(exp.ControlFile)
+		require.NoError(t, err)
+		defer cf.Close()
+		zr, err := gzip.NewReader(cf)
+		require.NoError(t, err)
+		tr := tar.NewReader(zr)
+		var pkginfo []byte
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+			require.True(t, strings.HasPrefix(hdr.Name, "."), hdr.Name)
+			if hdr.Name == ".PKGINFO" {
+				pkginfo, err = io.ReadAll(tr)
+				require.NoError(t, err)
+			}
+		}
+
+		_, err = f.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		pkg, err := apk.ParsePackage(ctx, f)
+		require.NoError(t, err)
+		require.Equal(t, "hello", pkg.Name)
+
+		path := filepath.Join(pc.OutDir, pc.Identity()+".PKGINFO")
+		if !alias {
+			require.NoFileExists(t, path)
+			continue
+		}
+		got, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, string(pkginfo), string(got))
+	}
+}
+
+func Test_checkOutDir(t *testing.T) {
+	tmp := t.TempDir()
+	workspace := filepath.Join(tmp, "workspace")
+	require.NoError(t, os.MkdirAll(workspace, 0o755))
+	require.NoError(t, os.Symlink(workspace, filepath.Join(tmp, "link")))
+
+	tests := []struct {
+		name   string
+		outDir string
+		inside bool
+	}{
+		{name: "sibling", outDir: filepath.Join(tmp, "packages", "x86_64")},
+		{name: "workspace itself", outDir: workspace, inside: true},
+		{name: "nested", outDir: filepath.Join(workspace, "packages", "x86_64"), inside: true},
+		{name: "relative components", outDir: filepath.Join(tmp, "packages", "..", "workspace", "out"), inside: true},
+		{name: "through symlink", outDir: filepath.Join(tmp, "link", "out"), inside: true},
+		{name: "common prefix", outDir: workspace + "-out"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pc := &PackageBuild{
+				Build:  &Build{WorkspaceDir: workspace},
+				OutDir: test.outDir,
+			}
+
+			err := pc.checkOutDir()
+			if test.inside {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+// testPackageBuilder returns a function producing PackageBuilds for a
+// "hello" package whose workspace contains a single file.
+func testPackageBuilder(t *testing.T, b *Build) func() *PackageBuild {
+	t.Helper()
+	tmp := t.TempDir()
+
+	b.WorkspaceDir = filepath.Join(tmp, "workspace")
+	b.GuestDir = filepath.Join(tmp, "guest")
+	b.SourceDateEpoch = time.Unix(0, 0)
+	require.NoError(t, os.MkdirAll(filepath.Join(b.WorkspaceDir, "melange-out", "hello", "usr", "share"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(b.WorkspaceDir, "melange-out", "hello", "usr", "share", "hello.txt"), []byte("hello\n"), 0o644))
+	require.NoError(t, os.MkdirAll(b.GuestDir, 0o755))
+
+	return func() *PackageBuild {
+		return &PackageBuild{
+			MelangeVersion: "v1.2.3",
+			Build:          b,
+			Origin:         &config.Package{Name: "hello", Version: "1.0.0"},
+			PackageName:    "hello",
+			OriginName:     "hello",
+			OutDir:         filepath.Join(tmp, "packages"),
+			Arch:           "x86_64",
+			Commit:         "deadbeef",
+		}
+	}
+}
+
+func TestEmitPackageReader(t *testing.T) {
+	ctx := context.Background()
+	newPackageBuild := testPackageBuilder(t, &Build{})
+
+	pc := newPackageBuild()
+	require.NoError(t, pc.EmitPackage(ctx))
+	want, err := os.ReadFile(pc.Filename())
+	require.NoError(t, err)
+
+	pc = newPackageBuild()
+	rc, result, err := pc.EmitPackageReader(ctx)
+	require.NoError(t, err)
+	got, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+
+	require.Equal(t, want, got)
+	require.Equal(t, "hello-1.0.0-r0", result.Identity)
+	require.Equal(t, pc.DataHash, result.DataHash)
+	require.Equal(t, int64(len(got)), result.Size)
+	require.False(t, result.Signed)
+}
+
+func TestEmitProvenance(t *testing.T) {
+	ctx := context.Background()
+	pc := testPackageBuilder(t, &Build{
+		ConfigFile:     "hello.yaml",
+		EmitProvenance: true,
+	})()
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	apk, err := os.ReadFile(pc.Filename())
+	require.NoError(t, err)
+	digest := sha256.Sum256(apk)
+
+	data, err := os.ReadFile(filepath.Join(pc.OutDir, "hello-1.0.0-r0.intoto.jsonl"))
+	require.NoError(t, err)
+
+	var stmt inTotoStatement
+	require.NoError(t, json.Unmarshal(data, &stmt))
+	require.Equal(t, slsaProvenanceType, stmt.PredicateType)
+	require.Len(t, stmt.Subject, 1)
+	require.Equal(t, "hello-1.0.0-r0.apk", stmt.Subject[0].Name)
+	require.Equal(t, hex.EncodeToString(digest[:]), stmt.Subject[0].Digest["sha256"])
+	require.Equal(t, pc.Result.Digest, stmt.Subject[0].Digest["sha256"])
+	require.Equal(t, "v1.2.3", stmt.Predicate.RunDetails.Builder.Version["melange"])
+	require.Equal(t, []resourceDescriptor{{
+		URI:    "hello.yaml",
+		Digest: map[string]string{"gitCommit": "deadbeef"},
+	}}, stmt.Predicate.BuildDefinition.ResolvedDependencies)
+}
+
+func TestMaxDataSize(t *testing.T) {
+	ctx := context.Background()
+	newPackageBuild := testPackageBuilder(t, &Build{MaxDataSize: 16})
+
+	pc := newPackageBuild()
+	err := pc.EmitPackage(ctx)
+	require.ErrorContains(t, err, "exceeding the limit of 16 bytes")
+	require.NoFileExists(t, pc.Filename())
+
+	pc.Build.MaxDataSize = 1 << 20
+	pc = newPackageBuild()
+	require.NoError(t, pc.EmitPackage(ctx))
+	require.FileExists(t, pc.Filename())
+}
+
+func TestInstalledSizeBounds(t *testing.T) {
+	ctx := context.Background()
+	newPackageBuild := testPackageBuilder(t, &Build{})
+
+	pc := newPackageBuild()
+	pc.Origin.MaxInstalledSize = 1
+	require.ErrorContains(t, pc.EmitPackage(ctx), "exceeding the maximum of 1 bytes")
+	require.NoFileExists(t, pc.Filename())
+
+	pc = newPackageBuild()
+	pc.Origin.MinInstalledSize = 1 << 30
+	require.ErrorContains(t, pc.EmitPackage(ctx), "below the minimum of 1073741824 bytes")
+	require.NoFileExists(t, pc.Filename())
+
+	pc = newPackageBuild()
+	pc.Origin.MinInstalledSize = 1
+	pc.Origin.MaxInstalledSize = 1 << 30
+	require.NoError(t, pc.EmitPackage(ctx))
+	require.FileExists(t, pc.Filename())
+}
+
+func TestEmitPerPackageIndex(t *testing.T) {
+	ctx := context.Background()
+	pc := testPackageBuilder(t, &Build{EmitPerPackageIndex: true})()
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	f, err := os.Open(filepath.Join(pc.OutDir, "hello-1.0.0-r0.index"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	idx, err := apk.IndexFromArchive(f)
+	require.NoError(t, err)
+	require.Len(t, idx.Packages, 1)
+	require.Equal(t, "hello", idx.Packages[0].Name)
+	require.Equal(t, "1.0.0-r0", idx.Packages[0].Version)
+	require.Equal(t, pc.Result.ControlHash, hex.EncodeToString(idx.Packages[0].Checksum))
+}
+
+func TestEmitPerPackageIndex_IndexSigningKey(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	packageKey, _ := writeTestKey(t, dir, "package.rsa")
+	indexKey, _ := writeTestKey(t, dir, "repo.rsa")
+
+	pc := testPackageBuilder(t, &Build{
+		EmitPerPackageIndex: true,
+		SigningKey:          packageKey,
+		IndexSigningKey:     indexKey,
+	})()
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	// The signature is the first entry of both the apk and the index.
+	signatureName := func(path string) string {
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		defer f.Close()
+
+		zr, err := gzip.NewReader(f)
+		require.NoError(t, err)
+		hdr, err := tar.NewReader(zr).Next()
+		require.NoError(t, err)
+		return hdr.Name
+	}
+
+	require.Equal(t, ".SIGN.RSA.package.rsa.pub", signatureName(pc.Filename()))
+	require.Equal(t, ".SIGN.RSA.repo.rsa.pub", signatureName(filepath.Join(pc.OutDir, "hello-1.0.0-r0.index")))
+}
+
+func TestEmitResultChanged(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{}
+	newPackageBuild := testPackageBuilder(t, b)
+
+	// Without a baseline, every package is changed.
+	pc := newPackageBuild()
+	require.NoError(t, pc.EmitPackage(ctx))
+	require.True(t, pc.Result.Changed)
+
+	b.BaselineDataHashes = map[string]string{"hello": pc.DataHash}
+	pc = newPackageBuild()
+	require.NoError(t, pc.EmitPackage(ctx))
+	require.False(t, pc.Result.Changed)
+
+	b.BaselineDataHashes = map[string]string{"hello": "baadf00d"}
+	pc = newPackageBuild()
+	require.NoError(t, pc.EmitPackage(ctx))
+	require.True(t, pc.Result.Changed)
+}
+
+func TestEmitDataArtifact(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{EmitDataArtifact: true}
+	newPackageBuild := testPackageBuilder(t, b)
+
+	pc := newPackageBuild()
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	data, err := os.ReadFile(filepath.Join(pc.OutDir, pc.Identity()+".data.tar.gz"))
+	require.NoError(t, err)
+	sum := sha256.Sum256(data)
+	require.Equal(t, pc.Result.DataHash, hex.EncodeToString(sum[:]))
+
+	apk, err := os.ReadFile(pc.Filename())
+	require.NoError(t, err)
+	require.True(t, bytes.HasSuffix(apk, data))
+}
+
+// localPackage is an apk on disk, installable with go-apk.
+type localPackage struct {
+	path, name, checksum string
+}
+
+func (p localPackage) URL() string            { return p.path }
+func (p localPackage) PackageName() string    { return p.name }
+func (p localPackage) ChecksumString() string { return p.checksum }
+
+func TestStubPackages(t *testing.T) {
+	ctx := context.Background()
+	keyFile, _ := writeTestKey(t, t.TempDir(), "melange.rsa")
+	pc := testPackageBuilder(t, &Build{StubPackages: true, SigningKey: keyFile})()
+	require.NoError(t, pc.EmitPackage(ctx))
+	require.True(t, pc.Result.Signed)
+	require.Zero(t, pc.InstalledSize)
+
+	f, err := os.Open(pc.Filename())
+	require.NoError(t, err)
+	defer f.Close()
+	pkg, err := apk.ParsePackage(ctx, f)
+	require.NoError(t, err)
+	require.Equal(t, "hello", pkg.Name)
+	require.Zero(t, pkg.InstalledSize)
+
+	// Only the signature and .PKGINFO precede the empty data section.
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	tr := tar.NewReader(zr)
+	names := []string{}
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	require.Equal(t, []string{".SIGN.RSA.melange.rsa.pub", ".PKGINFO"}, names)
+
+	a, err := apk.New(apk.WithFS(apkfs.NewMemFS()), apk.WithArch("x86_64"))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+	require.NoError(t, a.InstallPackages(ctx, nil, []apk.InstallablePackage{
+		localPackage{path: pc.Filename(), name: "hello", checksum: "Q1" + base64.StdEncoding.EncodeToString(pkg.Checksum)},
+	}))
+
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Len(t, installed, 1)
+	require.Equal(t, "hello", installed[0].Name)
+	require.Empty(t, installed[0].Files)
+}
+
+func TestSkipSignature(t *testing.T) {
+	ctx := context.Background()
+	keyFile, _ := writeTestKey(t, t.TempDir(), "melange.rsa")
+	b := &Build{SigningKey: keyFile}
+	newPackageBuild := testPackageBuilder(t, b)
+	require.NoError(t, os.MkdirAll(filepath.Join(b.WorkspaceDir, "melange-out", "hello-debug", "usr", "lib", "debug"), 0o755))
+
+	// The main package opts out, its subpackage is still signed.
+	sub := newPackageBuild()
+	sub.Origin.SkipSignature = true
+	sub.PackageName = "hello-debug"
+	pkg := newPackageBuild()
+	pkg.Origin = sub.Origin
+
+	for _, tc := range []struct {
+		pc     *PackageBuild
+		signed bool
+	}{{pc: pkg, signed: false}, {pc: sub, signed: true}} {
+		require.NoError(t, tc.pc.EmitPackage(ctx))
+		require.Equal(t, tc.signed, tc.pc.Result.Signed, tc.pc.PackageName)
+
+		f, err := os.Open(tc.pc.Filename())
+		require.NoError(t, err)
+		defer f.Close()
+		zr, err := gzip.NewReader(f)
+		require.NoError(t, err)
+		hdr, err := tar.NewReader(zr).Next()
+		require.NoError(t, err)
+		require.Equal(t, tc.signed, strings.HasPrefix(hdr.Name, ".SIGN."), tc.pc.PackageName)
+	}
+}
+
+func TestCheckSigningKey(t *testing.T) {
+	ctx := context.Background()
+	keyFile, _ := writeTestKey(t, t.TempDir(), "melange.rsa")
+	missing := filepath.Join(t.TempDir(), "missing.rsa")
+
+	b := &Build{SigningKey: keyFile}
+	require.NoError(t, b.checkSigningKey(ctx))
+	require.Equal(t, keyFile, b.SigningKey)
+
+	// A missing key fails before anything is built, naming the key.
+	b = &Build{SigningKey: missing}
+	require.ErrorContains(t, b.checkSigningKey(ctx), "signing key "+missing+" does not exist")
+
+	// Unless it is optional, in which case packages are not signed.
+	b = &Build{SigningKey: missing, SigningKeyOptional: true}
+	require.NoError(t, b.checkSigningKey(ctx))
+	require.Empty(t, b.SigningKey)
+}
+
+// encryptTestKey writes keyFile encrypted with passphrase to dir/name.
+func encryptTestKey(t *testing.T, keyFile, passphrase, dir, name string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(keyFile)
+	require.NoError(t, err)
+	block, _ := pem.Decode(data)
+	//nolint:staticcheck
+	block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, []byte(passphrase), x509.PEMCipherAES256)
+	require.NoError(t, err)
+
+	encrypted := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(encrypted, pem.EncodeToMemory(block), 0o600))
+	return encrypted
+}
+
+func TestCheckSigningKey_Encrypted(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	plain, _ := writeTestKey(t, dir, "plain.rsa")
+	keyFile := encryptTestKey(t, plain, "secret", dir, "melange.rsa")
+
+	// The passphrase is prompted for once, before anything is built, and
+	// kept for signing packages and indexes.
+	prompts := 0
+	prompt := func(passphrase string) func() (string, error) {
+		return func() (string, error) {
+			prompts++
+			return passphrase, nil
+		}
+	}
+	b := &Build{SigningKey: keyFile, PassphrasePrompt: prompt("secret")}
+	require.NoError(t, b.checkSigningKey(ctx))
+	require.Equal(t, 1, prompts)
+	require.Equal(t, "secret", b.SigningPassphrase)
+	require.Equal(t, "secret", b.indexSigningPassphrase())
+
+	// A wrong passphrase fails before anything is built.
+	b = &Build{SigningKey: keyFile, PassphrasePrompt: prompt("wrong")}
+	require.ErrorContains(t, b.checkSigningKey(ctx), "unable to decrypt signing key "+keyFile)
+	b = &Build{SigningKey: keyFile, SigningPassphrase: "wrong"}
+	require.ErrorContains(t, b.checkSigningKey(ctx), "unable to decrypt signing key "+keyFile)
+
+	// As does an encrypted key with no way to get its passphrase.
+	b = &Build{SigningKey: keyFile}
+	require.ErrorContains(t, b.checkSigningKey(ctx), "there is no passphrase")
+
+	// A separate index signing key is signed without a passphrase.
+	b = &Build{SigningKey: plain, IndexSigningKey: keyFile, SigningPassphrase: "secret", GenerateIndex: true}
+	require.ErrorContains(t, b.checkSigningKey(ctx), "index signing key "+keyFile+" is encrypted")
+	b = &Build{IndexSigningKey: keyFile, EmitPerPackageIndex: true}
+	require.ErrorContains(t, b.checkSigningKey(ctx), "index signing key "+keyFile+" is encrypted")
+}
+
+func TestEmitPerPackageIndex_EncryptedKey(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	plain, _ := writeTestKey(t, dir, "plain.rsa")
+	keyFile := encryptTestKey(t, plain, "secret", dir, "melange.rsa")
+
+	b := &Build{
+		EmitPerPackageIndex: true,
+		SigningKey:          keyFile,
+		PassphrasePrompt:    func() (string, error) { return "secret", nil },
+	}
+	require.NoError(t, b.checkSigningKey(ctx))
+	b.PassphrasePrompt = func() (string, error) {
+		return "", errors.New("prompted again")
+	}
+
+	pc := testPackageBuilder(t, b)()
+	require.NoError(t, pc.EmitPackage(ctx))
+	require.FileExists(t, filepath.Join(pc.OutDir, "hello-1.0.0-r0.index"))
+}
+
+func TestEmitFileChecksums(t *testing.T) {
+	ctx := context.Background()
+	pc := testPackageBuilder(t, &Build{EmitFileChecksums: true})()
+	require.NoError(t, os.Symlink("hello.txt", filepath.Join(pc.WorkspaceSubdir(), "usr", "share", "greeting.txt")))
+
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	//nolint:gosec
+	file := sha1.Sum([]byte("hello\n"))
+	//nolint:gosec
+	link := sha1.Sum([]byte("hello.txt"))
+	want := map[string]string{
+		"usr/share/hello.txt":    hex.EncodeToString(file[:]),
+		"usr/share/greeting.txt": hex.EncodeToString(link[:]),
+	}
+	require.Equal(t, want, pc.Result.FileChecksums)
+
+	// The checksums are those apk records for each file.
+	headers, _ := readDataSection(t, pc)
+	for name, sum := range want {
+		require.Equal(t, sum, headers[name].PAXRecords[apkChecksumPAXRecord])
+	}
+
+	data, err := os.ReadFile(filepath.Join(pc.OutDir, "hello-1.0.0-r0.filesums.json"))
+	require.NoError(t, err)
+	var sums fileChecksums
+	require.NoError(t, json.Unmarshal(data, &sums))
+	require.Equal(t, "sha1", sums.Algorithm)
+	require.Equal(t, want, sums.Files)
+}
+
+func TestArchAlias(t *testing.T) {
+	ctx := context.Background()
+	tmp := t.TempDir()
+
+	b := &Build{
+		Arch:            apko_types.ParseArchitecture("armv7"),
+		ArchAlias:       map[string]string{"armv7": "armhf"},
+		OutDir:          filepath.Join(tmp, "packages"),
+		WorkspaceDir:    filepath.Join(tmp, "workspace"),
+		GuestDir:        filepath.Join(tmp, "guest"),
+		SourceDateEpoch: time.Unix(0, 0),
+		Configuration: config.Configuration{
+			Package: config.Package{Name: "hello", Version: "1.0.0"},
+		},
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(b.WorkspaceDir, "melange-out", "hello", "usr", "share"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(b.WorkspaceDir, "melange-out", "hello", "usr", "share", "hello.txt"), []byte("hello\n"), 0o644))
+	require.NoError(t, os.MkdirAll(b.GuestDir, 0o755))
+
+	pb := &PipelineBuild{Build: b}
+	require.NoError(t, pb.Emit(ctx, &b.Configuration.Package))
+
+	f, err := os.Open(filepath.Join(b.OutDir, "armhf", "hello-1.0.0-r0.apk"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	pkg, err := apk.ParsePackage(ctx, f)
+	require.NoError(t, err)
+	require.Equal(t, "armhf", pkg.Arch)
+	require.NoDirExists(t, filepath.Join(b.OutDir, "armv7"))
+}
+
+func TestEmitArchScriptlets(t *testing.T) {
+	ctx := context.Background()
+
+	postInstall := func(arch string) string {
+		tmp := t.TempDir()
+		b := &Build{
+			Arch:            apko_types.ParseArchitecture(arch),
+			OutDir:          filepath.Join(tmp, "packages"),
+			WorkspaceDir:    filepath.Join(tmp, "workspace"),
+			GuestDir:        filepath.Join(tmp, "guest"),
+			SourceDateEpoch: time.Unix(0, 0),
+			Configuration: config.Configuration{
+				Package: config.Package{
+					Name:    "hello",
+					Version: "1.0.0",
+					Scriptlets: config.Scriptlets{
+						PostInstall: "#!/bin/sh\necho hello\n",
+						Arch: map[string]config.ArchScriptlets{
+							"amd64": {
+								Mode:        config.ArchScriptletsAppend,
+								PostInstall: "#!/bin/sh\nupdate-alternatives --install hello\n",
+							},
+						},
+					},
+				},
+			},
+		}
+		require.NoError(t, os.MkdirAll(filepath.Join(b.WorkspaceDir, "melange-out", "hello", "usr", "share"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(b.WorkspaceDir, "melange-out", "hello", "usr", "share", "hello.txt"), []byte("hello\n"), 0o644))
+		require.NoError(t, os.MkdirAll(b.GuestDir, 0o755))
+
+		pb := &PipelineBuild{Build: b}
+		require.NoError(t, pb.Emit(ctx, &b.Configuration.Package))
+
+		f, err := os.Open(filepath.Join(b.OutDir, b.Arch.ToAPK(), "hello-1.0.0-r0.apk"))
+		require.NoError(t, err)
+		defer f.Close()
+
+		zr, err := gzip.NewReader(f)
+		require.NoError(t, err)
+		zr.Multistream(false)
+		// The package is unsigned, so its first stream is the control section.
+		tr := tar.NewReader(zr)
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+			if hdr.Name == ".post-install" {
+				b, err := io.ReadAll(tr)
+				require.NoError(t, err)
+				return string(b)
+			}
+		}
+		return ""
+	}
+
+	require.Equal(t, "#!/bin/sh\necho hello\nupdate-alternatives --install hello\n", postInstall("x86_64"))
+	require.Equal(t, "#!/bin/sh\necho hello\n", postInstall("aarch64"))
+}
+
+func TestGroupByOrigin(t *testing.T) {
+	ctx := context.Background()
+	tmp := t.TempDir()
+
+	b := &Build{
+		Arch:            apko_types.ParseArchitecture("x86_64"),
+		GroupByOrigin:   true,
+		OutDir:          filepath.Join(tmp, "packages"),
+		WorkspaceDir:    filepath.Join(tmp, "workspace"),
+		GuestDir:        filepath.Join(tmp, "guest"),
+		SourceDateEpoch: time.Unix(0, 0),
+		Configuration: config.Configuration{
+			Package:     config.Package{Name: "hello", Version: "1.0.0"},
+			Subpackages: []config.Subpackage{{Name: "hello-doc"}},
+		},
+	}
+	for _, name := range []string{"hello", "hello-doc"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(b.WorkspaceDir, "melange-out", name, "usr", "share"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(b.WorkspaceDir, "melange-out", name, "usr", "share", name+".txt"), []byte("hello\n"), 0o644))
+	}
+	require.NoError(t, os.MkdirAll(b.GuestDir, 0o755))
+
+	pb := &PipelineBuild{Build: b}
+	require.NoError(t, pb.Emit(ctx, &b.Configuration.Package))
+	require.NoError(t, pb.Emit(ctx, pkgFromSub(&b.Configuration.Subpackages[0])))
+
+	require.FileExists(t, filepath.Join(b.OutDir, "x86_64", "hello", "hello-1.0.0-r0.apk"))
+	require.FileExists(t, filepath.Join(b.OutDir, "x86_64", "hello", "hello-doc-1.0.0-r0.apk"))
+
+	logDir := t.TempDir()
+	b.CreateBuildLog = true
+	pc := &PackageBuild{
+		Build:       b,
+		Origin:      &b.Configuration.Package,
+		PackageName: "hello-doc",
+		OriginName:  "hello",
+		OutDir:      b.packageDir(pkgFromSub(&b.Configuration.Subpackages[0])),
+		Arch:        "x86_64",
+	}
+	require.NoError(t, pc.AppendBuildLog(logDir))
+	buildLog, err := os.ReadFile(filepath.Join(logDir, "packages.log"))
+	require.NoError(t, err)
+	require.Equal(t, "x86_64|hello|hello-doc|1.0.0-r0|path=x86_64/hello/hello-doc-1.0.0-r0.apk\n", string(buildLog))
+
+	// Stripped origins group each package by itself.
+	b.StripOriginName = true
+	require.Equal(t, filepath.Join(b.OutDir, "x86_64", "hello-doc"), b.packageDir(pkgFromSub(&b.Configuration.Subpackages[0])))
+}
+
+func TestPackageNameSuffix(t *testing.T) {
+	ctx := context.Background()
+	tmp := t.TempDir()
+
+	b := &Build{
+		Arch:              apko_types.ParseArchitecture("x86_64"),
+		PackageNameSuffix: "-openssl",
+		OutDir:            filepath.Join(tmp, "packages"),
+		WorkspaceDir:      filepath.Join(tmp, "workspace"),
+		GuestDir:          filepath.Join(tmp, "guest"),
+		SourceDateEpoch:   time.Unix(0, 0),
+		Configuration: config.Configuration{
+			Package: config.Package{Name: "hello", Version: "1.0.0"},
+			Subpackages: []config.Subpackage{{
+				Name: "hello-dev",
+				Dependencies: config.Dependencies{
+					Runtime:  []string{"hello=1.0.0-r0", "zlib"},
+					Provides: []string{"hello-headers=1.0.0-r0"},
+					Replaces: []string{"hello"},
+				},
+			}},
+		},
+	}
+	for _, name := range []string{"hello", "hello-dev"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(b.WorkspaceDir, "melange-out", name, "usr", "share"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(b.WorkspaceDir, "melange-out", name, "usr", "share", name+".txt"), []byte("hello\n"), 0o644))
+	}
+	require.NoError(t, os.MkdirAll(b.GuestDir, 0o755))
+
+	pb := &PipelineBuild{Build: b}
+	require.NoError(t, pb.Emit(ctx, &b.Configuration.Package))
+	require.NoError(t, pb.Emit(ctx, pkgFromSub(&b.Configuration.Subpackages[0])))
+
+	parse := func(name string) *apk.Package {
+		f, err := os.Open(filepath.Join(b.OutDir, "x86_64", name))
+		require.NoError(t, err)
+		defer f.Close()
+		pkg, err := apk.ParsePackage(ctx, f)
+		require.NoError(t, err)
+		return pkg
+	}
+
+	main := parse("hello-openssl-1.0.0-r0.apk")
+	require.Equal(t, "hello-openssl", main.Name)
+	require.Equal(t, "hello-openssl", main.Origin)
+	// The contents are still taken from the workspace of the package.
+	require.NotZero(t, main.InstalledSize)
+
+	dev := parse("hello-dev-openssl-1.0.0-r0.apk")
+	require.Equal(t, "hello-dev-openssl", dev.Name)
+	require.Equal(t, "hello-openssl", dev.Origin)
+	// Dependencies on the packages of the build are on the same flavor.
+	require.Equal(t, []string{"hello-openssl=1.0.0-r0", "zlib"}, dev.Dependencies)
+	require.Equal(t, []string{"hello-headers=1.0.0-r0"}, dev.Provides)
+	require.Equal(t, []string{"hello-openssl"}, dev.Replaces)
+
+	// The configuration itself is unchanged.
+	require.Equal(t, "hello", b.Configuration.Package.Name)
+	require.Equal(t, []string{"hello=1.0.0-r0", "zlib"}, b.Configuration.Subpackages[0].Dependencies.Runtime)
+}
+
+func TestConfigFiles(t *testing.T) {
+	ctx := context.Background()
+	pc := testPackageBuilder(t, &Build{})()
+	pc.Origin.ConfigFiles = []string{"/etc/hello.conf", "usr/share/hello.txt"}
+
+	require.NoError(t, os.MkdirAll(filepath.Join(pc.WorkspaceSubdir(), "etc"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(pc.WorkspaceSubdir(), "etc", "hello.conf"), []byte("greeting = hello\n"), 0o644))
+
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	f, err := os.Open(pc.Filename())
+	require.NoError(t, err)
+	defer f.Close()
+
+	exp, err := expandapk.ExpandApk(ctx, f, t.TempDir())
+	require.NoError(t, err)
+	defer exp.Close()
+
+	control, err := exp.ControlData()
+	require.NoError(t, err)
+	require.Contains(t, string(control), "\n# config = etc/hello.conf\n# config = usr/share/hello.txt\n")
+
+	// apk reads the protected paths of installed packages, and does not
+	// overwrite modified files under them on upgrade.
+	list, err := fs.ReadFile(exp.TarFS, "etc/apk/protected_paths.d/hello.list")
+	require.NoError(t, err)
+	require.Equal(t, "+etc/hello.conf\n+usr/share/hello.txt\n", string(list))
+
+	// Config files must be part of the package.
+	pc = testPackageBuilder(t, &Build{})()
+	pc.Origin.ConfigFiles = []string{"etc/missing.conf"}
+	require.ErrorContains(t, pc.EmitPackage(ctx), "config file etc/missing.conf is not in hello")
+}
+
+func TestChangelog(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{}
+	newPackageBuild := testPackageBuilder(t, b)
+	b.SourceDir = t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(b.SourceDir, "CHANGELOG"), []byte("1.0.0: first release\n"), 0o644))
+
+	pc := newPackageBuild()
+	pc.Origin.Changelog = &config.Changelog{File: "CHANGELOG"}
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	f, err := os.Open(pc.Filename())
+	require.NoError(t, err)
+	defer f.Close()
+
+	exp, err := expandapk.ExpandApk(ctx, f, t.TempDir())
+	require.NoError(t, err)
+	defer exp.Close()
+
+	control, err := exp.ControlData()
+	require.NoError(t, err)
+	require.Contains(t, string(control), "\n# changelog present\n")
+
+	changelog, err := fs.ReadFile(exp.TarFS, "usr/share/doc/hello/changelog")
+	require.NoError(t, err)
+	require.Equal(t, "1.0.0: first release\n", string(changelog))
+
+	// Subpackages do not get a copy of the changelog.
+	sub := newPackageBuild()
+	sub.Origin.Changelog = &config.Changelog{Contents: "1.0.0: first release\n"}
+	sub.PackageName = "hello-doc"
+	require.Empty(t, sub.Changelog())
+
+	// The changelog and the directories created for it are owned by root,
+	// whoever melange runs as.
+	if os.Getuid() == 0 {
+		pc = newPackageBuild()
+		pc.Origin.Changelog = &config.Changelog{Contents: "1.0.0: first release\n"}
+		require.NoError(t, os.RemoveAll(filepath.Join(pc.WorkspaceSubdir(), "usr", "share", "doc")))
+		require.NoError(t, pc.writeChangelog())
+		for _, name := range []string{"usr/share/doc", "usr/share/doc/hello", "usr/share/doc/hello/changelog"} {
+			require.NoError(t, os.Lchown(filepath.Join(pc.WorkspaceSubdir(), name), 1000, 1000))
+		}
+
+		headers, _ := readDataSection(t, pc)
+		for _, name := range []string{"usr/share/doc", "usr/share/doc/hello", "usr/share/doc/hello/changelog"} {
+			require.Equal(t, 0, headers[name].Uid, name)
+			require.Equal(t, "root", headers[name].Uname, name)
+		}
+	}
+}
+
+func TestInjectedFileMode(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{InjectedFileMode: 0o640}
+	pc := testPackageBuilder(t, b)()
+	pc.Origin.Changelog = &config.Changelog{Contents: "1.0.0: first release\n"}
+	require.NoError(t, pc.writeChangelog())
+	require.NoError(t, os.MkdirAll(filepath.Join(pc.WorkspaceSubdir(), sbomDir), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(pc.WorkspaceSubdir(), sbomDir, "hello-1.0.0-r0.spdx.json"), []byte("{}\n"), 0o600))
+	require.NoError(t, pc.recordInjectedSBOMs())
+
+	// Remap the owner of the workspace, as when building in a user
+	// namespace; the injected files are still owned by root.
+	remapUIDs := map[int]int{os.Getuid(): 4242}
+	remapGIDs := map[int]int{os.Getgid(): 4242}
+	var buf bytes.Buffer
+	require.NoError(t, pc.writeDataTar(ctx, &buf, readlinkFS(pc.WorkspaceSubdir()), os.DirFS(b.GuestDir), remapUIDs, remapGIDs))
+
+	headers := map[string]*tar.Header{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		headers[hdr.Name] = hdr
+	}
+
+	for _, name := range []string{"usr/share/doc/hello/changelog", sbomDir + "/hello-1.0.0-r0.spdx.json"} {
+		require.Contains(t, headers, name)
+		require.Equal(t, int64(0o640), headers[name].Mode, name)
+		require.Equal(t, 0, headers[name].Uid, name)
+		require.Equal(t, 0, headers[name].Gid, name)
+		require.Equal(t, "root", headers[name].Uname, name)
+		require.Equal(t, "root", headers[name].Gname, name)
+	}
+	require.Equal(t, 4242, headers["usr/share/hello.txt"].Uid)
+	require.Equal(t, int64(0o644), headers["usr/share/hello.txt"].Mode)
+}
+
+func TestNormalizeStandardDirs(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{NormalizeStandardDirs: true}
+	pc := testPackageBuilder(t, b)()
+	require.NoError(t, os.MkdirAll(filepath.Join(pc.WorkspaceSubdir(), "usr", "share", "hello"), 0o775))
+	for _, dir := range []string{"usr", "usr/share/hello"} {
+		require.NoError(t, os.Chmod(filepath.Join(pc.WorkspaceSubdir(), dir), 0o775))
+	}
+
+	// Remap the owner of the workspace, as when building in a user
+	// namespace.
+	remapUIDs := map[int]int{os.Getuid(): 4242}
+	remapGIDs := map[int]int{os.Getgid(): 4242}
+	var buf bytes.Buffer
+	require.NoError(t, pc.writeDataTar(ctx, &buf, readlinkFS(pc.WorkspaceSubdir()), os.DirFS(b.GuestDir), remapUIDs, remapGIDs))
+
+	headers := map[string]*tar.Header{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		headers[strings.TrimSuffix(hdr.Name, "/")] = hdr
+	}
+
+	for _, name := range []string{"usr", "usr/share"} {
+		require.Contains(t, headers, name)
+		require.Equal(t, int64(0o755), headers[name].Mode, name)
+		require.Equal(t, 0, headers[name].Uid, name)
+		require.Equal(t, 0, headers[name].Gid, name)
+		require.Equal(t, "root", headers[name].Uname, name)
+		require.Equal(t, "root", headers[name].Gname, name)
+	}
+
+	// Other directories are left alone.
+	require.Equal(t, 4242, headers["usr/share/hello"].Uid)
+	require.Equal(t, int64(0o775), headers["usr/share/hello"].Mode)
+}
+
+func TestEmbedConfig(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{EmbedConfigDigest: true, EmbedConfigFile: true}
+	newPackageBuild := testPackageBuilder(t, b)
+
+	const yaml = "package:\n  name: hello\n  version: 1.0.0\n"
+	b.ConfigFile = filepath.Join(t.TempDir(), "hello.yaml")
+	require.NoError(t, os.WriteFile(b.ConfigFile, []byte(yaml), 0o644))
+	require.NoError(t, b.readConfigFile())
+
+	pc := newPackageBuild()
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	f, err := os.Open(pc.Filename())
+	require.NoError(t, err)
+	defer f.Close()
+
+	exp, err := expandapk.ExpandApk(ctx, f, t.TempDir())
+	require.NoError(t, err)
+	defer exp.Close()
+
+	control, err := exp.ControlData()
+	require.NoError(t, err)
+	sum := sha256.Sum256([]byte(yaml))
+	require.Contains(t, string(control), "\n# configdigest = "+hex.EncodeToString(sum[:])+"\n")
+
+	embedded, err := fs.ReadFile(exp.TarFS, "usr/share/melange/hello.yaml")
+	require.NoError(t, err)
+	require.Equal(t, yaml, string(embedded))
+
+	// The embedded file and the directories created for it are owned by
+	// root, whoever melange runs as.
+	if os.Getuid() == 0 {
+		names := []string{"usr/share/melange", "usr/share/melange/hello.yaml"}
+		for _, name := range names {
+			require.NoError(t, os.Lchown(filepath.Join(pc.WorkspaceSubdir(), name), 1000, 1000))
+		}
+
+		headers, _ := readDataSection(t, pc)
+		for _, name := range names {
+			require.Equal(t, 0, headers[name].Uid, name)
+			require.Equal(t, "root", headers[name].Uname, name)
+		}
+	}
+
+	// Neither is embedded unless enabled.
+	b.EmbedConfigDigest, b.EmbedConfigFile = false, false
+	pc = newPackageBuild()
+	require.NoError(t, os.RemoveAll(filepath.Join(pc.WorkspaceSubdir(), "usr", "share", "melange")))
+	var buf bytes.Buffer
+	require.NoError(t, pc.GenerateControlData(&buf))
+	require.NotContains(t, buf.String(), "# configdigest =")
+	require.NoError(t, pc.writeEmbeddedConfig())
+	require.NoDirExists(t, filepath.Join(pc.WorkspaceSubdir(), "usr", "share", "melange"))
+}
+
+func TestEmitPackage_SBOMDependencies(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{DepNameRewrite: PrefixDepNames("corp-")}
+	pc := testPackageBuilder(t, b)()
+	pc.Dependencies.Runtime = []string{"glibc"}
+
+	spec := &sbom.Spec{
+		Path:           pc.WorkspaceSubdir(),
+		PackageName:    pc.PackageName,
+		PackageVersion: "1.0.0-r0",
+		Arch:           pc.Arch,
+		Dependencies:   pc.Dependencies.Runtime,
+		Formats:        []string{sbom.FormatCycloneDX},
+	}
+	require.NoError(t, sbom.NewGenerator().GenerateSBOM(ctx, spec))
+	b.sbomSpecs = map[string]*sbom.Spec{pc.PackageName: spec}
+	require.NoError(t, pc.recordInjectedSBOMs())
+
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	// The SBOM in the package has the dependencies in .PKGINFO, rather
+	// than those configured.
+	f, err := os.Open(pc.Filename())
+	require.NoError(t, err)
+	defer f.Close()
+	exp, err := expandapk.ExpandApk(ctx, f, t.TempDir())
+	require.NoError(t, err)
+	defer exp.Close()
+	doc, err := fs.ReadFile(exp.TarFS, sbomDir+"/hello-1.0.0-r0.cdx.json")
+	require.NoError(t, err)
+	require.Contains(t, string(doc), "pkg:apk/corp-glibc?")
+	require.NotContains(t, string(doc), "pkg:apk/glibc?")
+	require.Equal(t, []string{"corp-glibc"}, pc.Dependencies.Runtime)
+}
+
+func TestSCAReport(t *testing.T) {
+	ctx := context.Background()
+	pc := testPackageBuilder(t, &Build{SCAReport: true})()
+
+	lib, err := os.ReadFile(filepath.Join("..", "sca", "testdata", "rpath", "usr", "lib", "libleaky-rpath.so.1"))
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join(pc.WorkspaceSubdir(), "usr", "lib"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(pc.WorkspaceSubdir(), "usr", "lib", "libleaky.so.1"), lib, 0o755))
+
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	report, err := os.ReadFile(filepath.Join(pc.OutDir, pc.Identity()+".sca-report.json"))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"findings": [{"path": "usr/lib/libleaky.so.1", "kind": "rpath", "value": "/home/build/output/lib"}]}`, string(report))
+}
+
+func TestComputeDataHash(t *testing.T) {
+	ctx := context.Background()
+	pc := testPackageBuilder(t, &Build{})()
+
+	// The test environment has no build user, so uid and gid 0 map to 0.
+	remap := map[int]int{0: 0}
+	hash, err := pc.ComputeDataHash(ctx, readlinkFS(pc.WorkspaceSubdir()), remap, remap)
+	require.NoError(t, err)
+	require.NoFileExists(t, pc.Filename())
+
+	require.NoError(t, pc.EmitPackage(ctx))
+	require.Equal(t, pc.Result.ContentHash, hash)
+	require.NotEqual(t, pc.Result.DataHash, hash)
+
+	// The content hash follows the contents.
+	require.NoError(t, os.WriteFile(filepath.Join(pc.WorkspaceSubdir(), "usr", "share", "hello.txt"), []byte("goodbye\n"), 0o644))
+	changed, err := pc.ComputeDataHash(ctx, readlinkFS(pc.WorkspaceSubdir()), remap, remap)
+	require.NoError(t, err)
+	require.NotEqual(t, hash, changed)
+}
+
+func TestContentHashCompression(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name string
+		b    *Build
+		want string
+	}{
+		{"gzip", &Build{}, DataCompressionGzip},
+		{"gzip-fast", &Build{DataCompression: DataCompressionAuto}, DataCompressionGzipFast},
+		{"store", &Build{
+			DataCompression:           DataCompressionAuto,
+			AutoCompressionThresholds: AutoCompressionThresholds{LargeSize: 1 << 30},
+		}, DataCompressionStore},
+		{"stable", &Build{StableCompression: true}, DataCompressionGzipBest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pc := testPackageBuilder(t, tc.b)()
+			require.NoError(t, pc.EmitPackage(ctx))
+			require.Equal(t, tc.want, pc.Result.DataCompression)
+
+			// Each compression gives a different data section, but the
+			// same content.
+			reference := testPackageBuilder(t, &Build{})()
+			require.NoError(t, reference.EmitPackage(ctx))
+			if tc.want != DataCompressionGzip {
+				require.NotEqual(t, reference.Result.DataHash, pc.Result.DataHash)
+			}
+			require.Equal(t, reference.Result.ContentHash, pc.Result.ContentHash)
+		})
+	}
+}
+
+func TestCanonicalControlData(t *testing.T) {
+	canonical := func(pc *PackageBuild) string {
+		var buf bytes.Buffer
+		require.NoError(t, pc.CanonicalControlData(&buf))
+		return buf.String()
+	}
+
+	a, b := testPackageBuilder(t, &Build{})(), testPackageBuilder(t, &Build{})()
+	a.Build.SourceDateEpoch = time.Unix(1700000000, 0)
+	b.Build.SourceDateEpoch = time.Unix(1800000000, 0)
+	b.Commit = "cafebabe"
+	require.Equal(t, canonical(a), canonical(b))
+	require.Contains(t, canonical(a), "\ncommit =\n")
+
+	// The emitted control data is unchanged.
+	var control bytes.Buffer
+	require.NoError(t, a.GenerateControlData(&control))
+	require.Contains(t, control.String(), "\ncommit = deadbeef\n")
+	require.Contains(t, control.String(), "\nbuilddate = 1700000000\n")
+
+	a.Build.VolatileControlFields = []string{"builddate"}
+	require.NotEqual(t, canonical(a), canonical(b))
+}
+
+func TestBuildDateSource(t *testing.T) {
+	ctx := context.Background()
+	epoch := time.Unix(1700000000, 0)
+	released := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		source string
+		want   time.Time
+	}{
+		{"", epoch},
+		{BuildDateSourceEpoch, epoch},
+		{BuildDateSourceReleaseDate, released},
+		{"2025-01-02T03:04:05Z", time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)},
+	} {
+		t.Run(tc.source, func(t *testing.T) {
+			b := &Build{BuildDateSource: tc.source}
+			b.Configuration.Package = config.Package{Name: "hello", Version: "1.0.0", ReleaseDate: released.Format(time.RFC3339)}
+			pc := testPackageBuilder(t, b)()
+			b.SourceDateEpoch = epoch
+
+			var control bytes.Buffer
+			require.NoError(t, pc.GenerateControlData(&control))
+			require.Contains(t, control.String(), fmt.Sprintf("\nbuilddate = %d\n", tc.want.Unix()))
+
+			require.NoError(t, pc.EmitPackage(ctx))
+			require.Equal(t, tc.want.Unix(), pc.Result.BuildDate.Unix())
+
+			// The data section keeps the timestamps of the epoch.
+			headers, _ := readDataSection(t, pc)
+			require.Equal(t, epoch.Unix(), headers["usr/share/hello.txt"].ModTime.Unix())
+		})
+	}
+
+	b := &Build{BuildDateSource: BuildDateSourceReleaseDate}
+	b.Configuration.Package.Name = "hello"
+	_, err := b.buildDate()
+	require.EqualError(t, err, "build date source is release-date, but hello has no release-date")
+
+	b.BuildDateSource = "yesterday"
+	_, err = b.buildDate()
+	require.ErrorContains(t, err, `build date source "yesterday" is neither`)
+}
+
+func TestSingleStream(t *testing.T) {
+	ctx := context.Background()
+	pc := testPackageBuilder(t, &Build{SingleStream: true})()
+	require.NoError(t, pc.EmitPackage(ctx))
+	require.Empty(t, pc.Result.ControlHash)
+	require.Equal(t, filepath.Join(pc.OutDir, "hello-1.0.0-r0.stream.tar.gz"), pc.Filename())
+
+	f, err := os.Open(pc.Filename())
+	require.NoError(t, err)
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	zr.Multistream(false)
+
+	names := []string{}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	require.Equal(t, []string{".PKGINFO", "usr", "usr/share", "usr/share/hello.txt"}, names)
+
+	// The control and data tarballs are one gzip member.
+	_, err = io.Copy(io.Discard, zr)
+	require.NoError(t, err)
+	require.ErrorIs(t, zr.Reset(f), io.EOF)
+
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, fi.Size(), pc.Result.Size)
+
+	keyFile, _ := writeTestKey(t, t.TempDir(), "melange.rsa")
+	pc = testPackageBuilder(t, &Build{SingleStream: true, SigningKey: keyFile})()
+	require.ErrorContains(t, pc.EmitPackage(ctx), "cannot be signed")
+}
+
+func Test_checkSingleStream(t *testing.T) {
+	require.NoError(t, (&Build{GenerateIndex: true, EmitOCILayout: true}).checkSingleStream())
+	require.NoError(t, (&Build{SingleStream: true}).checkSingleStream())
+
+	for _, tc := range []struct {
+		b    *Build
+		want string
+	}{
+		{&Build{SigningKey: "melange.rsa"}, "cannot be signed"},
+		{&Build{GenerateIndex: true}, "cannot be indexed"},
+		{&Build{ValidateWithApk: "apk"}, "cannot be validated with apk"},
+		{&Build{RunTestsAfterEmit: true}, "cannot be installed to run tests"},
+		{&Build{CompareAgainst: "old.apk"}, "cannot be compared"},
+		{&Build{ContentAddressedOutput: true}, "cannot be content addressed"},
+		{&Build{EmitOCILayout: true}, "cannot be wrapped in an OCI layout"},
+		{&Build{EmitDataArtifact: true}, "data artifacts cannot be emitted"},
+	} {
+		tc.b.SingleStream = true
+		require.ErrorContains(t, tc.b.checkSingleStream(), tc.want)
+	}
+}
+
+func TestStampGzipHeader(t *testing.T) {
+	ctx := context.Background()
+	plain := testPackageBuilder(t, &Build{})()
+	require.NoError(t, plain.EmitPackage(ctx))
+
+	pc := testPackageBuilder(t, &Build{StampGzipHeader: true})()
+	require.NoError(t, pc.EmitPackage(ctx))
+	require.NotEqual(t, plain.Result.DataHash, pc.Result.DataHash)
+
+	f, err := os.Open(pc.Filename())
+	require.NoError(t, err)
+	defer f.Close()
+
+	exp, err := expandapk.ExpandApk(ctx, f, t.TempDir())
+	require.NoError(t, err)
+	defer exp.Close()
+
+	data, err := os.Open(exp.PackageFile)
+	require.NoError(t, err)
+	defer data.Close()
+
+	zr, err := gzip.NewReader(data)
+	require.NoError(t, err)
+	require.Equal(t, "hello-1.0.0-r0", zr.Comment)
+}
+
+func TestEstimateCompressedSize(t *testing.T) {
+	ctx := context.Background()
+	pc := testPackageBuilder(t, &Build{})()
+
+	// Text with some redundancy, so that the compression level matters.
+	var text bytes.Buffer
+	for i := 0; text.Len() < 4<<20; i++ {
+		fmt.Fprintf(&text, "line %d of the file, which is %x\n", i, i*i*2654435761)
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(pc.WorkspaceSubdir(), "usr", "share", "lines.txt"), text.Bytes(), 0o644))
+
+	estimate, err := pc.EstimateCompressedSize(ctx, readlinkFS(pc.WorkspaceSubdir()))
+	require.NoError(t, err)
+	require.NoFileExists(t, pc.Filename())
+
+	require.NoError(t, pc.EmitPackage(ctx))
+	require.InDelta(t, pc.Result.Size, estimate, 0.25*float64(pc.Result.Size))
+}
+
+func TestNoArchSubpackage(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{
+		Configuration: config.Configuration{
+			Package:     config.Package{Name: "hello", Version: "1.0.0"},
+			Subpackages: []config.Subpackage{{Name: "hello-doc", NoArch: true}},
+		},
+		Arch:   apko_types.ParseArchitecture("amd64"),
+		OutDir: t.TempDir(),
+	}
+	testPackageBuilder(t, b)
+	require.NoError(t, os.MkdirAll(filepath.Join(b.WorkspaceDir, "melange-out", "hello-doc", "usr", "share", "doc"), 0o755))
+
+	pb := &PipelineBuild{Build: b, Package: &b.Configuration.Package}
+	require.NoError(t, pb.Emit(ctx, &b.Configuration.Package))
+	require.NoError(t, pb.Emit(ctx, pkgFromSub(&b.Configuration.Subpackages[0])))
+
+	arch := func(path string) string {
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		defer f.Close()
+		pkg, err := apk.ParsePackage(ctx, f)
+		require.NoError(t, err)
+		return pkg.Arch
+	}
+	require.Equal(t, "x86_64", arch(filepath.Join(b.OutDir, "x86_64", "hello-1.0.0-r0.apk")))
+	require.Equal(t, "noarch", arch(filepath.Join(b.OutDir, "noarch", "hello-doc-1.0.0-r0.apk")))
+
+	// The noarch package is placed in the directory of each arch, and
+	// listed in its index, as apk only looks there.
+	indexed := func(arch string) []string {
+		f, err := os.Open(filepath.Join(b.OutDir, arch, "APKINDEX.tar.gz"))
+		require.NoError(t, err)
+		defer f.Close()
+		idx, err := apk.IndexFromArchive(f)
+		require.NoError(t, err)
+		names := []string{}
+		for _, pkg := range idx.Packages {
+			names = append(names, pkg.Name+"/"+pkg.Arch)
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	noarch, err := b.linkNoArchPackages(ctx, pb)
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(b.OutDir, "x86_64", "hello-doc-1.0.0-r0.apk")}, noarch)
+	require.NoError(t, b.generateIndex(ctx, append(noarch, filepath.Join(b.OutDir, "x86_64", "hello-1.0.0-r0.apk"))))
+	require.Equal(t, "noarch", arch(noarch[0]))
+	require.Equal(t, []string{"hello-doc/noarch", "hello/x86_64"}, indexed("x86_64"))
+
+	// The build for another arch, which does not emit it, places it
+	// once the build emitting it has finished.
+	other := *b
+	other.Arch = apko_types.ParseArchitecture("arm64")
+	other.SkipNoArch = true
+	other.GenerateIndex = true
+	require.NoError(t, other.LinkNoArchPackages(ctx))
+	require.Equal(t, "noarch", arch(filepath.Join(b.OutDir, "aarch64", "hello-doc-1.0.0-r0.apk")))
+	require.Equal(t, []string{"hello-doc/noarch"}, indexed("aarch64"))
+}
+
+// BenchmarkDependenciesAndInstalledSize compares walking a package of 100k
+// files for SCA and the installed size separately with sharing one walk.
+func BenchmarkDependenciesAndInstalledSize(b *testing.B) {
+	ctx := context.Background()
+	tmp := b.TempDir()
+	build := &Build{WorkspaceDir: filepath.Join(tmp, "workspace")}
+	pc := &PackageBuild{
+		Build:       build,
+		Origin:      &config.Package{Name: "hello", Version: "1.0.0"},
+		PackageName: "hello",
+		OriginName:  "hello",
+	}
+
+	for d := 0; d < 100; d++ {
+		dir := filepath.Join(pc.WorkspaceSubdir(), "usr", "share", "hello", fmt.Sprintf("%02d", d))
+		require.NoError(b, os.MkdirAll(dir, 0o755))
+		for f := 0; f < 1000; f++ {
+			require.NoError(b, os.WriteFile(filepath.Join(dir, fmt.Sprintf("%04d", f)), []byte("hello\n"), 0o644))
+		}
+	}
+	fsys := readlinkFS(pc.WorkspaceSubdir())
+
+	b.Run("separate", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			pc.InstalledSize = 0
+			require.NoError(b, pc.GenerateDependencies(ctx, &SCABuildInterface{PackageBuild: pc}))
+			require.NoError(b, pc.calculateInstalledSize(fsys))
+		}
+	})
+
+	b.Run("shared", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			pc.InstalledSize = 0
+			walked, err := walkPackage(fsys)
+			require.NoError(b, err)
+			require.NoError(b, pc.GenerateDependencies(ctx, &SCABuildInterface{PackageBuild: pc, walked: walked}))
+			require.NoError(b, pc.addInstalledSize(walked))
+		}
+	})
+}
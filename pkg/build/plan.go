@@ -0,0 +1,104 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"slices"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/config"
+)
+
+// PackagePlan is a package which a configuration produces for an
+// architecture.
+type PackagePlan struct {
+	Name    string
+	Origin  string
+	Version string
+	Epoch   uint64
+	Arch    string
+	// The identity of the package, <name>-<version>-r<epoch>.
+	Identity string
+	// The path the package is written to, relative to the output
+	// directory: <arch>/<identity>.apk.
+	Filename string
+	// The configured dependencies of the package, without those SCA
+	// generates when it is built.
+	Dependencies config.Dependencies
+	// Whether the package is a subpackage with an if condition, which may
+	// leave it unbuilt.
+	Conditional bool
+}
+
+// EnumeratePackages returns every package and subpackage cfg produces for
+// each of arches, in the order they are built, without building them or
+// touching the filesystem.  Architectures outside the target architectures
+// of the package are skipped.  Architecture independent subpackages are
+// produced once, by the first architecture built, with an arch of noarch.
+// Build options which change where or whether packages are written, such as
+// architecture aliases and OnlyPackages, are not applied.
+func EnumeratePackages(cfg *config.Configuration, arches []apko_types.Architecture) []PackagePlan {
+	targets := cfg.Package.TargetArchitecture
+	if len(targets) == 1 && targets[0] == "all" {
+		targets = nil
+	}
+
+	pkgs := []*config.Package{&cfg.Package}
+	conditional, noarch := []bool{false}, []bool{false}
+	for i := range cfg.Subpackages {
+		pkgs = append(pkgs, pkgFromSub(&cfg.Subpackages[i]))
+		conditional = append(conditional, cfg.Subpackages[i].If != "")
+		noarch = append(noarch, cfg.Subpackages[i].NoArch)
+	}
+
+	plans := []PackagePlan{}
+	first := true
+	for _, arch := range arches {
+		apkArch := arch.ToAPK()
+		if len(targets) != 0 && !slices.Contains(targets, apkArch) {
+			continue
+		}
+
+		for i, pkg := range pkgs {
+			pkgArch := apkArch
+			if noarch[i] {
+				if !first {
+					continue
+				}
+				pkgArch = noarchArch
+			}
+
+			pc := &PackageBuild{
+				Origin:      &cfg.Package,
+				PackageName: pkg.Name,
+				OutDir:      pkgArch,
+			}
+			plans = append(plans, PackagePlan{
+				Name:         pkg.Name,
+				Origin:       cfg.Package.Name,
+				Version:      cfg.Package.Version,
+				Epoch:        cfg.Package.Epoch,
+				Arch:         pkgArch,
+				Identity:     pc.Identity(),
+				Filename:     pc.Filename(),
+				Dependencies: pkg.Dependencies,
+				Conditional:  conditional[i],
+			})
+		}
+		first = false
+	}
+
+	return plans
+}
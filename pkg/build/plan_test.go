@@ -0,0 +1,84 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnumeratePackages(t *testing.T) {
+	cfg := &config.Configuration{
+		Package: config.Package{
+			Name:    "hello",
+			Version: "1.2.3",
+			Epoch:   4,
+			Dependencies: config.Dependencies{
+				Runtime: []string{"glibc"},
+			},
+		},
+		Subpackages: []config.Subpackage{
+			{Name: "hello-doc"},
+			{Name: "hello-extra", If: "${{options.extra.enabled}} == 'true'"},
+		},
+	}
+	arches := []apko_types.Architecture{apko_types.ParseArchitecture("amd64"), apko_types.ParseArchitecture("arm64")}
+
+	got := EnumeratePackages(cfg, arches)
+	require.Len(t, got, 6)
+	require.Equal(t, PackagePlan{
+		Name:         "hello",
+		Origin:       "hello",
+		Version:      "1.2.3",
+		Epoch:        4,
+		Arch:         "x86_64",
+		Identity:     "hello-1.2.3-r4",
+		Filename:     "x86_64/hello-1.2.3-r4.apk",
+		Dependencies: config.Dependencies{Runtime: []string{"glibc"}},
+	}, got[0])
+	require.Equal(t, "x86_64/hello-doc-1.2.3-r4.apk", got[1].Filename)
+	require.False(t, got[1].Conditional)
+	require.True(t, got[2].Conditional)
+	require.Equal(t, "aarch64/hello-extra-1.2.3-r4.apk", got[5].Filename)
+
+	// Architectures the package does not target are skipped.
+	cfg.Package.TargetArchitecture = []string{"aarch64"}
+	got = EnumeratePackages(cfg, arches)
+	require.Len(t, got, 3)
+	for _, plan := range got {
+		require.Equal(t, "aarch64", plan.Arch)
+	}
+}
+
+func TestEnumeratePackages_NoArch(t *testing.T) {
+	cfg := &config.Configuration{
+		Package:     config.Package{Name: "hello", Version: "1.2.3"},
+		Subpackages: []config.Subpackage{{Name: "hello-doc", NoArch: true}},
+	}
+	arches := []apko_types.Architecture{apko_types.ParseArchitecture("amd64"), apko_types.ParseArchitecture("arm64")}
+
+	filenames := []string{}
+	for _, plan := range EnumeratePackages(cfg, arches) {
+		filenames = append(filenames, plan.Filename)
+	}
+	require.Equal(t, []string{
+		"x86_64/hello-1.2.3-r0.apk",
+		"noarch/hello-doc-1.2.3-r0.apk",
+		"aarch64/hello-1.2.3-r0.apk",
+	}, filenames)
+}
@@ -0,0 +1,160 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/index"
+	"github.com/chainguard-dev/clog"
+)
+
+// testPin returns the constraint which pins the package to the version
+// just emitted, so that it is the one installed for its tests rather than
+// one from another repository.
+func (pc *PackageBuild) testPin() string {
+	return fmt.Sprintf("%s=%s-r%d", pc.PackageName, pc.Origin.Version, pc.Origin.Epoch)
+}
+
+// postEmitTest returns the configuration under which the test pipelines of
+// the package just emitted are run, or nil if it has none.  Only the tests
+// of this package are kept.  Subpackages are pinned in their test
+// environment; the origin package is pinned as the package under test.
+func (pc *PackageBuild) postEmitTest() *config.Configuration {
+	cfg := pc.Build.Configuration
+
+	if pc.configName() == cfg.Package.Name {
+		if len(cfg.Test.Pipeline) == 0 {
+			return nil
+		}
+
+		cfg.Test.Environment.Contents.Packages = slices.Clone(cfg.Test.Environment.Contents.Packages)
+		cfg.Subpackages = nil
+
+		return &cfg
+	}
+
+	for _, sp := range cfg.Subpackages {
+		if sp.Name != pc.configName() {
+			continue
+		}
+		if len(sp.Test.Pipeline) == 0 {
+			return nil
+		}
+
+		sp.Test.Environment.Contents.Packages = append(slices.Clone(sp.Test.Environment.Contents.Packages), pc.testPin())
+		cfg.Test = config.Test{}
+		cfg.Subpackages = []config.Subpackage{sp}
+
+		return &cfg
+	}
+
+	return nil
+}
+
+// runTestsAfterEmit installs the package just emitted into a fresh guest and
+// runs its test pipelines.  The package is served from a temporary
+// repository whose index is signed with the signing key, so the public key
+// (<signing key>.pub) is added to the keyring of the guest.
+func (pc *PackageBuild) runTestsAfterEmit(ctx context.Context) error {
+	log := clog.FromContext(ctx)
+
+	cfg := pc.postEmitTest()
+	if cfg == nil {
+		return nil
+	}
+
+	if !pc.wantSignature() {
+		return fmt.Errorf("testing %s after emitting it requires a signing key, so that it can be installed", pc.PackageName)
+	}
+
+	tmp, err := os.MkdirTemp(pc.Build.TempDir, "melange-test-*")
+	if err != nil {
+		return fmt.Errorf("unable to create test directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	repo := filepath.Join(tmp, "repo")
+	if err := pc.writeTestRepository(ctx, repo); err != nil {
+		return err
+	}
+
+	t := &Test{
+		Configuration: *cfg,
+		WorkspaceDir:  filepath.Join(tmp, "workspace"),
+		GuestDir:      filepath.Join(tmp, "guest"),
+		PipelineDirs:  pc.Build.PipelineDirs,
+		Arch:          pc.Build.Arch,
+		ExtraKeys:     append(slices.Clone(pc.Build.ExtraKeys), pc.Build.SigningKey+".pub"),
+		ExtraRepos:    append(slices.Clone(pc.Build.ExtraRepos), repo),
+		BinShOverlay:  pc.Build.BinShOverlay,
+		CacheDir:      pc.Build.CacheDir,
+		ApkCacheDir:   pc.Build.ApkCacheDir,
+		CacheSource:   pc.Build.CacheSource,
+		Runner:        pc.Build.Runner,
+		Debug:         pc.Build.Debug,
+		DebugRunner:   pc.Build.DebugRunner,
+		LogPolicy:     pc.Build.LogPolicy,
+	}
+	if pc.configName() == cfg.Package.Name {
+		t.Package = pc.testPin()
+	}
+
+	log.Infof("testing %s", pc.Identity())
+	if err := t.TestPackage(ctx); err != nil {
+		return fmt.Errorf("testing %s: %w", pc.Identity(), err)
+	}
+
+	return nil
+}
+
+// writeTestRepository lays out a repository at dir holding only the package
+// just emitted.
+func (pc *PackageBuild) writeTestRepository(ctx context.Context, dir string) error {
+	archDir := filepath.Join(dir, pc.Build.Arch.ToAPK())
+	if err := os.MkdirAll(archDir, 0o755); err != nil {
+		return fmt.Errorf("unable to create test repository: %w", err)
+	}
+
+	src, err := filepath.Abs(pc.Filename())
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(archDir, filepath.Base(src))
+	if err := os.Symlink(src, dest); err != nil {
+		return fmt.Errorf("unable to add %s to test repository: %w", pc.Identity(), err)
+	}
+
+	idx, err := index.New(
+		index.WithPackageFiles([]string{dest}),
+		index.WithIndexFile(filepath.Join(archDir, "APKINDEX.tar.gz")),
+		index.WithSigningKey(pc.Build.SigningKey),
+		index.WithSigningPassphrase(pc.Build.SigningPassphrase),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to create test repository index: %w", err)
+	}
+
+	if err := idx.GenerateIndex(ctx); err != nil {
+		return fmt.Errorf("unable to generate test repository index: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostEmitTest(t *testing.T) {
+	b := &Build{}
+	newPackageBuild := testPackageBuilder(t, b)
+	b.Configuration = config.Configuration{
+		Package: config.Package{Name: "hello", Version: "1.0.0"},
+		Test: config.Test{
+			Environment: apko_types.ImageConfiguration{Contents: apko_types.ImageContents{Packages: []string{"busybox"}}},
+			Pipeline:    []config.Pipeline{{Runs: "hello --version"}},
+		},
+		Subpackages: []config.Subpackage{{
+			Name: "hello-doc",
+		}, {
+			Name: "hello-dev",
+			Test: config.Test{Pipeline: []config.Pipeline{{Runs: "test -f /usr/include/hello.h"}}},
+		}},
+	}
+
+	pc := newPackageBuild()
+	cfg := pc.postEmitTest()
+	require.NotNil(t, cfg)
+	require.Equal(t, "hello=1.0.0-r0", pc.testPin())
+	require.Empty(t, cfg.Subpackages)
+	require.Equal(t, b.Configuration.Test.Pipeline, cfg.Test.Pipeline)
+
+	pc.PackageName = "hello-dev"
+	cfg = pc.postEmitTest()
+	require.NotNil(t, cfg)
+	require.Empty(t, cfg.Test.Pipeline)
+	require.Len(t, cfg.Subpackages, 1)
+	require.Equal(t, "hello-dev", cfg.Subpackages[0].Name)
+	require.Equal(t, []string{"hello-dev=1.0.0-r0"}, cfg.Subpackages[0].Test.Environment.Contents.Packages)
+
+	// Packages without tests are not tested.
+	pc.PackageName = "hello-doc"
+	require.Nil(t, pc.postEmitTest())
+
+	// The build configuration is unchanged.
+	require.Len(t, b.Configuration.Subpackages, 2)
+	require.Empty(t, b.Configuration.Subpackages[1].Test.Environment.Contents.Packages)
+	require.Equal(t, []string{"busybox"}, b.Configuration.Test.Environment.Contents.Packages)
+}
+
+func TestWriteTestRepository(t *testing.T) {
+	ctx := context.Background()
+	keyFile, _ := writeTestKey(t, t.TempDir(), "melange.rsa")
+	b := &Build{SigningKey: keyFile, Arch: apko_types.ParseArchitecture("x86_64")}
+	pc := testPackageBuilder(t, b)()
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	repo := filepath.Join(t.TempDir(), "repo")
+	require.NoError(t, pc.writeTestRepository(ctx, repo))
+
+	require.FileExists(t, filepath.Join(repo, "x86_64", "APKINDEX.tar.gz"))
+	data, err := os.ReadFile(filepath.Join(repo, "x86_64", "hello-1.0.0-r0.apk"))
+	require.NoError(t, err)
+	emitted, err := os.ReadFile(pc.Filename())
+	require.NoError(t, err)
+	require.Equal(t, emitted, data)
+}
+
+func TestRunTestsAfterEmitRequiresSigningKey(t *testing.T) {
+	b := &Build{RunTestsAfterEmit: true}
+	newPackageBuild := testPackageBuilder(t, b)
+	b.Configuration = config.Configuration{
+		Package: config.Package{Name: "hello", Version: "1.0.0"},
+		Test:    config.Test{Pipeline: []config.Pipeline{{Runs: "hello --version"}}},
+	}
+
+	pc := newPackageBuild()
+	require.ErrorContains(t, pc.EmitPackage(context.Background()), "requires a signing key")
+}
@@ -0,0 +1,142 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/chainguard-dev/clog"
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	inTotoStatementType = "https://in-toto.io/Statement/v1"
+	slsaProvenanceType  = "https://slsa.dev/provenance/v1"
+	melangeBuildType    = "https://chainguard.dev/melange/build/v1"
+	melangeBuilderID    = "https://chainguard.dev/melange"
+)
+
+// The types below are the subset of the in-toto statement and SLSA v1
+// provenance predicate which melange populates.
+
+type inTotoStatement struct {
+	Type          string               `json:"_type"`
+	Subject       []resourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     slsaProvenance       `json:"predicate"`
+}
+
+type resourceDescriptor struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+type slsaProvenance struct {
+	BuildDefinition slsaBuildDefinition `json:"buildDefinition"`
+	RunDetails      slsaRunDetails      `json:"runDetails"`
+}
+
+type slsaBuildDefinition struct {
+	BuildType            string               `json:"buildType"`
+	ExternalParameters   provenanceParameters `json:"externalParameters"`
+	ResolvedDependencies []resourceDescriptor `json:"resolvedDependencies,omitempty"`
+}
+
+type provenanceParameters struct {
+	ConfigFile   string   `json:"configFile,omitempty"`
+	Package      string   `json:"package"`
+	Version      string   `json:"version"`
+	Epoch        uint64   `json:"epoch"`
+	Arch         string   `json:"arch"`
+	BuildOptions []string `json:"buildOptions,omitempty"`
+	Namespace    string   `json:"namespace,omitempty"`
+}
+
+type slsaRunDetails struct {
+	Builder slsaBuilder `json:"builder"`
+}
+
+type slsaBuilder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version,omitempty"`
+}
+
+// provenanceStatement returns an in-toto statement carrying SLSA provenance
+// for the package described by result.
+func (pc *PackageBuild) provenanceStatement(result *EmitResult) *inTotoStatement {
+	deps := []resourceDescriptor{}
+	if pc.Commit != "" {
+		deps = append(deps, resourceDescriptor{
+			URI:    filepath.Base(pc.Build.ConfigFile),
+			Digest: map[string]string{"gitCommit": pc.Commit},
+		})
+	}
+
+	return &inTotoStatement{
+		Type: inTotoStatementType,
+		Subject: []resourceDescriptor{{
+			Name:   filepath.Base(pc.Filename()),
+			Digest: map[string]string{"sha256": result.Digest},
+		}},
+		PredicateType: slsaProvenanceType,
+		Predicate: slsaProvenance{
+			BuildDefinition: slsaBuildDefinition{
+				BuildType: melangeBuildType,
+				ExternalParameters: provenanceParameters{
+					ConfigFile:   pc.Build.ConfigFile,
+					Package:      pc.PackageName,
+					Version:      pc.Origin.Version,
+					Epoch:        pc.Origin.Epoch,
+					Arch:         pc.Arch,
+					BuildOptions: pc.Build.EnabledBuildOptions,
+					Namespace:    pc.Build.Namespace,
+				},
+				ResolvedDependencies: deps,
+			},
+			RunDetails: slsaRunDetails{
+				Builder: slsaBuilder{
+					ID:      melangeBuilderID,
+					Version: map[string]string{"melange": pc.MelangeVersion},
+				},
+			},
+		},
+	}
+}
+
+// emitProvenance writes the provenance statement for result next to the
+// package as <identity>.intoto.jsonl.
+func (pc *PackageBuild) emitProvenance(ctx context.Context, result *EmitResult) error {
+	log := clog.FromContext(ctx)
+	_, span := otel.Tracer("melange").Start(ctx, "emitProvenance")
+	defer span.End()
+
+	data, err := json.Marshal(pc.provenanceStatement(result))
+	if err != nil {
+		return fmt.Errorf("unable to encode provenance: %w", err)
+	}
+
+	path := filepath.Join(pc.OutDir, pc.Identity()+".intoto.jsonl")
+	if err := writeFileAtomic(path, append(data, '\n')); err != nil {
+		return fmt.Errorf("unable to write provenance: %w", err)
+	}
+
+	log.Infof("wrote %s", path)
+
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// providesMapFile is the name of the provides map in OutDir.
+const providesMapFile = "provides-map.json"
+
+// providesMapMu serializes updates of provides maps, as builds sharing an
+// OutDir may finish concurrently within one process.
+var providesMapMu sync.Mutex
+
+// providesMap is the content of the provides map: for each arch, the
+// packages offering each name, which is a package name or a provide such as
+// so:libc.so.6 or cmd:sh, without its version.
+type providesMap map[string]map[string][]string
+
+// writeProvidesMap records the names offered by the packages emitted by this
+// build in the provides map in OutDir.  Names previously recorded for those
+// packages are replaced, while those of other packages are kept, so that the
+// map covers every build sharing the OutDir.
+func (b *Build) writeProvidesMap(ctx context.Context) error {
+	log := clog.FromContext(ctx)
+
+	providesMapMu.Lock()
+	defer providesMapMu.Unlock()
+
+	path := filepath.Join(b.OutDir, providesMapFile)
+	pm := providesMap{}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("unable to read provides map: %w", err)
+	default:
+		if err := json.Unmarshal(data, &pm); err != nil {
+			return fmt.Errorf("unable to parse provides map %s: %w", path, err)
+		}
+	}
+
+	for _, pkg := range b.emittedPackages {
+		names := pm[pkg.Arch]
+		if names == nil {
+			names = map[string][]string{}
+			pm[pkg.Arch] = names
+		}
+
+		for name, pkgs := range names {
+			pkgs = slices.DeleteFunc(pkgs, func(p string) bool { return p == pkg.Name })
+			if len(pkgs) == 0 {
+				delete(names, name)
+			} else {
+				names[name] = pkgs
+			}
+		}
+
+		for _, prov := range append([]string{pkg.Name}, pkg.Provides...) {
+			name := dependencyName(prov)
+			if !slices.Contains(names[name], pkg.Name) {
+				names[name] = append(names[name], pkg.Name)
+				sort.Strings(names[name])
+			}
+		}
+	}
+
+	data, err = json.MarshalIndent(pm, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode provides map: %w", err)
+	}
+	if err := writeFileAtomic(path, append(data, '\n')); err != nil {
+		return fmt.Errorf("unable to write provides map: %w", err)
+	}
+
+	log.Infof("wrote %s", path)
+
+	return nil
+}
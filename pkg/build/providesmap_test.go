@@ -0,0 +1,66 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteProvidesMap(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{EmitProvidesMap: true}
+	newPackageBuild := testPackageBuilder(t, b)
+	b.OutDir = t.TempDir()
+
+	// Names recorded by another build are kept, while those previously
+	// recorded for hello are replaced.
+	path := filepath.Join(b.OutDir, providesMapFile)
+	require.NoError(t, os.WriteFile(path, []byte(`{
+  "x86_64": {
+    "busybox": ["busybox"],
+    "cmd:sh": ["busybox"],
+    "cmd:hello-old": ["hello"]
+  }
+}`), 0o644))
+
+	pc := newPackageBuild()
+	pc.Dependencies.Provides = []string{"cmd:hello=1.0.0-r0", "cmd:sh"}
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	libs := newPackageBuild()
+	libs.PackageName = "hello-libs"
+	libs.Dependencies.Provides = []string{"so:libhello.so.1=1"}
+	require.NoError(t, libs.EmitPackage(ctx))
+
+	require.NoError(t, b.writeProvidesMap(ctx))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+  "x86_64": {
+    "busybox": ["busybox"],
+    "cmd:hello": ["hello"],
+    "cmd:sh": ["busybox", "hello"],
+    "hello": ["hello"],
+    "hello-libs": ["hello-libs"],
+    "so:libhello.so.1": ["hello-libs"]
+  }
+}`, string(data))
+}
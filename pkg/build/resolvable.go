@@ -0,0 +1,113 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+)
+
+// recordEmitted remembers the package just emitted, with its final
+// dependencies and provides, so that the runtime dependencies of the
+// packages of this build can be satisfied by each other.
+func (pc *PackageBuild) recordEmitted() {
+	pc.Build.emittedPackages = append(pc.Build.emittedPackages, &apk.Package{
+		Name:         pc.PackageName,
+		Version:      fmt.Sprintf("%s-r%d", pc.Origin.Version, pc.Origin.Epoch),
+		Arch:         pc.Arch,
+		Origin:       pc.OriginName,
+		Dependencies: pc.Dependencies.Runtime,
+		Provides:     pc.Dependencies.Provides,
+	})
+}
+
+// loadRuntimeDepsIndex reads the packages of a local APKINDEX.tar.gz.
+func loadRuntimeDepsIndex(path string) (*apk.APKIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening index %s: %w", path, err)
+	}
+
+	index, err := apk.IndexFromArchive(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading index %s: %w", path, err)
+	}
+
+	return index, nil
+}
+
+// verifyRuntimeDepsResolvable checks that every runtime dependency of the
+// packages emitted by this build, including version constraints, is
+// satisfied by a package in RuntimeDepsIndexes or by one of the packages
+// of the build itself.  Conflicts (!name) are not checked.
+func (b *Build) verifyRuntimeDepsResolvable(ctx context.Context) error {
+	log := clog.FromContext(ctx)
+
+	if len(b.RuntimeDepsIndexes) == 0 {
+		return fmt.Errorf("verifying runtime dependencies requires at least one index")
+	}
+
+	indexes := make([]apk.NamedIndex, 0, len(b.RuntimeDepsIndexes)+1)
+	for _, path := range b.RuntimeDepsIndexes {
+		index, err := loadRuntimeDepsIndex(path)
+		if err != nil {
+			return err
+		}
+
+		// The name of an index is its pin; none of them are pinned.
+		repo := apk.Repository{URI: path}
+		indexes = append(indexes, apk.NewNamedRepositoryWithIndex("", repo.WithIndex(index)))
+	}
+
+	self := apk.Repository{URI: b.OutDir}
+	indexes = append(indexes, apk.NewNamedRepositoryWithIndex("", self.WithIndex(&apk.APKIndex{
+		Packages: b.emittedPackages,
+	})))
+
+	resolver := apk.NewPkgResolver(ctx, indexes)
+
+	var problems []string
+	for _, pkg := range b.emittedPackages {
+		var unresolvable []string
+		for _, dep := range pkg.Dependencies {
+			if strings.HasPrefix(dep, "!") {
+				continue
+			}
+
+			if _, err := resolver.ResolvePackage(dep, map[*apk.RepositoryPackage]string{}); err != nil {
+				log.Debugf("%s: %s is not resolvable: %v", pkg.Name, dep, err)
+				unresolvable = append(unresolvable, dep)
+			}
+		}
+
+		if len(unresolvable) > 0 {
+			sort.Strings(unresolvable)
+			problems = append(problems, fmt.Sprintf("%s: %s", pkg.Name, strings.Join(unresolvable, ", ")))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("unresolvable runtime dependencies: %s", strings.Join(problems, "; "))
+	}
+
+	log.Infof("all runtime dependencies are resolvable")
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"chainguard.dev/melange/pkg/config"
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestIndex(t *testing.T, path string, pkgs ...*apk.Package) {
+	t.Helper()
+
+	archive, err := apk.ArchiveFromIndex(&apk.APKIndex{Packages: pkgs})
+	require.NoError(t, err)
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = io.Copy(f, archive)
+	require.NoError(t, err)
+}
+
+func TestVerifyRuntimeDepsResolvable(t *testing.T) {
+	ctx := context.Background()
+	index := filepath.Join(t.TempDir(), "APKINDEX.tar.gz")
+	writeTestIndex(t, index,
+		&apk.Package{Name: "busybox", Version: "1.36.1-r0", Arch: "x86_64", Provides: []string{"cmd:sh=1.36.1-r0"}},
+		&apk.Package{Name: "glibc", Version: "2.39-r0", Arch: "x86_64"},
+		&apk.Package{Name: "ld-linux", Version: "2.39-r0", Arch: "x86_64", Provides: []string{"so:libc.so.6=6"}},
+	)
+
+	emit := func(t *testing.T, deps ...[]string) *Build {
+		b := &Build{VerifyRuntimeDepsResolvable: true, RuntimeDepsIndexes: []string{index}}
+		newPackageBuild := testPackageBuilder(t, b)
+
+		pc := newPackageBuild()
+		pc.Dependencies = config.Dependencies{Runtime: deps[0], Provides: []string{"so:libhello.so.1=1"}}
+		require.NoError(t, pc.EmitPackage(ctx))
+
+		require.NoError(t, os.MkdirAll(filepath.Join(b.WorkspaceDir, "melange-out", "hello-dev"), 0o755))
+		pc = newPackageBuild()
+		pc.PackageName = "hello-dev"
+		pc.Dependencies = config.Dependencies{Runtime: deps[1]}
+		require.NoError(t, pc.EmitPackage(ctx))
+
+		return b
+	}
+
+	t.Run("resolvable", func(t *testing.T) {
+		b := emit(t,
+			[]string{"busybox", "cmd:sh", "glibc>=2.38", "!conflicting"},
+			[]string{"hello=1.0.0-r0", "so:libhello.so.1", "so:libc.so.6"},
+		)
+		require.NoError(t, b.verifyRuntimeDepsResolvable(ctx))
+	})
+
+	t.Run("unresolvable", func(t *testing.T) {
+		b := emit(t,
+			[]string{"missing", "glibc>=2.40", "busybox"},
+			[]string{"hello=2.0.0-r0", "so:libhello.so.1"},
+		)
+		err := b.verifyRuntimeDepsResolvable(ctx)
+		require.ErrorContains(t, err, "hello: glibc>=2.40, missing; hello-dev: hello=2.0.0-r0")
+	})
+
+	t.Run("no index", func(t *testing.T) {
+		b := &Build{VerifyRuntimeDepsResolvable: true}
+		require.ErrorContains(t, b.verifyRuntimeDepsResolvable(ctx), "requires at least one index")
+	})
+}
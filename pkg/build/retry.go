@@ -0,0 +1,69 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+)
+
+// outputWriteBackoff is the delay before the first retry of a failed output
+// write.  It doubles with every further retry.
+var outputWriteBackoff = 500 * time.Millisecond
+
+// isTransientWriteError returns true for errors which network filesystems
+// produce transiently and which are worth retrying.  Errors such as ENOSPC
+// or EPERM will not go away on their own and are not retried.
+func isTransientWriteError(err error) bool {
+	for _, errno := range []syscall.Errno{
+		syscall.EIO,
+		syscall.EAGAIN,
+		syscall.EINTR,
+		syscall.ETIMEDOUT,
+		syscall.ESTALE,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryOutputWrite runs fn, retrying it up to OutputWriteRetries times with
+// exponential backoff while it fails with a transient error.  Each retry is
+// a warning about the package.
+func (pc *PackageBuild) retryOutputWrite(ctx context.Context, what string, fn func() error) error {
+	b := pc.Build
+	backoff := outputWriteBackoff
+
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= b.OutputWriteRetries || !isTransientWriteError(err) {
+			return err
+		}
+
+		pc.warnf(ctx, "%s failed (attempt %d of %d), retrying in %s: %v", what, attempt+1, b.OutputWriteRetries+1, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
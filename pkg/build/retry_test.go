@@ -0,0 +1,92 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryOutputWrite(t *testing.T) {
+	outputWriteBackoff = time.Millisecond
+	ctx := context.Background()
+
+	eio := &os.PathError{Op: "write", Path: "foo.apk", Err: syscall.EIO}
+	enospc := &os.PathError{Op: "write", Path: "foo.apk", Err: syscall.ENOSPC}
+
+	tests := []struct {
+		name      string
+		retries   int
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{{
+		name:      "success",
+		retries:   3,
+		errs:      []error{nil},
+		wantCalls: 1,
+	}, {
+		name:      "transient then success",
+		retries:   3,
+		errs:      []error{eio, fmt.Errorf("wrapped: %w", eio), nil},
+		wantCalls: 3,
+	}, {
+		name:      "retries exhausted",
+		retries:   1,
+		errs:      []error{eio, eio, nil},
+		wantCalls: 2,
+		wantErr:   syscall.EIO,
+	}, {
+		name:      "no retries by default",
+		errs:      []error{eio, nil},
+		wantCalls: 1,
+		wantErr:   syscall.EIO,
+	}, {
+		name:      "permanent error",
+		retries:   3,
+		errs:      []error{enospc, nil},
+		wantCalls: 1,
+		wantErr:   syscall.ENOSPC,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Build{OutputWriteRetries: tt.retries}
+			pc := &PackageBuild{Build: b, PackageName: "foo"}
+
+			calls := 0
+			err := pc.retryOutputWrite(ctx, "writing foo.apk", func() error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+
+			require.Equal(t, tt.wantCalls, calls)
+			// Each retry is a warning about the package.
+			require.Len(t, b.warnings, calls-1)
+			if tt.wantErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, tt.wantErr)
+			}
+		})
+	}
+}
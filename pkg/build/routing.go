@@ -0,0 +1,95 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+
+	"github.com/chainguard-dev/clog"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// routeSubpackageFiles moves files from the main package's workspace into
+// the workspaces of the subpackages named by the package's SubpackageRules.
+// Rules are tried in order and the first match wins; a matching directory is
+// moved along with everything beneath it.  Files matching a rule which
+// targets a subpackage that is not being built stay in the main package,
+// with a warning about it.
+func (b *Build) routeSubpackageFiles(ctx context.Context, workspaceDir string, pkg *config.Package, subpackages []string) error {
+	log := clog.FromContext(ctx)
+
+	if len(pkg.SubpackageRules) == 0 {
+		return nil
+	}
+
+	for _, rule := range pkg.SubpackageRules {
+		if _, err := path.Match(rule.Glob, ""); err != nil {
+			return fmt.Errorf("subpackage rule glob %q is invalid: %w", rule.Glob, err)
+		}
+	}
+
+	srcDir := filepath.Join(workspaceDir, "melange-out", pkg.Name)
+	fsys := os.DirFS(srcDir)
+
+	return fs.WalkDir(fsys, ".", func(rel string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		for _, rule := range pkg.SubpackageRules {
+			if ok, _ := path.Match(rule.Glob, rel); !ok {
+				continue
+			}
+
+			if !slices.Contains(subpackages, rule.Subpackage) {
+				b.warnf(ctx, pkg.Name, "not moving %s: subpackage %s is not being built", rel, rule.Subpackage)
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+
+			dst := filepath.Join(workspaceDir, "melange-out", rule.Subpackage, rel)
+			if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+				return err
+			}
+			if _, err := os.Lstat(dst); err == nil {
+				return fmt.Errorf("cannot move %s into %s: %s already exists", rel, rule.Subpackage, rel)
+			}
+
+			log.Infof("moving %s to subpackage %s", rel, rule.Subpackage)
+			if err := os.Rename(filepath.Join(srcDir, rel), dst); err != nil {
+				return err
+			}
+
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func Test_routeSubpackageFiles(t *testing.T) {
+	ws := t.TempDir()
+	out := filepath.Join(ws, "melange-out")
+
+	for _, f := range []string{
+		"hello/usr/bin/hello",
+		"hello/usr/lib/libhello.so.1",
+		"hello/usr/lib/libhello.a",
+		"hello/usr/share/man/man1/hello.1",
+		"hello/usr/share/man/man3/hello.3",
+		"hello/usr/share/info/hello.info",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(out, filepath.Dir(f)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(out, f), []byte(f), 0o644))
+	}
+
+	pkg := &config.Package{
+		Name: "hello",
+		SubpackageRules: []config.SubpackageRule{
+			{Glob: "usr/share/man", Subpackage: "hello-doc"},
+			{Glob: "usr/lib/*.a", Subpackage: "hello-dev"},
+			{Glob: "usr/share/info", Subpackage: "hello-info"},
+		},
+	}
+
+	// hello-info is not being built, so its files stay put.
+	b := &Build{}
+	require.NoError(t, b.routeSubpackageFiles(context.Background(), ws, pkg, []string{"hello", "hello-doc", "hello-dev"}))
+	require.Equal(t, []Warning{{
+		Package: "hello",
+		Message: "not moving usr/share/info: subpackage hello-info is not being built",
+	}}, b.Warnings())
+
+	for _, f := range []string{
+		"hello/usr/bin/hello",
+		"hello/usr/lib/libhello.so.1",
+		"hello/usr/share/info/hello.info",
+		"hello-doc/usr/share/man/man1/hello.1",
+		"hello-doc/usr/share/man/man3/hello.3",
+		"hello-dev/usr/lib/libhello.a",
+	} {
+		require.FileExists(t, filepath.Join(out, f))
+	}
+	require.NoFileExists(t, filepath.Join(out, "hello/usr/lib/libhello.a"))
+	require.NoDirExists(t, filepath.Join(out, "hello/usr/share/man"))
+}
@@ -27,6 +27,9 @@ import (
 type SCABuildInterface struct {
 	// PackageBuild represents the underlying package build object.
 	PackageBuild *PackageBuild
+
+	// The entries of the package filesystem, if walked in advance.
+	walked []sca.WalkedEntry
 }
 
 // PackageName returns the currently built package name.
@@ -66,7 +69,13 @@ func (scabi *SCABuildInterface) FilesystemForRelative(pkgName string) (sca.SCAFS
 
 // Filesystem implements an abstract filesystem providing access to a package filesystem.
 func (scabi *SCABuildInterface) Filesystem() (sca.SCAFS, error) {
-	return scabi.FilesystemForRelative(scabi.PackageName())
+	return scabi.FilesystemForRelative(scabi.PackageBuild.configName())
+}
+
+// Walked returns the entries of the package filesystem walked in advance
+// by EmitPackage, which also computes the installed size from them, or nil.
+func (scabi *SCABuildInterface) Walked() []sca.WalkedEntry {
+	return scabi.walked
 }
 
 // Options returns the configured SCA engine options for the package being built.
@@ -78,3 +87,23 @@ func (scabi *SCABuildInterface) Options() config.PackageOption {
 func (scabi *SCABuildInterface) BaseDependencies() config.Dependencies {
 	return scabi.PackageBuild.Dependencies
 }
+
+// Strict returns true if analyzer errors fail the build, as set by
+// Build.StrictSCA.
+func (scabi *SCABuildInterface) Strict() bool {
+	return scabi.PackageBuild.Build.StrictSCA
+}
+
+// RecordWarning records the warnings of SCA on the Build, so that they fail
+// the package with WarningsAsErrors.
+func (scabi *SCABuildInterface) RecordWarning(msg string) {
+	scabi.PackageBuild.Build.recordWarning(scabi.PackageBuild.PackageName, msg)
+}
+
+// RecordDiscovery passes each dependency SCA generates to
+// Build.SCADiscoveryCallback, if it is set.
+func (scabi *SCABuildInterface) RecordDiscovery(d sca.Discovery) {
+	if cb := scabi.PackageBuild.Build.SCADiscoveryCallback; cb != nil {
+		cb(scabi.PackageBuild.PackageName, d)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"strings"
+
+	"chainguard.dev/melange/pkg/config"
+	"github.com/psanford/memfs"
+)
+
+// checkScriptlets enforces the structural rules of StrictScriptlets on the
+// scriptlets of the package, naming the scriptlet which breaks them.  Loading
+// a configuration does not check triggers, only config.ValidatePackaging does,
+// so these checks are what stop a malformed trigger from being packaged.
+func (pc *PackageBuild) checkScriptlets() error {
+	trigger := pc.Scriptlets.Trigger
+	hasScript := strings.TrimSpace(trigger.Script) != ""
+
+	switch {
+	case len(trigger.Paths) > 0 && !hasScript:
+		return fmt.Errorf("trigger scriptlet of %s has trigger paths but no script", pc.PackageName)
+	case hasScript && len(trigger.Paths) == 0:
+		return fmt.Errorf("trigger scriptlet of %s has a script but no trigger paths", pc.PackageName)
+	}
+
+	return nil
+}
+
+// scriptletGenerator expands an intent of config.GeneratedScriptlets into the
+// content of a scriptlet.
+type scriptletGenerator struct {
+	// The name of the intent in the configuration.
+	intent string
+	// The scriptlet it generates, in the control section.
+	file string
+	// Returns the value of the intent, which is empty if it is unset.
+	value func(config.GeneratedScriptlets) string
+	// Returns the scriptlet for the value of the intent in pkg.
+	generate func(pkg, value string) (string, error)
+}
+
+// scriptletGenerators are the intents which scriptlets can be generated from.
+var scriptletGenerators = []scriptletGenerator{{
+	intent:   "protect-running-service",
+	file:     ".pre-deinstall",
+	value:    func(g config.GeneratedScriptlets) string { return g.ProtectRunningService },
+	generate: protectRunningService,
+}}
+
+// serviceNameRE matches the service names which may be interpolated into a
+// generated scriptlet unquoted.
+var serviceNameRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*$`)
+
+// protectRunningService returns a pre-deinstall scriptlet which refuses to
+// remove pkg while a process named service is running.  If pidof is not
+// installed, the service is assumed not to be running.
+func protectRunningService(pkg, service string) (string, error) {
+	if !serviceNameRE.MatchString(service) {
+		return "", fmt.Errorf("invalid service name %q", service)
+	}
+
+	return fmt.Sprintf(`#!/bin/sh
+# Generated by melange from protect-running-service.
+if pidof %[1]s >/dev/null 2>&1; then
+	echo "%[1]s is running, stop it before removing %[2]s" >&2
+	exit 1
+fi
+`, service, pkg), nil
+}
+
+// writeGeneratedScriptlets adds the scriptlets generated from the intents of
+// the main package to the control FS.  Subpackages have none.
+func (pc *PackageBuild) writeGeneratedScriptlets(fsys *memfs.FS) error {
+	if pc.Origin == nil || pc.configName() != pc.Origin.Name {
+		return nil
+	}
+
+	for _, gen := range scriptletGenerators {
+		value := gen.value(pc.Origin.GeneratedScriptlets)
+		if value == "" {
+			continue
+		}
+
+		if _, err := fs.Stat(fsys, gen.file); err == nil {
+			return fmt.Errorf("%s of %s is generated from %s, it cannot also be configured", gen.file, pc.PackageName, gen.intent)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("unable to build control FS: %w", err)
+		}
+
+		script, err := gen.generate(pc.PackageName, value)
+		if err != nil {
+			return fmt.Errorf("generating %s of %s from %s: %w", gen.file, pc.PackageName, gen.intent, err)
+		}
+
+		// #nosec G306 -- scriptlets must be executable
+		if err := fsys.WriteFile(gen.file, []byte(script), 0755); err != nil {
+			return fmt.Errorf("unable to build control FS: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// accountEnvNameRE matches the characters of account names which cannot
+// appear in the name of a shell variable.
+var accountEnvNameRE = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// accountEnv returns shell which exports the ids of the accounts of the
+// build environment, as MELANGE_UID_<user> and MELANGE_GID_<group>, or ""
+// if there are none.  Characters of names which cannot appear in a variable
+// name are replaced with underscores.
+func (pc *PackageBuild) accountEnv() string {
+	accounts := pc.Build.Configuration.Environment.Accounts
+	if len(accounts.Users) == 0 && len(accounts.Groups) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString("# Generated by melange from the accounts of the build environment.\n")
+	for _, user := range accounts.Users {
+		fmt.Fprintf(&b, "export MELANGE_UID_%s=%d\n", accountEnvNameRE.ReplaceAllString(user.UserName, "_"), user.UID)
+	}
+	for _, group := range accounts.Groups {
+		fmt.Fprintf(&b, "export MELANGE_GID_%s=%d\n", accountEnvNameRE.ReplaceAllString(group.GroupName, "_"), group.GID)
+	}
+	return b.String()
+}
+
+// writeAccountEnv prepends accountEnv to the post-install scriptlet in the
+// control FS, if there is one, after its interpreter line.
+func (pc *PackageBuild) writeAccountEnv(fsys *memfs.FS) error {
+	env := pc.accountEnv()
+	if env == "" {
+		return nil
+	}
+
+	script, err := fs.ReadFile(fsys, ".post-install")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to build control FS: %w", err)
+	}
+
+	shebang := ""
+	if bytes.HasPrefix(script, []byte("#!")) {
+		line, rest, _ := bytes.Cut(script, []byte("\n"))
+		shebang, script = string(line)+"\n", rest
+	}
+
+	// #nosec G306 -- scriptlets must be executable
+	if err := fsys.WriteFile(".post-install", []byte(shebang+env+string(script)), 0755); err != nil {
+		return fmt.Errorf("unable to build control FS: %w", err)
+	}
+
+	return nil
+}
+
+// suspiciousScriptletSize is the size above which a scriptlet is warned
+// about, as it is more likely to be a file pasted in by mistake than a
+// script.
+const suspiciousScriptletSize = 64 << 10
+
+// checkScriptletSizes warns about scriptlets in the control FS larger than
+// suspiciousScriptletSize, and fails if any is larger than
+// Build.MaxScriptletSize.
+func (pc *PackageBuild) checkScriptletSizes(ctx context.Context, fsys *memfs.FS) error {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return fmt.Errorf("unable to read control FS: %w", err)
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, ".pre-") && !strings.HasPrefix(name, ".post-") && name != ".trigger" {
+			continue
+		}
+
+		fi, err := e.Info()
+		if err != nil {
+			return fmt.Errorf("unable to read control FS: %w", err)
+		}
+
+		if limit := pc.Build.MaxScriptletSize; limit > 0 && fi.Size() > limit {
+			return fmt.Errorf("%s scriptlet of %s is %d bytes, exceeding the limit of %d bytes", name, pc.PackageName, fi.Size(), limit)
+		}
+		if fi.Size() > suspiciousScriptletSize {
+			pc.warnf(ctx, "%s scriptlet of %s is %d bytes, check that no file was pasted into it by mistake", name, pc.PackageName, fi.Size())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// selected returns true if the package or subpackage named name is emitted,
+// which is always the case unless OnlyPackages is set.
+func (b *Build) selected(name string) bool {
+	return len(b.OnlyPackages) == 0 || slices.Contains(b.OnlyPackages, name)
+}
+
+// checkOnlyPackages ensures every package named by OnlyPackages is part of
+// the build.
+func (b *Build) checkOnlyPackages() error {
+	for _, name := range b.OnlyPackages {
+		if name == b.Configuration.Package.Name {
+			continue
+		}
+		if !slices.ContainsFunc(b.Configuration.Subpackages, func(sp config.Subpackage) bool { return sp.Name == name }) {
+			return fmt.Errorf("only emitting %q, which is not a package of this build", name)
+		}
+	}
+
+	return nil
+}
+
+// dependencyName returns the name of the package or provide which dep
+// refers to, without any version constraint.
+func dependencyName(dep string) string {
+	if i := strings.IndexAny(dep, "<>=~"); i >= 0 {
+		return dep[:i]
+	}
+	return dep
+}
+
+// skippedPrerequisites returns, for each package selected by OnlyPackages,
+// the configured runtime dependencies on packages of this build which are
+// not selected, and so will not be emitted with it.
+func (b *Build) skippedPrerequisites() map[string][]string {
+	if len(b.OnlyPackages) == 0 {
+		return nil
+	}
+
+	pkgs := []*config.Package{&b.Configuration.Package}
+	for i := range b.Configuration.Subpackages {
+		pkgs = append(pkgs, pkgFromSub(&b.Configuration.Subpackages[i]))
+	}
+
+	// Map the names, and configured provides, of skipped packages to them.
+	skipped := map[string]string{}
+	for _, pkg := range pkgs {
+		if b.selected(pkg.Name) {
+			continue
+		}
+		skipped[pkg.Name] = pkg.Name
+		for _, provide := range pkg.Dependencies.Provides {
+			skipped[dependencyName(provide)] = pkg.Name
+		}
+	}
+
+	missing := map[string][]string{}
+	for _, pkg := range pkgs {
+		if !b.selected(pkg.Name) {
+			continue
+		}
+		for _, dep := range pkg.Dependencies.Runtime {
+			if name, ok := skipped[dependencyName(dep)]; ok && !slices.Contains(missing[pkg.Name], name) {
+				missing[pkg.Name] = append(missing[pkg.Name], name)
+			}
+		}
+	}
+
+	return missing
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"chainguard.dev/melange/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOnlyPackages(t *testing.T) {
+	b := &Build{
+		Configuration: config.Configuration{
+			Package: config.Package{Name: "hello", Version: "1.0.0"},
+			Subpackages: []config.Subpackage{{
+				Name:         "hello-libs",
+				Dependencies: config.Dependencies{Provides: []string{"libhello=1.0.0"}},
+			}, {
+				Name:         "hello-dev",
+				Dependencies: config.Dependencies{Runtime: []string{"hello=1.0.0-r0", "libhello", "hello-libs>1.0", "busybox"}},
+			}, {
+				Name:         "hello-doc",
+				Dependencies: config.Dependencies{Runtime: []string{"hello-dev"}},
+			}},
+		},
+	}
+
+	// Everything is emitted by default.
+	require.True(t, b.selected("hello-doc"))
+	require.NoError(t, b.checkOnlyPackages())
+	require.Empty(t, b.skippedPrerequisites())
+
+	b.OnlyPackages = []string{"hello-dev", "hello-doc"}
+	require.NoError(t, b.checkOnlyPackages())
+	require.False(t, b.selected("hello"))
+	require.True(t, b.selected("hello-dev"))
+	require.Equal(t, map[string][]string{
+		"hello-dev": {"hello", "hello-libs"},
+	}, b.skippedPrerequisites())
+
+	b.OnlyPackages = []string{"hello-man"}
+	require.ErrorContains(t, b.checkOnlyPackages(), `"hello-man", which is not a package of this build`)
+}
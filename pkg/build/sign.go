@@ -7,11 +7,15 @@ import (
 
 	//nolint:gosec
 	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"time"
 
+	"github.com/chainguard-dev/clog"
 	sign "github.com/chainguard-dev/go-apk/pkg/signature"
 	"github.com/klauspost/compress/gzip"
 	"go.opentelemetry.io/otel"
@@ -86,6 +90,88 @@ func (s KeyApkSigner) Sign(control []byte) ([]byte, error) {
 	return sign.RSASignSHA1Digest(digest.Sum(nil), s.KeyFile, s.KeyPassphrase)
 }
 
+// checkSigningKey fails before anything is built if SigningKey cannot be
+// used to sign packages: if it does not exist, or if it is encrypted and
+// there is no passphrase, nor a prompt for one.  The prompt is called once
+// here, and the passphrase it returns is checked against the key and kept
+// in SigningPassphrase for the rest of the build.  If SigningKeyOptional is
+// set, a missing key is a warning instead, and packages are not signed.
+func (b *Build) checkSigningKey(ctx context.Context) error {
+	if b.SigningKey != "" {
+		if _, err := os.Stat(b.SigningKey); errors.Is(err, os.ErrNotExist) {
+			if !b.SigningKeyOptional {
+				return fmt.Errorf("signing key %s does not exist", b.SigningKey)
+			}
+			clog.FromContext(ctx).Warnf("signing key %s does not exist, packages will not be signed", b.SigningKey)
+			b.SigningKey = ""
+		} else if err != nil {
+			return fmt.Errorf("unable to stat signing key %s: %w", b.SigningKey, err)
+		} else if err := b.checkSigningPassphrase(); err != nil {
+			return err
+		}
+	}
+
+	// Indexes are only signed with a passphrase when they are signed with
+	// SigningKey.
+	if key := b.IndexSigningKey; key != "" && key != b.SigningKey && (b.GenerateIndex || b.EmitPerPackageIndex || b.SignChecksumsFile) {
+		encrypted, err := keyIsEncrypted(key)
+		if err != nil {
+			return err
+		}
+		if encrypted {
+			return fmt.Errorf("index signing key %s is encrypted, which is only supported when it is the signing key", key)
+		}
+	}
+
+	return nil
+}
+
+// checkSigningPassphrase reads the passphrase of SigningKey from
+// PassphrasePrompt if it is encrypted and SigningPassphrase is empty, and
+// fails if the passphrase does not decrypt it.
+func (b *Build) checkSigningPassphrase() error {
+	encrypted, err := keyIsEncrypted(b.SigningKey)
+	if err != nil {
+		return err
+	}
+	if !encrypted {
+		return nil
+	}
+
+	if b.SigningPassphrase == "" {
+		if b.PassphrasePrompt == nil {
+			return fmt.Errorf("signing key %s is encrypted, but there is no passphrase for it", b.SigningKey)
+		}
+		passphrase, err := b.PassphrasePrompt()
+		if err != nil {
+			return fmt.Errorf("unable to read passphrase for %s: %w", b.SigningKey, err)
+		}
+		b.SigningPassphrase = passphrase
+	}
+
+	if _, err := sign.RSASignSHA1Digest(make([]byte, sha1.Size), b.SigningKey, b.SigningPassphrase); err != nil {
+		return fmt.Errorf("unable to decrypt signing key %s with its passphrase: %w", b.SigningKey, err)
+	}
+
+	return nil
+}
+
+// keyIsEncrypted reports whether the PEM-encoded key in keyFile is
+// encrypted with a passphrase.
+func keyIsEncrypted(keyFile string) (bool, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return false, fmt.Errorf("unable to read signing key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return false, fmt.Errorf("signing key %s is not PEM-encoded", keyFile)
+	}
+
+	return x509.IsEncryptedPEMBlock(block), nil //nolint:staticcheck
+}
+
 func (s KeyApkSigner) SignatureName() string {
 	return fmt.Sprintf(".SIGN.RSA.%s.pub", filepath.Base(s.KeyFile))
 }
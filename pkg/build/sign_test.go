@@ -4,13 +4,22 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+
+	//nolint:gosec
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
 	"io"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"chainguard.dev/melange/pkg/build"
 	"github.com/chainguard-dev/clog/slogtest"
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 )
@@ -101,3 +110,50 @@ func (*mockSigner) Sign(controlData []byte) ([]byte, error) {
 func (*mockSigner) SignatureName() string {
 	return "mockiavelli"
 }
+
+func TestKeyApkSignerPassphrase(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//nolint:staticcheck
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(priv), []byte("secret"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "encrypted.rsa")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	pubDER, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+
+	control := []byte("donkey")
+	//nolint:gosec
+	digest := sha1.Sum(control)
+
+	signer := build.KeyApkSigner{
+		KeyFile:       keyFile,
+		KeyPassphrase: "secret",
+	}
+
+	sig, err := signer.Sign(control)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sign.RSAVerifySHA1Digest(digest[:], sig, pub); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without its passphrase, the key cannot be used.
+	signer.KeyPassphrase = ""
+	if _, err := signer.Sign(control); err == nil {
+		t.Error("expected an error without the passphrase")
+	}
+}
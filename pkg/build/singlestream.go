@@ -0,0 +1,111 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/pgzip"
+)
+
+// singleStreamExt is the extension of single stream packages, which are
+// not apks and so are not named as such.
+const singleStreamExt = ".stream.tar.gz"
+
+// checkSingleStream fails if SingleStream is combined with options which
+// read or publish the emitted package as an apk.
+func (b *Build) checkSingleStream() error {
+	if !b.SingleStream {
+		return nil
+	}
+
+	for _, c := range []struct {
+		set bool
+		msg string
+	}{
+		{b.SigningKey != "", "single stream packages cannot be signed"},
+		{b.GenerateIndex, "single stream packages cannot be indexed, disable index generation"},
+		{b.ValidateWithApk != "", "single stream packages cannot be validated with apk"},
+		{b.RunTestsAfterEmit, "single stream packages cannot be installed to run tests"},
+		{b.CompareAgainst != "", "single stream packages cannot be compared against a previous apk"},
+		{b.ContentAddressedOutput, "single stream packages cannot be content addressed"},
+		{b.EmitOCILayout, "single stream packages cannot be wrapped in an OCI layout"},
+		{b.EmitDataArtifact, "data artifacts cannot be emitted for single stream packages"},
+	} {
+		if c.set {
+			return errors.New(c.msg)
+		}
+	}
+
+	return nil
+}
+
+// writeSingleStream compresses the control tarball of control, followed by
+// the data tarball of data, as a single gzip member, for Build.SingleStream.
+// The result is not an apk: apk requires each section to be its own gzip
+// member.  The returned file is positioned at its start.
+func (pc *PackageBuild) writeSingleStream(ctx context.Context, control []byte, data io.Reader) (*os.File, error) {
+	controlTar, err := gzip.NewReader(bytes.NewReader(control))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress control section: %w", err)
+	}
+	defer controlTar.Close()
+
+	dataTar, err := gzip.NewReader(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress data section: %w", err)
+	}
+	defer dataTar.Close()
+
+	f, err := pc.Build.createTemp("melange-stream-*.tar.gz", pc.tempKey())
+	if err != nil {
+		return nil, fmt.Errorf("unable to open temporary file for writing: %w", err)
+	}
+
+	threads, release, err := pc.Build.CompressionPool.acquire(ctx, pgzipThreads)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("waiting for compression workers: %w", err)
+	}
+	defer release()
+
+	if err := func() error {
+		zw := pgzip.NewWriter(f)
+		if err := zw.SetConcurrency(pc.Build.pgzipBlockSize(), threads); err != nil {
+			return fmt.Errorf("tried to set pgzip concurrency to %d: %w", threads, err)
+		}
+		if _, err := io.Copy(zw, io.MultiReader(controlTar, dataTar)); err != nil {
+			return fmt.Errorf("unable to write single stream: %w", err)
+		}
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("flushing single stream gzip: %w", err)
+		}
+		_, err := f.Seek(0, io.SeekStart)
+		return err
+	}(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return f, nil
+}
@@ -0,0 +1,267 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	// sparseBlockSize is the granularity at which holes are detected: a
+	// run of zeroes is only treated as a hole if it covers whole blocks.
+	sparseBlockSize = 4096
+	// sparseMinSize is the size of the smallest file considered for
+	// sparse encoding.
+	sparseMinSize = 1 << 20
+	// sparseMaxSize is the size of the largest file which can be encoded,
+	// as the old GNU sparse header stores sizes in 11 octal digits.
+	sparseMaxSize = 1<<33 - 1
+
+	tarBlockSize = 512
+)
+
+// sparseEntry is a fragment of data within a sparse file.
+type sparseEntry struct {
+	offset, length int64
+}
+
+// writeSparse writes the regular file entry hdr, whose contents are read
+// from body, to w using the old GNU sparse format (typeflag 'S'), which apk
+// understands, so that runs of zeroes are stored as holes and the file is
+// extracted sparsely.  The PAX records of the entry, including its apk
+// checksum, are carried by a PAX extended header preceding it.  tw, which
+// must write to w, is flushed first.  The data fragments are spooled to a
+// temporary file from createSpool, which is removed afterwards.
+//
+// If the file turns out to have no holes, it is written to tw as a regular
+// entry from the spool, so that it is never held in memory.  It returns
+// false, having read and written nothing, if the file is not a candidate
+// for sparse encoding, for the caller to write normally.
+func writeSparse(tw *tar.Writer, w io.Writer, hdr *tar.Header, body io.Reader, createSpool func() (*os.File, error)) (bool, error) {
+	if hdr.Typeflag != tar.TypeReg || hdr.Format == tar.FormatUSTAR ||
+		hdr.Size < sparseMinSize || hdr.Size > sparseMaxSize || len(hdr.Name) > 100 {
+		return false, nil
+	}
+
+	// Spool the data fragments, so that their total size is known before
+	// the header is written.
+	spool, err := createSpool()
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	entries, err := spoolSparse(spool, body, hdr.Size)
+	if err != nil {
+		return false, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	if len(entries) == 1 && entries[0].length == hdr.Size {
+		// There are no holes; the spool holds the whole file.
+		if err := tw.WriteHeader(hdr); err != nil {
+			return false, err
+		}
+		if _, err := io.Copy(tw, spool); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	var stored int64
+	for _, e := range entries {
+		stored += e.length
+	}
+
+	if err := tw.Flush(); err != nil {
+		return false, err
+	}
+
+	if len(hdr.PAXRecords) > 0 {
+		if err := writePAXHeader(w, hdr); err != nil {
+			return false, err
+		}
+	}
+
+	if err := writeGNUSparseHeader(w, hdr, stored, entries); err != nil {
+		return false, err
+	}
+
+	if _, err := io.Copy(w, spool); err != nil {
+		return false, err
+	}
+	if _, err := w.Write(make([]byte, tarPadding(stored))); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// spoolSparse copies the non-zero blocks of body, which is size bytes long,
+// to spool and returns where they belong in the file.  If the file ends in
+// a hole, a final empty entry records its size.
+func spoolSparse(spool io.Writer, body io.Reader, size int64) ([]sparseEntry, error) {
+	entries := []sparseEntry{}
+	buf := make([]byte, sparseBlockSize)
+	zero := make([]byte, sparseBlockSize)
+
+	for off := int64(0); off < size; {
+		n, err := io.ReadFull(body, buf[:min(sparseBlockSize, int(size-off))])
+		if err != nil {
+			return nil, fmt.Errorf("reading file contents: %w", err)
+		}
+
+		if !bytes.Equal(buf[:n], zero[:n]) {
+			if _, err := spool.Write(buf[:n]); err != nil {
+				return nil, err
+			}
+			if last := len(entries) - 1; last >= 0 && entries[last].offset+entries[last].length == off {
+				entries[last].length += int64(n)
+			} else {
+				entries = append(entries, sparseEntry{offset: off, length: int64(n)})
+			}
+		}
+
+		off += int64(n)
+	}
+
+	if last := len(entries) - 1; last < 0 || entries[last].offset+entries[last].length < size {
+		entries = append(entries, sparseEntry{offset: size})
+	}
+
+	return entries, nil
+}
+
+// writePAXHeader writes a PAX extended header ('x') holding the PAX records
+// of hdr.
+func writePAXHeader(w io.Writer, hdr *tar.Header) error {
+	keys := make([]string, 0, len(hdr.PAXRecords))
+	for k := range hdr.PAXRecords {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var records bytes.Buffer
+	for _, k := range keys {
+		// Each record is prefixed by its own length, including the prefix.
+		rec := fmt.Sprintf(" %s=%s\n", k, hdr.PAXRecords[k])
+		n := len(rec)
+		for n < len(rec)+len(fmt.Sprint(n)) {
+			n = len(rec) + len(fmt.Sprint(n))
+		}
+		fmt.Fprintf(&records, "%d%s", n, rec)
+	}
+
+	blk := newTarBlock("PaxHeaders.0/"+hdr.Name, tar.TypeXHeader)
+	blk.putOctal(124, 12, int64(records.Len()))
+	blk.putOctal(136, 12, hdr.ModTime.Unix())
+	blk.putOctal(100, 8, 0o644)
+	copy(blk[257:], "ustar\x0000")
+	blk.checksum()
+
+	if _, err := w.Write(blk[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(records.Bytes()); err != nil {
+		return err
+	}
+	_, err := w.Write(make([]byte, tarPadding(int64(records.Len()))))
+	return err
+}
+
+// writeGNUSparseHeader writes the old GNU sparse header of hdr, followed by
+// as many extension blocks as its sparse map needs.
+func writeGNUSparseHeader(w io.Writer, hdr *tar.Header, stored int64, entries []sparseEntry) error {
+	blk := newTarBlock(hdr.Name, tar.TypeGNUSparse)
+	blk.putOctal(100, 8, hdr.Mode)
+	blk.putOctal(108, 8, int64(hdr.Uid))
+	blk.putOctal(116, 8, int64(hdr.Gid))
+	blk.putOctal(124, 12, stored)
+	blk.putOctal(136, 12, hdr.ModTime.Unix())
+	copy(blk[257:], "ustar  \x00")
+	copy(blk[265:265+32], hdr.Uname)
+	copy(blk[297:297+32], hdr.Gname)
+	blk.putOctal(483, 12, hdr.Size)
+
+	// The header holds four entries; extension blocks hold 21 each.
+	extensions := []*tarBlock{}
+	cur, base, slots := blk, 386, 4
+	for i, e := range entries {
+		if i >= 4 && (i-4)%21 == 0 {
+			ext := &tarBlock{}
+			cur[base+slots*24] = 1 // isextended
+			extensions = append(extensions, ext)
+			cur, base, slots = ext, 0, 21
+		}
+		slot := i
+		if i >= 4 {
+			slot = (i - 4) % 21
+		}
+		cur.putOctal(base+slot*24, 12, e.offset)
+		cur.putOctal(base+slot*24+12, 12, e.length)
+	}
+	blk.checksum()
+
+	if _, err := w.Write(blk[:]); err != nil {
+		return err
+	}
+	for _, ext := range extensions {
+		if _, err := w.Write(ext[:]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tarBlock is a raw tar header block.
+type tarBlock [tarBlockSize]byte
+
+func newTarBlock(name string, typeflag byte) *tarBlock {
+	blk := &tarBlock{}
+	copy(blk[0:100], name)
+	blk[156] = typeflag
+	return blk
+}
+
+// putOctal writes v as a NUL-terminated octal number into the field of
+// size bytes at off.
+func (blk *tarBlock) putOctal(off, size int, v int64) {
+	copy(blk[off:off+size], fmt.Sprintf("%0*o\x00", size-1, v))
+}
+
+// checksum computes and stores the header checksum.
+func (blk *tarBlock) checksum() {
+	copy(blk[148:156], "        ")
+	var sum int64
+	for _, b := range blk {
+		sum += int64(b)
+	}
+	copy(blk[148:156], fmt.Sprintf("%06o\x00 ", sum))
+}
+
+// tarPadding returns the number of bytes needed to pad n to a whole number
+// of tar blocks.
+func tarPadding(n int64) int64 {
+	return -n & (tarBlockSize - 1)
+}
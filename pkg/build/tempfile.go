@@ -0,0 +1,73 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// createTemp creates a temporary file in TempDir, as os.CreateTemp does.
+// When RandomSeed is set, the random part of the name is instead derived
+// from the seed and key, so that builds with the same seed use the same
+// paths.  key must be unique among the temporary files of a build (for
+// example, the identity of the package being emitted).  When NamedTempFiles
+// is set, the random part is the key itself, so that files left behind by a
+// crashed build can be traced to the package they belong to.
+//
+// As such names are predictable, any existing file of the same name is
+// removed and the file is created exclusively, so that a link planted at
+// the name in a shared TempDir is never followed.
+func (b *Build) createTemp(pattern, key string) (*os.File, error) {
+	var name string
+	switch {
+	case b.NamedTempFiles:
+		name = strings.Replace(pattern, "*", key, 1)
+	case b.RandomSeed != 0:
+		h := sha256.New()
+		_ = binary.Write(h, binary.BigEndian, b.RandomSeed)
+		h.Write([]byte(key))
+		name = strings.Replace(pattern, "*", hex.EncodeToString(h.Sum(nil)[:8]), 1)
+	default:
+		return os.CreateTemp(b.TempDir, pattern)
+	}
+
+	dir := b.TempDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	path := filepath.Join(dir, name)
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("unable to remove stale temporary file: %w", err)
+	}
+
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0o600)
+}
+
+// tempKey is the key of the temporary files of the package in createTemp.
+// It includes the architecture so that builds of several architectures
+// can share a TempDir.
+func (pc *PackageBuild) tempKey() string {
+	return pc.Identity() + "-" + pc.Arch
+}
@@ -0,0 +1,155 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_createTemp(t *testing.T) {
+	dir := t.TempDir()
+	name := func(b *Build, key string) string {
+		t.Helper()
+		f, err := b.createTemp("melange-data-*.tar.gz", key)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		require.Equal(t, dir, filepath.Dir(f.Name()))
+		require.True(t, strings.HasPrefix(filepath.Base(f.Name()), "melange-data-"))
+		return f.Name()
+	}
+
+	seeded := &Build{TempDir: dir, RandomSeed: 42}
+	require.Equal(t, name(seeded, "hello-1.0.0-r0"), name(seeded, "hello-1.0.0-r0"))
+	require.NotEqual(t, name(seeded, "hello-1.0.0-r0"), name(seeded, "hello-doc-1.0.0-r0"))
+	require.NotEqual(t, name(seeded, "hello-1.0.0-r0"), name(&Build{TempDir: dir, RandomSeed: 43}, "hello-1.0.0-r0"))
+
+	unseeded := &Build{TempDir: dir}
+	require.NotEqual(t, name(unseeded, "hello-1.0.0-r0"), name(unseeded, "hello-1.0.0-r0"))
+
+	named := &Build{TempDir: dir, RandomSeed: 42, NamedTempFiles: true}
+	require.Equal(t, filepath.Join(dir, "melange-data-hello-1.0.0-r0-x86_64.tar.gz"), name(named, "hello-1.0.0-r0-x86_64"))
+}
+
+func Test_createTemp_seededSymlink(t *testing.T) {
+	dir := t.TempDir()
+	b := &Build{TempDir: dir, RandomSeed: 42}
+
+	f, err := b.createTemp("melange-data-*.tar.gz", "hello-1.0.0-r0")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, os.Remove(f.Name()))
+
+	// A link planted at the predictable name is replaced, not followed.
+	target := filepath.Join(t.TempDir(), "target")
+	require.NoError(t, os.WriteFile(target, []byte("precious"), 0o644))
+	require.NoError(t, os.Symlink(target, f.Name()))
+
+	f, err = b.createTemp("melange-data-*.tar.gz", "hello-1.0.0-r0")
+	require.NoError(t, err)
+	_, err = f.WriteString("data")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	data, err := os.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, "precious", string(data))
+	fi, err := os.Lstat(f.Name())
+	require.NoError(t, err)
+	require.True(t, fi.Mode().IsRegular())
+}
+
+func TestEmitPackage_NamedTempFiles(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{TempDir: t.TempDir(), NamedTempFiles: true}
+	newPackageBuild := testPackageBuilder(t, b)
+
+	pc := newPackageBuild()
+	require.Equal(t, pc.Identity()+"-"+pc.Arch, pc.tempKey())
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	// The temporary data section is removed once the package is written.
+	entries, err := os.ReadDir(b.TempDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestEmitPackage_NamedTempFilesSymlink(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{TempDir: t.TempDir(), NamedTempFiles: true}
+	pc := testPackageBuilder(t, b)()
+
+	// A link planted at the name of the data section is not followed.
+	target := filepath.Join(t.TempDir(), "target")
+	require.NoError(t, os.WriteFile(target, []byte("precious"), 0o644))
+	require.NoError(t, os.Symlink(target, filepath.Join(b.TempDir, "melange-data-"+pc.tempKey()+".tar.gz")))
+
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	data, err := os.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, "precious", string(data))
+	entries, err := os.ReadDir(b.TempDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestEmitPackage_TempDir(t *testing.T) {
+	ctx := context.Background()
+	// Temporary files created outside TempDir fail.
+	t.Setenv("TMPDIR", filepath.Join(t.TempDir(), "missing"))
+	b := &Build{TempDir: t.TempDir(), PreserveSparse: true, BenchmarkCompression: true}
+	newPackageBuild := testPackageBuilder(t, b)
+
+	pc := newPackageBuild()
+	f, err := os.Create(filepath.Join(pc.WorkspaceSubdir(), "sparse"))
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(4<<20))
+	require.NoError(t, f.Close())
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	// The spooled sparse files and the benchmarked data section are
+	// removed once the package is written.
+	entries, err := os.ReadDir(b.TempDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestEmitPackage_RandomSeed(t *testing.T) {
+	ctx := context.Background()
+	b := &Build{TempDir: t.TempDir(), RandomSeed: 42}
+	newPackageBuild := testPackageBuilder(t, b)
+
+	pc := newPackageBuild()
+	require.NoError(t, pc.EmitPackage(ctx))
+	want, err := os.ReadFile(pc.Filename())
+	require.NoError(t, err)
+
+	pc = newPackageBuild()
+	require.NoError(t, pc.EmitPackage(ctx))
+	got, err := os.ReadFile(pc.Filename())
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	// The temporary data section is removed once the package is written.
+	entries, err := os.ReadDir(b.TempDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
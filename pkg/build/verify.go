@@ -0,0 +1,299 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+
+	//nolint:gosec
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+	"github.com/klauspost/compress/gzip"
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	rsaSignaturePrefix       = ".SIGN.RSA."
+	rsaSHA256SignaturePrefix = ".SIGN.RSA256."
+	signaturePrefix          = ".SIGN."
+)
+
+// checkVerifyInputs fails before anything is built if input signatures are
+// to be verified, but there is no keyring to verify them against or no apk
+// cache to read them from.
+func (b *Build) checkVerifyInputs() error {
+	if !b.VerifyInputSignatures {
+		return nil
+	}
+
+	if len(b.VerifyInputKeyring) == 0 {
+		return fmt.Errorf("verifying input signatures requires a keyring to verify them against")
+	}
+
+	if _, err := loadKeyring(b.VerifyInputKeyring); err != nil {
+		return fmt.Errorf("unable to load input keyring: %w", err)
+	}
+
+	if _, err := b.apkCacheDir(); err != nil {
+		return fmt.Errorf("verifying input signatures requires an apk cache: %w", err)
+	}
+
+	return nil
+}
+
+// VerifyInputs checks that every package installed into the guest was signed
+// by a key in VerifyInputKeyring, which is configured separately from the
+// keyring apko installs the packages with.  The control and signature
+// sections are read from the apk cache, so packages which are not cached,
+// such as those from local repositories, cannot be verified; they are
+// reported apart from packages whose signatures are not trusted.
+func (b *Build) VerifyInputs(ctx context.Context) error {
+	ctx, span := otel.Tracer("melange").Start(ctx, "VerifyInputs")
+	defer span.End()
+	log := clog.FromContext(ctx)
+
+	cacheDir, err := b.apkCacheDir()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(cacheDir); err != nil {
+		return fmt.Errorf("input signatures are read from the apk cache: %w", err)
+	}
+
+	keyring, err := loadKeyring(b.VerifyInputKeyring)
+	if err != nil {
+		return fmt.Errorf("unable to load input keyring: %w", err)
+	}
+
+	f, err := os.Open(filepath.Join(b.GuestDir, "lib", "apk", "db", "installed"))
+	if err != nil {
+		return fmt.Errorf("unable to open installed database: %w", err)
+	}
+	defer f.Close()
+
+	installed, err := apk.ParseInstalled(f)
+	if err != nil {
+		return fmt.Errorf("unable to parse installed database: %w", err)
+	}
+
+	uncached, untrusted := []string{}, []string{}
+	for _, pkg := range installed {
+		err := verifyCachedPackage(cacheDir, &pkg.Package, keyring)
+		switch {
+		case errors.Is(err, errNotCached):
+			uncached = append(uncached, pkg.Name)
+		case err != nil:
+			log.Warnf("unable to verify %s-%s: %v", pkg.Name, pkg.Version, err)
+			untrusted = append(untrusted, pkg.Name)
+		}
+	}
+
+	var errs []error
+	if len(uncached) > 0 {
+		errs = append(errs, fmt.Errorf("input packages not in the apk cache %s, whose signatures cannot be verified: %s", cacheDir, strings.Join(uncached, ", ")))
+	}
+	if len(untrusted) > 0 {
+		errs = append(errs, fmt.Errorf("untrusted input packages: %s", strings.Join(untrusted, ", ")))
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	log.Infof("verified signatures of %d input packages", len(installed))
+
+	return nil
+}
+
+// apkCacheDir returns the apk cache directory used by apko, which falls back
+// to the same system-defined directory as go-apk when ApkCacheDir is unset.
+func (b *Build) apkCacheDir() (string, error) {
+	if b.ApkCacheDir != "" {
+		return b.ApkCacheDir, nil
+	}
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("unable to determine apk cache directory: %w", err)
+	}
+
+	return filepath.Join(dir, "dev.chainguard.go-apk"), nil
+}
+
+// errNotCached is returned by verifyCachedPackage for packages which are
+// not in the apk cache.
+var errNotCached = errors.New("control section not found in apk cache")
+
+// verifyCachedPackage locates the control and signature sections of pkg in
+// the apk cache and verifies them against keyring.  The cache stores each
+// package as <repo>/<arch>/<name>-<version>/<control sha1>.{ctl,sig}.tar.gz;
+// the control section must hash to the sha1 recorded for pkg.
+func verifyCachedPackage(cacheDir string, pkg *apk.Package, keyring map[string][]byte) error {
+	ctlHex := hex.EncodeToString(pkg.Checksum)
+	pattern := filepath.Join(cacheDir, "*", "*", fmt.Sprintf("%s-%s", pkg.Name, pkg.Version), ctlHex+".ctl.tar.gz")
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		return errNotCached
+	}
+
+	ctlFile := matches[0]
+	sigFile := strings.TrimSuffix(ctlFile, ".ctl.tar.gz") + ".sig.tar.gz"
+
+	ctl, err := os.ReadFile(ctlFile)
+	if err != nil {
+		return err
+	}
+
+	// The cache is keyed by the control sha1 in the installed database,
+	// but nothing stops another control section being stored under it.
+	//nolint:gosec
+	if digest := sha1.Sum(ctl); !bytes.Equal(digest[:], pkg.Checksum) {
+		return fmt.Errorf("cached control section has sha1 %s, expected %s", hex.EncodeToString(digest[:]), ctlHex)
+	}
+
+	sig, err := os.Open(sigFile)
+	if err != nil {
+		return fmt.Errorf("signature section not found in apk cache: %w", err)
+	}
+	defer sig.Close()
+
+	return verifyApkSignature(sig, bytes.NewReader(ctl), keyring)
+}
+
+// loadKeyring reads the public keys in files, keyed by file name, which is
+// how signatures name the key they were made with.
+func loadKeyring(files []string) (map[string][]byte, error) {
+	keyring := map[string][]byte{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		keyring[filepath.Base(file)] = data
+	}
+
+	return keyring, nil
+}
+
+// verifyApkSignature verifies the gzipped signature section sig against the
+// digest of the gzipped control section ctl, using the key named by the
+// signature's .SIGN.RSA.<key> (SHA1) or .SIGN.RSA256.<key> (SHA256) member.
+// Other signature types are not supported.
+func verifyApkSignature(sig, ctl io.Reader, keyring map[string][]byte) error {
+	zr, err := gzip.NewReader(sig)
+	if err != nil {
+		return fmt.Errorf("unable to decompress signature section: %w", err)
+	}
+	defer zr.Close()
+
+	//nolint:gosec
+	sha1Digest := sha1.New()
+	sha256Digest := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(sha1Digest, sha256Digest), ctl); err != nil {
+		return fmt.Errorf("unable to hash control section: %w", err)
+	}
+
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read signature section: %w", err)
+		}
+
+		var prefix string
+		var verify func(signature, key []byte) error
+		switch {
+		case strings.HasPrefix(hdr.Name, rsaSignaturePrefix):
+			prefix = rsaSignaturePrefix
+			verify = func(signature, key []byte) error {
+				return sign.RSAVerifySHA1Digest(sha1Digest.Sum(nil), signature, key)
+			}
+		case strings.HasPrefix(hdr.Name, rsaSHA256SignaturePrefix):
+			prefix = rsaSHA256SignaturePrefix
+			verify = func(signature, key []byte) error {
+				return rsaVerifySHA256Digest(sha256Digest.Sum(nil), signature, key)
+			}
+		case strings.HasPrefix(hdr.Name, signaturePrefix):
+			return fmt.Errorf("unsupported signature type %s", hdr.Name)
+		default:
+			continue
+		}
+
+		keyName := strings.TrimPrefix(hdr.Name, prefix)
+		key, ok := keyring[keyName]
+		if !ok {
+			return fmt.Errorf("signed by unknown key %s", keyName)
+		}
+
+		signature, err := io.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("unable to read signature: %w", err)
+		}
+
+		if err := verify(signature, key); err != nil {
+			return fmt.Errorf("signature by %s is invalid: %w", keyName, err)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("no RSA signature found")
+}
+
+// rsaVerifySHA256Digest verifies an RSA PKCS#1 v1.5 signature of a SHA256
+// digest against the PEM-encoded public key, as sign.RSAVerifySHA1Digest
+// does for SHA1 digests.
+func rsaVerifySHA256Digest(digest, signature, publicKey []byte) error {
+	block, _ := pem.Decode(publicKey)
+	if block == nil {
+		return fmt.Errorf("public key is not PEM-encoded")
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("unable to parse public key: %w", err)
+	}
+
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("public key is not an RSA key")
+	}
+
+	return rsa.VerifyPKCS1v15(rsaPub, crypto.SHA256, digest, signature)
+}
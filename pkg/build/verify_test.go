@@ -0,0 +1,248 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestKey generates an RSA key pair in dir, returning the path of the
+// private key and the PEM-encoded public key.
+func writeTestKey(t *testing.T, dir, name string) (string, []byte) {
+	t.Helper()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	keyFile := filepath.Join(dir, name)
+	privPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	require.NoError(t, os.WriteFile(keyFile, privPEM, 0o600))
+
+	pubDER, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	require.NoError(t, err)
+
+	return keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+}
+
+// signatureSection returns a gzipped signature section holding a single
+// member.
+func signatureSection(t *testing.T, name string, signature []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(signature))}))
+	_, err := tw.Write(signature)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, zw.Close())
+
+	return buf.Bytes()
+}
+
+// signSHA256 returns a .SIGN.RSA256. signature section of control, made
+// with the key in keyFile.
+func signSHA256(t *testing.T, keyFile string, control []byte) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(keyFile)
+	require.NoError(t, err)
+	block, _ := pem.Decode(data)
+	priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	require.NoError(t, err)
+
+	digest := sha256.Sum256(control)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+
+	return signatureSection(t, ".SIGN.RSA256."+filepath.Base(keyFile)+".pub", signature)
+}
+
+func Test_verifyApkSignature(t *testing.T) {
+	dir := t.TempDir()
+	trustedKey, trustedPub := writeTestKey(t, dir, "trusted.rsa")
+	otherKey, otherPub := writeTestKey(t, dir, "other.rsa")
+
+	control := []byte("control section")
+	sign := func(keyFile string) []byte {
+		sig, err := EmitSignature(context.Background(), KeyApkSigner{KeyFile: keyFile}, control, time.Unix(0, 0))
+		require.NoError(t, err)
+		return sig
+	}
+
+	tests := []struct {
+		name    string
+		sig     []byte
+		control []byte
+		keyring map[string][]byte
+		wantErr string
+	}{{
+		name:    "trusted",
+		sig:     sign(trustedKey),
+		control: control,
+		keyring: map[string][]byte{"trusted.rsa.pub": trustedPub},
+	}, {
+		name:    "unknown key",
+		sig:     sign(otherKey),
+		control: control,
+		keyring: map[string][]byte{"trusted.rsa.pub": trustedPub},
+		wantErr: "signed by unknown key other.rsa.pub",
+	}, {
+		name:    "wrong key material",
+		sig:     sign(trustedKey),
+		control: control,
+		keyring: map[string][]byte{"trusted.rsa.pub": otherPub},
+		wantErr: "signature by trusted.rsa.pub is invalid",
+	}, {
+		name:    "tampered control",
+		sig:     sign(trustedKey),
+		control: []byte("tampered section"),
+		keyring: map[string][]byte{"trusted.rsa.pub": trustedPub},
+		wantErr: "signature by trusted.rsa.pub is invalid",
+	}, {
+		name:    "sha256",
+		sig:     signSHA256(t, trustedKey, control),
+		control: control,
+		keyring: map[string][]byte{"trusted.rsa.pub": trustedPub},
+	}, {
+		name:    "tampered control sha256",
+		sig:     signSHA256(t, trustedKey, control),
+		control: []byte("tampered section"),
+		keyring: map[string][]byte{"trusted.rsa.pub": trustedPub},
+		wantErr: "signature by trusted.rsa.pub is invalid",
+	}, {
+		name:    "unsupported type",
+		sig:     signatureSection(t, ".SIGN.DSA.trusted.rsa.pub", []byte("signature")),
+		control: control,
+		keyring: map[string][]byte{"trusted.rsa.pub": trustedPub},
+		wantErr: "unsupported signature type .SIGN.DSA.trusted.rsa.pub",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyApkSignature(bytes.NewReader(tt.sig), bytes.NewReader(tt.control), tt.keyring)
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_verifyCachedPackage(t *testing.T) {
+	keyFile, pub := writeTestKey(t, t.TempDir(), "trusted.rsa")
+	keyring := map[string][]byte{"trusted.rsa.pub": pub}
+
+	cacheDir := t.TempDir()
+	cache := func(pkg *apk.Package, control []byte) {
+		sig, err := EmitSignature(context.Background(), KeyApkSigner{KeyFile: keyFile}, control, time.Unix(0, 0))
+		require.NoError(t, err)
+
+		dir := filepath.Join(cacheDir, "repo", "x86_64", pkg.Name+"-"+pkg.Version)
+		require.NoError(t, os.MkdirAll(dir, 0o755))
+		name := filepath.Join(dir, hex.EncodeToString(pkg.Checksum))
+		require.NoError(t, os.WriteFile(name+".ctl.tar.gz", control, 0o644))
+		require.NoError(t, os.WriteFile(name+".sig.tar.gz", sig, 0o644))
+	}
+
+	control := []byte("hello control section")
+	digest := sha1.Sum(control) //nolint:gosec
+	hello := &apk.Package{Name: "hello", Version: "1.0.0-r0", Checksum: digest[:]}
+	cache(hello, control)
+	require.NoError(t, verifyCachedPackage(cacheDir, hello, keyring))
+
+	// A validly signed control section of another package, planted under
+	// the checksum of this one, is rejected.
+	other := []byte("other control section")
+	digest = sha1.Sum([]byte("evil control section")) //nolint:gosec
+	evil := &apk.Package{Name: "evil", Version: "1.0.0-r0", Checksum: digest[:]}
+	cache(evil, other)
+	require.ErrorContains(t, verifyCachedPackage(cacheDir, evil, keyring), "cached control section has sha1")
+}
+
+func Test_checkVerifyInputs(t *testing.T) {
+	_, pub := writeTestKey(t, t.TempDir(), "trusted.rsa")
+	pubFile := filepath.Join(t.TempDir(), "trusted.rsa.pub")
+	require.NoError(t, os.WriteFile(pubFile, pub, 0o644))
+
+	require.NoError(t, (&Build{}).checkVerifyInputs())
+	require.NoError(t, (&Build{VerifyInputSignatures: true, VerifyInputKeyring: []string{pubFile}}).checkVerifyInputs())
+
+	// The keyring is configured explicitly, not taken from the guest.
+	require.ErrorContains(t, (&Build{VerifyInputSignatures: true}).checkVerifyInputs(), "requires a keyring")
+	missing := filepath.Join(t.TempDir(), "missing.rsa.pub")
+	require.ErrorContains(t, (&Build{VerifyInputSignatures: true, VerifyInputKeyring: []string{missing}}).checkVerifyInputs(), "unable to load input keyring")
+}
+
+func TestVerifyInputs(t *testing.T) {
+	ctx := context.Background()
+	keyFile, pub := writeTestKey(t, t.TempDir(), "trusted.rsa")
+	pubFile := filepath.Join(t.TempDir(), "trusted.rsa.pub")
+	require.NoError(t, os.WriteFile(pubFile, pub, 0o644))
+
+	control := []byte("hello control section")
+	digest := sha1.Sum(control) //nolint:gosec
+	sig, err := EmitSignature(ctx, KeyApkSigner{KeyFile: keyFile}, control, time.Unix(0, 0))
+	require.NoError(t, err)
+
+	b := &Build{
+		VerifyInputSignatures: true,
+		VerifyInputKeyring:    []string{pubFile},
+		ApkCacheDir:           filepath.Join(t.TempDir(), "cache"),
+		GuestDir:              t.TempDir(),
+	}
+
+	db := filepath.Join(b.GuestDir, "lib", "apk", "db")
+	require.NoError(t, os.MkdirAll(db, 0o755))
+	local := sha1.Sum([]byte("local control section")) //nolint:gosec
+	require.NoError(t, os.WriteFile(filepath.Join(db, "installed"), []byte(
+		"P:hello\nV:1.0.0-r0\nC:Q1"+base64.StdEncoding.EncodeToString(digest[:])+"\n\n"+
+			"P:local\nV:1.0.0-r0\nC:Q1"+base64.StdEncoding.EncodeToString(local[:])+"\n\n"), 0o644))
+
+	// There is no cache to read signatures from.
+	require.ErrorContains(t, b.VerifyInputs(ctx), "input signatures are read from the apk cache")
+
+	dir := filepath.Join(b.ApkCacheDir, "repo", "x86_64", "hello-1.0.0-r0")
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	name := filepath.Join(dir, hex.EncodeToString(digest[:]))
+	require.NoError(t, os.WriteFile(name+".ctl.tar.gz", control, 0o644))
+	require.NoError(t, os.WriteFile(name+".sig.tar.gz", sig, 0o644))
+
+	// Packages which are not cached are not reported as untrusted.
+	err = b.VerifyInputs(ctx)
+	require.ErrorContains(t, err, "input packages not in the apk cache "+b.ApkCacheDir+", whose signatures cannot be verified: local")
+	require.NotContains(t, err.Error(), "untrusted")
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"strings"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// verifyVersionConsistency checks that the dependencies, provides and
+// replaces of the packages of the build which pin one of the packages of
+// the build to an exact version pin it to the version being built.  Every
+// subpackage takes its version from the origin, so a mismatch is a
+// templating error, such as a stale epoch in a hand-written constraint,
+// which would make the emitted packages uninstallable together.
+func (b *Build) verifyVersionConsistency() error {
+	pkg := &b.Configuration.Package
+	version := fmt.Sprintf("%s-r%d", pkg.Version, pkg.Epoch)
+
+	names := map[string]bool{pkg.Name: true}
+	deps := map[string]config.Dependencies{pkg.Name: pkg.Dependencies}
+	order := []string{pkg.Name}
+	for _, sp := range b.Configuration.Subpackages {
+		names[sp.Name] = true
+		deps[sp.Name] = sp.Dependencies
+		order = append(order, sp.Name)
+	}
+
+	var problems []string
+	for _, name := range order {
+		var mismatched []string
+		for _, list := range [][]string{deps[name].Runtime, deps[name].Provides, deps[name].Replaces} {
+			for _, dep := range list {
+				target, pinned, ok := strings.Cut(dep, "=")
+				if !ok || !names[target] || pinned == version {
+					continue
+				}
+				mismatched = append(mismatched, dep)
+			}
+		}
+
+		if len(mismatched) > 0 {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, strings.Join(mismatched, ", ")))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("packages of the build pinned to a version other than %s: %s", version, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
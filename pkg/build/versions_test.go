@@ -0,0 +1,58 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"chainguard.dev/melange/pkg/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyVersionConsistency(t *testing.T) {
+	b := &Build{
+		Configuration: config.Configuration{
+			Package: config.Package{
+				Name:         "hello",
+				Version:      "1.0.0",
+				Epoch:        1,
+				Dependencies: config.Dependencies{Runtime: []string{"hello-libs=1.0.0-r1"}},
+			},
+			Subpackages: []config.Subpackage{{
+				Name: "hello-libs",
+				Dependencies: config.Dependencies{
+					Provides: []string{"so:libhello.so.1=1", "hello-compat=1.0.0-r0"},
+				},
+			}, {
+				Name: "hello-dev",
+				Dependencies: config.Dependencies{
+					Runtime:  []string{"hello-libs>=1.0.0-r0", "hello-libs=1.0.0-r1", "zlib=1.3-r0"},
+					Replaces: []string{"hello<1.0.0-r1"},
+				},
+			}},
+		},
+	}
+	require.NoError(t, b.verifyVersionConsistency())
+
+	// A subpackage pinning another to a stale epoch.
+	b.Configuration.Subpackages[1].Dependencies.Runtime = append(b.Configuration.Subpackages[1].Dependencies.Runtime, "hello=1.0.0-r0")
+	b.Configuration.Subpackages = append(b.Configuration.Subpackages, config.Subpackage{
+		Name:         "hello-doc",
+		Dependencies: config.Dependencies{Provides: []string{"hello-libs=1.0.1-r1"}},
+	})
+	err := b.verifyVersionConsistency()
+	require.EqualError(t, err, "packages of the build pinned to a version other than 1.0.0-r1: hello-dev: hello=1.0.0-r0; hello-doc: hello-libs=1.0.1-r1")
+}
@@ -0,0 +1,75 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// Warning is a warning logged while emitting a package.
+type Warning struct {
+	// The name of the package the warning is about.
+	Package string
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Package, w.Message)
+}
+
+// warnf logs a warning about the package and records it on the Build, so
+// that it fails the package with WarningsAsErrors.
+func (pc *PackageBuild) warnf(ctx context.Context, format string, args ...any) {
+	pc.Build.warnf(ctx, pc.PackageName, format, args...)
+}
+
+// warnf logs a warning about the named package and records it, so that it
+// fails the package with WarningsAsErrors.
+func (b *Build) warnf(ctx context.Context, pkg, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	clog.FromContext(ctx).Warn(msg)
+	b.recordWarning(pkg, msg)
+}
+
+// recordWarning records a warning about the named package which has
+// already been logged.
+func (b *Build) recordWarning(pkg, msg string) {
+	b.warnings = append(b.warnings, Warning{Package: pkg, Message: msg})
+}
+
+// Warnings returns the warnings logged while emitting the packages of this
+// build so far, in the order they were logged.
+func (b *Build) Warnings() []Warning {
+	return append([]Warning{}, b.warnings...)
+}
+
+// warningsError returns an error listing the warnings logged about the
+// named package, or nil if there were none.
+func (b *Build) warningsError(pkg string) error {
+	var errs []error
+	for _, w := range b.warnings {
+		if w.Package == pkg {
+			errs = append(errs, errors.New(w.String()))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("warnings emitting %s: %w", pkg, errors.Join(errs...))
+}
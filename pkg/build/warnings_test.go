@@ -0,0 +1,72 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWarningsAsErrors(t *testing.T) {
+	ctx := context.Background()
+
+	for _, strict := range []bool{false, true} {
+		b := &Build{StripScriptlets: true, WarningsAsErrors: strict}
+		pc := testPackageBuilder(t, b)()
+		pc.Scriptlets.PostInstall = "#!/bin/sh\n"
+
+		err := pc.EmitPackage(ctx)
+		require.Equal(t, []Warning{{
+			Package: "hello",
+			Message: "stripping scriptlets from hello, the package may be incomplete if they performed setup",
+		}}, b.Warnings())
+
+		if !strict {
+			require.NoError(t, err)
+			continue
+		}
+		require.ErrorContains(t, err, "warnings emitting hello: hello: stripping scriptlets from hello")
+		// The package is not written.
+		require.NoFileExists(t, pc.Filename())
+	}
+}
+
+func TestWarningsAsErrors_SCA(t *testing.T) {
+	ctx := context.Background()
+
+	b := &Build{WarningsAsErrors: true}
+	pc := testPackageBuilder(t, b)()
+	pc.Dependencies.Runtime = []string{"python-3.12"}
+	require.NoError(t, os.MkdirAll(filepath.Join(pc.WorkspaceSubdir(), "usr", "lib", "python3.12", "site-packages"), 0o755))
+
+	err := pc.EmitPackage(ctx)
+	require.ErrorContains(t, err, `warnings emitting hello: hello: hello: Python dependency "python-3.12" already specified`)
+	require.NoFileExists(t, pc.Filename())
+}
+
+func TestWarningsError(t *testing.T) {
+	b := &Build{warnings: []Warning{
+		{Package: "hello", Message: "first"},
+		{Package: "other", Message: "unrelated"},
+		{Package: "hello", Message: "second"},
+	}}
+
+	require.NoError(t, b.warningsError("missing"))
+	require.EqualError(t, b.warningsError("hello"), "warnings emitting hello: hello: first\nhello: second")
+}
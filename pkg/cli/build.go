@@ -41,6 +41,9 @@ const BuiltinPipelineDir = "/usr/share/melange/pipelines"
 
 func Build() *cobra.Command {
 	var buildDate string
+	var validateSourceDateEpoch bool
+	var sourceDateEpochMaxSkew time.Duration
+	var sourceDateEpochMin string
 	var workspaceDir string
 	var pipelineDir string
 	var sourceDir string
@@ -49,14 +52,91 @@ func Build() *cobra.Command {
 	var apkCacheDir string
 	var guestDir string
 	var signingKey string
+	var indexSigningKey string
 	var generateIndex bool
 	var emptyWorkspace bool
 	var stripOriginName bool
+	var strippedOriginMode string
+	var emitProvenance bool
+	var stripScriptlets bool
+	var defaultFileUmask uint32
+	var licenseRenderMode string
+	var maxDataSize int64
+	var emitPerPackageIndex bool
+	var outputWriteRetries int
+	var tarFormat string
+	var sbomFormat string
+	var embedBuilderInfo bool
+	var builderID string
+	var emitFileChecksums bool
+	var pinProvides bool
+	var archAlias map[string]string
+	var validateWithApk string
+	var tempDir string
+	var randomSeed uint64
+	var namedTempFiles bool
+	var preserveSparse bool
+	var scaReport bool
+	var runTestsAfterEmit bool
+	var contentAddressedOutput bool
+	var contentAddressedLink string
+	var singleStream bool
+	var stampGzipHeader bool
+	var verifyRuntimeDeps bool
+	var runtimeDepsIndexes []string
+	var stableCompression bool
+	var maxConcurrentEmitBytes int64
+	var inputsHash string
+	var buildID string
+	var onlyPackages []string
+	var symlinkMode string
+	var strictSCA bool
+	var emitDataArtifact bool
+	var strictScriptlets bool
+	var groupByOrigin bool
+	var dataCompression string
+	var stubPackages bool
+	var explicitDirEntries bool
+	var legacyControlAlias bool
+	var warningsAsErrors bool
+	var trackFileOrigins bool
+	var rejectWorldWritable bool
+	var worldWritableAllowlist []string
+	var additionalOutDirs []string
+	var normalizeDepOperators bool
+	var embedConfigDigest bool
+	var embedConfigFile bool
+	var depNamePrefix string
+	var benchmarkCompression bool
+	var compareAgainst string
+	var injectedFileMode uint32
+	var emitChecksumsFile bool
+	var signChecksumsFile bool
+	var signingKeyOptional bool
+	var normalizeStandardDirs bool
+	var packageNameSuffix string
+	var emitMetadataJSON bool
+	var verifyVersionConsistency bool
+	var pgzipBlockSize int
+	var emitOCILayout bool
+	var detectDependencyCycles bool
+	var scriptletAccountEnv bool
+	var maxDependencies int
+	var maxDependenciesWarn bool
+	var warnIsolatedPackages bool
+	var deterministicCompression bool
+	var emitApkManifest bool
+	var detectCaseCollisions string
+	var buildDateSource string
+	var emitProvidesMap bool
+	var maxScriptletSize int64
+	var provideMergeStrategy string
 	var outDir string
 	var archstrs []string
 	var extraKeys []string
 	var extraRepos []string
 	var dependencyLog string
+	var mergedDependencyLog bool
 	var overlayBinSh string
 	var envFile string
 	var varsFile string
@@ -73,6 +153,8 @@ func Build() *cobra.Command {
 	var cpu, memory string
 	var timeout time.Duration
 	var extraPackages []string
+	var verifyInputSignatures bool
+	var verifyInputKeyring []string
 
 	var traceFile string
 
@@ -114,9 +196,18 @@ func Build() *cobra.Command {
 				return err
 			}
 
+			var earliestEpoch time.Time
+			if sourceDateEpochMin != "" {
+				earliestEpoch, err = time.Parse(time.RFC3339, sourceDateEpochMin)
+				if err != nil {
+					return fmt.Errorf("parsing --source-date-epoch-min: %w", err)
+				}
+			}
+
 			archs := apko_types.ParseArchitectures(archstrs)
 			options := []build.Option{
 				build.WithBuildDate(buildDate),
+				build.WithValidateSourceDateEpoch(validateSourceDateEpoch, sourceDateEpochMaxSkew, earliestEpoch),
 				build.WithWorkspaceDir(workspaceDir),
 				// Order matters, so add any specified pipelineDir before
 				// builtin pipelines.
@@ -127,6 +218,7 @@ func Build() *cobra.Command {
 				build.WithPackageCacheDir(apkCacheDir),
 				build.WithGuestDir(guestDir),
 				build.WithSigningKey(signingKey),
+				build.WithIndexSigningKey(indexSigningKey),
 				build.WithGenerateIndex(generateIndex),
 				build.WithEmptyWorkspace(emptyWorkspace),
 				build.WithOutDir(outDir),
@@ -134,8 +226,80 @@ func Build() *cobra.Command {
 				build.WithExtraRepos(extraRepos),
 				build.WithExtraPackages(extraPackages),
 				build.WithDependencyLog(dependencyLog),
+				build.WithMergedDependencyLog(mergedDependencyLog),
 				build.WithBinShOverlay(overlayBinSh),
 				build.WithStripOriginName(stripOriginName),
+				build.WithStrippedOriginMode(strippedOriginMode),
+				build.WithEmitProvenance(emitProvenance),
+				build.WithStripScriptlets(stripScriptlets),
+				build.WithDefaultFileUmask(os.FileMode(defaultFileUmask)),
+				build.WithLicenseRenderMode(licenseRenderMode),
+				build.WithMaxDataSize(maxDataSize),
+				build.WithEmitPerPackageIndex(emitPerPackageIndex),
+				build.WithOutputWriteRetries(outputWriteRetries),
+				build.WithTarFormat(tarFormat),
+				build.WithSBOMFormat(sbomFormat),
+				build.WithEmbedBuilderInfo(embedBuilderInfo),
+				build.WithBuilderID(builderID),
+				build.WithEmitFileChecksums(emitFileChecksums),
+				build.WithPinProvidesToPackageVersion(pinProvides),
+				build.WithArchAlias(archAlias),
+				build.WithValidateWithApk(validateWithApk),
+				build.WithTempDir(tempDir),
+				build.WithRandomSeed(randomSeed),
+				build.WithNamedTempFiles(namedTempFiles),
+				build.WithPreserveSparse(preserveSparse),
+				build.WithPassphrasePrompt(terminalPassphrasePrompt(signingKey)),
+				build.WithSCAReport(scaReport),
+				build.WithRunTestsAfterEmit(runTestsAfterEmit),
+				build.WithContentAddressedOutput(contentAddressedOutput),
+				build.WithContentAddressedLink(contentAddressedLink),
+				build.WithSingleStream(singleStream),
+				build.WithStampGzipHeader(stampGzipHeader),
+				build.WithVerifyRuntimeDepsResolvable(verifyRuntimeDeps, runtimeDepsIndexes),
+				build.WithStableCompression(stableCompression),
+				build.WithMaxConcurrentEmitBytes(maxConcurrentEmitBytes),
+				build.WithInputsHash(inputsHash),
+				build.WithBuildID(buildID),
+				build.WithOnlyPackages(onlyPackages),
+				build.WithSymlinkMode(symlinkMode),
+				build.WithStrictSCA(strictSCA),
+				build.WithEmitDataArtifact(emitDataArtifact),
+				build.WithStrictScriptlets(strictScriptlets),
+				build.WithGroupByOrigin(groupByOrigin),
+				build.WithDataCompression(dataCompression),
+				build.WithStubPackages(stubPackages),
+				build.WithExplicitDirEntries(explicitDirEntries),
+				build.WithLegacyControlAlias(legacyControlAlias),
+				build.WithWarningsAsErrors(warningsAsErrors),
+				build.WithTrackFileOrigins(trackFileOrigins),
+				build.WithRejectWorldWritable(rejectWorldWritable, worldWritableAllowlist),
+				build.WithAdditionalOutDirs(additionalOutDirs),
+				build.WithNormalizeDepOperators(normalizeDepOperators),
+				build.WithEmbedConfigDigest(embedConfigDigest),
+				build.WithEmbedConfigFile(embedConfigFile),
+				build.WithBenchmarkCompression(benchmarkCompression),
+				build.WithCompareAgainst(compareAgainst),
+				build.WithInjectedFileMode(os.FileMode(injectedFileMode)),
+				build.WithEmitChecksumsFile(emitChecksumsFile || signChecksumsFile, signChecksumsFile),
+				build.WithSigningKeyOptional(signingKeyOptional),
+				build.WithNormalizeStandardDirs(normalizeStandardDirs),
+				build.WithPackageNameSuffix(packageNameSuffix),
+				build.WithEmitMetadataJSON(emitMetadataJSON),
+				build.WithVerifyVersionConsistency(verifyVersionConsistency),
+				build.WithPgzipBlockSize(pgzipBlockSize),
+				build.WithEmitOCILayout(emitOCILayout),
+				build.WithDetectDependencyCycles(detectDependencyCycles),
+				build.WithScriptletAccountEnv(scriptletAccountEnv),
+				build.WithMaxDependencies(maxDependencies, maxDependenciesWarn),
+				build.WithWarnIsolatedPackages(warnIsolatedPackages),
+				build.WithDeterministicCompression(deterministicCompression),
+				build.WithEmitApkManifest(emitApkManifest),
+				build.WithDetectCaseCollisions(detectCaseCollisions),
+				build.WithBuildDateSource(buildDateSource),
+				build.WithEmitProvidesMap(emitProvidesMap),
+				build.WithMaxScriptletSize(maxScriptletSize),
+				build.WithProvideMergeStrategy(provideMergeStrategy),
 				build.WithEnvFile(envFile),
 				build.WithVarsFile(varsFile),
 				build.WithNamespace(purlNamespace),
@@ -151,6 +315,8 @@ func Build() *cobra.Command {
 				build.WithCPU(cpu),
 				build.WithMemory(memory),
 				build.WithTimeout(timeout),
+				build.WithVerifyInputSignatures(verifyInputSignatures),
+				build.WithVerifyInputKeyring(verifyInputKeyring),
 			}
 
 			if len(args) > 0 {
@@ -165,11 +331,18 @@ func Build() *cobra.Command {
 				options = append(options, build.WithSourceDir(sourceDir))
 			}
 
+			if depNamePrefix != "" {
+				options = append(options, build.WithDepNameRewrite(build.PrefixDepNames(depNamePrefix)))
+			}
+
 			return BuildCmd(ctx, archs, options...)
 		},
 	}
 
 	cmd.Flags().StringVar(&buildDate, "build-date", "", "date used for the timestamps of the files inside the image")
+	cmd.Flags().BoolVar(&validateSourceDateEpoch, "validate-source-date-epoch", false, "fail if the source date epoch is implausible: too far in the future, or before --source-date-epoch-min")
+	cmd.Flags().DurationVar(&sourceDateEpochMaxSkew, "source-date-epoch-max-skew", time.Hour, "how far in the future the source date epoch may be with --validate-source-date-epoch")
+	cmd.Flags().StringVar(&sourceDateEpochMin, "source-date-epoch-min", "", "earliest plausible source date epoch (RFC3339) with --validate-source-date-epoch")
 	cmd.Flags().StringVar(&workspaceDir, "workspace-dir", "", "directory used for the workspace at /home/build")
 	cmd.Flags().StringVar(&pipelineDir, "pipeline-dir", "", "directory used to extend defined built-in pipelines")
 	cmd.Flags().StringVar(&sourceDir, "source-dir", "", "directory used for included sources")
@@ -177,14 +350,91 @@ func Build() *cobra.Command {
 	cmd.Flags().StringVar(&cacheSource, "cache-source", "", "directory or bucket used for preloading the cache")
 	cmd.Flags().StringVar(&apkCacheDir, "apk-cache-dir", "", "directory used for cached apk packages (default is system-defined cache directory)")
 	cmd.Flags().StringVar(&guestDir, "guest-dir", "", "directory used for the build environment guest")
-	cmd.Flags().StringVar(&signingKey, "signing-key", "", "key to use for signing")
+	cmd.Flags().StringVar(&signingKey, "signing-key", "", "key to use for signing; if it is encrypted, its passphrase is prompted for once and held in memory for the whole build")
+	cmd.Flags().StringVar(&indexSigningKey, "index-signing-key", "", "key to use for signing the index, if not the signing key")
 	cmd.Flags().StringVar(&envFile, "env-file", "", "file to use for preloaded environment variables")
 	cmd.Flags().StringVar(&varsFile, "vars-file", "", "file to use for preloaded build configuration variables")
 	cmd.Flags().BoolVar(&generateIndex, "generate-index", true, "whether to generate APKINDEX.tar.gz")
+	cmd.Flags().BoolVar(&emitPerPackageIndex, "emit-per-package-index", false, "whether to write a single-package index (<package>.index) next to each package")
 	cmd.Flags().BoolVar(&emptyWorkspace, "empty-workspace", false, "whether the build workspace should be empty")
 	cmd.Flags().BoolVar(&stripOriginName, "strip-origin-name", false, "whether origin names should be stripped (for bootstrap)")
+	cmd.Flags().Int64Var(&maxDataSize, "max-data-size", 0, "experimental: fail if a package's compressed data section exceeds this many bytes (0 for no limit)")
+	cmd.Flags().StringVar(&licenseRenderMode, "license-render-mode", build.LicenseRenderPerEntry, "how licenses are written to packages: per-entry (one line each) or expression (a single SPDX expression)")
+	cmd.Flags().Uint32Var(&defaultFileUmask, "default-file-umask", 0, "permission bits to clear from packaged files and directories, e.g. 0022")
+	cmd.Flags().BoolVar(&stripScriptlets, "strip-scriptlets", false, "whether scriptlets and triggers should be omitted from packages (for immutable images)")
+	cmd.Flags().StringVar(&strippedOriginMode, "stripped-origin-mode", build.StrippedOriginSelf, "origin to use when origin names are stripped: self (the package name) or empty")
 	cmd.Flags().StringVar(&outDir, "out-dir", "./packages/", "directory where packages will be output")
+	cmd.Flags().BoolVar(&emitProvenance, "emit-provenance", false, "write an in-toto SLSA provenance statement next to each package")
+	cmd.Flags().StringVar(&tarFormat, "tar-format", build.TarFormatPAX, "tar format of the package data section: pax, gnu (no per-file checksums) or ustar (no per-file checksums, long paths or large files)")
+	cmd.Flags().StringVar(&sbomFormat, "sbom-format", build.SBOMFormatSPDX, "SBOM formats to write into each package: spdx, cyclonedx or both")
+	cmd.Flags().BoolVar(&embedBuilderInfo, "embed-builder-info", false, "record the melange version and builder ID as comments in .PKGINFO")
+	cmd.Flags().StringVar(&builderID, "builder-id", "", "identifier of this builder, recorded in .PKGINFO with --embed-builder-info")
+	cmd.Flags().BoolVar(&emitFileChecksums, "emit-file-checksums", false, "write the checksum of every file in a package as <identity>.filesums.json next to it")
+	cmd.Flags().BoolVar(&pinProvides, "pin-provides-to-package-version", false, "pin generated provides to the version-rN of the package providing them")
+	cmd.Flags().StringToStringVar(&archAlias, "arch-alias", nil, "arch names to write into packages in place of melange's own (e.g., armv7=armhf)")
+	cmd.Flags().StringVar(&validateWithApk, "validate-with-apk", "", "validate emitted packages with apk-tools: optional (skipped if apk is not installed) or required")
+	cmd.Flags().StringVar(&tempDir, "temp-dir", "", "directory for temporary files created while emitting packages (default is the system temporary directory)")
+	cmd.Flags().Uint64Var(&randomSeed, "random-seed", 0, "seed for the names of temporary files, for reproducibility testing (0 is unseeded)")
+	cmd.Flags().BoolVar(&namedTempFiles, "named-temp-files", false, "name temporary files after the package they belong to, to aid debugging")
+	cmd.Flags().BoolVar(&preserveSparse, "preserve-sparse", false, "store holes in sparse files as sparse entries in the data section")
+	cmd.Flags().BoolVar(&scaReport, "sca-report", false, "write the problems found by SCA, such as leaked RPATHs, next to each package")
+	cmd.Flags().BoolVar(&runTestsAfterEmit, "run-tests-after-emit", false, "run the test pipelines of each package as soon as it is emitted (requires --signing-key)")
+	cmd.Flags().BoolVar(&contentAddressedOutput, "content-addressed-output", false, "write packages to a store in the output directory keyed by their data hash, linking their usual names to it")
+	cmd.Flags().StringVar(&contentAddressedLink, "content-addressed-link", build.ContentAddressedLinkSymlink, "how package names refer to content addressed packages (symlink or copy)")
+	cmd.Flags().BoolVar(&singleStream, "experimental-single-stream", false, "EXPERIMENTAL: write packages as a single gzip stream, which apk CANNOT install")
+	cmd.Flags().BoolVar(&stampGzipHeader, "stamp-gzip-header", false, "record the package identity in the gzip header comment of the data section (changes the data hash)")
+	cmd.Flags().BoolVar(&verifyRuntimeDeps, "verify-runtime-deps", false, "fail the build if a runtime dependency of a package is not resolvable against --runtime-deps-index or the packages of the build")
+	cmd.Flags().StringSliceVar(&runtimeDepsIndexes, "runtime-deps-index", []string{}, "path to a local APKINDEX.tar.gz used by --verify-runtime-deps (may be repeated)")
+	cmd.Flags().BoolVar(&stableCompression, "stable-compression", false, "compress packages with a slower, single threaded gzip encoder whose output does not change when dependencies are upgraded")
+	cmd.Flags().Int64Var(&maxConcurrentEmitBytes, "max-concurrent-emit-bytes", 0, "bound the combined installed size of packages compressed at once, across all architectures (0 means no limit)")
+	cmd.Flags().StringVar(&inputsHash, "inputs-hash", "", "hash of the build inputs, recorded in .PKGINFO as a comment")
+	cmd.Flags().StringVar(&buildID, "build-id", "", "identifier of this build, recorded in .PKGINFO as a comment (\"auto\" generates one); breaks reproducibility")
+	cmd.Flags().StringSliceVar(&onlyPackages, "only-package", []string{}, "only lint and emit the named packages or subpackages (may be repeated); pipelines still run for all of them")
+	cmd.Flags().StringVar(&symlinkMode, "symlink-mode", build.SymlinkModePreserve, "how targets of symlinks within a package are written: preserve, relative or absolute")
+	cmd.Flags().BoolVar(&strictSCA, "strict-sca", false, "fail the build when an SCA analyzer cannot analyze a file, rather than skipping it")
+	cmd.Flags().BoolVar(&emitDataArtifact, "emit-data-artifact", false, "write the data section of each package next to it as <identity>.data.tar.gz")
+	cmd.Flags().BoolVar(&strictScriptlets, "strict-scriptlets", false, "fail to emit packages whose scriptlets are inconsistent, such as trigger paths without a script")
+	cmd.Flags().BoolVar(&groupByOrigin, "group-by-origin", false, "write packages to a subdirectory of the per-arch output directory named after their origin (requires --generate-index=false)")
+	cmd.Flags().StringVar(&dataCompression, "data-compression", "", "compression of the data section: empty for gzip at the default level, or \"auto\" to pick the level by the size and contents of each package")
+	cmd.Flags().BoolVar(&stubPackages, "stub-packages", false, "emit packages as stubs carrying their metadata but an empty data section, for tooling")
+	cmd.Flags().BoolVar(&explicitDirEntries, "explicit-dir-entries", false, "ensure every directory in the data section has an entry of its own")
+	cmd.Flags().BoolVar(&legacyControlAlias, "legacy-control-alias", false, "also write .PKGINFO next to each package as <package>.PKGINFO for legacy tooling (non-standard)")
+	cmd.Flags().BoolVar(&warningsAsErrors, "warnings-as-errors", false, "fail to emit packages about which any warnings were logged")
+	cmd.Flags().BoolVar(&trackFileOrigins, "track-file-origins", false, "write the pipeline step which produced each file of a package as <identity>.fileorigin.json next to it")
+	cmd.Flags().BoolVar(&rejectWorldWritable, "reject-world-writable", false, "fail to emit packages with world-writable files or directories")
+	cmd.Flags().StringSliceVar(&worldWritableAllowlist, "world-writable-allowlist", []string{}, "path globs of files and directories which may be world-writable with --reject-world-writable")
+	cmd.Flags().StringSliceVar(&additionalOutDirs, "additional-out-dir", []string{}, "directory to also place built packages in, hard linked to those in --out-dir when possible")
+	cmd.Flags().BoolVar(&normalizeDepOperators, "normalize-dep-operators", false, "canonicalize the spelling of version constraints in dependencies and provides")
+	cmd.Flags().BoolVar(&embedConfigDigest, "embed-config-digest", false, "record the sha256 of the configuration file in .PKGINFO")
+	cmd.Flags().BoolVar(&embedConfigFile, "embed-config-file", false, "ship the configuration file in each package as /usr/share/melange/<name>.yaml")
+	cmd.Flags().StringVar(&depNamePrefix, "dep-name-prefix", "", "prefix the names of the dependencies, provides and replaces of packages, except typed names such as so:")
+	cmd.Flags().BoolVar(&benchmarkCompression, "benchmark-compression", false, "diagnostic: compress the data section of each package again with gzip, zstd and xz and report their sizes and times; the packages are unchanged")
+	cmd.Flags().StringVar(&compareAgainst, "compare-against", "", "reference package, or directory of them, to compare each emitted package against, writing the differences next to it")
+	cmd.Flags().Uint32Var(&injectedFileMode, "injected-file-mode", 0, "mode of the files melange adds to packages, such as changelogs and SBOMs (default 0644)")
+	cmd.Flags().BoolVar(&emitChecksumsFile, "emit-checksums-file", false, "write the sha256 of each package to SHA256SUMS in the output directory")
+	cmd.Flags().BoolVar(&signChecksumsFile, "sign-checksums-file", false, "sign SHA256SUMS with the index signing key, implies --emit-checksums-file")
+	cmd.Flags().BoolVar(&signingKeyOptional, "signing-key-optional", false, "build unsigned packages with a warning if the signing key does not exist, rather than failing")
+	cmd.Flags().BoolVar(&normalizeStandardDirs, "normalize-standard-dirs", false, "make standard directories such as /usr and /etc owned by root with their standard modes in packages")
+	cmd.Flags().StringVar(&packageNameSuffix, "package-name-suffix", "", "suffix appended to the names of the package and its subpackages, for building several flavors of one configuration")
+	cmd.Flags().BoolVar(&emitMetadataJSON, "emit-metadata-json", false, "write the control data of each package next to it as <identity>.metadata.json")
+	cmd.Flags().BoolVar(&verifyVersionConsistency, "verify-version-consistency", false, "fail if packages of the build pin each other to a version other than the one being built")
+	cmd.Flags().IntVar(&pgzipBlockSize, "pgzip-block-size", 0, "size in bytes of the blocks the data section is compressed in parallel, a power of two from 32KiB to 64MiB (default 1MiB)")
+	cmd.Flags().BoolVar(&emitOCILayout, "emit-oci-layout", false, "also wrap each package as an OCI artifact in an OCI layout directory next to it")
+	cmd.Flags().BoolVar(&detectDependencyCycles, "detect-dependency-cycles", false, "fail if the packages of the build depend on each other in a cycle")
+	cmd.Flags().BoolVar(&scriptletAccountEnv, "scriptlet-account-env", false, "export the ids of the accounts of the build environment to post-install scriptlets as MELANGE_UID_<user> and MELANGE_GID_<group>")
+	cmd.Flags().IntVar(&maxDependencies, "max-dependencies", 0, "fail if a package has more than this many depend, provides and replaces lines in its control data (0 for no limit)")
+	cmd.Flags().BoolVar(&maxDependenciesWarn, "max-dependencies-warn", false, "warn rather than fail when a package exceeds --max-dependencies")
+	cmd.Flags().BoolVar(&warnIsolatedPackages, "warn-isolated-packages", false, "warn about packages which depend on nothing and provide nothing, except virtual packages")
+	cmd.Flags().BoolVar(&deterministicCompression, "deterministic-compression", false, "compress the data section single threaded, so that it does not depend on the number of cores (slower for large packages)")
+	cmd.Flags().BoolVar(&emitApkManifest, "emit-apk-manifest", false, "write the checksum of every file in each package next to it as <identity>.manifest, in the format of apk manifest")
+	cmd.Flags().StringVar(&detectCaseCollisions, "detect-case-collisions", "", "report paths which collide on case-insensitive filesystems: warn or error (unset to not check)")
+	cmd.Flags().StringVar(&buildDateSource, "build-date-source", build.BuildDateSourceEpoch, "build date recorded in packages: source-date-epoch, release-date (from the configuration) or an RFC3339 timestamp")
+	cmd.Flags().BoolVar(&emitProvidesMap, "emit-provides-map", false, "record the package names and provides of the packages in provides-map.json in the output directory")
+	cmd.Flags().Int64Var(&maxScriptletSize, "max-scriptlet-size", 0, "largest size in bytes of a scriptlet, 0 for no limit")
+	cmd.Flags().StringVar(&provideMergeStrategy, "provide-merge-strategy", build.ProvideMergeUnion, "how declared and generated provides of the same name are merged: union, declared-wins or generated-wins")
+	cmd.Flags().IntVar(&outputWriteRetries, "output-write-retries", 0, "number of times to retry writing a package after a transient I/O error")
 	cmd.Flags().StringVar(&dependencyLog, "dependency-log", "", "log dependencies to a specified file")
+	cmd.Flags().BoolVar(&mergedDependencyLog, "merged-dependency-log", false, "write the dependency log of every arch to the file given by --dependency-log, keyed by arch, rather than to one file per arch")
 	cmd.Flags().StringVar(&overlayBinSh, "overlay-binsh", "", "use specified file as /bin/sh overlay in build environment")
 	cmd.Flags().StringVar(&purlNamespace, "namespace", "unknown", "namespace to use in package URLs in SBOM (eg wolfi, alpine)")
 	cmd.Flags().StringSliceVar(&archstrs, "arch", nil, "architectures to build for (e.g., x86_64,ppc64le,arm64) -- default is all, unless specified in config")
@@ -194,6 +444,8 @@ func Build() *cobra.Command {
 	cmd.Flags().StringSliceVarP(&extraKeys, "keyring-append", "k", []string{}, "path to extra keys to include in the build environment keyring")
 	cmd.Flags().StringSliceVarP(&extraRepos, "repository-append", "r", []string{}, "path to extra repositories to include in the build environment")
 	cmd.Flags().StringSliceVar(&extraPackages, "package-append", []string{}, "extra packages to install for each of the build environments")
+	cmd.Flags().BoolVar(&verifyInputSignatures, "verify-input-signatures", false, "verify that packages installed into the build environment are signed by a key in --verify-input-keyring, reading them from the apk cache")
+	cmd.Flags().StringSliceVar(&verifyInputKeyring, "verify-input-keyring", []string{}, "path to a public key which packages installed into the build environment may be signed by, for --verify-input-signatures (may be repeated)")
 	cmd.Flags().BoolVar(&createBuildLog, "create-build-log", false, "creates a package.log file containing a list of packages that were built by the command")
 	cmd.Flags().BoolVar(&debug, "debug", false, "enables debug logging of build pipelines")
 	cmd.Flags().BoolVar(&debugRunner, "debug-runner", false, "when enabled, the builder pod will persist after the build succeeds or fails")
@@ -248,9 +500,13 @@ func BuildCmd(ctx context.Context, archs []apko_types.Architecture, baseOpts ...
 	//
 	// Yes, this happens.  Really.
 	// https://github.com/distroless/nginx/runs/7219233843?check_suite_focus=true
+	// Share a single compression pool between all architectures so that
+	// emitting their packages concurrently does not oversubscribe the CPU.
+	pool := build.NewCompressionPool(runtime.GOMAXPROCS(0))
+
 	bcs := []*build.Build{}
 	for _, arch := range archs {
-		opts := append(baseOpts, build.WithArch(arch))
+		opts := append(baseOpts, build.WithArch(arch), build.WithCompressionPool(pool))
 
 		bc, err := build.New(ctx, opts...)
 		if errors.Is(err, build.ErrSkipThisArch) {
@@ -269,6 +525,11 @@ func BuildCmd(ctx context.Context, archs []apko_types.Architecture, baseOpts ...
 		return nil
 	}
 
+	// Architecture independent subpackages are only emitted once.
+	for _, bc := range bcs[1:] {
+		bc.SkipNoArch = true
+	}
+
 	var errg errgroup.Group
 
 	if bcs[0].Interactive {
@@ -297,5 +558,17 @@ func BuildCmd(ctx context.Context, archs []apko_types.Architecture, baseOpts ...
 			return nil
 		})
 	}
-	return errg.Wait()
+	if err := errg.Wait(); err != nil {
+		return err
+	}
+
+	// Place the architecture independent subpackages, which the first
+	// build emitted, in the directories of the other architectures.
+	for _, bc := range bcs[1:] {
+		if err := bc.LinkNoArchPackages(ctx); err != nil {
+			return fmt.Errorf("failed to place noarch packages: %w", err)
+		}
+	}
+
+	return nil
 }
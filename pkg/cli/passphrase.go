@@ -0,0 +1,48 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// terminalPassphrasePrompt returns a function which reads the passphrase of
+// signingKey from the terminal with echo disabled, or nil if stdin is not a
+// terminal.  The passphrase is read once and reused by the builds of every
+// architecture, which may call it concurrently.
+func terminalPassphrasePrompt(signingKey string) func() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil
+	}
+
+	return sync.OnceValues(func() (string, error) {
+		fmt.Fprintf(os.Stderr, "Enter passphrase for %s: ", signingKey)
+		buf, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+
+		passphrase := string(buf)
+		clear(buf)
+
+		return passphrase, nil
+	})
+}
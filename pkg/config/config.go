@@ -68,6 +68,105 @@ type Scriptlets struct {
 	// Optional: The script to run after upgrading. The script should contain the
 	// shebang interpreter.
 	PostUpgrade string `json:"post-upgrade,omitempty" yaml:"post-upgrade,omitempty"`
+	// Optional: Scriptlets which apply only when the package is built for
+	// an architecture, keyed by that architecture
+	Arch map[string]ArchScriptlets `json:"arch,omitempty" yaml:"arch,omitempty"`
+}
+
+const (
+	// ArchScriptletsReplace uses the scriptlets of an architecture instead
+	// of the scriptlets of every architecture.
+	ArchScriptletsReplace = "replace"
+	// ArchScriptletsAppend runs the scriptlets of an architecture after the
+	// scriptlets of every architecture.
+	ArchScriptletsAppend = "append"
+)
+
+// ArchScriptlets are scriptlets of a package which apply only when it is
+// built for one architecture.
+type ArchScriptlets struct {
+	// Optional: How these scriptlets are combined with the scriptlets of
+	// every architecture, either replace (the default) or append.  Appended
+	// scripts are run by the interpreter of the script they are appended
+	// to, so their own interpreter line is dropped
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+	// Optional: The script to run pre install
+	PreInstall string `json:"pre-install,omitempty" yaml:"pre-install,omitempty"`
+	// Optional: The script to run post install
+	PostInstall string `json:"post-install,omitempty" yaml:"post-install,omitempty"`
+	// Optional: The script to run before uninstalling
+	PreDeinstall string `json:"pre-deinstall,omitempty" yaml:"pre-deinstall,omitempty"`
+	// Optional: The script to run after uninstalling
+	PostDeinstall string `json:"post-deinstall,omitempty" yaml:"post-deinstall,omitempty"`
+	// Optional: The script to run before upgrading
+	PreUpgrade string `json:"pre-upgrade,omitempty" yaml:"pre-upgrade,omitempty"`
+	// Optional: The script to run after upgrading
+	PostUpgrade string `json:"post-upgrade,omitempty" yaml:"post-upgrade,omitempty"`
+}
+
+// ForArch returns the scriptlets of a package built for the apk
+// architecture arch, with the scriptlets of that architecture merged in.
+func (s Scriptlets) ForArch(arch string) Scriptlets {
+	out := s
+	out.Arch = nil
+	for _, key := range archScriptletsKeys(s.Arch) {
+		if apko_types.ParseArchitecture(key).ToAPK() != arch {
+			continue
+		}
+		as := s.Arch[key]
+		for _, m := range []struct {
+			base     *string
+			override string
+		}{
+			{&out.PreInstall, as.PreInstall},
+			{&out.PostInstall, as.PostInstall},
+			{&out.PreDeinstall, as.PreDeinstall},
+			{&out.PostDeinstall, as.PostDeinstall},
+			{&out.PreUpgrade, as.PreUpgrade},
+			{&out.PostUpgrade, as.PostUpgrade},
+		} {
+			*m.base = mergeScriptlet(*m.base, m.override, as.Mode)
+		}
+	}
+	return out
+}
+
+// archScriptletsKeys returns the architectures of m in a stable order.
+func archScriptletsKeys(m map[string]ArchScriptlets) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mergeScriptlet combines the script of every architecture with the script
+// of one architecture, according to mode.
+func mergeScriptlet(base, override, mode string) string {
+	switch {
+	case override == "":
+		return base
+	case mode != ArchScriptletsAppend || base == "":
+		return override
+	}
+
+	if strings.HasPrefix(override, "#!") {
+		_, override, _ = strings.Cut(override, "\n")
+	}
+	if !strings.HasSuffix(base, "\n") {
+		base += "\n"
+	}
+	return base + override
+}
+
+// GeneratedScriptlets are intents which melange expands into standard
+// scriptlets of the main package, instead of them being written by hand.
+type GeneratedScriptlets struct {
+	// Optional: The name of a service whose package refuses to be removed
+	// while a process of that name is running. Generates the pre-deinstall
+	// scriptlet
+	ProtectRunningService string `json:"protect-running-service,omitempty" yaml:"protect-running-service,omitempty"`
 }
 
 type PackageOption struct {
@@ -79,6 +178,14 @@ type PackageOption struct {
 	NoDepends bool `json:"no-depends" yaml:"no-depends"`
 	// Optional: Mark this package as not providing any executables
 	NoCommands bool `json:"no-commands" yaml:"no-commands"`
+	// Optional: Generate py3.X:<name> provides for the Python modules and
+	// distributions in this package, and dependencies on the distributions
+	// they require
+	PythonProvides bool `json:"python-provides,omitempty" yaml:"python-provides,omitempty"`
+	// Optional: Do not generate provides of these types for this package,
+	// where the type is the part of a provide before the colon, such as
+	// so, cmd or pc.  Configured provides are unaffected
+	NoProvidesTypes []string `json:"no-provides-types,omitempty" yaml:"no-provides-types,omitempty"`
 }
 
 type Checks struct {
@@ -119,6 +226,118 @@ type Package struct {
 	Timeout time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
 	// Optional: Resources to allocate to the build.
 	Resources *Resources `json:"resources,omitempty" yaml:"resources,omitempty"`
+	// Optional: Rules moving files from this package into subpackages once
+	// all pipelines have run
+	SubpackageRules []SubpackageRule `json:"subpackage-rules,omitempty" yaml:"subpackage-rules,omitempty"`
+	// Optional: The largest installed size in bytes this package is expected
+	// to have.  Emitting a larger package fails.
+	MaxInstalledSize int64 `json:"max-installed-size,omitempty" yaml:"max-installed-size,omitempty"`
+	// Optional: The smallest installed size in bytes this package is expected
+	// to have.  Emitting a smaller package fails.
+	MinInstalledSize int64 `json:"min-installed-size,omitempty" yaml:"min-installed-size,omitempty"`
+	// Optional: Rewrites of script interpreters applied as packages are
+	// emitted
+	ShebangRewrite *ShebangRewrite `json:"shebang-rewrite,omitempty" yaml:"shebang-rewrite,omitempty"`
+	// Optional: Rewrites of paths leaked into text files, such as
+	// configuration files embedding the build workspace, applied as
+	// packages are emitted
+	ConfigPathScrub *ConfigPathScrub `json:"config-path-scrub,omitempty" yaml:"config-path-scrub,omitempty"`
+	// Optional: Paths of configuration files in this package, which apk
+	// preserves if they were modified locally when the package is upgraded
+	ConfigFiles []string `json:"config-files,omitempty" yaml:"config-files,omitempty"`
+	// Optional: Names of the upstream packages this package is a fork of.
+	// Each is replaced at every version below this package's version
+	ForkReplaces []string `json:"fork-replaces,omitempty" yaml:"fork-replaces,omitempty"`
+	// Optional: Path globs of files, and of directories whose contents,
+	// keep the ownership they have in the workspace instead of files owned
+	// by the build user being owned by root.  User and group names are
+	// resolved from etc/passwd and etc/group in the build guest, so the
+	// owners should be created there (for example, by a package in the
+	// build environment) for the names to be recorded
+	PreserveOwnership []string `json:"preserve-ownership,omitempty" yaml:"preserve-ownership,omitempty"`
+	// Optional: A changelog shipped in this package as
+	// /usr/share/doc/<name>/changelog
+	Changelog *Changelog `json:"changelog,omitempty" yaml:"changelog,omitempty"`
+	// Optional: The origin recorded for this package and its subpackages,
+	// such as the name of the upstream project a binary bundle is
+	// repackaged from.  It is used as is, whether or not origin names are
+	// stripped
+	OriginOverride string `json:"origin-override,omitempty" yaml:"origin-override,omitempty"`
+	// Optional: Scriptlets of this package generated from high-level
+	// intents. A generated scriptlet cannot also be given in scriptlets
+	GeneratedScriptlets GeneratedScriptlets `json:"generated-scriptlets,omitempty" yaml:"generated-scriptlets,omitempty"`
+	// Optional: Whether this package is emitted unsigned even when a
+	// signing key is given, such as for a debug-only artifact.  Its
+	// subpackages are still signed
+	SkipSignature bool `json:"skip-signature,omitempty" yaml:"skip-signature,omitempty"`
+	// Optional: When this version was released upstream, in RFC3339
+	// format.  It is recorded as the build date of the packages if the
+	// build date source is release-date
+	ReleaseDate string `json:"release-date,omitempty" yaml:"release-date,omitempty"`
+	// Optional: How the data section of this package is compressed,
+	// overriding the compression of the build: one of auto, gzip,
+	// gzip-fast, gzip-best or store.  apk only reads gzip data sections,
+	// so other codecs are not supported
+	DataCompression string `json:"data-compression,omitempty" yaml:"data-compression,omitempty"`
+}
+
+// Changelog is the changelog of a package, given either inline or as a file.
+type Changelog struct {
+	// The text of the changelog
+	Contents string `json:"contents,omitempty" yaml:"contents,omitempty"`
+	// The path of a file holding the changelog, relative to the source
+	// directory
+	File string `json:"file,omitempty" yaml:"file,omitempty"`
+}
+
+type SubpackageRule struct {
+	// Required: A glob, relative to the package root, matching the files or
+	// directories to move (e.g. usr/share/man or usr/lib/*.a)
+	Glob string `json:"glob" yaml:"glob"`
+	// Required: The name of the subpackage to move the matching files into
+	Subpackage string `json:"subpackage" yaml:"subpackage"`
+}
+
+type ShebangRewrite struct {
+	// Required: The rewrites to apply; the first rule matching a script's
+	// interpreter is used
+	Rules []ShebangRule `json:"rules" yaml:"rules"`
+	// Optional: The size in bytes of the largest script which is rewritten.
+	// Defaults to 1MiB
+	MaxSize int64 `json:"max-size,omitempty" yaml:"max-size,omitempty"`
+}
+
+type ConfigPathScrub struct {
+	// Required: Path globs of the files to scrub, and of directories
+	// whose contents are scrubbed (e.g. etc/myapp/*.conf)
+	Paths []string `json:"paths" yaml:"paths"`
+	// Required: The rewrites to apply, in order, to each file
+	Rules []PathScrubRule `json:"rules" yaml:"rules"`
+	// Optional: The size in bytes of the largest file which is scrubbed.
+	// Defaults to 1MiB
+	MaxSize int64 `json:"max-size,omitempty" yaml:"max-size,omitempty"`
+}
+
+type PathScrubRule struct {
+	// The path to replace wherever it appears (e.g. /home/build).  Exactly
+	// one of from and regex must be set
+	From string `json:"from,omitempty" yaml:"from,omitempty"`
+	// A regular expression matching the paths to replace
+	Regex string `json:"regex,omitempty" yaml:"regex,omitempty"`
+	// Required: The replacement, such as the installed location.  With
+	// regex, $1 and so on expand to its submatches
+	To string `json:"to" yaml:"to"`
+}
+
+type ShebangRule struct {
+	// The interpreter to replace (e.g. /usr/bin/python3.11).  Exactly one of
+	// from and regex must be set
+	From string `json:"from,omitempty" yaml:"from,omitempty"`
+	// A regular expression matching the whole interpreter to replace
+	Regex string `json:"regex,omitempty" yaml:"regex,omitempty"`
+	// Required: The replacement interpreter.  With regex, $1 and so on
+	// expand to its submatches
+	To string `json:"to" yaml:"to"`
 }
 
 type Resources struct {
@@ -367,6 +586,13 @@ type Subpackage struct {
 	Checks Checks `json:"checks,omitempty" yaml:"checks,omitempty"`
 	// Test section for the subpackage.
 	Test Test `json:"test,omitempty" yaml:"test,omitempty"`
+	// Optional: Mark this subpackage as architecture independent, such as
+	// one holding only documentation or configuration. It is emitted once,
+	// with an arch of noarch, rather than for every architecture
+	NoArch bool `json:"noarch,omitempty" yaml:"noarch,omitempty"`
+	// Optional: How the data section of this subpackage is compressed,
+	// overriding the compression of the build, as for the package
+	DataCompression string `json:"data-compression,omitempty" yaml:"data-compression,omitempty"`
 }
 
 // PackageURL returns the package URL ("purl") for the subpackage. For more
@@ -535,6 +761,10 @@ type Dependencies struct {
 	// Optional: An integer compared against other equal package provides used to
 	// determine priority
 	ProviderPriority int `json:"provider-priority,omitempty" yaml:"provider-priority,omitempty"`
+	// Optional: An integer compared against the replaces priority of other
+	// packages owning the same files to determine which package's files are
+	// installed
+	ReplacesPriority int `json:"replaces-priority,omitempty" yaml:"replaces-priority,omitempty"`
 
 	// List of self-provided dependencies found outside of lib directories
 	// ("lib", "usr/lib", "lib64", or "usr/lib64").
@@ -659,6 +889,25 @@ func replaceAll(r *strings.Replacer, in []string) []string {
 	return out
 }
 
+func replaceArchScriptlets(r *strings.Replacer, in map[string]ArchScriptlets) map[string]ArchScriptlets {
+	if in == nil {
+		return nil
+	}
+	out := make(map[string]ArchScriptlets, len(in))
+	for arch, as := range in {
+		out[arch] = ArchScriptlets{
+			Mode:          as.Mode,
+			PreInstall:    r.Replace(as.PreInstall),
+			PostInstall:   r.Replace(as.PostInstall),
+			PreDeinstall:  r.Replace(as.PreDeinstall),
+			PostDeinstall: r.Replace(as.PostDeinstall),
+			PreUpgrade:    r.Replace(as.PreUpgrade),
+			PostUpgrade:   r.Replace(as.PostUpgrade),
+		}
+	}
+	return out
+}
+
 // propagateChildPipelines performs downward propagation of configuration values.
 func (p *Pipeline) propagateChildPipelines() {
 	for idx := range p.Pipeline {
@@ -781,6 +1030,7 @@ func ParseConfiguration(ctx context.Context, configurationFilePath string, opts
 					Provides:         replaceAll(replacer, sp.Dependencies.Provides),
 					Replaces:         replaceAll(replacer, sp.Dependencies.Replaces),
 					ProviderPriority: sp.Dependencies.ProviderPriority,
+					ReplacesPriority: sp.Dependencies.ReplacesPriority,
 				},
 				Options: sp.Options,
 				Scriptlets: Scriptlets{
@@ -794,9 +1044,12 @@ func ParseConfiguration(ctx context.Context, configurationFilePath string, opts
 					PostDeinstall: replacer.Replace(sp.Scriptlets.PostDeinstall),
 					PreUpgrade:    replacer.Replace(sp.Scriptlets.PreUpgrade),
 					PostUpgrade:   replacer.Replace(sp.Scriptlets.PostUpgrade),
+					Arch:          replaceArchScriptlets(replacer, sp.Scriptlets.Arch),
 				},
-				URL: replacer.Replace(sp.URL),
-				If:  replacer.Replace(sp.If),
+				URL:             replacer.Replace(sp.URL),
+				If:              replacer.Replace(sp.If),
+				NoArch:          sp.NoArch,
+				DataCompression: sp.DataCompression,
 			}
 			for _, p := range sp.Pipeline {
 				// take a copy of the with map, so we can replace the values
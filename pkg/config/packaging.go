@@ -0,0 +1,253 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/github/go-spdx/v2/spdxexp"
+)
+
+var (
+	// packageVersionRegex matches an apk version without its -rN suffix,
+	// which melange appends from the epoch.
+	packageVersionRegex = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*[a-z]?((_alpha|_beta|_pre|_rc)[0-9]*)?((_cvs|_svn|_git|_hg|_p)[0-9]*)?$`)
+
+	// dependencyRegex matches a dependency as written into .PKGINFO: an
+	// optionally negated name, an optional version constraint and an
+	// optional repository pin.
+	dependencyRegex = regexp.MustCompile(`^!?[^\s@=><~!]+([=><~]+[^\s@=><~]+)?(@[a-zA-Z0-9]+)?$`)
+)
+
+// ValidatePackaging checks the package and subpackages sections of cfg for
+// problems which would otherwise only surface when packages are emitted:
+// invalid names and versions, malformed dependencies, triggers without a
+// script (or vice versa), invalid license expressions, duplicate subpackage
+// names and subpackage rules targeting unknown subpackages.  Unlike the
+// validation performed when loading a configuration, every problem found is
+// returned rather than only the first.
+func ValidatePackaging(cfg *Configuration) []error {
+	errs := []error{}
+	problem := func(format string, args ...any) {
+		errs = append(errs, ErrInvalidConfiguration{Problem: fmt.Errorf(format, args...)})
+	}
+
+	pkg := cfg.Package
+	if !packageNameRegex.MatchString(pkg.Name) {
+		problem("package name %q must match regex %q", pkg.Name, packageNameRegex)
+	}
+
+	if pkg.Version == "" {
+		problem("package version must not be empty")
+	} else if !packageVersionRegex.MatchString(pkg.Version) {
+		problem("package version %q is not a valid apk version", pkg.Version)
+	}
+
+	if pkg.ReleaseDate != "" {
+		if _, err := time.Parse(time.RFC3339, pkg.ReleaseDate); err != nil {
+			problem("release-date %q is not an RFC3339 timestamp", pkg.ReleaseDate)
+		}
+	}
+
+	for i, cp := range pkg.Copyright {
+		if cp.License == "" {
+			problem("copyright (index: %d) must specify a license", i)
+			continue
+		}
+		if valid, bad := spdxexp.ValidateLicenses([]string{cp.License}); !valid {
+			problem("copyright (index: %d) license %q is not a valid SPDX expression: %s", i, cp.License, strings.Join(bad, ", "))
+		}
+	}
+
+	for _, err := range validatePackageContents(pkg.Name, pkg.Dependencies, pkg.Scriptlets, pkg.Options) {
+		problem("package %q: %w", pkg.Name, err)
+	}
+	if err := validateDataCompression(pkg.DataCompression); err != nil {
+		problem("package %q: %w", pkg.Name, err)
+	}
+
+	seen := map[string]int{pkg.Name: -1}
+	for i, sp := range cfg.Subpackages {
+		if !packageNameRegex.MatchString(sp.Name) {
+			problem("subpackage name %q (subpackages index: %d) must match regex %q", sp.Name, i, packageNameRegex)
+		}
+
+		if prev, ok := seen[sp.Name]; ok {
+			if prev < 0 {
+				problem("subpackage name %q (subpackages index: %d) duplicates the package name", sp.Name, i)
+			} else {
+				problem("subpackage name %q (subpackages index: %d) duplicates subpackages index %d", sp.Name, i, prev)
+			}
+		} else {
+			seen[sp.Name] = i
+		}
+
+		for _, err := range validatePackageContents(sp.Name, sp.Dependencies, sp.Scriptlets, sp.Options) {
+			problem("subpackage %q: %w", sp.Name, err)
+		}
+		if err := validateDataCompression(sp.DataCompression); err != nil {
+			problem("subpackage %q: %w", sp.Name, err)
+		}
+	}
+
+	for i, rule := range pkg.SubpackageRules {
+		if _, err := path.Match(rule.Glob, ""); rule.Glob == "" || err != nil {
+			problem("subpackage rule (index: %d) glob %q is invalid", i, rule.Glob)
+		}
+		if idx, ok := seen[rule.Subpackage]; !ok || idx < 0 {
+			problem("subpackage rule (index: %d) targets unknown subpackage %q", i, rule.Subpackage)
+		}
+	}
+
+	if sr := pkg.ShebangRewrite; sr != nil {
+		for i, rule := range sr.Rules {
+			if (rule.From == "") == (rule.Regex == "") {
+				problem("shebang rewrite rule (index: %d) must set exactly one of from and regex", i)
+			}
+			if rule.Regex != "" {
+				if _, err := regexp.Compile(rule.Regex); err != nil {
+					problem("shebang rewrite rule (index: %d) regex %q is invalid: %v", i, rule.Regex, err)
+				}
+			}
+			if rule.To == "" {
+				problem("shebang rewrite rule (index: %d) must specify a replacement", i)
+			}
+		}
+	}
+
+	if ps := pkg.ConfigPathScrub; ps != nil {
+		if len(ps.Paths) == 0 {
+			problem("config path scrub must specify at least one path")
+		}
+		for i, pattern := range ps.Paths {
+			if _, err := path.Match(pattern, ""); pattern == "" || err != nil {
+				problem("config path scrub path (index: %d) %q is invalid", i, pattern)
+			}
+		}
+		if len(ps.Rules) == 0 {
+			problem("config path scrub must specify at least one rule")
+		}
+		for i, rule := range ps.Rules {
+			if (rule.From == "") == (rule.Regex == "") {
+				problem("config path scrub rule (index: %d) must set exactly one of from and regex", i)
+			}
+			if rule.Regex != "" {
+				if _, err := regexp.Compile(rule.Regex); err != nil {
+					problem("config path scrub rule (index: %d) regex %q is invalid: %v", i, rule.Regex, err)
+				}
+			}
+		}
+	}
+
+	for i, name := range pkg.ForkReplaces {
+		if !packageNameRegex.MatchString(name) {
+			problem("fork replaces (index: %d) %q must be a package name matching regex %q", i, name, packageNameRegex)
+		}
+	}
+
+	for i, file := range pkg.ConfigFiles {
+		if rel := strings.TrimPrefix(path.Clean("/"+file), "/"); file == "" || rel != strings.TrimPrefix(file, "/") {
+			problem("config file (index: %d) %q must be a clean path within the package", i, file)
+		}
+	}
+
+	if cl := pkg.Changelog; cl != nil {
+		if (cl.Contents == "") == (cl.File == "") {
+			problem("changelog must set exactly one of contents and file")
+		}
+		if cl.File != "" && (path.IsAbs(cl.File) || path.Clean(cl.File) != cl.File || strings.HasPrefix(cl.File, "../")) {
+			problem("changelog file %q must be a clean path within the source directory", cl.File)
+		}
+	}
+
+	for i, pattern := range pkg.PreserveOwnership {
+		if _, err := path.Match(pattern, ""); pattern == "" || err != nil {
+			problem("preserve ownership (index: %d) glob %q is invalid", i, pattern)
+		}
+	}
+
+	if pkg.MinInstalledSize < 0 || pkg.MaxInstalledSize < 0 {
+		problem("installed size bounds must not be negative")
+	}
+	if pkg.MaxInstalledSize > 0 && pkg.MinInstalledSize > pkg.MaxInstalledSize {
+		problem("min-installed-size %d exceeds max-installed-size %d", pkg.MinInstalledSize, pkg.MaxInstalledSize)
+	}
+
+	return errs
+}
+
+// dataCompressions are the data section compressions a package may
+// configure, as implemented by pkg/build.
+var dataCompressions = []string{"auto", "gzip", "gzip-fast", "gzip-best", "store"}
+
+// validateDataCompression checks the data-compression of a package or
+// subpackage, which is unset or one of dataCompressions.
+func validateDataCompression(compression string) error {
+	if compression == "" || slices.Contains(dataCompressions, compression) {
+		return nil
+	}
+	return fmt.Errorf("data-compression %q must be one of %s", compression, strings.Join(dataCompressions, ", "))
+}
+
+// validatePackageContents checks the dependencies and scriptlets of a
+// single package or subpackage.
+func validatePackageContents(name string, deps Dependencies, scriptlets Scriptlets, opts PackageOption) []error {
+	errs := []error{}
+
+	for _, set := range []struct {
+		field string
+		deps  []string
+	}{
+		{"runtime", deps.Runtime},
+		{"provides", deps.Provides},
+		{"replaces", deps.Replaces},
+	} {
+		for _, dep := range set.deps {
+			if !dependencyRegex.MatchString(dep) {
+				errs = append(errs, fmt.Errorf("%s dependency %q is malformed", set.field, dep))
+			}
+			if dep == name && set.field == "runtime" {
+				errs = append(errs, fmt.Errorf("runtime dependency %q refers to the package itself", dep))
+			}
+		}
+	}
+
+	if scriptlets.Trigger.Script != "" && len(scriptlets.Trigger.Paths) == 0 {
+		errs = append(errs, errors.New("trigger script requires at least one trigger path"))
+	}
+	if scriptlets.Trigger.Script == "" && len(scriptlets.Trigger.Paths) > 0 {
+		errs = append(errs, errors.New("trigger paths require a trigger script"))
+	}
+
+	for _, arch := range archScriptletsKeys(scriptlets.Arch) {
+		if as := scriptlets.Arch[arch]; as.Mode != "" && as.Mode != ArchScriptletsReplace && as.Mode != ArchScriptletsAppend {
+			errs = append(errs, fmt.Errorf("%s scriptlets mode %q must be %s or %s", arch, as.Mode, ArchScriptletsReplace, ArchScriptletsAppend))
+		}
+	}
+
+	for i, typ := range opts.NoProvidesTypes {
+		if typ == "" || strings.ContainsAny(typ, ":=") {
+			errs = append(errs, fmt.Errorf("no-provides-types (index: %d) %q must be a provide type such as so, cmd or pc", i, typ))
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,178 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidatePackaging(t *testing.T) {
+	valid := Configuration{
+		Package: Package{
+			Name:      "hello",
+			Version:   "1.2.3_rc1",
+			Copyright: []Copyright{{License: "MIT OR Apache-2.0"}},
+			Dependencies: Dependencies{
+				Runtime:  []string{"busybox", "so:libc.so.6", "glibc>=2.38", "!hello-compat"},
+				Provides: []string{"cmd:hello=1.2.3-r0"},
+			},
+			Scriptlets: Scriptlets{
+				Trigger: Trigger{Script: "#!/bin/sh\n", Paths: []string{"/usr/lib"}},
+			},
+		},
+		Subpackages: []Subpackage{{
+			Name:            "hello-doc",
+			Options:         PackageOption{NoProvidesTypes: []string{"so", "cmd"}},
+			DataCompression: "store",
+		}},
+	}
+	valid.Package.SubpackageRules = []SubpackageRule{{Glob: "usr/share/man", Subpackage: "hello-doc"}}
+	require.Empty(t, ValidatePackaging(&valid))
+
+	invalid := Configuration{
+		Package: Package{
+			Name:      "hello",
+			Version:   "1.2.3-beta",
+			Copyright: []Copyright{{License: "MIT OR"}, {}},
+			Dependencies: Dependencies{
+				Runtime: []string{"hello", "bad dep"},
+			},
+			Scriptlets: Scriptlets{
+				Trigger: Trigger{Script: "#!/bin/sh\n"},
+			},
+			SubpackageRules: []SubpackageRule{
+				{Glob: "usr/[", Subpackage: "hello-doc"},
+				{Glob: "usr/share/man", Subpackage: "hello-man"},
+			},
+			ShebangRewrite: &ShebangRewrite{
+				Rules: []ShebangRule{{From: "/usr/bin/python3.11", Regex: "python", To: "/usr/bin/python3"}},
+			},
+			ConfigPathScrub: &ConfigPathScrub{
+				Paths: []string{"etc/[hello"},
+				Rules: []PathScrubRule{{Regex: "/home/build/(", To: "/usr"}},
+			},
+			ConfigFiles:       []string{"/etc/hello.conf", "../etc/passwd"},
+			ForkReplaces:      []string{"hello-upstream<1.0"},
+			PreserveOwnership: []string{"var/lib/[app"},
+			Changelog:         &Changelog{File: "../CHANGELOG"},
+			MinInstalledSize:  2048,
+			MaxInstalledSize:  1024,
+			ReleaseDate:       "2024-03-01",
+		},
+		Subpackages: []Subpackage{{
+			Name: "hello-doc",
+		}, {
+			Name: "hello-doc",
+		}, {
+			Name: "hello",
+			Scriptlets: Scriptlets{
+				Trigger: Trigger{Paths: []string{"/usr/lib"}},
+				Arch:    map[string]ArchScriptlets{"x86_64": {Mode: "prepend"}},
+			},
+		}, {
+			Name: "-bad",
+			Dependencies: Dependencies{
+				Provides: []string{"foo=="},
+			},
+			Options:         PackageOption{NoProvidesTypes: []string{"so:"}},
+			DataCompression: "zstd",
+		}},
+	}
+
+	errs := ValidatePackaging(&invalid)
+	msgs := []string{}
+	for _, err := range errs {
+		require.ErrorAs(t, err, &ErrInvalidConfiguration{})
+		msgs = append(msgs, err.Error())
+	}
+
+	for _, want := range []string{
+		`package version "1.2.3-beta" is not a valid apk version`,
+		`copyright (index: 0) license "MIT OR" is not a valid SPDX expression`,
+		`copyright (index: 1) must specify a license`,
+		`package "hello": runtime dependency "hello" refers to the package itself`,
+		`package "hello": runtime dependency "bad dep" is malformed`,
+		`package "hello": trigger script requires at least one trigger path`,
+		`subpackage name "hello-doc" (subpackages index: 1) duplicates subpackages index 0`,
+		`subpackage name "hello" (subpackages index: 2) duplicates the package name`,
+		`subpackage "hello": trigger paths require a trigger script`,
+		`subpackage "hello": x86_64 scriptlets mode "prepend" must be replace or append`,
+		`subpackage name "-bad" (subpackages index: 3) must match regex`,
+		`subpackage "-bad": provides dependency "foo==" is malformed`,
+		`subpackage "-bad": no-provides-types (index: 0) "so:" must be a provide type`,
+		`subpackage "-bad": data-compression "zstd" must be one of auto, gzip, gzip-fast, gzip-best, store`,
+		`subpackage rule (index: 0) glob "usr/[" is invalid`,
+		`subpackage rule (index: 1) targets unknown subpackage "hello-man"`,
+		`shebang rewrite rule (index: 0) must set exactly one of from and regex`,
+		`config path scrub path (index: 0) "etc/[hello" is invalid`,
+		`config path scrub rule (index: 0) regex "/home/build/(" is invalid`,
+		`config file (index: 1) "../etc/passwd" must be a clean path within the package`,
+		`fork replaces (index: 0) "hello-upstream<1.0" must be a package name`,
+		`changelog file "../CHANGELOG" must be a clean path within the source directory`,
+		`preserve ownership (index: 0) glob "var/lib/[app" is invalid`,
+		`min-installed-size 2048 exceeds max-installed-size 1024`,
+		`release-date "2024-03-01" is not an RFC3339 timestamp`,
+	} {
+		found := false
+		for _, msg := range msgs {
+			if strings.Contains(msg, want) {
+				found = true
+				break
+			}
+		}
+		require.Truef(t, found, "missing error %q in %q", want, msgs)
+	}
+	require.Len(t, errs, 25)
+}
+
+func TestScriptletsForArch(t *testing.T) {
+	s := Scriptlets{
+		PreInstall:  "#!/bin/sh\necho pre\n",
+		PostInstall: "#!/bin/sh\necho post",
+		Arch: map[string]ArchScriptlets{
+			"amd64": {
+				PreInstall:  "#!/bin/busybox sh\necho x86_64 pre\n",
+				PostUpgrade: "#!/bin/sh\necho x86_64 upgrade\n",
+			},
+			"aarch64": {
+				Mode:          ArchScriptletsAppend,
+				PostInstall:   "#!/bin/sh\necho aarch64 post\n",
+				PostDeinstall: "#!/bin/sh\necho aarch64 deinstall\n",
+			},
+		},
+	}
+
+	require.Equal(t, Scriptlets{
+		PreInstall:  "#!/bin/busybox sh\necho x86_64 pre\n",
+		PostInstall: "#!/bin/sh\necho post",
+		PostUpgrade: "#!/bin/sh\necho x86_64 upgrade\n",
+	}, s.ForArch("x86_64"))
+
+	// Appended scripts lose their interpreter, unless there is nothing to
+	// append them to.
+	require.Equal(t, Scriptlets{
+		PreInstall:    "#!/bin/sh\necho pre\n",
+		PostInstall:   "#!/bin/sh\necho post\necho aarch64 post\n",
+		PostDeinstall: "#!/bin/sh\necho aarch64 deinstall\n",
+	}, s.ForArch("aarch64"))
+
+	require.Equal(t, Scriptlets{
+		PreInstall:  "#!/bin/sh\necho pre\n",
+		PostInstall: "#!/bin/sh\necho post",
+	}, s.ForArch("riscv64"))
+}
@@ -37,6 +37,7 @@ type Index struct {
 	SourceIndexFile    string
 	MergeIndexFileFlag bool
 	SigningKey         string
+	SigningPassphrase  string
 	ExpectedArch       string
 	Index              apkrepo.APKIndex
 }
@@ -98,6 +99,15 @@ func WithSigningKey(signingKey string) Option {
 	}
 }
 
+// WithSigningPassphrase sets the passphrase of the signing key, when it is
+// encrypted.
+func WithSigningPassphrase(passphrase string) Option {
+	return func(idx *Index) error {
+		idx.SigningPassphrase = passphrase
+		return nil
+	}
+}
+
 // WithExpectedArch sets the expected package architecture.  Any packages with
 // an unexpected architecture will not be indexed.
 func WithExpectedArch(expectedArch string) Option {
@@ -246,7 +256,13 @@ func (idx *Index) WriteArchiveIndex(ctx context.Context, destinationFile string)
 
 	if idx.SigningKey != "" {
 		log.Infof("signing apk index at %s", idx.IndexFile)
-		if err := sign.SignIndex(ctx, idx.SigningKey, idx.IndexFile); err != nil {
+		signIndex := sign.SignIndex
+		if idx.SigningPassphrase != "" {
+			signIndex = func(ctx context.Context, signingKey, indexFile string) error {
+				return signIndexWithPassphrase(ctx, signingKey, idx.SigningPassphrase, indexFile)
+			}
+		}
+		if err := signIndex(ctx, idx.SigningKey, idx.IndexFile); err != nil {
 			return fmt.Errorf("failed to sign apk index: %w", err)
 		}
 	}
@@ -4,6 +4,11 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" //nolint:gosec
+	"crypto/x509"
+	"encoding/pem"
 	"io"
 	"os"
 	"path/filepath"
@@ -13,6 +18,7 @@ import (
 	"github.com/chainguard-dev/clog/slogtest"
 	"github.com/chainguard-dev/go-apk/pkg/apk"
 	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -119,6 +125,73 @@ func mangleApk(t *testing.T, newDesc string) string {
 	return f.Name()
 }
 
+func TestSigningPassphrase(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//nolint:staticcheck
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(priv), []byte("secret"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "encrypted.rsa")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join("..", "sca", "testdata", "libcap-2.69-r0.apk")
+	indexFile := filepath.Join(t.TempDir(), "APKINDEX.tar.gz")
+
+	idx, err := New(WithIndexFile(indexFile), WithPackageFiles([]string{filename}), WithSigningKey(keyFile), WithSigningPassphrase("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.GenerateIndex(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(indexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The signature is a gzip stream of its own, prepended to the index
+	// it signs.
+	r := bytes.NewReader(data)
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr.Multistream(false)
+	tr := tar.NewReader(zr)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := ".SIGN.RSA.encrypted.rsa.pub", hdr.Name; want != got {
+		t.Errorf("signature name: want %q, got %q", want, got)
+	}
+	sig, err := io.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(io.Discard, zr); err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha1.Sum(data[len(data)-r.Len():]) //nolint:gosec
+	if err := sign.RSAVerifySHA1Digest(digest[:], sig, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestMergeIndex(t *testing.T) {
 	ctx := slogtest.TestContextWithLogger(t)
 	newDesc := "This should replace the existing description"
@@ -0,0 +1,69 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+	"github.com/chainguard-dev/go-apk/pkg/tarball"
+	"github.com/psanford/memfs"
+)
+
+// signIndexWithPassphrase prepends a signature of the unsigned index at
+// indexFile, made with the encrypted signingKey, to it, as sign.SignIndex
+// does for keys without a passphrase.
+func signIndexWithPassphrase(ctx context.Context, signingKey, passphrase, indexFile string) error {
+	indexData, indexDigest, err := sign.ReadAndHashIndexFile(indexFile)
+	if err != nil {
+		return err
+	}
+
+	sigData, err := sign.RSASignSHA1Digest(indexDigest, signingKey, passphrase)
+	if err != nil {
+		return fmt.Errorf("unable to sign index: %w", err)
+	}
+
+	sigFS := memfs.New()
+	if err := sigFS.WriteFile(fmt.Sprintf(".SIGN.RSA.%s.pub", filepath.Base(signingKey)), sigData, 0o644); err != nil {
+		return fmt.Errorf("unable to append signature: %w", err)
+	}
+
+	tarctx, err := tarball.NewContext(
+		tarball.WithOverrideUIDGID(0, 0),
+		tarball.WithOverrideUname("root"),
+		tarball.WithOverrideGname("root"),
+		tarball.WithSkipClose(true),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to build tarball context: %w", err)
+	}
+
+	var signed bytes.Buffer
+	if err := tarctx.WriteTargz(ctx, &signed, sigFS, sigFS); err != nil {
+		return fmt.Errorf("unable to write signature tarball: %w", err)
+	}
+	signed.Write(indexData)
+
+	if err := os.WriteFile(indexFile, signed.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("unable to write signed index: %w", err)
+	}
+
+	return nil
+}
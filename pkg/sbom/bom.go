@@ -47,6 +47,8 @@ type pkg struct {
 	Checksums        map[string]string
 	Relationships    []relationship
 	ExternalRefs     []purl.PackageURL
+	// Names of the packages this package depends on at runtime.
+	Dependencies []string
 }
 
 func (p *pkg) ID() string {
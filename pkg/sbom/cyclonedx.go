@@ -0,0 +1,163 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"time"
+
+	purl "github.com/package-url/packageurl-go"
+	"sigs.k8s.io/release-utils/version"
+)
+
+// The types below are the subset of the CycloneDX 1.5 JSON format which
+// melange populates.
+
+type cdxDocument struct {
+	BOMFormat    string          `json:"bomFormat"`
+	SpecVersion  string          `json:"specVersion"`
+	SerialNumber string          `json:"serialNumber"`
+	Version      int             `json:"version"`
+	Metadata     cdxMetadata     `json:"metadata"`
+	Components   []cdxComponent  `json:"components"`
+	Dependencies []cdxDependency `json:"dependencies"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     cdxTools     `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxTools struct {
+	Components []cdxComponent `json:"components"`
+}
+
+type cdxComponent struct {
+	BOMRef    string        `json:"bom-ref,omitempty"`
+	Type      string        `json:"type"`
+	Supplier  *cdxSupplier  `json:"supplier,omitempty"`
+	Name      string        `json:"name"`
+	Version   string        `json:"version,omitempty"`
+	Licenses  []cdxLicense  `json:"licenses,omitempty"`
+	Copyright string        `json:"copyright,omitempty"`
+	PURL      string        `json:"purl,omitempty"`
+	Props     []cdxProperty `json:"properties,omitempty"`
+}
+
+type cdxSupplier struct {
+	Name string `json:"name"`
+}
+
+type cdxLicense struct {
+	Expression string `json:"expression"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cdxDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+// apkPURL returns the package URL of an apk in namespace.  The version is
+// omitted for dependencies, which name a package but not a build of it.
+func apkPURL(namespace, name, version, arch string) string {
+	var q purl.Qualifiers
+	if arch != "" {
+		q = purl.QualifiersFromMap(map[string]string{"arch": arch})
+	}
+	return purl.NewPackageURL("apk", namespace, name, version, q, "").ToString()
+}
+
+// serialNumber derives a stable URN from the package name and version, so
+// that rebuilding a package produces an identical document.
+func serialNumber(spec *Spec) string {
+	h := sha1.Sum([]byte(fmt.Sprintf("apk-%s-%s", spec.PackageName, spec.PackageVersion))) //nolint:gosec
+	// Format as a version 5 (name-based, SHA-1) UUID.
+	h[6] = (h[6] & 0x0f) | 0x50
+	h[8] = (h[8] & 0x3f) | 0x80
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+// buildDocumentCycloneDX creates a CycloneDX 1.5 document from our generic
+// representation.
+func buildDocumentCycloneDX(spec *Spec, doc *bom) *cdxDocument {
+	cdxDoc := &cdxDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: serialNumber(spec),
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: spec.SourceDateEpoch.UTC().Format(time.RFC3339),
+			Tools: cdxTools{
+				Components: []cdxComponent{{
+					Type:    "application",
+					Name:    "melange",
+					Version: version.GetVersionInfo().GitVersion,
+				}},
+			},
+		},
+		Components:   []cdxComponent{},
+		Dependencies: []cdxDependency{},
+	}
+
+	for i, p := range doc.Packages {
+		ref := apkPURL(p.Namespace, p.Name, p.Version, p.Arch)
+		component := cdxComponent{
+			BOMRef:    ref,
+			Type:      "library",
+			Name:      p.Name,
+			Version:   p.Version,
+			Copyright: p.Copyright,
+			PURL:      ref,
+		}
+		if p.Namespace != "" {
+			component.Supplier = &cdxSupplier{Name: p.Namespace}
+		}
+		if p.LicenseDeclared != "" && p.LicenseDeclared != "NOASSERTION" {
+			component.Licenses = []cdxLicense{{Expression: p.LicenseDeclared}}
+		}
+		if p.Arch != "" {
+			component.Props = []cdxProperty{{Name: "apk:arch", Value: p.Arch}}
+		}
+
+		if i == 0 {
+			cdxDoc.Metadata.Component = component
+		} else {
+			cdxDoc.Components = append(cdxDoc.Components, component)
+		}
+
+		dependsOn := []string{}
+		for _, dep := range p.Dependencies {
+			depRef := apkPURL(p.Namespace, dep, "", p.Arch)
+			cdxDoc.Components = append(cdxDoc.Components, cdxComponent{
+				BOMRef: depRef,
+				Type:   "library",
+				Name:   dep,
+				PURL:   depRef,
+			})
+			cdxDoc.Dependencies = append(cdxDoc.Dependencies, cdxDependency{Ref: depRef, DependsOn: []string{}})
+			dependsOn = append(dependsOn, depRef)
+		}
+		cdxDoc.Dependencies = append([]cdxDependency{{Ref: ref, DependsOn: dependsOn}}, cdxDoc.Dependencies...)
+	}
+
+	return cdxDoc
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateSBOM_CycloneDX(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "hello"), []byte("hello"), 0o644))
+
+	spec := &Spec{
+		Path:            dir,
+		PackageName:     "hello",
+		PackageVersion:  "1.0.0-r0",
+		License:         "Apache-2.0",
+		Copyright:       "Copyright 2024 Chainguard, Inc.",
+		Namespace:       "wolfi",
+		Arch:            "x86_64",
+		SourceDateEpoch: time.Unix(1700000000, 0),
+		Dependencies:    []string{"so:libc.so.6", "glibc>=2.38", "ca-certificates-bundle", "busybox", "!hello-compat"},
+		Formats:         []string{FormatCycloneDX},
+	}
+	require.NoError(t, NewGenerator().GenerateSBOM(context.Background(), spec))
+
+	got, err := os.ReadFile(filepath.Join(dir, "var", "lib", "db", "sbom", "hello-1.0.0-r0.cdx.json"))
+	require.NoError(t, err)
+
+	want, err := os.ReadFile(filepath.Join("testdata", "cyclonedx.golden.json"))
+	require.NoError(t, err)
+
+	require.JSONEq(t, string(want), string(got))
+
+	// Only the requested format is written.
+	_, err = os.Stat(filepath.Join(dir, "var", "lib", "db", "sbom", "hello-1.0.0-r0.spdx.json"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
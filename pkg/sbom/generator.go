@@ -28,6 +28,13 @@ func NewGenerator() *Generator {
 	return &Generator{}
 }
 
+const (
+	// FormatSPDX writes an SPDX 2.3 JSON document.
+	FormatSPDX = "spdx"
+	// FormatCycloneDX writes a CycloneDX 1.5 JSON document.
+	FormatCycloneDX = "cyclonedx"
+)
+
 type Spec struct {
 	Path            string
 	PackageName     string
@@ -39,6 +46,8 @@ type Spec struct {
 	Namespace       string
 	Arch            string
 	SourceDateEpoch time.Time
+	Dependencies    []string // Runtime dependencies, as written in .PKGINFO
+	Formats         []string // Defaults to FormatSPDX
 }
 
 type Generator struct{}
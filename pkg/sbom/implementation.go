@@ -102,9 +102,32 @@ func generateAPKPackage(spec *Spec) (pkg, error) {
 		newPackage.LicenseDeclared = spec.License
 	}
 
+	newPackage.Dependencies = dependencyNames(spec.Dependencies)
+
 	return newPackage, nil
 }
 
+// dependencyNames returns the sorted, unique package names referred to by
+// deps, dropping version constraints.  Virtual dependencies (so:, cmd:, etc.)
+// do not name a package and are skipped.
+func dependencyNames(deps []string) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, dep := range deps {
+		name, _, _ := strings.Cut(strings.TrimPrefix(dep, "!"), "@")
+		if i := strings.IndexAny(name, "=<>~"); i >= 0 {
+			name = name[:i]
+		}
+		if name == "" || strings.Contains(name, ":") || strings.HasPrefix(dep, "!") || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // addPackage adds a package to the document
 func addPackage(doc *spdx.Document, p *pkg) {
 	spdxPkg := spdx.Package{
@@ -241,11 +264,11 @@ func buildDocumentSPDX(ctx context.Context, spec *Spec, doc *bom) (*spdx.Documen
 	return &spdxDoc, nil
 }
 
-// writeSBOM writes the SBOM to the apk filesystem
+// writeSBOM writes the SBOM, in each requested format, to the apk filesystem
 func writeSBOM(ctx context.Context, spec *Spec, doc *bom) error {
-	spdxDoc, err := buildDocumentSPDX(ctx, spec, doc)
-	if err != nil {
-		return fmt.Errorf("building SPDX document: %w", err)
+	formats := spec.Formats
+	if len(formats) == 0 {
+		formats = []string{FormatSPDX}
 	}
 
 	dirPath, err := filepath.Abs(spec.Path)
@@ -258,24 +281,54 @@ func writeSBOM(ctx context.Context, spec *Spec, doc *bom) error {
 		return fmt.Errorf("creating SBOM directory in apk filesystem: %w", err)
 	}
 
-	apkSBOMpath := filepath.Join(
-		dirPath, apkSBOMdir,
-		fmt.Sprintf("%s-%s.spdx.json", spec.PackageName, spec.PackageVersion),
-	)
-	f, err := os.Create(apkSBOMpath)
+	for _, format := range formats {
+		var (
+			document any
+			ext      string
+		)
+
+		switch format {
+		case FormatSPDX:
+			spdxDoc, err := buildDocumentSPDX(ctx, spec, doc)
+			if err != nil {
+				return fmt.Errorf("building SPDX document: %w", err)
+			}
+			document, ext = spdxDoc, "spdx.json"
+		case FormatCycloneDX:
+			document, ext = buildDocumentCycloneDX(spec, doc), "cdx.json"
+		default:
+			return fmt.Errorf("unknown SBOM format %q", format)
+		}
+
+		apkSBOMpath := filepath.Join(
+			dirPath, apkSBOMdir,
+			fmt.Sprintf("%s-%s.%s", spec.PackageName, spec.PackageVersion, ext),
+		)
+		if err := writeJSON(apkSBOMpath, document); err != nil {
+			return fmt.Errorf("encoding %s sbom: %w", format, err)
+		}
+	}
+
+	return nil
+}
+
+// writeJSON writes v, indented, to path.
+func writeJSON(path string, v any) error {
+	f, err := os.Create(path)
 	if err != nil {
 		return fmt.Errorf("opening SBOM file for writing: %w", err)
 	}
+	defer f.Close()
 
 	enc := json.NewEncoder(f)
 	enc.SetIndent("", "  ")
 	enc.SetEscapeHTML(true)
 
-	if err := enc.Encode(spdxDoc); err != nil {
-		return fmt.Errorf("encoding spdx sbom: %w", err)
+	if err := enc.Encode(v); err != nil {
+		return err
 	}
 
-	return nil
+	return f.Close()
 }
 
 // getDirectoryTree reads a directory and returns a list of strings of all files init
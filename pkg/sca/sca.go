@@ -19,11 +19,15 @@ import (
 	"context"
 	"debug/buildinfo"
 	"debug/elf"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"unicode"
 
@@ -72,6 +76,197 @@ type SCAHandle interface {
 	BaseDependencies() config.Dependencies
 }
 
+// SourceRecorder may optionally be implemented by an SCAHandle in order to be
+// told which files caused each dependency, provide or vendored provide to be
+// generated.
+type SourceRecorder interface {
+	// RecordSource records that the file at path caused dep to be generated.
+	RecordSource(dep, path string)
+}
+
+// DiscoveryKind identifies the list of generated dependencies to which a
+// Discovery was added.
+type DiscoveryKind string
+
+const (
+	DiscoveryRuntime  DiscoveryKind = "runtime"
+	DiscoveryProvides DiscoveryKind = "provides"
+	DiscoveryVendored DiscoveryKind = "vendored"
+)
+
+// Discovery is a dependency, provide or vendored provide generated by an
+// analyzer.
+type Discovery struct {
+	Kind DiscoveryKind
+	// Dependency is the generated dependency, for example "so:libc.so.6".
+	Dependency string
+	// Path is the file which caused it to be generated.
+	Path string
+}
+
+// DiscoveryRecorder may optionally be implemented by an SCAHandle in order to
+// be told about each dependency as soon as an analyzer generates it, rather
+// than once the analysis is complete, for example to report the progress of
+// a slow analysis.  The same dependency may be discovered more than once;
+// the result of Analyze remains authoritative.
+type DiscoveryRecorder interface {
+	// RecordDiscovery records a generated dependency.  It is called
+	// synchronously by the analyzer.
+	RecordDiscovery(d Discovery)
+}
+
+// WarningRecorder may optionally be implemented by an SCAHandle in order to
+// be told about the warnings analyzers log, such as a library lacking a
+// SONAME, for example to fail the build on them.
+type WarningRecorder interface {
+	// RecordWarning records a warning, which has already been logged.
+	RecordWarning(msg string)
+}
+
+// warnf logs a warning about the package, and informs the SCAHandle about it
+// if it implements WarningRecorder.
+func warnf(ctx context.Context, hdl SCAHandle, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	clog.FromContext(ctx).Warn(msg)
+	if wr, ok := hdl.(WarningRecorder); ok {
+		wr.RecordWarning(msg)
+	}
+}
+
+// recordSource informs the SCAHandle about the source of a generated dependency
+// if it implements SourceRecorder, and about the dependency itself if it
+// implements DiscoveryRecorder.
+func recordSource(hdl SCAHandle, kind DiscoveryKind, dep, path string) {
+	if sr, ok := hdl.(SourceRecorder); ok {
+		sr.RecordSource(dep, path)
+	}
+	if dr, ok := hdl.(DiscoveryRecorder); ok {
+		dr.RecordDiscovery(Discovery{Kind: kind, Dependency: dep, Path: path})
+	}
+}
+
+// Finding describes a problem with a file in a package which SCA noticed
+// while analyzing it, but which does not affect its dependencies.
+type Finding struct {
+	// Path is the path of the file within the package.
+	Path string `json:"path"`
+	// Kind identifies the problem, for example "rpath" or "runpath".
+	Kind string `json:"kind"`
+	// Value is the offending value.
+	Value string `json:"value"`
+}
+
+// FindingRecorder may optionally be implemented by an SCAHandle in order to be
+// told about problems found in the package.
+type FindingRecorder interface {
+	// RecordFinding records a problem found in the package.
+	RecordFinding(f Finding)
+}
+
+// recordFinding informs the SCAHandle about a finding if it implements
+// FindingRecorder.
+func recordFinding(hdl SCAHandle, f Finding) {
+	if fr, ok := hdl.(FindingRecorder); ok {
+		fr.RecordFinding(f)
+	}
+}
+
+// StrictHandle may optionally be implemented by an SCAHandle in order to make
+// the errors analyzers otherwise only log, such as a file which cannot be
+// read, fail the analysis.
+type StrictHandle interface {
+	// Strict returns true if analyzer errors are fatal.
+	Strict() bool
+}
+
+// WalkedEntry is an entry of the filesystem of a package, as visited by
+// fs.WalkDir.
+type WalkedEntry struct {
+	Path  string
+	Entry fs.DirEntry
+}
+
+// WalkedHandle may optionally be implemented by an SCAHandle which walked
+// the filesystem of the package in advance, such as to compute its
+// installed size in the same pass, so that the analyzers replay that walk
+// instead of each walking the filesystem again.
+type WalkedHandle interface {
+	// Walked returns the entries of Filesystem in the order fs.WalkDir
+	// visits them, or nil if it was not walked in advance.  Their Info
+	// should not need to stat the file again.
+	Walked() []WalkedEntry
+}
+
+// walkFilesystem calls fn for each entry of fsys, the filesystem of the
+// package, as fs.WalkDir does, replaying the walk of hdl if it implements
+// WalkedHandle.
+func walkFilesystem(hdl SCAHandle, fsys fs.FS, fn fs.WalkDirFunc) error {
+	var walked []WalkedEntry
+	if wh, ok := hdl.(WalkedHandle); ok {
+		walked = wh.Walked()
+	}
+	if walked == nil {
+		return fs.WalkDir(fsys, ".", fn)
+	}
+
+	// The directory whose remaining entries are skipped, if any.
+	skip := ""
+	for _, we := range walked {
+		if skip != "" && (skip == "." || strings.HasPrefix(we.Path, skip+"/")) {
+			continue
+		}
+		skip = ""
+
+		err := fn(we.Path, we.Entry, nil)
+		switch {
+		case errors.Is(err, fs.SkipAll):
+			return nil
+		case errors.Is(err, fs.SkipDir) && we.Entry.IsDir():
+			if we.Path == "." {
+				return nil
+			}
+			skip = we.Path
+		case errors.Is(err, fs.SkipDir):
+			skip = path.Dir(we.Path)
+		case err != nil:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AnalyzerError is an error encountered by an analyzer on a single file.
+type AnalyzerError struct {
+	// Analyzer is the name of the analyzer which failed.
+	Analyzer string
+	// Path is the path of the file within the package.
+	Path string
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *AnalyzerError) Error() string {
+	return fmt.Sprintf("%s analyzer failed on %s: %v", e.Analyzer, e.Path, e.Err)
+}
+
+func (e *AnalyzerError) Unwrap() error {
+	return e.Err
+}
+
+// analyzerFailure reports that analyzer failed on the file at path.  The
+// failure is returned if the SCAHandle is strict; otherwise it is logged and
+// the analysis carries on without the file.
+func analyzerFailure(ctx context.Context, hdl SCAHandle, analyzer, path string, err error) error {
+	ae := &AnalyzerError{Analyzer: analyzer, Path: path, Err: err}
+	if sh, ok := hdl.(StrictHandle); ok && sh.Strict() {
+		return ae
+	}
+
+	warnf(ctx, hdl, "%v", ae)
+	return nil
+}
+
 // DependencyGenerator takes an SCAHandle and config.Dependencies pointer and returns
 // findings based on analysis.
 type DependencyGenerator func(context.Context, SCAHandle, *config.Dependencies) error
@@ -96,6 +291,37 @@ func isInDir(path string, dirs []string) bool {
 	return false
 }
 
+// buildWorkspaceDir is the directory packages are built in, which should not
+// be referred to by anything shipped in them.
+const buildWorkspaceDir = "/home/build"
+
+// checkRunpaths records a finding for each entry of the DT_RPATH and
+// DT_RUNPATH of the ELF object at path which leaks a build-time path: one
+// within the build workspace, or one which is relative to the working
+// directory rather than to $ORIGIN.  Such objects only find their libraries
+// when run from the build environment.
+func checkRunpaths(hdl SCAHandle, ef *elf.File, path string) {
+	for _, dt := range []struct {
+		kind string
+		tag  elf.DynTag
+	}{{"rpath", elf.DT_RPATH}, {"runpath", elf.DT_RUNPATH}} {
+		values, err := ef.DynString(dt.tag)
+		if err != nil {
+			continue
+		}
+
+		for _, value := range values {
+			for _, entry := range strings.Split(value, ":") {
+				leaked := entry == buildWorkspaceDir || strings.HasPrefix(entry, buildWorkspaceDir+"/")
+				relative := !strings.HasPrefix(entry, "/") && !strings.HasPrefix(entry, "$ORIGIN") && !strings.HasPrefix(entry, "${ORIGIN}")
+				if leaked || relative {
+					recordFinding(hdl, Finding{Path: path, Kind: dt.kind, Value: entry})
+				}
+			}
+		}
+	}
+}
+
 var pathBinDirs = []string{"bin/", "sbin/", "usr/bin/", "usr/sbin/"}
 
 func generateCmdProviders(ctx context.Context, hdl SCAHandle, generated *config.Dependencies) error {
@@ -110,7 +336,7 @@ func generateCmdProviders(ctx context.Context, hdl SCAHandle, generated *config.
 		return err
 	}
 
-	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+	if err := walkFilesystem(hdl, fsys, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -129,7 +355,9 @@ func generateCmdProviders(ctx context.Context, hdl SCAHandle, generated *config.
 			if isInDir(path, pathBinDirs) {
 				basename := filepath.Base(path)
 				log.Infof("  found command %s", path)
-				generated.Provides = append(generated.Provides, fmt.Sprintf("cmd:%s=%s", basename, hdl.Version()))
+				dep := fmt.Sprintf("cmd:%s=%s", basename, hdl.Version())
+				generated.Provides = append(generated.Provides, dep)
+				recordSource(hdl, DiscoveryProvides, dep, path)
 			}
 		}
 
@@ -207,7 +435,7 @@ func generateSharedObjectNameDeps(ctx context.Context, hdl SCAHandle, generated
 		return err
 	}
 
-	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+	if err := walkFilesystem(hdl, fsys, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -227,18 +455,18 @@ func generateSharedObjectNameDeps(ctx context.Context, hdl SCAHandle, generated
 
 			targetPkg, realPath, err := dereferenceCrossPackageSymlink(hdl, path)
 			if err != nil {
-				return nil
+				return analyzerFailure(ctx, hdl, "shared object", path, err)
 			}
 
 			targetFS, err := hdl.FilesystemForRelative(targetPkg)
 			if err != nil {
-				return nil
+				return analyzerFailure(ctx, hdl, "shared object", path, err)
 			}
 
 			if realPath != "" {
 				rawFile, err := targetFS.Open(realPath)
 				if err != nil {
-					return nil
+					return analyzerFailure(ctx, hdl, "shared object", path, err)
 				}
 				defer rawFile.Close()
 
@@ -256,7 +484,7 @@ func generateSharedObjectNameDeps(ctx context.Context, hdl SCAHandle, generated
 				sonames, err := ef.DynString(elf.DT_SONAME)
 				// most likely SONAME is not set on this object
 				if err != nil {
-					log.Warnf("library %s lacks SONAME", path)
+					warnf(ctx, hdl, "library %s lacks SONAME", path)
 					return nil
 				}
 
@@ -264,7 +492,9 @@ func generateSharedObjectNameDeps(ctx context.Context, hdl SCAHandle, generated
 					log.Infof("  found soname %s for %s", soname, path)
 
 					if !hdl.Options().NoDepends {
-						generated.Runtime = append(generated.Runtime, fmt.Sprintf("so:%s", soname))
+						dep := fmt.Sprintf("so:%s", soname)
+						generated.Runtime = append(generated.Runtime, dep)
+						recordSource(hdl, DiscoveryRuntime, dep, path)
 					}
 				}
 			}
@@ -283,11 +513,9 @@ func generateSharedObjectNameDeps(ctx context.Context, hdl SCAHandle, generated
 
 		basename := filepath.Base(path)
 
-		// most likely a shell script instead of an ELF, so treat any
-		// error as non-fatal.
 		rawFile, err := fsys.Open(path)
 		if err != nil {
-			return nil
+			return analyzerFailure(ctx, hdl, "shared object", path, err)
 		}
 		defer rawFile.Close()
 
@@ -296,12 +524,16 @@ func generateSharedObjectNameDeps(ctx context.Context, hdl SCAHandle, generated
 			return nil
 		}
 
+		// most likely a shell script instead of an ELF, so treat any
+		// error as non-fatal.
 		ef, err := elf.NewFile(seekableFile)
 		if err != nil {
 			return nil
 		}
 		defer ef.Close()
 
+		checkRunpaths(hdl, ef, path)
+
 		interp, err := findInterpreter(ef)
 		if err != nil {
 			return err
@@ -314,19 +546,21 @@ func generateSharedObjectNameDeps(ctx context.Context, hdl SCAHandle, generated
 			interpName := fmt.Sprintf("so:%s", filepath.Base(interp))
 			interpName = strings.ReplaceAll(interpName, "so:ld-musl", "so:libc.musl")
 			generated.Runtime = append(generated.Runtime, interpName)
+			recordSource(hdl, DiscoveryRuntime, interpName, path)
 		}
 
 		libs, err := ef.ImportedLibraries()
 		if err != nil {
-			log.Warnf("WTF: ImportedLibraries() returned error: %v", err)
-			return nil
+			return analyzerFailure(ctx, hdl, "shared object", path, err)
 		}
 
 		if !hdl.Options().NoDepends {
 			for _, lib := range libs {
 				if strings.Contains(lib, ".so.") {
 					log.Infof("  found lib %s for %s", lib, path)
-					generated.Runtime = append(generated.Runtime, fmt.Sprintf("so:%s", lib))
+					dep := fmt.Sprintf("so:%s", lib)
+					generated.Runtime = append(generated.Runtime, dep)
+					recordSource(hdl, DiscoveryRuntime, dep, path)
 					depends[lib] = append(depends[lib], path)
 				}
 			}
@@ -350,17 +584,20 @@ func generateSharedObjectNameDeps(ctx context.Context, hdl SCAHandle, generated
 			sonames, err := ef.DynString(elf.DT_SONAME)
 			// most likely SONAME is not set on this object
 			if err != nil {
-				log.Warnf("library %s lacks SONAME", path)
+				warnf(ctx, hdl, "library %s lacks SONAME", path)
 				return nil
 			}
 
 			for _, soname := range sonames {
 				libver := sonameLibver(soname)
+				dep := fmt.Sprintf("so:%s=%s", soname, libver)
 
 				if allowedPrefix(path, libDirs) {
-					generated.Provides = append(generated.Provides, fmt.Sprintf("so:%s=%s", soname, libver))
+					generated.Provides = append(generated.Provides, dep)
+					recordSource(hdl, DiscoveryProvides, dep, path)
 				} else {
-					generated.Vendored = append(generated.Vendored, fmt.Sprintf("so:%s=%s", soname, libver))
+					generated.Vendored = append(generated.Vendored, dep)
+					recordSource(hdl, DiscoveryVendored, dep, path)
 				}
 			}
 		}
@@ -381,9 +618,10 @@ func generateSharedObjectNameDeps(ctx context.Context, hdl SCAHandle, generated
 		}
 		// strong indication of go-fips openssl compiled binary, will dlopen the below at runtime
 		if !hdl.Options().NoDepends && cgo && boringcrypto {
-			generated.Runtime = append(generated.Runtime, "openssl-config-fipshardened")
-			generated.Runtime = append(generated.Runtime, "so:libcrypto.so.3")
-			generated.Runtime = append(generated.Runtime, "so:libssl.so.3")
+			for _, dep := range []string{"openssl-config-fipshardened", "so:libcrypto.so.3", "so:libssl.so.3"} {
+				generated.Runtime = append(generated.Runtime, dep)
+				recordSource(hdl, DiscoveryRuntime, dep, path)
+			}
 		}
 
 		return nil
@@ -412,7 +650,7 @@ func generatePkgConfigDeps(ctx context.Context, hdl SCAHandle, generated *config
 		return err
 	}
 
-	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+	if err := walkFilesystem(hdl, fsys, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -437,20 +675,19 @@ func generatePkgConfigDeps(ctx context.Context, hdl SCAHandle, generated *config
 		// TODO(kaniini): Sigh.  apkofs should have ReadFile by default.
 		dataFile, err := fsys.Open(path)
 		if err != nil {
-			return nil
+			return analyzerFailure(ctx, hdl, "pkg-config", path, err)
 		}
 		defer dataFile.Close()
 
 		data, err := io.ReadAll(dataFile)
 		if err != nil {
-			return nil
+			return analyzerFailure(ctx, hdl, "pkg-config", path, err)
 		}
 
 		// TODO(kaniini): Sigh.  go-pkgconfig should support reading from any io.Reader.
 		pkg, err := pkgconfig.Parse(string(data))
 		if err != nil {
-			log.Warnf("Unable to load .pc file (%s) using pkgconfig: %v", path, err)
-			return nil
+			return analyzerFailure(ctx, hdl, "pkg-config", path, err)
 		}
 
 		pcName := filepath.Base(path)
@@ -463,12 +700,15 @@ func generatePkgConfigDeps(ctx context.Context, hdl SCAHandle, generated *config
 
 		apkVersion := pkgConfigVersionRegexp.ReplaceAllString(pkg.Version, "_$1")
 		if !hdl.Options().NoProvides {
+			dep := fmt.Sprintf("pc:%s=%s", pcName, sigh(apkVersion))
 			if allowedPrefix(path, pcDirs) {
 				log.Infof("  found pkg-config %s for %s", pcName, path)
-				generated.Provides = append(generated.Provides, fmt.Sprintf("pc:%s=%s", pcName, sigh(apkVersion)))
+				generated.Provides = append(generated.Provides, dep)
+				recordSource(hdl, DiscoveryProvides, dep, path)
 			} else {
 				log.Infof("  found vendored pkg-config %s for %s", pcName, path)
-				generated.Vendored = append(generated.Vendored, fmt.Sprintf("pc:%s=%s", pcName, sigh(apkVersion)))
+				generated.Vendored = append(generated.Vendored, dep)
+				recordSource(hdl, DiscoveryVendored, dep, path)
 			}
 		}
 
@@ -477,17 +717,23 @@ func generatePkgConfigDeps(ctx context.Context, hdl SCAHandle, generated *config
 			// so much though for us.
 			for _, dep := range pkg.Requires {
 				log.Infof("  found pkg-config dependency (requires) %s for %s", dep.Identifier, path)
-				generated.Runtime = append(generated.Runtime, fmt.Sprintf("pc:%s", dep.Identifier))
+				pcdep := fmt.Sprintf("pc:%s", dep.Identifier)
+				generated.Runtime = append(generated.Runtime, pcdep)
+				recordSource(hdl, DiscoveryRuntime, pcdep, path)
 			}
 
 			for _, dep := range pkg.RequiresPrivate {
 				log.Infof("  found pkg-config dependency (requires private) %s for %s", dep.Identifier, path)
-				generated.Runtime = append(generated.Runtime, fmt.Sprintf("pc:%s", dep.Identifier))
+				pcdep := fmt.Sprintf("pc:%s", dep.Identifier)
+				generated.Runtime = append(generated.Runtime, pcdep)
+				recordSource(hdl, DiscoveryRuntime, pcdep, path)
 			}
 
 			for _, dep := range pkg.RequiresInternal {
 				log.Infof("  found pkg-config dependency (requires internal) %s for %s", dep.Identifier, path)
-				generated.Runtime = append(generated.Runtime, fmt.Sprintf("pc:%s", dep.Identifier))
+				pcdep := fmt.Sprintf("pc:%s", dep.Identifier)
+				generated.Runtime = append(generated.Runtime, pcdep)
+				recordSource(hdl, DiscoveryRuntime, pcdep, path)
 			}
 		}
 
@@ -510,8 +756,8 @@ func generatePythonDeps(ctx context.Context, hdl SCAHandle, generated *config.De
 		return err
 	}
 
-	var pythonModuleVer string
-	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+	var pythonModuleVer, pythonModuleDir string
+	if err := walkFilesystem(hdl, fsys, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -539,6 +785,7 @@ func generatePythonDeps(ctx context.Context, hdl SCAHandle, generated *config.De
 		// If the X.Y part is not present, then pythonModuleVer will remain an empty string and
 		// no dependency will be generated.
 		pythonModuleVer = basename[6:]
+		pythonModuleDir = path
 		return nil
 	}); err != nil {
 		return err
@@ -552,17 +799,216 @@ func generatePythonDeps(ctx context.Context, hdl SCAHandle, generated *config.De
 	// Do not add a Python dependency if one already exists.
 	for _, dep := range hdl.BaseDependencies().Runtime {
 		if strings.HasPrefix(dep, "python") {
-			log.Warnf("%s: Python dependency %q already specified, consider removing it in favor of SCA-generated dependency", hdl.PackageName(), dep)
+			warnf(ctx, hdl, "%s: Python dependency %q already specified, consider removing it in favor of SCA-generated dependency", hdl.PackageName(), dep)
 			return nil
 		}
 	}
 
 	log.Infof("  found python module, generating python-%s-base dependency", pythonModuleVer)
-	generated.Runtime = append(generated.Runtime, fmt.Sprintf("python-%s-base", pythonModuleVer))
+	dep := fmt.Sprintf("python-%s-base", pythonModuleVer)
+	generated.Runtime = append(generated.Runtime, dep)
+	recordSource(hdl, DiscoveryRuntime, dep, pythonModuleDir)
 
 	return nil
 }
 
+var (
+	pythonIdentifierRegexp  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	pythonRequirementRegexp = regexp.MustCompile(`^\s*([A-Za-z0-9][A-Za-z0-9._-]*)`)
+	pythonNameSeparators    = regexp.MustCompile(`[-_.]+`)
+)
+
+// generatePythonModuleDeps generates py3.X:<name> provides for the top-level
+// modules and the distributions installed in usr/lib/python3.X/site-packages,
+// and py3.X:<name> dependencies on the distributions they require, which
+// mirrors the so: and cmd: virtuals.  Distribution names are normalized as
+// in PEP 503; module names are kept as they are imported.
+func generatePythonModuleDeps(ctx context.Context, hdl SCAHandle, generated *config.Dependencies) error {
+	log := clog.FromContext(ctx)
+	if !hdl.Options().PythonProvides {
+		return nil
+	}
+
+	log.Infof("scanning for python modules and distributions...")
+	fsys, err := hdl.Filesystem()
+	if err != nil {
+		return err
+	}
+
+	dirs, err := fs.Glob(fsys, "usr/lib/python3.*/site-packages")
+	if err != nil {
+		return err
+	}
+
+	provides := map[string]string{}
+	depends := map[string]string{}
+	for _, dir := range dirs {
+		minor := strings.TrimPrefix(filepath.Base(filepath.Dir(dir)), "python3.")
+		if _, err := strconv.Atoi(minor); err != nil {
+			continue
+		}
+		prefix := fmt.Sprintf("py3.%s:", minor)
+
+		entries, err := fs.ReadDir(fsys, dir)
+		if err != nil {
+			return err
+		}
+
+		for _, ent := range entries {
+			name := ent.Name()
+			path := filepath.Join(dir, name)
+
+			var metadata, requires string
+			switch {
+			case strings.HasSuffix(name, ".dist-info") && ent.IsDir():
+				metadata = filepath.Join(path, "METADATA")
+			case strings.HasSuffix(name, ".egg-info") && ent.IsDir():
+				metadata = filepath.Join(path, "PKG-INFO")
+				requires = filepath.Join(path, "requires.txt")
+			case strings.HasSuffix(name, ".egg-info"):
+				metadata = path
+			default:
+				if module := pythonModuleName(name, ent.IsDir()); module != "" {
+					provides[prefix+module] = path
+				}
+				continue
+			}
+
+			dist, reqs, err := readPythonMetadata(fsys, metadata, requires)
+			if err != nil {
+				if err := analyzerFailure(ctx, hdl, "python module", metadata, err); err != nil {
+					return err
+				}
+				continue
+			}
+			if dist != "" {
+				provides[prefix+normalizePythonName(dist)] = metadata
+			}
+			for _, req := range reqs {
+				depends[prefix+normalizePythonName(req)] = metadata
+			}
+		}
+	}
+
+	for _, dep := range sortedKeys(provides) {
+		log.Infof("  found python provide %s", dep)
+		provide := fmt.Sprintf("%s=%s", dep, hdl.Version())
+		generated.Provides = append(generated.Provides, provide)
+		recordSource(hdl, DiscoveryProvides, provide, provides[dep])
+	}
+
+	if hdl.Options().NoDepends {
+		return nil
+	}
+
+	for _, dep := range sortedKeys(depends) {
+		if _, ok := provides[dep]; ok {
+			continue
+		}
+		log.Infof("  found python dependency %s", dep)
+		generated.Runtime = append(generated.Runtime, dep)
+		recordSource(hdl, DiscoveryRuntime, dep, depends[dep])
+	}
+
+	return nil
+}
+
+// pythonModuleName returns the name under which the site-packages entry name
+// is imported, or an empty string if it is not a module.
+func pythonModuleName(name string, isDir bool) string {
+	if !isDir {
+		switch {
+		case strings.HasSuffix(name, ".py"):
+			name = strings.TrimSuffix(name, ".py")
+		case strings.HasSuffix(name, ".so"):
+			// Extension modules carry an ABI tag, e.g. foo.cpython-312-x86_64-linux-gnu.so.
+			name, _, _ = strings.Cut(name, ".")
+		default:
+			return ""
+		}
+	}
+
+	if name == "__pycache__" || !pythonIdentifierRegexp.MatchString(name) {
+		return ""
+	}
+
+	return name
+}
+
+// normalizePythonName normalizes a distribution name as described by PEP 503.
+func normalizePythonName(name string) string {
+	return strings.ToLower(pythonNameSeparators.ReplaceAllString(name, "-"))
+}
+
+// readPythonMetadata returns the distribution name and the names of the
+// distributions required by the core metadata file at metadata.  For
+// egg-info, which lists requirements separately, requires is the path of
+// requires.txt.  Requirements which only apply to extras are ignored.
+func readPythonMetadata(fsys fs.FS, metadata, requires string) (string, []string, error) {
+	data, err := fs.ReadFile(fsys, metadata)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var name string
+	reqs := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			// The headers end at the first blank line.
+			break
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "Name":
+			name = value
+		case "Requires-Dist":
+			req, marker, _ := strings.Cut(value, ";")
+			if strings.Contains(marker, "extra") {
+				continue
+			}
+			if m := pythonRequirementRegexp.FindStringSubmatch(req); m != nil {
+				reqs = append(reqs, m[1])
+			}
+		}
+	}
+
+	if requires != "" {
+		data, err := fs.ReadFile(fsys, requires)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", nil, err
+		}
+
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "[") {
+				// Sections list the requirements of extras.
+				break
+			}
+			if m := pythonRequirementRegexp.FindStringSubmatch(line); m != nil {
+				reqs = append(reqs, m[1])
+			}
+		}
+	}
+
+	return name, reqs, nil
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func sonameLibver(soname string) string {
 	parts := strings.Split(soname, ".so.")
 	if len(parts) < 2 {
@@ -637,7 +1083,7 @@ func generateShbangDeps(ctx context.Context, hdl SCAHandle, generated *config.De
 	}
 
 	cmds := map[string]string{}
-	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+	if err := walkFilesystem(hdl, fsys, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -650,16 +1096,18 @@ func generateShbangDeps(ctx context.Context, hdl SCAHandle, generated *config.De
 			return nil
 		}
 
-		if fp, err := fsys.Open(path); err == nil {
-			shbang, err := getShbang(fp)
-			if err != nil {
-				log.Warnf("Error reading shbang from %s: %v", path, err)
-			} else if shbang != "" {
-				cmds[filepath.Base(shbang)] = path
-			}
-			fp.Close()
-		} else {
-			log.Infof("Failed to open %s: %v", path, err)
+		fp, err := fsys.Open(path)
+		if err != nil {
+			return analyzerFailure(ctx, hdl, "shbang", path, err)
+		}
+		defer fp.Close()
+
+		shbang, err := getShbang(fp)
+		if err != nil {
+			return analyzerFailure(ctx, hdl, "shbang", path, err)
+		}
+		if shbang != "" {
+			cmds[filepath.Base(shbang)] = path
 		}
 		return nil
 	}); err != nil {
@@ -669,6 +1117,7 @@ func generateShbangDeps(ctx context.Context, hdl SCAHandle, generated *config.De
 	for base, path := range cmds {
 		log.Infof("Added shbang dep cmd:%s for %s", base, path)
 		generated.Runtime = append(generated.Runtime, "cmd:"+base)
+		recordSource(hdl, DiscoveryRuntime, "cmd:"+base, path)
 	}
 
 	return nil
@@ -680,17 +1129,25 @@ func Analyze(ctx context.Context, hdl SCAHandle, generated *config.Dependencies)
 	if hdl.Options().NoProvides {
 		return nil
 	}
-	generators := []DependencyGenerator{
-		generateSharedObjectNameDeps,
-		generateCmdProviders,
-		generatePkgConfigDeps,
-		generatePythonDeps,
-		generateShbangDeps,
+	generators := []struct {
+		name string
+		gen  DependencyGenerator
+	}{
+		{"shared object", generateSharedObjectNameDeps},
+		{"command", generateCmdProviders},
+		{"pkg-config", generatePkgConfigDeps},
+		{"python", generatePythonDeps},
+		{"python module", generatePythonModuleDeps},
+		{"shbang", generateShbangDeps},
 	}
 
-	for _, gen := range generators {
-		if err := gen(ctx, hdl, generated); err != nil {
-			return err
+	for _, g := range generators {
+		if err := g.gen(ctx, hdl, generated); err != nil {
+			var ae *AnalyzerError
+			if errors.As(err, &ae) {
+				return err
+			}
+			return fmt.Errorf("%s analyzer: %w", g.name, err)
 		}
 	}
 
@@ -16,9 +16,13 @@ package sca
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
@@ -241,3 +245,360 @@ func TestShbangDeps(t *testing.T) {
 		t.Errorf("Analyze(): (-want, +got):\n%s", diff)
 	}
 }
+
+type recordingHandle struct {
+	*testHandle
+
+	sources map[string][]string
+}
+
+func (rh *recordingHandle) RecordSource(dep, path string) {
+	rh.sources[dep] = append(rh.sources[dep], path)
+}
+
+func TestRecordSources(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	th := handleFromApk(ctx, t, "libcap-2.69-r0.apk", "neon.yaml")
+	defer th.exp.Close()
+
+	rh := &recordingHandle{testHandle: th, sources: map[string][]string{}}
+
+	got := config.Dependencies{}
+	if err := Analyze(ctx, rh, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dep := range append(got.Runtime, got.Provides...) {
+		if len(rh.sources[dep]) == 0 {
+			t.Errorf("no source recorded for %q", dep)
+		}
+	}
+
+	if diff := cmp.Diff([]string{"usr/lib/libcap.so.2.69"}, rh.sources["so:libcap.so.2=2"]); diff != "" {
+		t.Errorf("sources for so:libcap.so.2=2: (-want, +got):\n%s", diff)
+	}
+}
+
+// discoveringHandle records each dependency as it is discovered.
+type discoveringHandle struct {
+	*testHandle
+
+	discoveries []Discovery
+}
+
+func (dh *discoveringHandle) RecordDiscovery(d Discovery) {
+	dh.discoveries = append(dh.discoveries, d)
+}
+
+func TestRecordDiscoveries(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	th := handleFromApk(ctx, t, "libcap-2.69-r0.apk", "neon.yaml")
+	defer th.exp.Close()
+
+	dh := &discoveringHandle{testHandle: th}
+
+	got := config.Dependencies{}
+	if err := Analyze(ctx, dh, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every dependency in the result was discovered as it was generated,
+	// into the list it was added to.
+	discovered := config.Dependencies{}
+	for _, d := range dh.discoveries {
+		if d.Path == "" {
+			t.Errorf("no path for discovery of %q", d.Dependency)
+		}
+		switch d.Kind {
+		case DiscoveryRuntime:
+			discovered.Runtime = append(discovered.Runtime, d.Dependency)
+		case DiscoveryProvides:
+			discovered.Provides = append(discovered.Provides, d.Dependency)
+		case DiscoveryVendored:
+			discovered.Vendored = append(discovered.Vendored, d.Dependency)
+		}
+	}
+	for _, tt := range []struct {
+		kind           string
+		got, discovery []string
+	}{
+		{"runtime", got.Runtime, discovered.Runtime},
+		{"provides", got.Provides, discovered.Provides},
+		{"vendored", got.Vendored, discovered.Vendored},
+	} {
+		for _, dep := range tt.got {
+			if !slices.Contains(tt.discovery, dep) {
+				t.Errorf("%s dependency %q was not discovered", tt.kind, dep)
+			}
+		}
+	}
+
+	if !slices.Contains(dh.discoveries, Discovery{Kind: DiscoveryProvides, Dependency: "so:libcap.so.2=2", Path: "usr/lib/libcap.so.2.69"}) {
+		t.Errorf("so:libcap.so.2=2 not discovered: %v", dh.discoveries)
+	}
+}
+
+// dirHandle is an SCAHandle over a directory, for testing generators
+// against a sample layout.
+type dirHandle struct {
+	dir  string
+	opts config.PackageOption
+}
+
+type dirSCAFS struct {
+	fs.FS
+	dir string
+}
+
+func (d dirSCAFS) Readlink(name string) (string, error) {
+	return os.Readlink(filepath.Join(d.dir, name))
+}
+
+func (d dirSCAFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(d.FS, name)
+}
+
+func (dh *dirHandle) PackageName() string                         { return "py3.12-sample" }
+func (dh *dirHandle) RelativeNames() []string                     { return []string{"py3.12-sample"} }
+func (dh *dirHandle) Version() string                             { return "1.0.0-r0" }
+func (dh *dirHandle) Options() config.PackageOption               { return dh.opts }
+func (dh *dirHandle) BaseDependencies() config.Dependencies       { return config.Dependencies{} }
+func (dh *dirHandle) FilesystemForRelative(string) (SCAFS, error) { return dh.Filesystem() }
+func (dh *dirHandle) Filesystem() (SCAFS, error) {
+	return dirSCAFS{FS: os.DirFS(dh.dir), dir: dh.dir}, nil
+}
+
+func TestPythonModuleDeps(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	dir := t.TempDir()
+
+	site := filepath.Join(dir, "usr", "lib", "python3.12", "site-packages")
+	for path, content := range map[string]string{
+		"sample/__init__.py":                           "",
+		"sample/__pycache__/__init__.cpython-312.pyc":  "",
+		"sample_helpers.py":                            "",
+		"_speedups.cpython-312-x86_64-linux-gnu.so":    "",
+		"sample.pth":                                   "",
+		"Sample_Project-1.0.0.dist-info/METADATA":      "Metadata-Version: 2.1\nName: Sample_Project\nVersion: 1.0.0\nRequires-Dist: requests (>=2.0)\nRequires-Dist: typing-extensions; python_version < \"3.13\"\nRequires-Dist: PySocks!=1.5.7; extra == \"socks\"\n\nRequires-Dist: not-a-header\n",
+		"Sample_Project-1.0.0.dist-info/top_level.txt": "sample\n",
+		"legacy-2.0-py3.12.egg-info/PKG-INFO":          "Metadata-Version: 1.1\nName: legacy\nVersion: 2.0\n",
+		"legacy-2.0-py3.12.egg-info/requires.txt":      "six>=1.0\nsample-project\n\n[docs]\nsphinx\n",
+		"__pycache__/sample_helpers.cpython-312.pyc":   "",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(site, path)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(site, path), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Python provides are opt-in.
+	got := config.Dependencies{}
+	if err := generatePythonModuleDeps(ctx, &dirHandle{dir: dir}, &got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(config.Dependencies{}, got); diff != "" {
+		t.Errorf("generatePythonModuleDeps() without python-provides: (-want, +got):\n%s", diff)
+	}
+
+	hdl := &dirHandle{dir: dir, opts: config.PackageOption{PythonProvides: true}}
+	if err := generatePythonModuleDeps(ctx, hdl, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := config.Dependencies{
+		Runtime: []string{
+			"py3.12:requests",
+			"py3.12:six",
+			"py3.12:typing-extensions",
+		},
+		Provides: []string{
+			"py3.12:_speedups=1.0.0-r0",
+			"py3.12:legacy=1.0.0-r0",
+			"py3.12:sample=1.0.0-r0",
+			"py3.12:sample-project=1.0.0-r0",
+			"py3.12:sample_helpers=1.0.0-r0",
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("generatePythonModuleDeps(): (-want, +got):\n%s", diff)
+	}
+}
+
+type findingHandle struct {
+	*dirHandle
+
+	findings []Finding
+}
+
+func (fh *findingHandle) RecordFinding(f Finding) {
+	fh.findings = append(fh.findings, f)
+}
+
+func TestRunpathFindings(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	fh := &findingHandle{dirHandle: &dirHandle{dir: filepath.Join("testdata", "rpath")}}
+
+	got := config.Dependencies{}
+	if err := generateSharedObjectNameDeps(ctx, fh, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Finding{
+		{Path: "usr/lib/libleaky-rpath.so.1", Kind: "rpath", Value: "/home/build/output/lib"},
+		{Path: "usr/lib/libleaky-runpath.so.1", Kind: "runpath", Value: "lib"},
+	}
+	if diff := cmp.Diff(want, fh.findings); diff != "" {
+		t.Errorf("findings: (-want, +got):\n%s", diff)
+	}
+}
+
+type strictHandle struct {
+	*dirHandle
+
+	strict bool
+}
+
+func (sh *strictHandle) Strict() bool {
+	return sh.strict
+}
+
+func TestStrictAnalysis(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	dir := t.TempDir()
+
+	bin := filepath.Join(dir, "usr", "bin")
+	if err := os.MkdirAll(bin, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bin, "broken"), []byte("#!/usr/bin/env  \n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bin, "hello"), []byte("#!/usr/bin/perl\nprint 1;\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	// By default, the broken script is skipped.
+	got := config.Dependencies{}
+	if err := Analyze(ctx, &strictHandle{dirHandle: &dirHandle{dir: dir}}, &got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"cmd:perl"}, got.Runtime); diff != "" {
+		t.Errorf("Analyze() runtime: (-want, +got):\n%s", diff)
+	}
+
+	got = config.Dependencies{}
+	err := Analyze(ctx, &strictHandle{dirHandle: &dirHandle{dir: dir}, strict: true}, &got)
+	var ae *AnalyzerError
+	if !errors.As(err, &ae) {
+		t.Fatalf("Analyze() = %v, wanted an AnalyzerError", err)
+	}
+	if ae.Analyzer != "shbang" || ae.Path != "usr/bin/broken" {
+		t.Errorf("Analyze() failed in %s on %s, wanted shbang on usr/bin/broken", ae.Analyzer, ae.Path)
+	}
+	if want := "shbang analyzer failed on usr/bin/broken: "; !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("Analyze() = %q, wanted prefix %q", err, want)
+	}
+}
+
+// walkedHandle replays a walk of the filesystem done in advance.
+type walkedHandle struct {
+	SCAHandle
+
+	walked []WalkedEntry
+}
+
+func (wh *walkedHandle) Walked() []WalkedEntry {
+	return wh.walked
+}
+
+func prewalk(t *testing.T, hdl SCAHandle) *walkedHandle {
+	t.Helper()
+
+	fsys, err := hdl.Filesystem()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wh := &walkedHandle{SCAHandle: hdl, walked: []WalkedEntry{}}
+	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		wh.walked = append(wh.walked, WalkedEntry{Path: path, Entry: fs.FileInfoToDirEntry(fi)})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return wh
+}
+
+func TestAnalyzeWalked(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	th := handleFromApk(ctx, t, "libcap-2.69-r0.apk", "neon.yaml")
+	defer th.exp.Close()
+
+	want := config.Dependencies{}
+	if err := Analyze(ctx, th, &want); err != nil {
+		t.Fatal(err)
+	}
+
+	got := config.Dependencies{}
+	if err := Analyze(ctx, prewalk(t, th), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Analyze() replaying a walk: (-want, +got):\n%s", diff)
+	}
+}
+
+func TestWalkFilesystem(t *testing.T) {
+	dir := t.TempDir()
+	for _, path := range []string{"a/skip/x", "a/y", "b/w", "b/x", "b/y/z", "c"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, path), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hdl := &dirHandle{dir: dir}
+	fsys, err := hdl.Filesystem()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	visit := func(h SCAHandle) []string {
+		visited := []string{}
+		if err := walkFilesystem(h, fsys, func(path string, _ fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			visited = append(visited, path)
+			switch path {
+			case "a/skip", "b/x":
+				return fs.SkipDir
+			case "c":
+				return fs.SkipAll
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return visited
+	}
+
+	want := visit(hdl)
+	if diff := cmp.Diff([]string{".", "a", "a/skip", "a/y", "b", "b/w", "b/x", "c"}, want); diff != "" {
+		t.Errorf("walkFilesystem(): (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(want, visit(prewalk(t, hdl))); diff != "" {
+		t.Errorf("walkFilesystem() replaying a walk: (-want, +got):\n%s", diff)
+	}
+}